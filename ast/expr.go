@@ -23,7 +23,7 @@ type (
 	}
 
 	CallExpr struct {
-		Name   token.Ident
+		Name   *Ident
 		Lparen token.Pos
 		Args   []Expr
 		Rparen token.Pos
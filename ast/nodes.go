@@ -90,6 +90,12 @@ type (
 		Param interface{}
 	}
 
+	FuncBody struct {
+		Decls []Decl    // local declarations
+		Begin token.Pos // position of "begin" or "asm" keyword
+		End   token.Pos // position of the closing "end" keyword
+	}
+
 	ArgumentList struct {
 		Kind    token.Token // either token.INVALID or token.VAR, token.CONST, token.OUT
 		Names   []Ident     // list of names specified
@@ -0,0 +1,118 @@
+// Extensions of the original work are copyright (c) 2016 Raintree Systems Inc.
+//
+// Copyright 2009 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This file implements scopes and the objects they contain.
+
+package ast
+
+import (
+	"strings"
+
+	"github.com/raintreeinc/delphi/token"
+)
+
+// A Scope maintains the set of named language entities declared
+// in the scope and a link to the immediately surrounding (outer)
+// scope. Names are case insensitive.
+//
+type Scope struct {
+	Outer   *Scope
+	Objects map[string]*Object // keyed by canonical (lower-case) name
+}
+
+// NewScope creates a new scope nested in the outer scope.
+func NewScope(outer *Scope) *Scope {
+	const n = 4 // initial scope capacity
+	return &Scope{outer, make(map[string]*Object, n)}
+}
+
+// Lookup returns the object with the given name if it is
+// found in scope s, otherwise it returns nil. Outer scopes
+// are ignored.
+//
+func (s *Scope) Lookup(name string) *Object {
+	return s.Objects[strings.ToLower(name)]
+}
+
+// Insert attempts to insert a named object obj into the scope s.
+// If the scope already contains an object alt with the same name,
+// Insert leaves the scope unchanged and returns alt. Otherwise
+// it inserts obj and returns nil.
+//
+func (s *Scope) Insert(obj *Object) (alt *Object) {
+	name := strings.ToLower(obj.Name)
+	if alt = s.Objects[name]; alt == nil {
+		s.Objects[name] = obj
+	}
+	return
+}
+
+// ----------------------------------------------------------------------------
+// Objects
+
+// An Object describes a named language entity such as a unit,
+// constant, type, variable, function (incl. methods), property or label.
+//
+// The Data fields contains object-specific data:
+//
+//	Kind    Data type         Data value
+//	ObjMod  *Scope            interface scope
+//	ObjTyp  *Scope            member scope of classes, records and interfaces
+//
+// The Type field contains the *Ident naming the declared type of
+// variables, constants, properties and function results; for types
+// it names the ancestor of a class or the aliased type.
+//
+type Object struct {
+	Kind ObjKind
+	Name string      // declared name
+	Decl interface{} // corresponding declaring *Ident; or nil
+	Data interface{} // object-specific data; or nil
+	Type interface{} // placeholder for type information; may be nil
+}
+
+// NewObj creates a new object of a given kind and name.
+func NewObj(kind ObjKind, name string) *Object {
+	return &Object{Kind: kind, Name: name}
+}
+
+// Pos computes the source position of the declaration of an object name.
+// The result may be an invalid position if it cannot be computed
+// (obj.Decl may be nil or not correct).
+func (obj *Object) Pos() token.Pos {
+	if ident, ok := obj.Decl.(*Ident); ok {
+		return ident.NamePos
+	}
+	return token.Pos(0)
+}
+
+// ObjKind describes what an object represents.
+type ObjKind int
+
+// The list of possible Object kinds.
+const (
+	ObjBad  ObjKind = iota // for error handling
+	ObjMod                 // module: unit, program or library
+	ObjCon                 // constant or enumeration value
+	ObjTyp                 // type
+	ObjVar                 // variable, field or argument
+	ObjFun                 // function, procedure or method
+	ObjProp                // property
+	ObjLbl                 // label
+)
+
+var objKindStrings = [...]string{
+	ObjBad:  "bad",
+	ObjMod:  "unit",
+	ObjCon:  "const",
+	ObjTyp:  "type",
+	ObjVar:  "var",
+	ObjFun:  "func",
+	ObjProp: "property",
+	ObjLbl:  "label",
+}
+
+func (kind ObjKind) String() string { return objKindStrings[kind] }
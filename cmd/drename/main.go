@@ -3,40 +3,79 @@
 // This utility is useful for cleaning up or restructuring old and large code-bases.
 // Especially where you have conditional compiling.
 //
-// Warning: drename currently is not context-sensitive hence it may rename
-// more than you wanted. And mostly is hacked together to serve a particular
-// need. Eventually it will be adjusted to be context sensitive.
+// Identifiers are resolved to their declarations, hence only references to
+// the declaration in the named unit are renamed; same-named locals, fields
+// and members of other classes are left untouched. Code excluded by
+// {$IFDEF}s is only seen when it is active for one of the -define sets.
+// Without -define the sources are resolved for every combination of the
+// conditional symbols they test. Identifiers named like a renamed
+// declaration in code that is inactive for every set are reported as
+// SKIPPED; nothing is written and drename exits with an error.
+//
+// Units are renamed with the [unitrename] section of the batch file,
+// which also renames the unit files and updates uses clauses.
+//
+// Top-level declarations are moved to another unit with the [move.Unit]
+// sections; uses clauses of the units referencing them are updated.
+// Moves cannot be combined with renames in the same batch.
+//
+// Use -d to preview the changes as unified diffs. With -w all files are
+// written atomically; -backup saves the originals so that -undo can
+// restore them.
 
 package main
 
 import (
 	"bytes"
-	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"regexp"
+	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/BurntSushi/toml"
+	"sync"
 
 	"github.com/egonelbre/async"
+	"github.com/raintreeinc/delphi/internal/diff"
+	"github.com/raintreeinc/delphi/internal/files"
 	"github.com/raintreeinc/delphi/internal/walk"
-	"github.com/raintreeinc/delphi/scanner"
-	"github.com/raintreeinc/delphi/token"
+	"github.com/raintreeinc/delphi/rename"
 )
 
 var (
 	verbose   = flag.Int("v", 0, "verbosity level")
 	batchfile = flag.String("batch", "", "file describing all renames")
-	nprocs    = flag.Int("procs", 8, "number of parallel parsers to use")
+	nprocs    = flag.Int("procs", 8, "number of parallel writers to use")
 	write     = flag.Bool("w", false, "write changes to files")
+	showdiff  = flag.Bool("d", false, "print unified diffs of the changes")
+	backup    = flag.String("backup", "", "directory for backing up modified files, used with -w and -undo")
+	undo      = flag.Bool("undo", false, "restore files from the -backup directory")
+	defines   DefinesFlag
 )
 
+func init() {
+	flag.Var(&defines, "define", "conditional defines separated by ';', repeat to rename across several configurations")
+}
+
 func main() {
 	flag.Parse()
 
+	if *undo {
+		if *backup == "" {
+			fmt.Println("Error: -undo requires -backup.")
+			os.Exit(1)
+		}
+		restored, err := files.Restore(*backup)
+		if err != nil {
+			fmt.Printf("Error restoring backup: %s\n", err)
+			os.Exit(1)
+		}
+		for _, filename := range restored {
+			fmt.Println("RESTORED " + filename)
+		}
+		return
+	}
+
 	globs := flag.Args()
 	if len(globs) == 0 {
 		fmt.Println("Error: globs not specified.")
@@ -44,7 +83,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	batch, err := LoadBatchFile(*batchfile)
+	batch, err := rename.LoadBatchFile(*batchfile)
 	if err != nil {
 		fmt.Printf("Error loading mapping: %s\n", err)
 		flag.PrintDefaults()
@@ -62,164 +101,166 @@ func main() {
 	filenames := make(chan string, *nprocs)
 	errors := make(chan error)
 	go func() {
-		walk.Globs(globs, filenames, errors)
+		walk.Globs(globs, filenames, errors, rename.IsSourceFile)
 		close(filenames)
+		close(errors)
 	}()
 
-	async.Spawn(*nprocs, func(id int) {
-		for filename := range filenames {
-			err := process(batch, filename)
-			if err != nil {
-				errors <- fmt.Errorf("%v: %v", filename, err)
-			}
+	sources := rename.NewSources()
+	go func() {
+		for err := range errors {
+			fmt.Println(err)
 		}
-	}, func() { close(errors) })
-
-	for err := range errors {
-		fmt.Println(err)
+	}()
+	for filename := range filenames {
+		sources.Add(filename)
 	}
 
-	fmt.Println("<DONE>")
-}
-
-var rxTarget = regexp.MustCompile(`(?i)\brtScreenBuffer\b`)
-
-func process(batch *BatchRename, filename string) error {
-	src, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+	configs := defines.Sets
+	if len(configs) == 0 {
+		configs = rename.Configurations(sources.Conditionals())
 	}
 
-	// Initialize the scanner.
-	var sc scanner.Scanner
-	fset := token.NewFileSet()
-	file := fset.AddFile(filename, fset.Base(), len(src))
-	sc.Init(file, src, func(pos token.Position, msg string) { fmt.Printf("%s\tERROR\t%s\n", pos, msg) }, 0)
-
-	var out bytes.Buffer
-	{ // main processing
-		uses := []string{}
-		start := 0
+	batch.Unresolved = *verbose > 0
 
-		for {
-			pos, tok, lit := sc.Scan()
-
-			// emit unprocessed content
-			if offset := fset.Position(pos).Offset; start < offset {
-				out.Write(src[start:offset])
-				start = offset
+	edits := make(rename.Edits)
+	renames := make(rename.Renames)
+	var moves []string
+	for i, config := range configs {
+		prog, errs := sources.Load(config)
+		if *verbose > 0 {
+			for _, err := range errs {
+				fmt.Println(err)
 			}
-			if tok == token.EOF {
-				break
-			} else if tok != token.IDENT {
-				continue
+		}
+		for _, err := range batch.Collect(prog, edits, renames) {
+			fmt.Println(err)
+		}
+		if i == 0 {
+			// moves edit whole declarations, use the first configuration
+			var errs []error
+			moves, errs = batch.CollectMoves(prog, edits)
+			for _, err := range errs {
+				fmt.Println(err)
 			}
+		}
+	}
 
-			lit = Canonical(lit)
-
-			// process uses list
-			if batch.IsUnit(lit) {
-				contains := false
-				for _, unit := range uses {
-					if unit == lit {
-						contains = true
-						break
-					}
-				}
-				if !contains {
-					uses = append(uses, Canonical(lit))
-				}
-				continue
+	skipped := sources.Inactive(configs, batch.Names())
+	for _, err := range skipped {
+		fmt.Println("SKIPPED " + err.Error())
+	}
+
+	filenames = make(chan string, *nprocs)
+	go func() {
+		for _, filename := range edits.Files() {
+			filenames <- filename
+		}
+		for filename := range renames {
+			if _, edited := edits[filename]; !edited {
+				filenames <- filename
 			}
+		}
+		close(filenames)
+	}()
 
-			// process replacements
-			if repl, ok := batch.Lookup(uses, lit); ok {
-				start += len(lit)
-				out.WriteString(repl)
+	var mu sync.Mutex
+	var changes []rename.Change
+	results := make(chan error)
+	async.Spawn(*nprocs, func(id int) {
+		for filename := range filenames {
+			change, err := rename.Process(filename, edits[filename])
+			if err != nil {
+				results <- fmt.Errorf("%v: %v", filename, err)
 				continue
 			}
+			change.Rename = renames[filename]
+			if change.Rename != "" || !bytes.Equal(change.Old, change.New) {
+				mu.Lock()
+				changes = append(changes, change)
+				mu.Unlock()
+			}
 		}
+	}, func() { close(results) })
+
+	failed := false
+	for err := range results {
+		fmt.Println(err)
+		failed = true
 	}
 
-	if !bytes.Equal(src, out.Bytes()) {
-		if *write {
-			fmt.Println("MODIFIED " + filename)
-			ioutil.WriteFile(filename, out.Bytes(), 0755)
-		} else if *verbose > 1 {
-			fmt.Println("<--- " + filename + " --->\n" + out.String())
-		} else {
-			fmt.Println("MODIFIES " + filename)
+	sort.Slice(changes, func(i, k int) bool { return changes[i].Filename < changes[k].Filename })
+	for _, change := range changes {
+		if change.Rename != "" && !*write {
+			fmt.Println("MOVES " + change.Filename + " -> " + change.Rename)
+		}
+		switch {
+		case *showdiff:
+			fmt.Print(diff.Unified("a/"+relative(change.Filename), "b/"+relative(change.Target()), change.Old, change.New))
+		case *verbose > 1:
+			fmt.Println("<--- " + change.Target() + " --->\n" + string(change.New))
+		case !*write && change.Rename == "":
+			fmt.Println("MODIFIES " + change.Filename)
 		}
 	}
-	return nil
-}
-
-type BatchRename struct {
-	Unit map[string]Mapping
-}
-type Mapping map[string]string
 
-func LoadBatchFile(file string) (*BatchRename, error) {
-	m := &BatchRename{}
-	_, err := toml.DecodeFile(file, m)
-	if err != nil {
-		return nil, err
+	for _, summary := range edits.Summary() {
+		fmt.Println("RENAMED " + summary)
+	}
+	for _, move := range moves {
+		fmt.Println("MOVE " + move)
 	}
 
-	m.canonicalize()
-	return m, nil
-}
-
-func (batch *BatchRename) CheckDuplicates() []error {
-	dups := []error{}
-	duplicate := map[string]bool{}
-	for unit, mapping := range batch.Unit {
-		for _, name := range mapping {
-			cname := strings.ToLower(name)
-			if duplicate[cname] {
-				dups = append(dups, errors.New(fmt.Sprintf("%s: %s", unit, name)))
+	if *write && len(changes) > 0 {
+		if failed {
+			fmt.Println("Error: not writing changes, some files failed.")
+			os.Exit(1)
+		}
+		if len(skipped) > 0 {
+			fmt.Println("Error: not writing changes, some references are in inactive code.")
+			os.Exit(1)
+		}
+		if err := rename.Apply(changes, *backup); err != nil {
+			fmt.Printf("Error writing changes: %s\n", err)
+			os.Exit(1)
+		}
+		for _, change := range changes {
+			if change.Rename != "" {
+				fmt.Println("MOVED " + change.Filename + " -> " + change.Rename)
+			} else {
+				fmt.Println("MODIFIED " + change.Filename)
 			}
-			duplicate[cname] = true
 		}
 	}
 
-	return dups
+	fmt.Println("<DONE>")
+	if len(skipped) > 0 {
+		os.Exit(1)
+	}
 }
 
-// Converts all source identifiers to Canonical form
-// NB: calling this is necessary for IsUnit/Lookup to work properly
-func (batch *BatchRename) canonicalize() {
-	units := make(map[string]Mapping, len(batch.Unit))
-	for unit, mapping := range batch.Unit {
-		cmapping := make(Mapping, len(mapping))
-		for ident, repl := range mapping {
-			cmapping[Canonical(ident)] = repl
+// relative returns filename relative to the working directory.
+func relative(filename string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, filename); err == nil && !strings.HasPrefix(rel, "..") {
+			filename = rel
 		}
-		units[Canonical(unit)] = cmapping
 	}
-	batch.Unit = units
+	return filepath.ToSlash(filename)
 }
 
-// Looks whether an identifier is potentially a unit
-// NB: ident must be both in canonical form.
-func (batch *BatchRename) IsUnit(ident string) bool {
-	_, ok := batch.Unit[ident]
-	return ok
-}
+type DefinesFlag struct{ Sets [][]string }
 
-// Looks whether an identifier must be replaced.
-// NB: uses and ident must be both in canonical form.
-func (batch *BatchRename) Lookup(uses []string, ident string) (replacement string, ok bool) {
-	for _, unit := range uses {
-		mapping, ok := batch.Unit[unit]
-		if !ok {
-			continue
-		}
-		if repl, ok := mapping[ident]; ok {
-			return repl, ok
-		}
+func (flag *DefinesFlag) String() string {
+	var sets []string
+	for _, set := range flag.Sets {
+		sets = append(sets, strings.Join(set, ";"))
 	}
-	return "", false
+	return strings.Join(sets, " ")
+}
+
+func (flag *DefinesFlag) Set(value string) error {
+	flag.Sets = append(flag.Sets, strings.Split(value, ";"))
+	return nil
 }
 
-func Canonical(name string) string { return strings.ToLower(name) }
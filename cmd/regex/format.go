@@ -0,0 +1,89 @@
+package regex
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/search"
+)
+
+// Formats lists the output formats for counts, "table" is the default
+// summary of the distinct matches and the others list every match.
+var Formats = []string{"table", "json", "csv", "grep"}
+
+// CheckFormat returns an error when format is not one of Formats.
+func CheckFormat(format string) error {
+	for _, known := range Formats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, expected %s", format, strings.Join(Formats, ", "))
+}
+
+// WriteLocations writes the locations of the matches in format, names
+// are the names of the submatch groups, unnamed groups are numbered.
+func WriteLocations(w io.Writer, format string, names []string, locations []search.Location) error {
+	switch format {
+	case "json":
+		return writeJSON(w, locations)
+	case "csv":
+		return writeCSV(w, names, locations)
+	case "grep":
+		for _, loc := range locations {
+			if _, err := fmt.Fprintf(w, "%v:%v:%v: %v\n", loc.File, loc.Line, loc.Col, delphi.Quote(loc.Text)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return CheckFormat(format)
+}
+
+type jsonLocation struct {
+	File   string   `json:"file"`
+	Line   int      `json:"line"`
+	Col    int      `json:"col"`
+	Match  string   `json:"match"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+func writeJSON(w io.Writer, locations []search.Location) error {
+	list := make([]jsonLocation, 0, len(locations))
+	for _, loc := range locations {
+		list = append(list, jsonLocation{loc.File, loc.Line, loc.Col, loc.Text, loc.Groups})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(list)
+}
+
+func writeCSV(w io.Writer, names []string, locations []search.Location) error {
+	out := csv.NewWriter(w)
+
+	header := []string{"file", "line", "col", "match"}
+	for i, name := range names {
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		header = append(header, name)
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	for _, loc := range locations {
+		record := []string{loc.File, strconv.Itoa(loc.Line), strconv.Itoa(loc.Col), loc.Text}
+		record = append(record, loc.Groups...)
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
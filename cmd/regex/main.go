@@ -6,12 +6,15 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"text/tabwriter"
 
 	"github.com/egonelbre/async"
 	"github.com/raintreeinc/delphi/delphi"
 	"github.com/raintreeinc/delphi/internal/cli"
 	"github.com/raintreeinc/delphi/internal/walk"
+	"github.com/raintreeinc/delphi/search"
 )
 
 const ShortDesc = "count or replace using regular expressions"
@@ -26,9 +29,30 @@ func Help(args []string) {
   -match   extract specific match
   -case    case sensitive
   -nospace ignore spaces when counting
+  -format  output format of counts: table, json, csv or grep (default table)
+
+           json, csv and grep list every match with its line and
+           column, the submatch selected by -match and all submatch
+           groups; grep prints file:line:col: match
+
+  -code     match only in code, skipping comments, literals and
+            inactive {$IFDEF} branches
+  -comments match only in comments
+  -strings  match only in string and character literals
+  -define   defines for evaluating {$IFDEF}s, default DELPHI_DEFINE
+
+            -code, -comments and -strings can be combined, matches do
+            not span from one selected token class to an unselected one
 
-  -w    write replacements to file
   -r    replacement for pattern
+  -d    print unified diffs of the replacements with the matches
+        highlighted
+  -i    ask for each group of replacements on the same lines whether
+        to apply it and write the accepted ones to file
+  -w    write replacements to file
+
+        file mode and line endings are preserved, the replacement is
+        written with the line endings of the file
 
   -care check only files that match these globs
 `)
@@ -41,12 +65,20 @@ type Flags struct {
 	Verbose bool
 	Help    bool
 
-	Procs int
-	Write bool
+	Procs       int
+	Write       bool
+	Diff        bool
+	Interactive bool
 
 	Match         int
 	CaseSensitive bool
 	IgnoreSpace   bool
+	Format        string
+
+	Code     bool
+	Comments bool
+	Strings  bool
+	Define   string
 
 	Care walk.GlobsFlag
 
@@ -71,9 +103,17 @@ func (flags *Flags) Parse(args []string) {
 	flags.Set.IntVar(&flags.Match, "match", 0, "extract specific match")
 	flags.Set.BoolVar(&flags.CaseSensitive, "case", false, "case sensitive")
 	flags.Set.BoolVar(&flags.IgnoreSpace, "nospace", false, "ignore spaces when counting")
+	flags.Set.StringVar(&flags.Format, "format", "table", "output format of counts: table, json, csv or grep")
+
+	flags.Set.BoolVar(&flags.Code, "code", false, "match only in code")
+	flags.Set.BoolVar(&flags.Comments, "comments", false, "match only in comments")
+	flags.Set.BoolVar(&flags.Strings, "strings", false, "match only in string literals")
+	flags.Set.StringVar(&flags.Define, "define", "", "defines for evaluating {$IFDEF}s, default DELPHI_DEFINE")
 
-	flags.Set.BoolVar(&flags.Write, "w", false, "write replacements to file")
 	flags.Set.StringVar(&flags.Replacement, "r", "", "replacement for pattern")
+	flags.Set.BoolVar(&flags.Diff, "d", false, "print unified diffs of the replacements")
+	flags.Set.BoolVar(&flags.Interactive, "i", false, "ask whether to apply each replacement")
+	flags.Set.BoolVar(&flags.Write, "w", false, "write replacements to file")
 
 	flags.Set.Var(&flags.Care, "care", "check only files that match these globs")
 
@@ -83,6 +123,25 @@ func (flags *Flags) Parse(args []string) {
 		flags.Pattern = args[0]
 		flags.Paths = args[1:]
 	}
+
+	if flags.Define == "" {
+		flags.Define = delphi.Define()
+	}
+}
+
+// Scope returns the token classes selected by the flags.
+func (flags *Flags) Scope() search.Scope {
+	scope := search.Raw
+	if flags.Code {
+		scope |= search.Code
+	}
+	if flags.Comments {
+		scope |= search.Comments
+	}
+	if flags.Strings {
+		scope |= search.Strings
+	}
+	return scope
 }
 
 func Main(args []string) {
@@ -109,10 +168,17 @@ func Main(args []string) {
 		cli.Errorf("invalid pattern %q: %s\n", flags.Pattern, err)
 		os.Exit(1)
 	}
+	if err := CheckFormat(flags.Format); err != nil {
+		cli.Errorf("%s\n", err)
+		os.Exit(1)
+	}
 
 	filenames := make(chan string, flags.Procs)
 	errors := make(chan error, flags.Procs)
-	counters := make(chan *Counter, flags.Procs)
+	counters := make(chan *search.Counter, flags.Procs)
+
+	scope := flags.Scope()
+	defines := strings.Split(flags.Define, ";")
 
 	care := walk.IsDelphiFile
 	if !flags.Care.IsEmpty() {
@@ -125,16 +191,21 @@ func Main(args []string) {
 		close(filenames)
 	}()
 
+	var mu sync.Mutex
+	var changed []*search.File
+
 	// count/replace
 	async.Spawn(flags.Procs, func(id int) {
-		total := NewCounter()
+		total := search.NewCounter()
+		total.Locate = flags.Format != "table"
 		r := re.Copy()
 		for filename := range filenames {
-			file, err := LoadFile(filename)
+			file, err := search.LoadFile(filename)
 			if err != nil {
 				errors <- err
 				continue
 			}
+			file.Restrict(scope, defines)
 
 			if flags.Count {
 				file.CountRegular(r, total, flags.Match, !flags.CaseSensitive, flags.IgnoreSpace)
@@ -143,14 +214,9 @@ func Main(args []string) {
 				file.Replace(r, flags.Replacement)
 
 				if file.Changed() {
-					if flags.Write {
-						if err := file.WriteChanges(); err != nil {
-							errors <- err
-						}
-						cli.Printf("modified %q\n", file.Path)
-					} else {
-						cli.Printf("modifies %q\n", file.Path)
-					}
+					mu.Lock()
+					changed = append(changed, file)
+					mu.Unlock()
 				}
 			}
 		}
@@ -161,11 +227,25 @@ func Main(args []string) {
 		cli.Errorf("%s\n", err)
 	}
 
-	total := NewCounter()
+	if flags.Replacement != "" {
+		sort.Slice(changed, func(i, k int) bool { return changed[i].Path < changed[k].Path })
+		Replaced(&flags, changed, os.Stdin, os.Stdout)
+	}
+
+	total := search.NewCounter()
 	for counter := range counters {
 		total.Merge(counter)
 	}
 
+	if flags.Count && flags.Format != "table" {
+		total.SortLocations()
+		if err := WriteLocations(os.Stdout, flags.Format, re.SubexpNames()[1:], total.Locations); err != nil {
+			cli.Errorf("%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if flags.Count {
 		var names []string
 		for name := range total.Actual {
@@ -0,0 +1,157 @@
+package regex
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/raintreeinc/delphi/internal/cli"
+	"github.com/raintreeinc/delphi/internal/diff"
+	"github.com/raintreeinc/delphi/search"
+)
+
+// Replaced reports, and with -w or -i writes, the replacements in the
+// changed files, with -i only the accepted ones.
+func Replaced(flags *Flags, changed []*search.File, in io.Reader, out io.Writer) {
+	if flags.Interactive {
+		Confirm(changed, in, out)
+	}
+
+	replacements, modified := 0, 0
+	for _, file := range changed {
+		if !file.Changed() {
+			continue
+		}
+		n := len(file.Replacements)
+
+		if flags.Diff {
+			name := filepath.ToSlash(file.Path)
+			fmt.Fprint(out, diff.UnifiedHighlight("a/"+name, "b/"+name, file.Source, file.Modified, highlight(file.Replacements)))
+		}
+
+		if flags.Write || flags.Interactive {
+			if err := file.WriteChanges(); err != nil {
+				cli.Errorf("%s\n", err)
+				continue
+			}
+			cli.Printf("modified %q, %s\n", file.Path, plural(n, "replacement"))
+		} else {
+			cli.Printf("modifies %q, %s\n", file.Path, plural(n, "replacement"))
+		}
+		replacements += n
+		modified++
+	}
+	cli.Infof("%s in %s\n", plural(replacements, "replacement"), plural(modified, "file"))
+}
+
+// highlight marks the replaced matches in the old content and the
+// replacements in the new content.
+func highlight(replacements []search.Replacement) *diff.Highlight {
+	hl := &diff.Highlight{Delete: cli.Deleted, Insert: cli.Inserted}
+	shift := 0
+	for _, r := range replacements {
+		hl.A = append(hl.A, diff.Range{Start: r.Start, End: r.End})
+		start := r.Start + shift
+		hl.B = append(hl.B, diff.Range{Start: start, End: start + len(r.Text)})
+		shift += len(r.Text) - (r.End - r.Start)
+	}
+	return hl
+}
+
+// Confirm asks for every group of replacements on the same lines whether
+// to apply it, the replacements of the files are reduced to the accepted
+// ones.
+func Confirm(changed []*search.File, in io.Reader, out io.Writer) {
+	input := bufio.NewReader(in)
+
+	quit := false
+	for _, file := range changed {
+		var accepted []search.Replacement
+		all, none := false, false
+		for _, group := range groups(file) {
+			answer := byte('n')
+			switch {
+			case quit || none:
+			case all:
+				answer = 'y'
+			default:
+				var hunk strings.Builder
+				diff.WriteHunks(&hunk, file.Source, file.Apply(group), highlight(group))
+				fmt.Fprintf(out, "%s\n%s", file.Path, hunk.String())
+				answer = ask(input, out)
+			}
+
+			switch answer {
+			case 'y':
+				accepted = append(accepted, group...)
+			case 'a':
+				all = true
+				accepted = append(accepted, group...)
+			case 'd':
+				none = true
+			case 'q':
+				quit = true
+			}
+		}
+		file.Replacements = accepted
+		file.Modified = file.Apply(accepted)
+	}
+}
+
+// ask reads the answer for a group of replacements, the end of the input
+// quits.
+func ask(input *bufio.Reader, out io.Writer) byte {
+	for {
+		fmt.Fprintf(out, "Replace [y,n,a,d,q,?]? ")
+		line, err := input.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" && err != nil {
+			fmt.Fprintln(out)
+			return 'q'
+		}
+		if len(line) == 1 && strings.Contains("ynadq", line) {
+			return line[0]
+		}
+		fmt.Fprint(out, `y - replace
+n - do not replace
+a - replace this and the remaining matches in the file
+d - do not replace this or the remaining matches in the file
+q - quit, do not replace this or any of the remaining matches
+`)
+	}
+}
+
+// groups splits the replacements of file into groups touching the same
+// lines.
+func groups(file *search.File) [][]search.Replacement {
+	var result [][]search.Replacement
+	line, offset := 1, 0
+	lineAt := func(at int) int {
+		line += bytes.Count(file.Source[offset:at], []byte("\n"))
+		offset = at
+		return line
+	}
+
+	last := 0 // last line of the current group
+	for _, r := range file.Replacements {
+		first := lineAt(r.Start)
+		if len(result) == 0 || first > last {
+			result = append(result, nil)
+		}
+		result[len(result)-1] = append(result[len(result)-1], r)
+		if end := lineAt(r.End); end > last {
+			last = end
+		}
+	}
+	return result
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
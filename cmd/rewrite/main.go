@@ -0,0 +1,219 @@
+package rewrite
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/egonelbre/async"
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/internal/cli"
+	"github.com/raintreeinc/delphi/internal/diff"
+	"github.com/raintreeinc/delphi/internal/files"
+	"github.com/raintreeinc/delphi/internal/walk"
+	"github.com/raintreeinc/delphi/rewrite"
+)
+
+const ShortDesc = "search and replace code by structure"
+
+func Help(args []string) {
+	cli.Helpf("Usage:\n")
+	cli.Helpf("\t%s [arguments] pattern path...\n\n", args[0])
+	cli.Helpf(`Arguments:
+  -n    number of workers (default 8)
+
+  -r    replacement for pattern
+  -d    print unified diffs of the replacements, the default without -w
+  -w    write replacements to files
+
+  -define  defines for evaluating {$IFDEF}s, default DELPHI_DEFINE
+  -care    check only files that match these globs
+
+Patterns:
+  A pattern is Delphi code with metavariables, a $ followed by a name.
+  Patterns are matched on the tokens of the active code, white space,
+  line breaks and comments don't matter and identifiers and keywords are
+  compared ignoring case.
+
+  A metavariable matches code with balanced parentheses, brackets and
+  blocks: the statements of a block before end, until, except or finally;
+  a single statement after then, else, do, begin, try, repeat or ;; and
+  part of an expression otherwise. A metavariable used several times must
+  match the same code. Hexadecimal numbers are written with a leading
+  digit, e.g. $0FF.
+
+  The metavariables of the replacement are substituted by the code they
+  matched, an empty replacement deletes the matches. Line breaks of the
+  replacement are written with the line ending of the file. Without -r
+  the matches are listed.
+
+Examples:
+  %[1]s -r '$x.Free; $x := nil' 'FreeAndNil($x)' src
+  %[1]s -w -r 'if $c then $s' 'if $c then begin $s end' src
+  %[1]s -w -r '' 'Assert($c);' src
+`, args[0])
+}
+
+type Flags struct {
+	Help bool
+
+	Procs int
+	Write bool
+	Diff  bool
+
+	Define string
+	Care   walk.GlobsFlag
+
+	Pattern     string
+	Replace     bool // -r was given, the replacement may be empty
+	Replacement string
+	Paths       []string
+
+	Set *flag.FlagSet
+}
+
+func (flags *Flags) Parse(args []string) {
+	flags.Set = flag.NewFlagSet(args[0], flag.ExitOnError)
+
+	flags.Set.BoolVar(&flags.Help, "help", false, "show help")
+	flags.Set.BoolVar(&flags.Help, "h", false, "show help")
+
+	flags.Set.IntVar(&flags.Procs, "n", 8, "number of workers")
+
+	flags.Set.StringVar(&flags.Replacement, "r", "", "replacement for pattern")
+	flags.Set.BoolVar(&flags.Diff, "d", false, "print unified diffs of the replacements")
+	flags.Set.BoolVar(&flags.Write, "w", false, "write replacements to files")
+
+	flags.Set.StringVar(&flags.Define, "define", "", "defines for evaluating {$IFDEF}s, default DELPHI_DEFINE")
+	flags.Set.Var(&flags.Care, "care", "check only files that match these globs")
+
+	flags.Set.Parse(args[1:])
+	flags.Set.Visit(func(f *flag.Flag) {
+		if f.Name == "r" {
+			flags.Replace = true
+		}
+	})
+
+	if args := flags.Set.Args(); len(args) >= 1 {
+		flags.Pattern = args[0]
+		flags.Paths = args[1:]
+	}
+
+	if flags.Define == "" {
+		flags.Define = delphi.Define()
+	}
+}
+
+// Result are the matches in a file and the rewritten source.
+type Result struct {
+	Path     string
+	Source   []byte
+	Modified []byte
+	Matches  []*rewrite.Match
+}
+
+func Main(args []string) {
+	var flags Flags
+	flags.Parse(args)
+	if flags.Help || flags.Pattern == "" {
+		Help(args)
+		return
+	}
+
+	if len(flags.Paths) == 0 {
+		flags.Paths = []string{"."}
+	}
+	replace := flags.Replace
+	if replace && !flags.Write {
+		flags.Diff = true
+	}
+
+	pattern, err := rewrite.Compile(flags.Pattern)
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := pattern.CheckReplacement(flags.Replacement); err != nil {
+		cli.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	defines := strings.Split(flags.Define, ";")
+
+	filenames := make(chan string, flags.Procs)
+	errors := make(chan error, flags.Procs)
+
+	care := walk.IsDelphiFile
+	if !flags.Care.IsEmpty() {
+		care = flags.Care.Matches
+	}
+
+	go func() {
+		walk.Globs(flags.Paths, filenames, errors, care)
+		close(filenames)
+	}()
+
+	var mu sync.Mutex
+	var results []*Result
+	async.Spawn(flags.Procs, func(id int) {
+		for filename := range filenames {
+			src, err := ioutil.ReadFile(filename)
+			if err != nil {
+				errors <- err
+				continue
+			}
+
+			matches := pattern.Find(src, defines)
+			if len(matches) == 0 {
+				continue
+			}
+			result := &Result{Path: filename, Source: src, Modified: src, Matches: matches}
+			if replace {
+				result.Modified = rewrite.Replace(src, matches, flags.Replacement)
+			}
+
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}
+	}, func() { close(errors) })
+
+	for err := range errors {
+		cli.Errorf("%s\n", err)
+	}
+
+	sort.Slice(results, func(i, k int) bool { return results[i].Path < results[k].Path })
+
+	count := 0
+	var changes []files.Change
+	for _, result := range results {
+		count += len(result.Matches)
+		switch {
+		case !replace:
+			for _, match := range result.Matches {
+				code := strings.Join(strings.Fields(match.Code(result.Source)), " ")
+				fmt.Fprintf(os.Stdout, "%v:%v:%v: %v\n", result.Path, match.Line, match.Column, code)
+			}
+		case flags.Diff:
+			name := filepath.ToSlash(result.Path)
+			fmt.Fprint(os.Stdout, diff.Unified("a/"+name, "b/"+name, result.Source, result.Modified))
+		}
+		changes = append(changes, files.Change{Filename: result.Path, Data: result.Modified})
+	}
+
+	if replace && flags.Write && len(changes) > 0 {
+		if err := files.Apply(changes); err != nil {
+			cli.Errorf("failed to write changes: %v\n", err)
+			os.Exit(1)
+		}
+		for _, change := range changes {
+			cli.Printf("modified %q\n", change.Filename)
+		}
+	}
+
+	cli.Infof("%d matches in %d files\n", count, len(results))
+}
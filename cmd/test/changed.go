@@ -0,0 +1,154 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/raintreeinc/delphi/deps"
+	"github.com/raintreeinc/delphi/discover"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// Changes are the units modified since a git ref.
+type Changes struct {
+	Units []string // changed unit names
+	All   bool     // an include file changed, every unit may be affected
+}
+
+// ChangedSince lists the units changed in the working tree since ref,
+// including uncommitted and untracked files.
+func ChangedSince(ref string) (*Changes, error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	diff, err := git("diff", "--name-only", "-z", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git("ls-files", "--others", "--exclude-standard", "--full-name", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	top = strings.TrimSpace(top)
+	filenames := append(gitPaths(top, diff), gitPaths(top, untracked)...)
+	return ChangedFiles(filenames), nil
+}
+
+// gitPaths returns the NUL separated paths of a git -z listing, relative
+// to the repository root top, as file names.
+func gitPaths(top, list string) []string {
+	var filenames []string
+	for _, name := range strings.Split(list, "\x00") {
+		if name != "" {
+			filenames = append(filenames, filepath.Join(top, filepath.FromSlash(name)))
+		}
+	}
+	return filenames
+}
+
+// ChangedFiles returns the units of the changed files.
+func ChangedFiles(filenames []string) *Changes {
+	changes := &Changes{}
+	for _, filename := range filenames {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".pas", ".dfm":
+			unit := trimExt(filepath.Base(filename))
+			if !contains(unit, changes.Units) {
+				changes.Units = append(changes.Units, unit)
+			}
+		case ".inc":
+			changes.All = true
+		}
+	}
+	return changes
+}
+
+// Empty reports whether no unit changed.
+func (changes *Changes) Empty() bool {
+	return !changes.All && len(changes.Units) == 0
+}
+
+func git(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %v: %v %v", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Affected returns the test files that use a changed unit directly or
+// through other units. The uses graph is built from the units found in
+// the search directories, verbose reports the warnings found building it.
+func (changes *Changes) Affected(files []*discover.TestFile, search []string, verbose bool) []*discover.TestFile {
+	if changes.All {
+		return files
+	}
+
+	users := usesIndex(files, search, verbose).UsedBy()
+
+	affected := map[string]bool{}
+	var queue []string
+	for _, unit := range changes.Units {
+		queue = append(queue, strings.ToLower(unit))
+	}
+	for len(queue) > 0 {
+		unit := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if affected[unit] {
+			continue
+		}
+		affected[unit] = true
+		queue = append(queue, users[unit]...)
+	}
+
+	var result []*discover.TestFile
+	for _, file := range files {
+		if affected[strings.ToLower(file.UnitName)] {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// usesIndex builds the uses graph of the test files from the units found
+// in the search directories and the directories of the test files. Every
+// directory is walked once, through the outermost listed directory
+// containing it. Unreadable directories and units are reported, the
+// warnings of the index only when verbose.
+func usesIndex(files []*discover.TestFile, search []string, verbose bool) *deps.Index {
+	index := deps.NewIndex()
+	dirs := append([]string{}, search...)
+	var roots []string
+	for _, file := range files {
+		dirs = append(dirs, filepath.Dir(file.Path))
+		roots = append(roots, file.Path)
+	}
+	for _, dir := range deps.Roots(dirs) {
+		if err := index.AddSourceDir(dir); err != nil {
+			cli.Warnf("%v\n", err)
+		}
+	}
+
+	err := index.Build(roots)
+	if verbose {
+		for _, warning := range index.Warnings {
+			cli.Warnf("%v\n", warning)
+		}
+	}
+	if err != nil {
+		cli.Warnf("%v\n", err)
+	}
+	return index
+}
+
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+func TestChangedFiles(t *testing.T) {
+	changes := ChangedFiles([]string{
+		filepath.Join("src", "Calc.pas"),
+		filepath.Join("src", "Calc.dfm"),
+		filepath.Join("src", "Main.dpr"),
+		filepath.Join("tests", "Calc_Test.PAS"),
+		"README.md",
+	})
+	if !reflect.DeepEqual(changes.Units, []string{"Calc", "Calc_Test"}) || changes.All {
+		t.Errorf("got %+v", changes)
+	}
+	if changes.Empty() {
+		t.Errorf("changes reported empty")
+	}
+
+	if changes := ChangedFiles([]string{"defines.inc"}); !changes.All || changes.Empty() {
+		t.Errorf("include: got %+v", changes)
+	}
+	if changes := ChangedFiles(nil); !changes.Empty() {
+		t.Errorf("no files: got %+v", changes)
+	}
+}
+
+func TestGitPaths(t *testing.T) {
+	top := filepath.Join("repo", "root")
+	list := "src/My Units/Calc.pas\x00tests/Calc_Test.pas\x00"
+	got := gitPaths(top, list)
+	exp := []string{
+		filepath.Join(top, "src", "My Units", "Calc.pas"),
+		filepath.Join(top, "tests", "Calc_Test.pas"),
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %q, expected %q", got, exp)
+	}
+	if changes := ChangedFiles(got); !reflect.DeepEqual(changes.Units, []string{"Calc", "Calc_Test"}) {
+		t.Errorf("got units %v", changes.Units)
+	}
+	if got := gitPaths(top, ""); len(got) != 0 {
+		t.Errorf("empty listing: got %q", got)
+	}
+}
+
+var affectedUnits = map[string]string{
+	"src/Core.pas": `unit Core;
+interface
+implementation
+end.
+`,
+	"src/sub/Mid.pas": `unit Mid;
+interface
+implementation
+uses Core;
+end.
+`,
+	"tests/Calc_Test.pas": `unit Calc_Test;
+interface
+uses Mid;
+implementation
+end.
+`,
+	"tests/Other_Test.pas": `unit Other_Test;
+interface
+uses SysUtils;
+implementation
+end.
+`,
+}
+
+// writeAffected writes affectedUnits into a temporary directory and
+// returns the test files and the search path of -root.
+func writeAffected(t *testing.T) (dir string, files []*discover.TestFile, search []string) {
+	dir, err := ioutil.TempDir("", "changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, src := range affectedUnits {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files = []*discover.TestFile{
+		{Path: filepath.Join(dir, "tests", "Calc_Test.pas"), UnitName: "Calc_Test"},
+		{Path: filepath.Join(dir, "tests", "Other_Test.pas"), UnitName: "Other_Test"},
+	}
+	// -root adds the sub folders as well
+	search = []string{filepath.Join(dir, "src"), filepath.Join(dir, "src", "sub")}
+	return dir, files, search
+}
+
+func TestAffected(t *testing.T) {
+	_, files, search := writeAffected(t)
+
+	for _, test := range []struct {
+		changes *Changes
+		exp     []string
+	}{
+		{&Changes{Units: []string{"core"}}, []string{"Calc_Test"}},
+		{&Changes{Units: []string{"Mid"}}, []string{"Calc_Test"}},
+		{&Changes{Units: []string{"Other_Test"}}, []string{"Other_Test"}},
+		{&Changes{Units: []string{"SysUtils"}}, nil},
+		{&Changes{All: true}, []string{"Calc_Test", "Other_Test"}},
+	} {
+		var got []string
+		for _, file := range test.changes.Affected(files, search, false) {
+			got = append(got, file.UnitName)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%+v: got %v, expected %v", test.changes, got, test.exp)
+		}
+	}
+}
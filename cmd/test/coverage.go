@@ -0,0 +1,549 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/raintreeinc/delphi/discover"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// Coverage instruments units with line probes and collects the hits of
+// the test run.
+type Coverage struct {
+	Dir   string // directory of the instrumented units
+	Files []*CoverFile
+
+	probes []probe
+}
+
+// CoverFile is an instrumented unit.
+type CoverFile struct {
+	Unit string
+	Path string      // original source
+	Hits map[int]int // hit count of each instrumented line
+}
+
+// probe is the location of a single probe.
+type probe struct {
+	file *CoverFile
+	line int
+}
+
+// NewCoverage creates coverage writing the instrumented units into dir.
+func NewCoverage(dir string) *Coverage {
+	return &Coverage{Dir: dir}
+}
+
+// Instrument writes an instrumented copy of the unit at path into the
+// coverage directory, files with the same name such as forms are copied
+// along.
+func (cov *Coverage) Instrument(path string, defines []string) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cov.Dir, 0755); err != nil {
+		return err
+	}
+
+	file := &CoverFile{
+		Unit: trimExt(filepath.Base(path)),
+		Path: path,
+		Hits: map[int]int{},
+	}
+	out, lines := instrument(path, src, defines, len(cov.probes))
+	for _, line := range lines {
+		cov.probes = append(cov.probes, probe{file, line})
+		file.Hits[line] = 0
+	}
+	cov.Files = append(cov.Files, file)
+
+	if err := ioutil.WriteFile(filepath.Join(cov.Dir, filepath.Base(path)), out, 0644); err != nil {
+		return err
+	}
+
+	others, _ := filepath.Glob(trimExt(path) + ".*")
+	for _, other := range others {
+		if strings.EqualFold(other, path) {
+			continue
+		}
+		data, err := ioutil.ReadFile(other)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(cov.Dir, filepath.Base(other)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteUnit writes the unit counting the probe hits. The counts are
+// written on exit to the file named by DELPHI_TEST_COVERAGE.
+func (cov *Coverage) WriteUnit() error {
+	filename := filepath.Join(cov.Dir, coverageUnit+".pas")
+	return CreateFile(filename, Coverage_Template, struct {
+		Unit   string
+		Probes int
+	}{coverageUnit, len(cov.probes)})
+}
+
+// ReadHits adds the hit counts written by a runner to the covered lines.
+// A runner killed before exiting does not write its counts.
+func (cov *Coverage) ReadHits(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		id, err1 := strconv.Atoi(fields[0])
+		count, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || id < 0 || id >= len(cov.probes) {
+			return fmt.Errorf("%v: invalid line %q", filename, scanner.Text())
+		}
+		probe := cov.probes[id]
+		probe.file.Hits[probe.line] += count
+	}
+	return scanner.Err()
+}
+
+// Lines returns the number of covered and instrumented lines.
+func (file *CoverFile) Lines() (covered, total int) {
+	for _, hits := range file.Hits {
+		if hits > 0 {
+			covered++
+		}
+		total++
+	}
+	return covered, total
+}
+
+// Lines returns the number of covered and instrumented lines of all files.
+func (cov *Coverage) Lines() (covered, total int) {
+	for _, file := range cov.Files {
+		c, t := file.Lines()
+		covered += c
+		total += t
+	}
+	return covered, total
+}
+
+func rate(covered, total int) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(covered) / float64(total)
+}
+
+func (cov *Coverage) String() string {
+	covered, total := cov.Lines()
+	return fmt.Sprintf("coverage: %.1f%% of %d lines", 100*rate(covered, total), total)
+}
+
+// WriteFiles writes the Cobertura XML and the HTML report, files with
+// empty names are skipped.
+func (cov *Coverage) WriteFiles(cobertura, html string) error {
+	return NewErrors("coverage",
+		writeFile(cobertura, cov.WriteCobertura),
+		writeFile(html, cov.WriteHTML),
+	)
+}
+
+func writeFile(filename string, write func(w io.Writer) error) error {
+	if filename == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+type (
+	coberturaReport struct {
+		XMLName         xml.Name           `xml:"coverage"`
+		LineRate        string             `xml:"line-rate,attr"`
+		BranchRate      string             `xml:"branch-rate,attr"`
+		LinesCovered    int                `xml:"lines-covered,attr"`
+		LinesValid      int                `xml:"lines-valid,attr"`
+		BranchesCovered int                `xml:"branches-covered,attr"`
+		BranchesValid   int                `xml:"branches-valid,attr"`
+		Complexity      int                `xml:"complexity,attr"`
+		Version         string             `xml:"version,attr"`
+		Timestamp       int64              `xml:"timestamp,attr"`
+		Sources         []string           `xml:"sources>source"`
+		Packages        []coberturaPackage `xml:"packages>package"`
+	}
+	coberturaPackage struct {
+		Name       string           `xml:"name,attr"`
+		LineRate   string           `xml:"line-rate,attr"`
+		BranchRate string           `xml:"branch-rate,attr"`
+		Complexity int              `xml:"complexity,attr"`
+		Classes    []coberturaClass `xml:"classes>class"`
+	}
+	coberturaClass struct {
+		Name       string          `xml:"name,attr"`
+		Filename   string          `xml:"filename,attr"`
+		LineRate   string          `xml:"line-rate,attr"`
+		BranchRate string          `xml:"branch-rate,attr"`
+		Complexity int             `xml:"complexity,attr"`
+		Methods    struct{}        `xml:"methods"`
+		Lines      []coberturaLine `xml:"lines>line"`
+	}
+	coberturaLine struct {
+		Number int `xml:"number,attr"`
+		Hits   int `xml:"hits,attr"`
+	}
+)
+
+func rateString(covered, total int) string {
+	return strconv.FormatFloat(rate(covered, total), 'f', 4, 64)
+}
+
+// WriteCobertura writes the coverage as Cobertura XML with a package per
+// source directory.
+func (cov *Coverage) WriteCobertura(w io.Writer) error {
+	covered, total := cov.Lines()
+	report := coberturaReport{
+		LineRate:     rateString(covered, total),
+		BranchRate:   "0",
+		LinesCovered: covered,
+		LinesValid:   total,
+		Version:      "delphi test",
+		Timestamp:    time.Now().Unix(),
+	}
+
+	dirs := map[string]*coberturaPackage{}
+	lines := map[string][2]int{}
+	var names []string
+	for _, file := range cov.Files {
+		dir := filepath.Dir(file.Path)
+		pkg, ok := dirs[dir]
+		if !ok {
+			pkg = &coberturaPackage{Name: filepath.Base(dir), BranchRate: "0"}
+			dirs[dir] = pkg
+			names = append(names, dir)
+		}
+
+		c, t := file.Lines()
+		class := coberturaClass{
+			Name:       file.Unit,
+			Filename:   filepath.ToSlash(filepath.Join(filepath.Base(dir), filepath.Base(file.Path))),
+			LineRate:   rateString(c, t),
+			BranchRate: "0",
+		}
+		for _, line := range file.sortedLines() {
+			class.Lines = append(class.Lines, coberturaLine{line, file.Hits[line]})
+		}
+		pkg.Classes = append(pkg.Classes, class)
+
+		sum := lines[dir]
+		lines[dir] = [2]int{sum[0] + c, sum[1] + t}
+	}
+
+	sort.Strings(names)
+	for _, dir := range names {
+		pkg := dirs[dir]
+		pkg.LineRate = rateString(lines[dir][0], lines[dir][1])
+		report.Sources = appendUnique(report.Sources, filepath.Dir(dir))
+		report.Packages = append(report.Packages, *pkg)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (file *CoverFile) sortedLines() []int {
+	var lines []int
+	for line := range file.Hits {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, item := range list {
+		if item == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// WriteHTML writes a single page with a summary and the annotated
+// sources of all files.
+func (cov *Coverage) WriteHTML(w io.Writer) error {
+	type line struct {
+		Number int
+		Text   string
+		Class  string // hit, miss or empty when not instrumented
+		Hits   int
+	}
+	type file struct {
+		ID       string
+		Unit     string
+		Path     string
+		Percent  string
+		Covered  int
+		Total    int
+		Lines    []line
+		ReadFail string
+	}
+
+	var data struct {
+		Summary string
+		Files   []file
+	}
+	data.Summary = cov.String()
+
+	sorted := append([]*CoverFile{}, cov.Files...)
+	sort.Slice(sorted, func(i, k int) bool {
+		return strings.ToLower(sorted[i].Unit) < strings.ToLower(sorted[k].Unit)
+	})
+	for i, cf := range sorted {
+		c, t := cf.Lines()
+		f := file{
+			ID:      fmt.Sprintf("file%d", i),
+			Unit:    cf.Unit,
+			Path:    cf.Path,
+			Percent: fmt.Sprintf("%.1f%%", 100*rate(c, t)),
+			Covered: c,
+			Total:   t,
+		}
+
+		src, err := ioutil.ReadFile(cf.Path)
+		if err != nil {
+			f.ReadFail = err.Error()
+		}
+		text := strings.Replace(string(src), "\r\n", "\n", -1)
+		for n, s := range strings.Split(text, "\n") {
+			l := line{Number: n + 1, Text: s}
+			if hits, ok := cf.Hits[n+1]; ok {
+				l.Hits = hits
+				l.Class = "miss"
+				if hits > 0 {
+					l.Class = "hit"
+				}
+			}
+			f.Lines = append(f.Lines, l)
+		}
+		data.Files = append(data.Files, f)
+	}
+
+	return coverageHTML.Execute(w, data)
+}
+
+// Covering reports whether coverage is collected.
+func (build *Build) Covering() bool {
+	return build.CoverFile != "" || build.CoverHTML != ""
+}
+
+// Instrument instruments the units used by the tests for coverage, the
+// instrumented copies are found first in the search path.
+func (build *Build) Instrument() error {
+	cov := NewCoverage(build.CoverDir())
+	for _, path := range coverageUnits(build.Tests, build.Search, build.CoverUnits, build.Verbose) {
+		if build.Verbose {
+			cli.Infof("instrumenting %v\n", path)
+		}
+		if err := cov.Instrument(path, build.Define); err != nil {
+			return err
+		}
+	}
+	if err := cov.WriteUnit(); err != nil {
+		return err
+	}
+
+	build.Coverage = cov
+	build.Search = append([]string{cov.Dir}, build.Search...)
+	return nil
+}
+
+// coverEnv returns the environment entry telling the runner in dir where
+// to write its hit counts.
+func (build *Build) coverEnv(dir string) []string {
+	if build.Coverage == nil {
+		return nil
+	}
+	filename := filepath.Join(dir, build.Project+".coverage")
+	os.Remove(filename)
+
+	build.mu.Lock()
+	build.coverHits = append(build.coverHits, filename)
+	build.mu.Unlock()
+	return []string{"DELPHI_TEST_COVERAGE=" + filename}
+}
+
+// CoverResults reads the hit counts of the runners, prints a summary and
+// writes the coverage reports.
+func (build *Build) CoverResults() error {
+	cov := build.Coverage
+	if cov == nil {
+		return nil
+	}
+	for _, filename := range build.coverHits {
+		if err := cov.ReadHits(filename); err != nil {
+			return err
+		}
+	}
+	cli.Infof("%v\n", cov)
+	return cov.WriteFiles(build.CoverFile, build.CoverHTML)
+}
+
+// coverageUnits returns the units of the search path used by the tests,
+// directly or through other units, without the test units. When match
+// is not nil only the units with a matching name are returned, verbose
+// reports the warnings found building the uses graph.
+func coverageUnits(files []*discover.TestFile, search []string, match *regexp.Regexp, verbose bool) []string {
+	index := usesIndex(files, search, verbose)
+
+	var paths []string
+	for name := range index.Uses {
+		path, ok := index.Path[name]
+		if !ok || isTestFile(path, files) {
+			continue
+		}
+		if match != nil && !match.MatchString(trimExt(filepath.Base(path))) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func isTestFile(path string, files []*discover.TestFile) bool {
+	for _, file := range files {
+		if strings.EqualFold(file.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+var Coverage_Template = texttemplate.Must(texttemplate.New("").Parse(`// AUTOMATICALLY GENERATED BY "delphi test"
+unit {{.Unit}};
+
+{$IFDEF FPC}{$MODE DELPHI}{$ENDIF}
+{$Q-}
+{$R-}
+
+interface
+
+// Hit counts an executed line.
+procedure Hit(Id: Integer);
+
+implementation
+
+uses
+  SysUtils,
+  Classes;
+
+var
+  lHits: array[0..{{.Probes}}] of Cardinal;
+
+procedure Hit(Id: Integer);
+begin
+  Inc(lHits[Id]);
+end;
+
+// WriteHits writes "<id> <count>" lines to the file in DELPHI_TEST_COVERAGE.
+procedure WriteHits;
+var
+  lFile: string;
+  lLines: TStringList;
+  I: Integer;
+begin
+  lFile := GetEnvironmentVariable('DELPHI_TEST_COVERAGE');
+  if lFile = '' then
+    Exit;
+  lLines := TStringList.Create;
+  try
+    for I := Low(lHits) to High(lHits) do
+      if lHits[I] > 0 then
+        lLines.Add(IntToStr(I) + ' ' + IntToStr(lHits[I]));
+    lLines.SaveToFile(lFile);
+  finally
+    lLines.Free;
+  end;
+end;
+
+initialization
+finalization
+  WriteHits;
+end.
+`))
+
+var coverageHTML = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Summary}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table.summary td { padding: 0 1em 0 0; }
+table.summary td.number { text-align: right; }
+table.source { border-collapse: collapse; font-family: monospace; white-space: pre; }
+table.source td { padding: 0 0.5em; }
+table.source td.number, table.source td.hits { color: #888; text-align: right; }
+tr.hit td.text { background: #dfd; }
+tr.miss td.text { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>{{.Summary}}</h1>
+<table class="summary">
+{{- range .Files}}
+<tr><td><a href="#{{.ID}}">{{.Unit}}</a></td><td class="number">{{.Percent}}</td><td class="number">{{.Covered}}/{{.Total}}</td></tr>
+{{- end}}
+</table>
+{{- range .Files}}
+<h2 id="{{.ID}}">{{.Unit}} {{.Percent}}</h2>
+<p>{{.Path}}</p>
+{{- if .ReadFail}}
+<p>{{.ReadFail}}</p>
+{{- else}}
+<table class="source">
+{{- range .Lines}}
+<tr class="{{.Class}}"><td class="number">{{.Number}}</td><td class="hits">{{if .Class}}{{.Hits}}{{end}}</td><td class="text">{{.Text}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
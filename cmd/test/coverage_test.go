@@ -0,0 +1,121 @@
+package test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInstrument(t *testing.T) {
+	src := `unit Math;
+
+interface
+
+function Add(A, B: Integer): Integer;
+
+implementation
+
+uses
+  SysUtils;
+
+type
+  TPoint = record
+    X, Y: Integer;
+  end;
+
+  TShape = class(TObject)
+    procedure Draw;
+  end;
+
+  TShapeClass = class of TShape;
+
+procedure TShape.Draw;
+begin
+end;
+
+function Add(A, B: Integer): Integer;
+var
+  I: Integer;
+begin
+  Result := A;
+  for I := 1 to B do
+  begin
+    Inc(Result);
+  end;
+  try
+    case Result of
+      0: Result := 1;
+    end;
+  except
+    on E: Exception do
+      raise;
+  end;
+  asm
+    nop; nop
+  end;
+end;
+
+initialization
+  Add(1, 2);
+end.
+`
+	out, lines := instrument("Math.pas", []byte(src), nil, 3)
+
+	exp := []int{31, 32, 34, 36, 37, 44}
+	if !reflect.DeepEqual(lines, exp) {
+		t.Errorf("got probes on lines %v, expected %v", lines, exp)
+	}
+	if got := strings.Count(string(out), "\n"); got != strings.Count(src, "\n") {
+		t.Errorf("got %v lines, expected %v", got, strings.Count(src, "\n"))
+	}
+
+	outLines := strings.Split(string(out), "\n")
+	for i, exp := range map[int]string{
+		9:  "uses DelphiCoverage,",
+		31: "  DelphiCoverage.Hit(3);Result := A;",
+		36: "  DelphiCoverage.Hit(6);try",
+		37: "    DelphiCoverage.Hit(7);case Result of",
+		44: "  DelphiCoverage.Hit(8);asm",
+		50: "  Add(1, 2);",
+	} {
+		if outLines[i-1] != exp {
+			t.Errorf("line %v: got %q, expected %q", i, outLines[i-1], exp)
+		}
+	}
+}
+
+func TestInstrumentAnonymousMethod(t *testing.T) {
+	src := `unit Tasks;
+
+interface
+
+implementation
+
+procedure Start;
+begin
+  Run(procedure var I: Integer; const N = 2; begin
+    I := N;
+  end);
+  Done;
+end;
+
+end.
+`
+	out, lines := instrument("Tasks.pas", []byte(src), nil, 1)
+
+	exp := []int{9, 10, 12}
+	if !reflect.DeepEqual(lines, exp) {
+		t.Errorf("got probes on lines %v, expected %v", lines, exp)
+	}
+
+	outLines := strings.Split(string(out), "\n")
+	for i, exp := range map[int]string{
+		9:  "  DelphiCoverage.Hit(1);Run(procedure var I: Integer; const N = 2; begin",
+		10: "    DelphiCoverage.Hit(2);I := N;",
+		12: "  DelphiCoverage.Hit(3);Done;",
+	} {
+		if outLines[i-1] != exp {
+			t.Errorf("line %v: got %q, expected %q", i, outLines[i-1], exp)
+		}
+	}
+}
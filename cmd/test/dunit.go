@@ -2,35 +2,34 @@ package test
 
 import (
 	"bytes"
-	"html/template"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"text/template"
+
+	"github.com/raintreeinc/delphi/discover"
 )
 
 var (
 	DUnit_Template = template.Must(template.New("").Parse(`// DO NOT MODIFY MANUALLY, AUTO-GENERATED
-// delphi test -dunit {{.TestUnit}}.pas .
+// delphi test -dunit {{.Project}}.pas .
 
-unit {{.TestUnit}};
+unit {{.Project}};
 
 interface
 
 uses
-  {{range $test := .Tests -}}
-  {{$test.UnitName}},
-  {{ end }}
-  TestFramework,
-  rtTest,
-  rtTestDUnit
-  ;
+  {{range $unit := .Units -}}
+  {{$unit.Name}},
+  {{ end -}}
+  TestFramework;
 
 type
-{{range $test := .Tests}}
-  // unit {{$test.UnitName}}
-  {{$test.ClassName}} = class(TRtTestCase)
+{{range $unit := .Units}}
+  // unit {{$unit.Name}}
+  {{$unit.Class}} = class(TTestCase)
   published
-  {{- range $func := $test.Funcs }}
+  {{- range $func := $unit.Funcs }}
     procedure {{ $func.Method }};
   {{- end }}
   end;
@@ -38,59 +37,39 @@ type
 
 implementation
 
-{{range $test := .Tests}}
-{ {{$test.ClassName}} }
-{{range $func := $test.Funcs }}
-procedure {{$test.ClassName}}.{{$func.Method}};
+{{range $unit := .Units}}
+{ {{$unit.Class}} }
+{{range $func := $unit.Funcs }}
+procedure {{$unit.Class}}.{{$func.Method}};
 begin
-  RunTestCase({{$test.UnitName}}.{{$func.Call}});
+  {{$unit.Name}}.{{$func.Name}};
 end;
 {{end}}
 {{end}}
 
 initialization
-  {{range $test := .Tests -}}
-  TestFramework.RegisterTest({{$test.ClassName}}.Suite);
+  {{range $unit := .Units -}}
+  TestFramework.RegisterTest({{$unit.Class}}.Suite);
   {{ end }}
 end.
 `))
 )
 
-func GenerateDUnit(tests []*TestFile, outfile string) error {
-	type Func struct {
-		Method string
-		Call   string
-	}
-
-	type Test struct {
-		UnitName  string
-		ClassName string
-		Funcs     []Func
-	}
-
-	type Tests struct {
-		TestUnit string
-		Tests    []Test
-	}
-
-	dtests := Tests{}
-	ext := filepath.Ext(outfile)
-	dtests.TestUnit = filepath.Base(outfile[:len(outfile)-len(ext)])
+// GenerateDUnit writes a DUnit unit wrapping the Test_ procedures of
+// tests in test case classes.
+func GenerateDUnit(tests []*discover.TestFile, outfile string) error {
+	var files []*discover.TestFile
 	for _, test := range tests {
-		dtest := Test{}
-		dtest.UnitName = test.UnitName
-		dtest.ClassName = "T" + strings.Title(trimPrefix(trimSuffix(dtest.UnitName, "_Test"), "rt")) + "Test"
-		for _, fn := range test.Funcs {
-			dtest.Funcs = append(dtest.Funcs, Func{
-				Method: trimPrefix(fn, "Test_"),
-				Call:   fn,
-			})
+		if len(test.Funcs) > 0 {
+			files = append(files, test)
 		}
-		dtests.Tests = append(dtests.Tests, dtest)
 	}
 
+	ext := filepath.Ext(outfile)
+	data := NewTemplateData(filepath.Base(outfile[:len(outfile)-len(ext)]), files)
+
 	var buf bytes.Buffer
-	err := DUnit_Template.Execute(&buf, dtests)
+	err := DUnit_Template.Execute(&buf, data)
 	if err != nil {
 		return err
 	}
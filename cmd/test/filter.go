@@ -0,0 +1,124 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+// Filter selects tests by name and splits units into shards.
+type Filter struct {
+	Run  *regexp.Regexp // tests to run, nil runs all
+	Skip *regexp.Regexp // tests to skip, nil skips none
+
+	Shard  int // 1-based shard index
+	Shards int // number of shards, 0 when not sharding
+}
+
+// NewFilter creates a filter from the -run, -skip and -shard flags.
+// Patterns are matched case-insensitively against "Unit.Test" names.
+func NewFilter(run, skip, shard string) (*Filter, error) {
+	filter := &Filter{}
+
+	var err error
+	if run != "" {
+		if filter.Run, err = regexp.Compile("(?i)" + run); err != nil {
+			return nil, fmt.Errorf("invalid -run: %v", err)
+		}
+	}
+	if skip != "" {
+		if filter.Skip, err = regexp.Compile("(?i)" + skip); err != nil {
+			return nil, fmt.Errorf("invalid -skip: %v", err)
+		}
+	}
+	if shard != "" {
+		_, err := fmt.Sscanf(shard, "%d/%d", &filter.Shard, &filter.Shards)
+		// Sscanf ignores trailing text
+		exact := fmt.Sprintf("%d/%d", filter.Shard, filter.Shards) == shard
+		if err != nil || !exact || filter.Shards < 1 || filter.Shard < 1 || filter.Shard > filter.Shards {
+			return nil, fmt.Errorf("invalid -shard %q, expected i/n with 1 <= i <= n", shard)
+		}
+	}
+	return filter, nil
+}
+
+// Match reports whether the test with the given "Unit.Test" name runs.
+func (filter *Filter) Match(name string) bool {
+	if filter.Run != nil && !filter.Run.MatchString(name) {
+		return false
+	}
+	if filter.Skip != nil && filter.Skip.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// Apply removes the tests that do not match and returns the files that
+// still contain tests. With shards the remaining units are sorted by name
+// and dealt out in turn, every agent building the same sources gets the
+// same split.
+func (filter *Filter) Apply(files []*discover.TestFile) []*discover.TestFile {
+	var result []*discover.TestFile
+	for _, file := range files {
+		tests := file.Tests[:0]
+		for _, test := range file.Tests {
+			if filter.Match(file.UnitName + "." + test.FullName()) {
+				tests = append(tests, test)
+			}
+		}
+		file.Tests = tests
+
+		funcs := file.Funcs[:0]
+		for _, name := range file.Funcs {
+			if filter.Match(file.UnitName + "." + name) {
+				funcs = append(funcs, name)
+			}
+		}
+		file.Funcs = funcs
+
+		if len(file.Tests) > 0 {
+			result = append(result, file)
+		}
+	}
+
+	if filter.Shards <= 1 {
+		return result
+	}
+
+	sort.SliceStable(result, func(i, k int) bool {
+		return strings.ToLower(result[i].UnitName) < strings.ToLower(result[k].UnitName)
+	})
+	shard := result[:0]
+	for i, file := range result {
+		if i%filter.Shards == filter.Shard-1 {
+			shard = append(shard, file)
+		}
+	}
+	return shard
+}
+
+// TestNames returns the "Unit.Test" names of all tests in files.
+func TestNames(files []*discover.TestFile) []string {
+	var names []string
+	for _, file := range files {
+		for _, test := range file.Tests {
+			names = append(names, file.UnitName+"."+test.FullName())
+		}
+	}
+	return names
+}
+
+// writeSelection writes the names of the tests the runner should run,
+// one per line.
+func writeSelection(filename string, files []*discover.TestFile) error {
+	var b strings.Builder
+	for _, name := range TestNames(files) {
+		b.WriteString(name)
+		b.WriteString("\r\n")
+	}
+	return ioutil.WriteFile(filename, []byte(b.String()), 0644)
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter, err := NewFilter("calc|parser", "slow", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, exp := range map[string]bool{
+		"Calc_Test.Test_Add":        true,
+		"PARSER_Test.Test_Empty":    true,
+		"Calc_Test.Test_SlowAdd":    false,
+		"Format_Test.Test_Currency": false,
+	} {
+		if got := filter.Match(name); got != exp {
+			t.Errorf("%s: got %v, expected %v", name, got, exp)
+		}
+	}
+
+	all, err := NewFilter("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all.Match("Any.Test") {
+		t.Errorf("empty filter does not match")
+	}
+
+	for _, flags := range [][2]string{{"(", ""}, {"", "["}} {
+		if _, err := NewFilter(flags[0], flags[1], ""); err == nil {
+			t.Errorf("-run %q -skip %q: expected error", flags[0], flags[1])
+		}
+	}
+}
+
+func TestFilterApply(t *testing.T) {
+	file := &discover.TestFile{
+		UnitName: "Calc_Test",
+		Funcs:    []string{"Test_Add", "Test_Slow"},
+		Tests: []*discover.Test{
+			{Name: "Test_Add"},
+			{Name: "Test_Slow"},
+			{Class: "TCalcTest", Name: "TestSlowDivide", Kind: discover.DUnit},
+		},
+	}
+	empty := &discover.TestFile{
+		UnitName: "Slow_Test",
+		Funcs:    []string{"Test_Slow"},
+		Tests:    []*discover.Test{{Name: "Test_Slow"}},
+	}
+
+	filter, err := NewFilter("", "slow", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := filter.Apply([]*discover.TestFile{file, empty})
+	if len(files) != 1 || files[0] != file {
+		t.Fatalf("got %v files", len(files))
+	}
+	if names := TestNames(files); !reflect.DeepEqual(names, []string{"Calc_Test.Test_Add"}) {
+		t.Errorf("got tests %v", names)
+	}
+	if !reflect.DeepEqual(file.Funcs, []string{"Test_Add"}) {
+		t.Errorf("got funcs %v", file.Funcs)
+	}
+}
+
+func TestFilterShards(t *testing.T) {
+	units := func() []*discover.TestFile {
+		var files []*discover.TestFile
+		// not sorted, sharding sorts by unit name
+		for i := 10; i > 0; i-- {
+			files = append(files, &discover.TestFile{
+				UnitName: fmt.Sprintf("Unit%02d_Test", i),
+				Tests:    []*discover.Test{{Name: "Test_A"}},
+			})
+		}
+		return files
+	}
+
+	for n := 1; n <= 4; n++ {
+		seen := map[string]int{}
+		for i := 1; i <= n; i++ {
+			filter, err := NewFilter("", "", fmt.Sprintf("%d/%d", i, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := TestNames(filter.Apply(units()))
+			again := TestNames(filter.Apply(units()))
+			if !reflect.DeepEqual(first, again) {
+				t.Errorf("shard %d/%d: got %v and %v", i, n, first, again)
+			}
+			if len(first) < 10/n || len(first) > (10+n-1)/n {
+				t.Errorf("shard %d/%d: unbalanced %v", i, n, first)
+			}
+			for _, name := range first {
+				seen[name]++
+			}
+		}
+		if len(seen) != 10 {
+			t.Errorf("%d shards: got %d of 10 units", n, len(seen))
+		}
+		for name, count := range seen {
+			if count != 1 {
+				t.Errorf("%d shards: %s in %d shards", n, name, count)
+			}
+		}
+	}
+}
+
+func TestFilterShardFlag(t *testing.T) {
+	for shard, valid := range map[string]bool{
+		"1/1":  true,
+		"2/3":  true,
+		"3/3":  true,
+		"0/3":  false,
+		"4/3":  false,
+		"1/0":  false,
+		"-1/3": false,
+		"2":    false,
+		"a/b":  false,
+		"1/2x": false,
+		"1/2/": false,
+	} {
+		filter, err := NewFilter("", "", shard)
+		if (err == nil) != valid {
+			t.Errorf("-shard %q: got error %v", shard, err)
+			continue
+		}
+		if valid && fmt.Sprintf("%d/%d", filter.Shard, filter.Shards) != shard {
+			t.Errorf("-shard %q: got %d/%d", shard, filter.Shard, filter.Shards)
+		}
+	}
+}
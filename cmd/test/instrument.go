@@ -0,0 +1,256 @@
+package test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// coverageUnit is the generated unit counting the probe hits.
+const coverageUnit = "DelphiCoverage"
+
+// instrumenter inserts line probes into the statement lists of the
+// routine bodies in the implementation section of a unit.
+//
+// Probes are inserted on the same line as the statement they count, so
+// compiler messages keep pointing at the original lines. Statements
+// following then, else and do without begin are counted with the
+// statement containing them.
+type instrumenter struct {
+	src   []byte
+	items []probeItem
+	p     int
+
+	next    int      // id of the next probe
+	lines   []int    // line of each inserted probe
+	inserts []insert // text inserted into src, sorted by offset
+}
+
+// probeItem is a single active token with its location.
+type probeItem struct {
+	tok    token.Token
+	lit    string
+	offset int
+	line   int
+}
+
+type insert struct {
+	offset int
+	text   string
+}
+
+// block is an open construct terminated by end or until.
+type block int
+
+const (
+	stmts     block = iota // begin, repeat, try: a statement list
+	handlers               // except with on handlers
+	caseOf                 // case statement
+	asmBlock               // asm, contents are not parsed
+	declBody               // record, class, object or interface declaration
+	anonDecls              // anonymous method heading and declarations up to begin
+)
+
+// instrument returns src with probes numbered from first and the line of
+// each probe.
+func instrument(filename string, src []byte, defines []string, first int) ([]byte, []int) {
+	ins := &instrumenter{src: src, next: first}
+
+	fset := token.NewFileSet()
+	file := fset.AddFile(filename, fset.Base(), len(src))
+	conds := scanner.NewConditions(defines)
+
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, 0)
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.CDIRECTIVE {
+			conds.Directive(lit)
+			continue
+		}
+		if tok == token.COMMENT || !conds.Active() {
+			continue
+		}
+		position := fset.Position(pos)
+		ins.items = append(ins.items, probeItem{tok, lit, position.Offset, position.Line})
+	}
+
+	ins.unit()
+	return ins.output(), ins.lines
+}
+
+func (ins *instrumenter) peek(n int) token.Token {
+	if ins.p+n >= 0 && ins.p+n < len(ins.items) {
+		return ins.items[ins.p+n].tok
+	}
+	return token.EOF
+}
+
+// unit walks the implementation section up to initialization.
+func (ins *instrumenter) unit() {
+	for ; ins.p < len(ins.items); ins.p++ {
+		if ins.peek(0) == token.IMPLEMENTATION {
+			break
+		}
+	}
+	if ins.p >= len(ins.items) {
+		return
+	}
+
+	// use the coverage unit, on the same line to keep line numbers
+	if ins.peek(1) == token.USES {
+		ins.p++
+		ins.insertAfter(" " + coverageUnit + ",")
+	} else {
+		ins.insertAfter(" uses " + coverageUnit + ";")
+	}
+	ins.p++
+
+	var open []block
+	top := func() block {
+		if len(open) == 0 {
+			return declBody
+		}
+		return open[len(open)-1]
+	}
+	pop := func() {
+		if len(open) > 0 {
+			open = open[:len(open)-1]
+		}
+	}
+
+	for ; ins.p < len(ins.items); ins.p++ {
+		tok := ins.peek(0)
+		if top() == asmBlock {
+			if tok == token.END {
+				pop()
+			}
+			continue
+		}
+
+		switch tok {
+		case token.INITIALIZATION, token.FINALIZATION:
+			if len(open) == 0 {
+				return
+			}
+		case token.PROCEDURE, token.FUNCTION:
+			// anonymous method inside a statement, its heading and
+			// var or const sections contain no statements
+			switch top() {
+			case stmts, handlers, caseOf:
+				open = append(open, anonDecls)
+			}
+		case token.BEGIN, token.REPEAT, token.TRY:
+			if tok == token.BEGIN && top() == anonDecls {
+				// the body ends with the end of the begin
+				pop()
+			}
+			open = append(open, stmts)
+			ins.probe()
+		case token.FINALLY:
+			ins.probe()
+		case token.EXCEPT:
+			if ins.p+1 < len(ins.items) && strings.EqualFold(ins.items[ins.p+1].lit, "on") {
+				if len(open) > 0 {
+					open[len(open)-1] = handlers
+				}
+			} else {
+				ins.probe()
+			}
+		case token.SEMICOLON:
+			if top() == stmts {
+				ins.probe()
+			}
+		case token.CASE:
+			// variant parts of records have no end of their own
+			if top() != declBody {
+				open = append(open, caseOf)
+			}
+		case token.ASM:
+			if top() == anonDecls {
+				pop()
+			}
+			open = append(open, asmBlock)
+		case token.RECORD:
+			open = append(open, declBody)
+		case token.CLASS, token.OBJECT, token.INTERFACE, token.DISPINTERFACE:
+			if ins.declaresBody() {
+				open = append(open, declBody)
+			}
+		case token.END, token.UNTIL:
+			pop()
+		}
+	}
+}
+
+// declaresBody reports whether the class, object or interface keyword starts
+// a declaration terminated by end.
+func (ins *instrumenter) declaresBody() bool {
+	prev := ins.peek(-1)
+	if prev != token.EQL && prev != token.PACKED {
+		return false
+	}
+	n := 1
+	for ins.peek(n).IsDirective() && ins.peek(n) != token.HELPER8 {
+		n++ // sealed, abstract
+	}
+	switch ins.peek(n) {
+	case token.OF, token.SEMICOLON:
+		return false
+	case token.LPAREN:
+		for depth := 0; ins.peek(n) != token.EOF; n++ {
+			if ins.peek(n) == token.LPAREN {
+				depth++
+			} else if ins.peek(n) == token.RPAREN {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		return ins.peek(n+1) != token.SEMICOLON
+	}
+	return true
+}
+
+// probe inserts a probe before the statement following the current token.
+func (ins *instrumenter) probe() {
+	switch ins.peek(1) {
+	case token.END, token.UNTIL, token.FINALLY, token.EXCEPT, token.SEMICOLON, token.EOF:
+		return
+	}
+	item := ins.items[ins.p+1]
+	ins.inserts = append(ins.inserts, insert{
+		offset: item.offset,
+		text:   fmt.Sprintf("%v.Hit(%d);", coverageUnit, ins.next),
+	})
+	ins.lines = append(ins.lines, item.line)
+	ins.next++
+}
+
+// insertAfter inserts text after the current token.
+func (ins *instrumenter) insertAfter(text string) {
+	item := ins.items[ins.p]
+	end := item.offset + len(item.tok.String())
+	if ins.p+1 < len(ins.items) && ins.items[ins.p+1].offset < end {
+		end = ins.items[ins.p+1].offset
+	}
+	ins.inserts = append(ins.inserts, insert{offset: end, text: text})
+}
+
+func (ins *instrumenter) output() []byte {
+	var b strings.Builder
+	last := 0
+	for _, in := range ins.inserts {
+		b.Write(ins.src[last:in.offset])
+		b.WriteString(in.text)
+		last = in.offset
+	}
+	b.Write(ins.src[last:])
+	return []byte(b.String())
+}
@@ -0,0 +1,281 @@
+package test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/discover"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// Leak modes of -leaks.
+const (
+	LeaksOff    = "off"
+	LeaksReport = "report"
+	LeaksFail   = "fail"
+)
+
+// leakDefines enable the FastMM4 leak report with allocation stacks in
+// the log file.
+var leakDefines = []string{
+	"FullDebugMode",
+	"EnableMemoryLeakReporting",
+	"LogMemoryLeakDetailToFile",
+	"NoMessageBoxes",
+}
+
+// Leak is a block of memory that was not freed when the runner exited.
+type Leak struct {
+	Size  int    // size in bytes
+	Count int    // number of blocks
+	Class string // class of a leaked object, when known
+	Stack []Frame
+
+	// test allocating the block, found from the stack, empty otherwise
+	Unit string
+	Test string
+}
+
+// Frame is a single entry of an allocation stack trace.
+type Frame struct {
+	Address string
+	Unit    string // unit name, FastMM only
+	Func    string
+	File    string
+	Line    int
+}
+
+func (frame Frame) String() string {
+	s := frame.Address
+	if frame.Func != "" {
+		s += " " + frame.Func
+	}
+	if frame.File != "" {
+		s += fmt.Sprintf(" %v:%v", frame.File, frame.Line)
+	}
+	return s
+}
+
+func (leak *Leak) String() string {
+	s := fmt.Sprintf("%d bytes", leak.Size)
+	if leak.Class != "" {
+		s += " " + leak.Class
+	}
+	if leak.Count > 1 {
+		s += fmt.Sprintf(" x %d", leak.Count)
+	}
+	return s
+}
+
+// Where returns the test that allocated the block, "run" when unknown.
+func (leak *Leak) Where() string {
+	if leak.Test != "" {
+		return leak.Unit + "." + leak.Test
+	}
+	if leak.Unit != "" {
+		return leak.Unit
+	}
+	return "run"
+}
+
+// ParseLeaks parses a FastMM4 event log or a FPC heaptrc dump.
+//
+// FastMM4 logs a block for each leak when compiled with FullDebugMode and
+// LogMemoryLeakDetailToFile, otherwise only the summary of leaked sizes
+// and classes. Heaptrc lists the unfreed blocks with their call traces.
+func ParseLeaks(r io.Reader) ([]*Leak, error) {
+	var leaks []*Leak
+	var detailed bool // FastMM4 blocks were found, skip the summary
+	var leak *Leak
+	var inStack bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		text := strings.TrimSpace(line)
+
+		// FastMM4
+		if m := rxFastMMBlock.FindStringSubmatch(text); m != nil {
+			size, _ := strconv.Atoi(m[1])
+			leak = &Leak{Size: size, Count: 1}
+			leaks = append(leaks, leak)
+			detailed = true
+			inStack = false
+			continue
+		}
+		if leak != nil && strings.HasPrefix(text, "This block was allocated by") {
+			inStack = true
+			continue
+		}
+		if leak != nil && strings.HasPrefix(text, "The block is currently used for an object of class:") {
+			leak.Class = strings.TrimSpace(text[strings.Index(text, ":")+1:])
+			continue
+		}
+		if m := rxFastMMSummary.FindStringSubmatch(text); m != nil && !detailed {
+			size, _ := strconv.Atoi(m[1])
+			for _, item := range strings.Split(m[2], ",") {
+				class, count := strings.TrimSpace(item), 1
+				if p := strings.LastIndex(class, " x "); p >= 0 {
+					count, _ = strconv.Atoi(class[p+3:])
+					class = class[:p]
+				}
+				leaks = append(leaks, &Leak{Size: size, Count: count, Class: class})
+			}
+			continue
+		}
+
+		// heaptrc
+		if m := rxHeaptrcBlock.FindStringSubmatch(text); m != nil {
+			size, _ := strconv.Atoi(m[1])
+			leak = &Leak{Size: size, Count: 1}
+			leaks = append(leaks, leak)
+			inStack = true
+			continue
+		}
+
+		if text == "" {
+			inStack = false
+			continue
+		}
+		if leak == nil || !inStack {
+			continue
+		}
+		if frame, ok := parseFrame(text); ok {
+			leak.Stack = append(leak.Stack, frame)
+		} else {
+			inStack = false
+		}
+	}
+	return leaks, scanner.Err()
+}
+
+var (
+	// A memory block has been leaked. The size is: 20
+	rxFastMMBlock = regexp.MustCompile(`^A memory block has been leaked\. The size is: (\d+)`)
+	// 13 - 20 bytes: TFoo x 1, UnicodeString x 2
+	rxFastMMSummary = regexp.MustCompile(`^\d+ - (\d+) bytes: (.+)$`)
+	// 402A3B [System.pas][System][@GetMem$qqri][2654]
+	rxFastMMFrame = regexp.MustCompile(`^([0-9A-Fa-f]+)((?:\s*\[[^\]]*\])*)$`)
+
+	// Call trace for block $00007F1C2B7E5100 size 12
+	rxHeaptrcBlock = regexp.MustCompile(`^Call trace for block \$[0-9A-Fa-f]+ size (\d+)`)
+	// $0000000000401234  TFOO__CREATE,  line 10 of foo.pas
+	rxHeaptrcFrame = regexp.MustCompile(`^\$([0-9A-Fa-f]+)\s*(?:([^,\s][^,]*),)?\s*(?:line (\d+) of (.+))?$`)
+)
+
+func parseFrame(text string) (Frame, bool) {
+	if m := rxHeaptrcFrame.FindStringSubmatch(text); m != nil {
+		line, _ := strconv.Atoi(m[3])
+		return Frame{
+			Address: "$" + m[1],
+			Func:    strings.TrimSpace(m[2]),
+			File:    strings.TrimSpace(m[4]),
+			Line:    line,
+		}, true
+	}
+	if m := rxFastMMFrame.FindStringSubmatch(text); m != nil {
+		frame := Frame{Address: m[1]}
+		var parts []string
+		for _, part := range strings.Split(m[2], "]") {
+			part = strings.TrimSpace(part)
+			parts = append(parts, strings.TrimPrefix(part, "["))
+		}
+		if len(parts) >= 4 {
+			frame.File = parts[0]
+			frame.Unit = parts[1]
+			frame.Func = parts[2]
+			frame.Line, _ = strconv.Atoi(parts[3])
+		}
+		return frame, true
+	}
+	return Frame{}, false
+}
+
+// Locate attributes each leak to the first frame of its allocation stack
+// inside a test unit, the test is found when the frame is in one of the
+// unit's tests.
+func Locate(leaks []*Leak, files []*discover.TestFile) {
+	for _, leak := range leaks {
+	stack:
+		for _, frame := range leak.Stack {
+			for _, file := range files {
+				if !strings.EqualFold(frame.Unit, file.UnitName) &&
+					!strings.EqualFold(trimExt(filepath.Base(frame.File)), file.UnitName) {
+					continue
+				}
+				leak.Unit = file.UnitName
+				leak.Test = file.TestOf(frame.Func)
+				break stack
+			}
+		}
+	}
+}
+
+// leakOptions returns the compiler options enabling the leak report.
+func (build *Build) leakOptions(opts *delphi.Options) {
+	if build.Leaks == "" || build.Leaks == LeaksOff {
+		return
+	}
+	if _, ok := build.Compiler.(*delphi.FPC); ok {
+		// heaptrc with line info
+		opts.Args = append(opts.Args, "-gh", "-gl")
+		return
+	}
+	opts.Define = append(append([]string{}, opts.Define...), leakDefines...)
+}
+
+// leakEnv returns the environment entries telling the runner in dir
+// where to write its leak report.
+func (build *Build) leakEnv(dir string) []string {
+	if build.Leaks == "" || build.Leaks == LeaksOff {
+		return nil
+	}
+	filename := filepath.Join(dir, build.Project+".leaks")
+	os.Remove(filename)
+
+	build.mu.Lock()
+	build.leakLogs = append(build.leakLogs, filename)
+	build.mu.Unlock()
+	return []string{
+		"DELPHI_TEST_LEAKS=" + filename,
+		"HEAPTRC=log=" + filename,
+	}
+}
+
+// LeakResults reads the leak reports of the runners into the report
+// and prints them.
+func (build *Build) LeakResults() error {
+	for _, filename := range build.leakLogs {
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		leaks, err := ParseLeaks(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+		build.Report.Leaks = append(build.Report.Leaks, leaks...)
+	}
+	Locate(build.Report.Leaks, build.Tests)
+
+	for _, leak := range build.Report.Leaks {
+		cli.Warnf("%v: leaked %v\n", leak.Where(), leak)
+		if build.Verbose {
+			for _, frame := range leak.Stack {
+				cli.Warnf("    %v\n", frame)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+func TestParseLeaksFastMM(t *testing.T) {
+	log := `--------------------------------2024/1/2 10:11:12--------------------------------
+A memory block has been leaked. The size is: 20
+
+This block was allocated by thread 0x1F30, and the stack trace (return addresses) at the time was:
+402A3B [System.pas][System][@GetMem$qqri][2654]
+40567C [Calc.pas][Calc][TCalc.Create][30]
+40577D [Calc_Test.pas][Calc_Test][Test_Leak][12]
+
+The block is currently used for an object of class: TCalc
+
+The allocation number is: 123
+
+Current memory dump of 256 bytes starting at pointer address 7FF8A4E8:
+00 00 00 00
+`
+	leaks, err := ParseLeaks(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks) != 1 {
+		t.Fatalf("got %v leaks, expected 1", len(leaks))
+	}
+	leak := leaks[0]
+	if leak.Size != 20 || leak.Class != "TCalc" || len(leak.Stack) != 3 {
+		t.Errorf("got %+v", leak)
+	}
+	if frame := leak.Stack[1]; frame.Func != "TCalc.Create" || frame.File != "Calc.pas" || frame.Line != 30 {
+		t.Errorf("got frame %+v", frame)
+	}
+
+	Locate(leaks, []*discover.TestFile{{
+		UnitName: "Calc_Test",
+		Tests:    []*discover.Test{{Kind: discover.Procedure, Name: "Test_Leak"}},
+	}})
+	if leak.Where() != "Calc_Test.Test_Leak" {
+		t.Errorf("got %q, expected Calc_Test.Test_Leak", leak.Where())
+	}
+}
+
+func TestParseLeaksFastMMSummary(t *testing.T) {
+	log := `This application has leaked memory. The small block leaks are (excluding expected leaks registered by pointer):
+
+13 - 20 bytes: TCalc x 1, UnicodeString x 2
+`
+	leaks, err := ParseLeaks(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks) != 2 || leaks[1].Class != "UnicodeString" || leaks[1].Count != 2 || leaks[1].Size != 20 {
+		t.Errorf("got %v", leaks)
+	}
+}
+
+func TestParseLeaksHeaptrc(t *testing.T) {
+	log := `Heap dump by heaptrc unit of /tmp/All_Tests
+123 memory blocks allocated : 4567/8910
+121 memory blocks freed     : 4500/8800
+2 unfreed memory blocks : 67
+True heap size : 360448
+True free heap : 359680
+Should be : 359816
+Call trace for block $00007F1C2B7E5100 size 12
+  $0000000000401234  TCALC__CREATE,  line 10 of calc.pas
+  $0000000000401300  TEST_LEAK,  line 20 of calc_test.pas
+  $0000000000401400  main,  line 30 of All_Tests.dpr
+Call trace for block $00007F1C2B7E5200 size 55
+  $0000000000401500
+`
+	leaks, err := ParseLeaks(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks) != 2 {
+		t.Fatalf("got %v leaks, expected 2", len(leaks))
+	}
+	if leaks[0].Size != 12 || len(leaks[0].Stack) != 3 || leaks[1].Size != 55 || len(leaks[1].Stack) != 1 {
+		t.Errorf("got %v", leaks)
+	}
+	if frame := leaks[0].Stack[1]; frame.Func != "TEST_LEAK" || frame.File != "calc_test.pas" || frame.Line != 20 {
+		t.Errorf("got frame %+v", frame)
+	}
+
+	Locate(leaks, []*discover.TestFile{{
+		UnitName: "Calc_Test",
+		Tests:    []*discover.Test{{Kind: discover.Procedure, Name: "Test_Leak"}},
+	}})
+	if leaks[0].Where() != "Calc_Test.Test_Leak" || leaks[1].Where() != "run" {
+		t.Errorf("got %q and %q", leaks[0].Where(), leaks[1].Where())
+	}
+}
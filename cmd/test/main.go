@@ -2,18 +2,22 @@ package test
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/loov/watchrun/pgroup"
 	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/discover"
 	"github.com/raintreeinc/delphi/internal/cli"
-	"github.com/raintreeinc/delphi/internal/walk"
-	"github.com/raintreeinc/delphi/scanner"
-	"github.com/raintreeinc/delphi/token"
 )
 
 const ShortDesc = "test units"
@@ -27,8 +31,94 @@ func Help(args []string) {
   -define   compilator defines
   -root     search path root, add all folders recursively
 
-  -dunit    generate DUnit tests
-  -ounit    generate dpr for TestOneUnit
+  -compiler          dcc32, dcc64, fpc or path to the compiler, default DELPHI_COMPILER
+  -compiler-version  Delphi version of dcc, e.g. 7 or XE2, default DELPHI_COMPILER_VERSION
+
+  -format   compiler diagnostics format: text, json or sarif
+            json and sarif are written to stdout, other output to stderr
+  -report   write test results to file, JSON for .json otherwise JUnit XML
+  -parallel run tests in N runner processes, each in its own directory
+  -timeout  stop the whole run after the duration, e.g. 30m, 0 disables
+  -test-timeout
+            stop a runner when a single test runs longer than the duration,
+            the test is reported as hung, 0 disables
+
+  -run      run only tests matching the regular expression
+  -skip     skip tests matching the regular expression
+            patterns match "Unit.Test" names, ignoring case
+  -shard    run only the units in shard i of n, e.g. 2/4
+  -changed-since
+            run only test units that use, directly or indirectly,
+            a unit changed since the git ref
+  -list     print the tests that would run and exit
+  -watch    run the tests, then watch the search path and the test
+            directories and rerun the tests affected by changed units
+
+  -leaks    report memory leaks of the runner: off, report or fail,
+            fail fails the run when memory leaked
+
+  -cover    write line coverage of the units used by the tests as Cobertura XML
+  -cover-html
+            write line coverage as an HTML report
+  -cover-units
+            instrument only units matching the regular expression
+
+  -template runner template: delphi, dunit, dunitx, fpcunit or a template file,
+            default DELPHI_TEST_TEMPLATE or delphi
+  -testcase test case base classes in addition to TTestCase, separated by ;
+            published methods of their descendants are DUnit tests
+
+  -dunit    generate a DUnit unit wrapping the Test_ procedures
+  -ounit    generate the runner dpr from the template
+
+Fixtures:
+  Units can declare parameterless Setup and Teardown procedures, run
+  around each Test_ procedure, and SetupUnit and TeardownUnit, run before
+  the first and after the last test of the unit. Their failures are
+  reported as fixture errors, a failing SetupUnit fails the unit's tests.
+
+Coverage:
+  With -cover or -cover-html the units used by the tests, directly or
+  through other units, are copied into the build directory with a probe
+  counting each statement line. The test units are not instrumented.
+  Runners killed by a timeout do not report their hits.
+
+Leaks:
+  With -leaks the runner is built with FastMM4 in FullDebugMode for dcc,
+  FastMM4 and FastMM_FullDebugMode.dll must be in the search path, and
+  with heaptrc for fpc. The leaks are read from the log written on exit
+  and attributed to the test allocating them from the stack trace.
+
+  delphi test exits with status 1 when compiling fails, a test fails or
+  times out, or with -leaks=fail a test leaks memory.
+
+Templates:
+  Runner templates are Go text/template files producing the test program.
+  The program runs the tests named in the file in DELPHI_TEST_RUN and
+  writes "##delphi-test" result lines. Templates get:
+
+    .Project    program name
+    .Units      units with tests, each with
+      .Name       unit name
+      .Path       unit file
+      .Class      class name for wrapping .Funcs
+      .Funcs      Test_ procedures with .Name and .Method (without Test_)
+      .Cases      DUnit and FPCUnit test case classes
+      .Fixtures   DUnitX fixture classes
+      .Tests      all tests with .Kind, .Class, .Name and .Line
+      .Setup, .Teardown, .SetupUnit, .TeardownUnit
+                  fixture procedures, empty when not declared
+    .Define     compiler defines
+    .Search     search path
+    .OutputDir  executable directory
+    .BuildDir   compiled units directory
+    .Leaks      report memory leaks
+
+  and can use the blocks {{template "header" .}}, {{template "selection" .}}
+  (LoadSelection, Selected, Escape), {{template "names" .}} (TestName) and
+  {{template "fixtures" .}} (RunFixture, StartUnit, EndUnit, WrappedUnit),
+  {{template "memory" .}} (FastMM4 as the first used unit) and
+  {{template "leaks" .}} (SetupLeaks).
 `)
 }
 
@@ -42,8 +132,32 @@ type Flags struct {
 	Define   string
 	Paths    []string
 
-	DUnit string
-	OUnit string
+	Compiler        string
+	CompilerVersion string
+	Format          string
+	Report          string
+	Parallel        int
+	Timeout         time.Duration
+	TestTimeout     time.Duration
+
+	Run   string
+	Skip  string
+	Shard string
+	List  bool
+	Watch bool
+
+	ChangedSince string
+
+	Leaks string
+
+	Cover      string
+	CoverHTML  string
+	CoverUnits string
+
+	Template string
+	TestCase string
+	DUnit    string
+	OUnit    string
 
 	Set *flag.FlagSet
 }
@@ -61,8 +175,31 @@ func (flags *Flags) Parse(args []string) {
 	flags.Set.StringVar(&flags.Define, "define", "", "compile defines, default DELPHI_DEFINE")
 	flags.Set.StringVar(&flags.Root, "root", "", "search root, adds all folders recursively")
 
-	flags.Set.StringVar(&flags.DUnit, "dunit", "", "generate DUnit tests")
-	flags.Set.StringVar(&flags.OUnit, "ounit", "", "generate dpr for TestOneUnit")
+	flags.Set.StringVar(&flags.Compiler, "compiler", "", "compiler to use, default DELPHI_COMPILER")
+	flags.Set.StringVar(&flags.CompilerVersion, "compiler-version", "", "Delphi version of dcc, default DELPHI_COMPILER_VERSION")
+	flags.Set.StringVar(&flags.Format, "format", "text", "compiler diagnostics format: text, json or sarif")
+	flags.Set.StringVar(&flags.Report, "report", "", "write test results to file, JSON for .json otherwise JUnit XML")
+	flags.Set.IntVar(&flags.Parallel, "parallel", 1, "number of runner processes")
+	flags.Set.DurationVar(&flags.Timeout, "timeout", 0, "timeout for the whole run")
+	flags.Set.DurationVar(&flags.TestTimeout, "test-timeout", 10*time.Minute, "timeout for a single test")
+
+	flags.Set.StringVar(&flags.Run, "run", "", "run only tests matching the regular expression")
+	flags.Set.StringVar(&flags.Skip, "skip", "", "skip tests matching the regular expression")
+	flags.Set.StringVar(&flags.Shard, "shard", "", "run only the units in shard i of n")
+	flags.Set.BoolVar(&flags.List, "list", false, "print the tests that would run and exit")
+	flags.Set.BoolVar(&flags.Watch, "watch", false, "rerun the tests affected by changed files")
+	flags.Set.StringVar(&flags.ChangedSince, "changed-since", "", "run only tests depending on units changed since the git ref")
+
+	flags.Set.StringVar(&flags.Leaks, "leaks", LeaksOff, "report memory leaks: off, report or fail")
+
+	flags.Set.StringVar(&flags.Cover, "cover", "", "write line coverage as Cobertura XML")
+	flags.Set.StringVar(&flags.CoverHTML, "cover-html", "", "write line coverage as HTML")
+	flags.Set.StringVar(&flags.CoverUnits, "cover-units", "", "instrument only units matching the regular expression")
+
+	flags.Set.StringVar(&flags.Template, "template", TemplateName(), "runner template name or file")
+	flags.Set.StringVar(&flags.TestCase, "testcase", "", "test case base classes in addition to TTestCase")
+	flags.Set.StringVar(&flags.DUnit, "dunit", "", "generate a DUnit unit wrapping the Test_ procedures")
+	flags.Set.StringVar(&flags.OUnit, "ounit", "", "generate the runner dpr from the template")
 
 	flags.Set.Parse(args[1:])
 
@@ -100,6 +237,34 @@ func Main(args []string) {
 		return
 	}
 
+	filter, err := NewFilter(flags.Run, flags.Skip, flags.Shard)
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+	for _, base := range strings.Split(flags.TestCase, ";") {
+		if base != "" {
+			discover.TestCaseBases = append(discover.TestCaseBases, base)
+		}
+	}
+	switch flags.Leaks {
+	case LeaksOff, LeaksReport, LeaksFail:
+	default:
+		cli.Errorf("invalid -leaks %q, expected off, report or fail\n", flags.Leaks)
+		return
+	}
+	var coverUnits *regexp.Regexp
+	if flags.CoverUnits != "" {
+		coverUnits, err = regexp.Compile("(?i)" + flags.CoverUnits)
+		if err != nil {
+			cli.Errorf("invalid -cover-units: %v\n", err)
+			return
+		}
+	}
+	if flags.List {
+		cli.Output = os.Stderr
+	}
+
 	var tempdir string
 	if flags.BuildDir == "" {
 		tempdir, _ = ioutil.TempDir(delphi.TempDir(), "delphitest")
@@ -108,10 +273,45 @@ func Main(args []string) {
 	if flags.Search == "" {
 		flags.Search = delphi.SearchPath()
 	}
+	if flags.Define == "" {
+		flags.Define = delphi.Define()
+	}
+	if flags.CompilerVersion == "" {
+		flags.CompilerVersion = delphi.CompilerVersion()
+	}
+	compiler, err := delphi.NewCompiler(flags.Compiler, flags.CompilerVersion)
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+	if err := delphi.CheckFormat(flags.Format); err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+	runner, err := LoadTemplate(flags.Template)
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+	if flags.Format == "" {
+		flags.Format = "text"
+	}
+	if flags.Format != "text" {
+		cli.Output = os.Stderr
+	}
+
 	build := &Build{}
 	defer cleanup(build, tempdir)
 
 	build.Verbose = flags.Verbose
+	build.Compiler = compiler
+	build.Template = runner
+	build.Format = flags.Format
+	build.ReportFile = flags.Report
+	build.Parallel = flags.Parallel
+	build.Timeout = flags.Timeout
+	build.TestTimeout = flags.TestTimeout
+	build.Leaks = flags.Leaks
 	build.Name = "All"
 	build.Dir = flags.BuildDir
 	build.Project = build.Name + "_Tests"
@@ -134,44 +334,38 @@ func Main(args []string) {
 
 	cli.Priorityf("collecting tests\n")
 
-	filenames := make(chan string, 8)
-	errors := make(chan error, 8)
-	go func() {
-		walk.Globs(flags.Paths, filenames, errors, walk.IsDelphiFile)
-		close(filenames)
-		close(errors)
-	}()
-	go func() {
-		for err := range errors {
-			if err != nil {
-				cli.Errorf("%v\n", err)
-			}
-		}
-	}()
-
-	for filename := range filenames {
-		if !strings.EqualFold(filepath.Ext(filename), ".pas") {
-			continue
-		}
-
-		test, err := NewTestFile(filename)
+	testfiles := CollectTests(flags.Paths, build.Define)
+	if flags.ChangedSince != "" {
+		changes, err := ChangedSince(flags.ChangedSince)
 		if err != nil {
 			cli.Errorf("%v\n", err)
-			continue
+			return
 		}
-		if len(test.Funcs) == 0 {
-			continue
+		if flags.Verbose {
+			cli.Infof("changed since %v: %v\n", flags.ChangedSince, strings.Join(changes.Units, ", "))
 		}
-
-		dir := filepath.Dir(filename)
-		if !contains(dir, build.Search) {
-			build.Search = append(build.Search, dir)
+		testfiles = changes.Affected(testfiles, build.Search, flags.Verbose)
+	}
+	testfiles = filter.Apply(testfiles)
+
+	if flags.List {
+		for _, file := range testfiles {
+			for _, test := range file.Tests {
+				if flags.Verbose {
+					fmt.Printf("%v:%v: %v.%v\n", file.Path, test.Line, file.UnitName, test.FullName())
+				} else {
+					fmt.Printf("%v.%v\n", file.UnitName, test.FullName())
+				}
+			}
 		}
-		build.Tests = append(build.Tests, test)
+		return
 	}
 
+	build.SetTests(testfiles)
+
 	if flags.Verbose {
 		cli.Infof("Building: %v\n", build.Project)
+		cli.Infof("Compiler: %v\n", build.Compiler.Name())
 		cli.Infof("     DPR: %v\n", build.DPR())
 		cli.Infof("     Dir: %v\n", build.Dir)
 
@@ -184,6 +378,13 @@ func Main(args []string) {
 		for _, define := range build.Define {
 			cli.Infof("    %v\n", define)
 		}
+
+		cli.Infof("   Tests:\n")
+		for _, testfile := range build.Tests {
+			for _, test := range testfile.Tests {
+				cli.Infof("    %v(%v) %v [%v]\n", testfile.UnitName, test.Line, test.FullName(), test.Kind)
+			}
+		}
 	}
 
 	if flags.DUnit != "" {
@@ -201,27 +402,48 @@ func Main(args []string) {
 	}
 
 	if flags.OUnit != "" {
-		cli.Infof("Generating dpr for TestOneUnit:\n")
+		cli.Infof("Generating runner dpr for:\n")
 		for _, testfile := range build.Tests {
 			cli.Infof("    %v\n", testfile.UnitName)
 			for _, testname := range testfile.Funcs {
 				cli.Infof("        %v\n", testname)
 			}
 		}
-		if err := GenerateOUnit(build.Tests, flags.OUnit); err != nil {
+		if err := GenerateOUnit(build.Tests, flags.OUnit, build.Template); err != nil {
 			cli.Errorf("%v\n", err)
 		}
 		return
 	}
 
+	build.CoverFile = flags.Cover
+	build.CoverHTML = flags.CoverHTML
+	build.CoverUnits = coverUnits
+	if flags.Watch {
+		build.Watch(testfiles, func() []*discover.TestFile {
+			return filter.Apply(CollectTests(flags.Paths, build.Define))
+		})
+		return
+	}
+
+	if build.Covering() {
+		if err := build.Instrument(); err != nil {
+			cli.Errorf("%v\n", err)
+			cleanup(build, tempdir)
+			os.Exit(1)
+		}
+	}
+
 	if err := build.Create(); err != nil {
 		cli.Errorf("%v\n", err)
-		return
+		cleanup(build, tempdir)
+		os.Exit(1)
 	}
 
 	if err := build.Run(); err != nil {
 		cli.Errorf("%v\n", err)
-		return
+		// the exit code tells CI about failed tests, leaks and timeouts
+		cleanup(build, tempdir)
+		os.Exit(1)
 	}
 }
 
@@ -234,109 +456,270 @@ type Build struct {
 	Define []string
 	Search []string
 
-	Tests []*TestFile
+	Tests    []*discover.TestFile
+	Selected []*discover.TestFile // tests to run, all Tests when nil
+
+	Compiler    delphi.Compiler
+	Template    *template.Template // runner program template
+	Format      string
+	Diagnostics *delphi.Diagnostics
+
+	Report     *Report
+	ReportFile string
+	Parallel   int // number of runner processes
+
+	Timeout     time.Duration // for the whole run, 0 disables
+	TestTimeout time.Duration // for a single test, 0 disables
+
+	Leaks string // leak mode: off, report or fail
+
+	Coverage   *Coverage      // instrumented units, nil without coverage
+	CoverFile  string         // Cobertura XML output
+	CoverHTML  string         // HTML output
+	CoverUnits *regexp.Regexp // units to instrument, all when nil
 
 	Compile *exec.Cmd
 	Execute *exec.Cmd
+
+	mu      sync.Mutex
+	killed  bool
+	running []*exec.Cmd // started compiler and runner processes
+	reports []*Report   // reports of the started runners
+
+	coverHits []string // hit count files written by the runners
+	leakLogs  []string // leak reports written by the runners
+
+	timedOut bool
 }
 
 func (build *Build) DPR() string { return filepath.Join(build.Dir, build.Project+".dpr") }
 func (build *Build) CFG() string { return filepath.Join(build.Dir, build.Project+".cfg") }
 func (build *Build) DOF() string { return filepath.Join(build.Dir, build.Project+".dof") }
 
-func (build *Build) EXE() string { return filepath.Join(build.OutputDir(), build.Project+".exe") }
+func (build *Build) EXE() string { return build.Compiler.Executable(build.Options()) }
+
+// Selection is the file listing the tests the runner executes.
+func (build *Build) Selection() string { return filepath.Join(build.Dir, build.Project+".tests") }
 
 func (build *Build) OutputDir() string { return filepath.Join(build.Dir, build.Project+"_bin") }
 func (build *Build) BuildDir() string  { return filepath.Join(build.Dir, build.Project+"_dcu") }
 
-func (build *Build) Kill() error {
-	var err1, err2 error
-	if build.Compile.Process != nil {
-		err1 = build.Compile.Process.Kill()
+// CoverDir is the directory of the units instrumented for coverage.
+func (build *Build) CoverDir() string { return filepath.Join(build.Dir, build.Project+"_cover") }
+
+// Options returns the compiler options for the test project.
+func (build *Build) Options() *delphi.Options {
+	opts := &delphi.Options{
+		Source:    build.DPR(),
+		OutputDir: build.OutputDir(),
+		UnitDir:   build.BuildDir(),
+		Search:    build.Search,
+		Define:    build.Define,
 	}
-	if build.Execute.Process != nil {
-		err2 = build.Execute.Process.Kill()
+	build.leakOptions(opts)
+	return opts
+}
+
+// env returns the environment of a runner in dir executing the tests
+// listed in selection.
+func (build *Build) env(dir, selection string) []string {
+	env := append(os.Environ(), "DELPHI_TEST_RUN="+selection)
+	env = append(env, build.coverEnv(dir)...)
+	env = append(env, build.leakEnv(dir)...)
+	return env
+}
+
+// Kill stops all started processes and prevents starting new ones.
+func (build *Build) Kill() error {
+	build.mu.Lock()
+	defer build.mu.Unlock()
+
+	build.killed = true
+	var errs []error
+	for _, cmd := range build.running {
+		errs = append(errs, pgroup.Kill(cmd))
 	}
-	return NewErrors("killing build", err1, err2)
+	build.running = nil
+	return NewErrors("killing build", errs...)
 }
 
 func (build *Build) Prepare() error {
-	// prepare folders
+	// prepare folders, instrumented units of an earlier run must not
+	// be found in the search path
 	err := NewErrors("prepare",
 		os.MkdirAll(build.OutputDir(), 0755),
 		os.MkdirAll(build.BuildDir(), 0755),
+		os.RemoveAll(build.CoverDir()),
 	)
 	if err != nil {
 		return err
 	}
 
-	build.Compile = exec.Command(delphi.DCC(), build.DPR())
+	// forget an earlier run in watch mode
+	build.mu.Lock()
+	build.killed = false
+	build.running = nil
+	build.reports = nil
+	build.timedOut = false
+	build.coverHits = nil
+	build.leakLogs = nil
+	build.mu.Unlock()
+	build.Coverage = nil
+
+	build.Compile = build.Compiler.Command(build.Options())
+	build.Diagnostics = &delphi.Diagnostics{Compiler: build.Compiler}
+	if build.Format == "text" {
+		build.Diagnostics.Output = cli.Output
+	}
 	if build.Verbose {
 		build.Execute = exec.Command(build.EXE(), "-v")
 	} else {
 		build.Execute = exec.Command(build.EXE())
 	}
 
-	build.Execute.Stdout = os.Stdout
-	build.Compile.Stdout = os.Stdout
+	build.Report = &Report{Output: cli.Output, FailLeaks: build.Leaks == LeaksFail}
+	build.Execute.Stdout = build.Report
+	build.Compile.Stdout = build.Diagnostics
+	build.Compile.Stderr = build.Diagnostics
 
 	return nil
 }
 
 func (build *Build) Create() error {
+	// the search path has changed since Prepare
+	build.Compile = build.Compiler.Command(build.Options())
+	build.Compile.Stdout = build.Diagnostics
+	build.Compile.Stderr = build.Diagnostics
+
+	build.Execute.Env = build.env(build.Dir, build.Selection())
+	data := build.TemplateData()
 	return NewErrors("create",
-		CreateFile(build.DPR(), DPR_Template, build),
-		CreateFile(build.DOF(), DOF_Template, build),
-		CreateFile(build.CFG(), CFG_Template, build),
+		CreateFile(build.DPR(), build.Template, data),
+		CreateFile(build.DOF(), DOF_Template, data),
+		CreateFile(build.CFG(), CFG_Template, data),
+		writeSelection(build.Selection(), build.selected()),
 	)
 }
 
+// selected returns the tests to run.
+func (build *Build) selected() []*discover.TestFile {
+	if build.Selected != nil {
+		return build.Selected
+	}
+	return build.Tests
+}
+
 func (build *Build) Run() error {
+	if build.Timeout > 0 {
+		timer := time.AfterFunc(build.Timeout, build.timeout)
+		defer timer.Stop()
+	}
+
 	cli.Priorityf("running compiler\n")
-	if err := build.Compile.Run(); err != nil {
+	err := build.run(build.Compile)
+	if rerr := build.ReportDiagnostics(); rerr != nil {
+		return rerr
+	}
+	if err != nil {
 		return err
 	}
 	cli.Priorityf("running tests\n")
-	if err := build.Execute.Run(); err != nil {
-		return err
+	start := time.Now()
+	if build.Parallel > 1 {
+		err = build.RunParallel()
+	} else {
+		err = build.runTests(build.Execute, build.Report)
 	}
-	return nil
+	if rerr := build.LeakResults(); rerr != nil {
+		return rerr
+	}
+	if rerr := build.Results(time.Since(start)); rerr != nil {
+		return rerr
+	}
+	if rerr := build.CoverResults(); rerr != nil {
+		return rerr
+	}
+	if build.timedOut {
+		return fmt.Errorf("run timed out after %v", build.Timeout)
+	}
+	if err == nil && build.Report.FailLeaks && len(build.Report.Leaks) > 0 {
+		return fmt.Errorf("%d memory leaks", len(build.Report.Leaks))
+	}
+	return err
 }
 
-type TestFile struct {
-	Path     string
-	Full     string
-	UnitName string
-	Funcs    []string
+// run starts cmd and waits for it to finish.
+func (build *Build) run(cmd *exec.Cmd) error {
+	if err := build.start(cmd); err != nil {
+		return err
+	}
+	return cmd.Wait()
 }
 
-func NewTestFile(path string) (*TestFile, error) {
-	ext := filepath.Ext(path)
-	file := &TestFile{
-		Path:     path,
-		UnitName: filepath.Base(path[:len(path)-len(ext)]),
-		Funcs:    []string{},
+// Results prints a summary of the test results and writes the report.
+func (build *Build) Results(duration time.Duration) error {
+	report := build.Report
+	if err := report.Flush(); err != nil {
+		return err
 	}
+	report.Duration = duration
+	report.Locate(build.Tests)
 
-	file.Path = delphi.AbsPath(path)
+	for _, result := range report.Results {
+		if result.Status == Error || result.Status == Fixture {
+			cli.Warnf("%v.%v: %v\n", result.Unit, result.Name, result.Message)
+		}
+	}
+	if report.Failed() {
+		cli.Warnf("%v\n", report)
+	} else {
+		cli.Infof("%v\n", report)
+	}
 
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+	if build.ReportFile != "" {
+		return report.WriteFile(build.ReportFile)
 	}
+	return nil
+}
 
-	var pre token.Token
-	scanner.Scan(data, 0, func(tok token.Token, lit string) error {
-		if pre == token.PROCEDURE && tok == token.IDENT {
-			if strings.HasPrefix(strings.ToLower(lit), "test_") {
-				if !contains(lit, file.Funcs) {
-					file.Funcs = append(file.Funcs, lit)
-				}
-			}
+// ReportDiagnostics prints the compiler diagnostics in the build format followed
+// by a summary.
+func (build *Build) ReportDiagnostics() error {
+	build.Diagnostics.Flush()
+	if build.Format != "text" {
+		err := delphi.WriteDiagnostics(os.Stdout, build.Format, build.Compiler.Name(), build.Diagnostics.List)
+		if err != nil {
+			return err
 		}
-		pre = tok
-		return nil
-	}, nil)
+	}
+
+	summary := build.Diagnostics.Summary()
+	if summary.Errors > 0 {
+		cli.Warnf("compiled with %v\n", summary)
+	} else {
+		cli.Infof("compiled with %v\n", summary)
+	}
+	return nil
+}
 
-	return file, nil
+// CollectTests finds the test units in paths, globs of files and
+// directories, reporting the units that cannot be read.
+func CollectTests(paths []string, defines []string) []*discover.TestFile {
+	files, errs := discover.Collect(paths, defines)
+	for _, err := range errs {
+		cli.Errorf("%v\n", err)
+	}
+	return files
+}
+
+// SetTests sets the tests of the build, their directories are added to
+// the search path.
+func (build *Build) SetTests(files []*discover.TestFile) {
+	for _, file := range files {
+		dir := filepath.Dir(file.Path)
+		if !contains(dir, build.Search) {
+			build.Search = append(build.Search, dir)
+		}
+	}
+	build.Tests = files
 }
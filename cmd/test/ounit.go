@@ -2,96 +2,24 @@ package test
 
 import (
 	"bytes"
-	"html/template"
 	"io/ioutil"
 	"path/filepath"
-)
-
-var (
-	OUnit_Template = template.Must(template.New("").Parse(`// DO NOT MODIFY MANUALLY, AUTO-GENERATED
-// delphi test -ounit {{.Project}} .
-
-program {{.Project}};
-
-{$APPTYPE CONSOLE}
-{$WARN DUPLICATE_CTOR_DTOR OFF}
-uses
-  FastMM4,
-  rtTest,
-  Forms,
-  
-  {{range $test := .Tests -}}
-  {{$test.UnitName}},
-  {{end}}
-
-  rtFlag;
-
-var
-  lVerbose: Boolean;
-begin
-  Application.Initialize;
-
-  lVerbose := Flag.Bool('v', False, 'verbose output');
-  Flag.Check;
-
-  {{range $test := .Tests -}}
-  RunTests('{{$test.UnitName}}', [
-    {{range $index, $func := $test.Funcs}}{{if $index}},{{end}}
-    TestCase('{{$func.Method}}', {{$test.UnitName}}.{{$func.Call}})
-    {{- end}}
-  ], lVerbose);
-  {{end}}
+	"text/template"
 
-{$WARN SYMBOL_PLATFORM OFF}
-  if not (DebugHook = 0) then
-{$WARN SYMBOL_PLATFORM ON}
-  begin
-    WriteLn;
-    Write('Press ENTER to quit');
-    ReadLn;
-  end;
-
-end.
-`))
+	"github.com/raintreeinc/delphi/discover"
 )
 
-func GenerateOUnit(tests []*TestFile, outfile string) error {
-	type Func struct {
-		Method string
-		Call   string
-	}
-
-	type Test struct {
-		UnitName  string
-		ClassName string
-		Funcs     []Func
-	}
-
-	type Tests struct {
-		Project string
-		Tests    []Test
-	}
-
-	dtests := Tests{}
+// GenerateOUnit writes the runner program for tests using the runner
+// template T, the program is named after outfile.
+func GenerateOUnit(tests []*discover.TestFile, outfile string, T *template.Template) error {
 	ext := filepath.Ext(outfile)
-	dtests.Project = filepath.Base(outfile[:len(outfile)-len(ext)])
-	for _, test := range tests {
-		dtest := Test{}
-		dtest.UnitName = test.UnitName
-		for _, fn := range test.Funcs {
-			dtest.Funcs = append(dtest.Funcs, Func{
-				Method: trimPrefix(fn, "Test_"),
-				Call:   fn,
-			})
-		}
-		dtests.Tests = append(dtests.Tests, dtest)
-	}
+	data := NewTemplateData(filepath.Base(outfile[:len(outfile)-len(ext)]), tests)
 
 	var buf bytes.Buffer
-	err := OUnit_Template.Execute(&buf, dtests)
+	err := T.Execute(&buf, data)
 	if err != nil {
 		return err
 	}
 
 	return ioutil.WriteFile(outfile, windowsLineEndings(buf.Bytes()), 0755)
-}
\ No newline at end of file
+}
@@ -0,0 +1,156 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/loov/watchrun/pgroup"
+	"github.com/raintreeinc/delphi/discover"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// distribute splits the units into at most n groups with a similar
+// number of tests. The split only depends on the units.
+func distribute(files []*discover.TestFile, n int) [][]*discover.TestFile {
+	sorted := append([]*discover.TestFile{}, files...)
+	sort.SliceStable(sorted, func(i, k int) bool {
+		a, b := sorted[i], sorted[k]
+		if len(a.Tests) != len(b.Tests) {
+			return len(a.Tests) > len(b.Tests)
+		}
+		return strings.ToLower(a.UnitName) < strings.ToLower(b.UnitName)
+	})
+
+	groups := make([][]*discover.TestFile, n)
+	counts := make([]int, n)
+	for _, file := range sorted {
+		min := 0
+		for i := range counts {
+			if counts[i] < counts[min] {
+				min = i
+			}
+		}
+		groups[min] = append(groups[min], file)
+		counts[min] += len(file.Tests)
+	}
+
+	result := groups[:0]
+	for _, group := range groups {
+		if len(group) > 0 {
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// worker is a runner process executing a part of the tests in its own
+// working directory.
+type worker struct {
+	Dir    string
+	Tests  []*discover.TestFile
+	Cmd    *exec.Cmd
+	Report *Report
+}
+
+// RunParallel runs the tests in build.Parallel runner processes and
+// merges their results into build.Report.
+func (build *Build) RunParallel() error {
+	groups := distribute(build.selected(), build.Parallel)
+
+	output := &lineWriter{w: cli.Output}
+	workers := make([]*worker, len(groups))
+	for i, group := range groups {
+		w := &worker{
+			Dir:   filepath.Join(build.Dir, fmt.Sprintf("worker%d", i+1)),
+			Tests: group,
+		}
+		selection := filepath.Join(w.Dir, build.Project+".tests")
+		err := NewErrors("prepare worker",
+			os.MkdirAll(w.Dir, 0755),
+			writeSelection(selection, group),
+		)
+		if err != nil {
+			return err
+		}
+
+		w.Report = &Report{Output: output.prefixed(fmt.Sprintf("[%d] ", i+1))}
+		w.Cmd = exec.Command(build.Execute.Path, build.Execute.Args[1:]...)
+		w.Cmd.Dir = w.Dir
+		w.Cmd.Env = build.env(w.Dir, selection)
+		w.Cmd.Stdout = w.Report
+		workers[i] = w
+
+		if build.Verbose {
+			var units []string
+			for _, file := range group {
+				units = append(units, file.UnitName)
+			}
+			cli.Infof("worker %d: %v\n", i+1, strings.Join(units, ", "))
+		}
+	}
+
+	errs := make([]error, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w *worker) {
+			defer wg.Done()
+			if err := build.runTests(w.Cmd, w.Report); err != nil {
+				errs[i] = fmt.Errorf("worker %d: %v", i+1, err)
+			}
+		}(i, w)
+	}
+	wg.Wait()
+
+	for _, w := range workers {
+		if err := w.Report.Flush(); err != nil {
+			return err
+		}
+		build.Report.Results = append(build.Report.Results, w.Report.Results...)
+	}
+	return NewErrors("running tests", errs...)
+}
+
+// start starts cmd unless the build has been killed, Kill stops all
+// started commands.
+func (build *Build) start(cmd *exec.Cmd) error {
+	build.mu.Lock()
+	defer build.mu.Unlock()
+	if build.killed {
+		return fmt.Errorf("killed")
+	}
+	pgroup.Setup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	build.running = append(build.running, cmd)
+	return nil
+}
+
+// lineWriter serializes output of several workers, each Write must
+// contain complete lines.
+type lineWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lineWriter) prefixed(prefix string) io.Writer {
+	return writerFunc(func(data []byte) (int, error) {
+		lw.mu.Lock()
+		defer lw.mu.Unlock()
+		if _, err := io.WriteString(lw.w, prefix); err != nil {
+			return 0, err
+		}
+		return lw.w.Write(data)
+	})
+}
+
+type writerFunc func(data []byte) (int, error)
+
+func (fn writerFunc) Write(data []byte) (int, error) { return fn(data) }
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+func TestDistribute(t *testing.T) {
+	// units with 1 to 8 tests
+	var files []*discover.TestFile
+	for i := 1; i <= 8; i++ {
+		file := &discover.TestFile{UnitName: fmt.Sprintf("Unit%d_Test", i)}
+		for k := 0; k < i; k++ {
+			file.Tests = append(file.Tests, &discover.Test{Name: fmt.Sprintf("Test_%d", k)})
+		}
+		files = append(files, file)
+	}
+	reversed := make([]*discover.TestFile, len(files))
+	for i, file := range files {
+		reversed[len(files)-1-i] = file
+	}
+
+	names := func(groups [][]*discover.TestFile) [][]string {
+		var result [][]string
+		for _, group := range groups {
+			var units []string
+			for _, file := range group {
+				units = append(units, file.UnitName)
+			}
+			result = append(result, units)
+		}
+		return result
+	}
+
+	for n := 1; n <= 10; n++ {
+		groups := distribute(files, n)
+		if !reflect.DeepEqual(names(groups), names(distribute(reversed, n))) {
+			t.Errorf("%d workers: split depends on the order of the units", n)
+		}
+
+		expgroups := n
+		if expgroups > len(files) {
+			expgroups = len(files)
+		}
+		if len(groups) != expgroups {
+			t.Errorf("%d workers: got %d groups, expected %d", n, len(groups), expgroups)
+		}
+
+		seen := map[string]int{}
+		min, max := -1, 0
+		for _, group := range groups {
+			tests := 0
+			for _, file := range group {
+				seen[file.UnitName]++
+				tests += len(file.Tests)
+			}
+			if min < 0 || tests < min {
+				min = tests
+			}
+			if tests > max {
+				max = tests
+			}
+		}
+		if len(seen) != len(files) {
+			t.Errorf("%d workers: got %d of %d units", n, len(seen), len(files))
+		}
+		for name, count := range seen {
+			if count != 1 {
+				t.Errorf("%d workers: %s in %d groups", n, name, count)
+			}
+		}
+		// a group exceeds another by at most the largest unit
+		if n <= len(files) && max-min > 8 {
+			t.Errorf("%d workers: unbalanced %v", n, names(groups))
+		}
+	}
+
+	// 36 tests in two groups of 18
+	groups := distribute(files, 2)
+	for _, group := range groups {
+		tests := 0
+		for _, file := range group {
+			tests += len(file.Tests)
+		}
+		if tests != 18 {
+			t.Errorf("2 workers: got %v", names(groups))
+		}
+	}
+}
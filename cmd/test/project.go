@@ -2,9 +2,9 @@ package test
 
 import (
 	"bytes"
-	"html/template"
 	"io/ioutil"
 	"runtime"
+	"text/template"
 )
 
 func CreateFile(filename string, T *template.Template, data interface{}) error {
@@ -25,41 +25,631 @@ func CreateFile(filename string, T *template.Template, data interface{}) error {
 	return nil
 }
 
-var (
-	DPR_Template = template.Must(template.New("").Parse(`// AUTOMATICALLY GENERATED BY "delphi test"
+// Delphi_Template runs the standalone Test_ procedures without a test
+// framework, it compiles with Delphi and Free Pascal.
+const Delphi_Template = `{{template "header" .}}
 program {{.Project}};
 
+{$IFDEF FPC}{$MODE DELPHI}{$ENDIF}
 {$APPTYPE CONSOLE}
-uses
-  FastMM4,
-  FastCode,
-  rtTest,
-  Forms,
-  
-  {{range $index, $test := .Tests}}
-  {{$test.UnitName}},
-  {{end}}
-
-  rtFlag;
+uses{{template "memory" .}}
+  SysUtils,
+  DateUtils,
+  Classes
+  {{- range .Units}},
+  {{.Name}}
+  {{- end}};
+{{template "selection" .}}
+{{template "leaks" .}}
+{{template "fixtures" .}}
 
 var
   lVerbose: Boolean;
+  lFailed: Integer;
+
+// RunTest runs a single test between Setup and Teardown and writes
+// "##delphi-test" result lines that "delphi test" collects into the
+// report. A failing test takes precedence over a failing Teardown.
+procedure RunTest(const UnitName, TestName: string; Test, Setup, Teardown: TProcedure);
+var
+  lStart: TDateTime;
+  lStatus, lMessage: string;
 begin
-  Application.Initialize;
+  if not Selected(UnitName + '.' + TestName) then
+    Exit;
+
+  WriteLn('##delphi-test start ', UnitName, ' ', TestName);
+  if lVerbose then
+    WriteLn('RUN  ', UnitName, '.', TestName);
+  lStart := Now;
+  lStatus := 'pass';
+  lMessage := '';
+  try
+    RunFixture('Setup', Setup);
+    try
+      Test;
+    except
+      on E: Exception do
+      begin
+        lStatus := 'fail';
+        lMessage := E.ClassName + ': ' + E.Message;
+      end;
+    end;
+    RunFixture('Teardown', Teardown);
+  except
+    on E: EFixtureError do
+      if lStatus = 'pass' then
+      begin
+        lStatus := 'fixture';
+        lMessage := E.Message;
+      end;
+  end;
 
-  lVerbose := Flag.Bool('v', False, 'verbose output');
-  Flag.Check;
+  if lStatus <> 'pass' then
+    Inc(lFailed);
+  if lStatus = 'fail' then
+    WriteLn('FAIL ', UnitName, '.', TestName, ': ', lMessage);
+  Write('##delphi-test ', lStatus, ' ', UnitName, ' ', TestName, ' ', MilliSecondsBetween(Now, lStart));
+  if lMessage <> '' then
+    Write(' ', Escape(lMessage));
+  WriteLn;
+  Flush(Output);
+end;
 
-  {{range $test_index, $test := .Tests}}
-  RunTests('{{$test.UnitName}}', [
-    {{range $index, $func := $test.Funcs}}{{if $index}},{{end}}
-    TestCase('{{$func}}', {{$test.UnitName}}.{{$func}})
-    {{- end}}
-  ], lVerbose);
-  {{end}}
+begin
+  lVerbose := FindCmdLineSwitch('v', ['-', '/'], True);
+  SetupLeaks;
+  LoadSelection;
+  {{range $unit := .Units}}{{if .Funcs}}
+  StartUnit('{{.Name}}');
+  {{- range .Funcs}}
+  RunTest('{{$unit.Name}}', '{{.Name}}', {{$unit.Name}}.{{.Name}},
+    {{if $unit.Setup}}{{$unit.Name}}.{{$unit.Setup}}{{else}}nil{{end}}, {{if $unit.Teardown}}{{$unit.Name}}.{{$unit.Teardown}}{{else}}nil{{end}});
+  {{- end}}
+  EndUnit('{{.Name}}');
+  {{end}}{{end}}
+  if (lFailed > 0) or lFixtureFailed then
+    ExitCode := 1;
 end.
-`))
+`
+
+// DUnitRunner_Template runs the registered DUnit tests, Test_ procedures
+// are wrapped in test case classes.
+const DUnitRunner_Template = `{{template "header" .}}
+program {{.Project}};
+
+{$APPTYPE CONSOLE}
+uses{{template "memory" .}}
+  SysUtils,
+  DateUtils,
+  Classes,
+  TestFramework
+  {{- range .Units}},
+  {{.Name}}
+  {{- end}};
+{{template "selection" .}}
+{{template "leaks" .}}
+{{template "names" .}}
+{{template "fixtures" .}}
+
+type
+{{- range .Units}}{{if .Funcs}}
+  {{.Class}} = class(TTestCase)
+  public
+    procedure SetUp; override;
+    procedure TearDown; override;
+  published
+  {{- range .Funcs}}
+    procedure {{.Name}};
+  {{- end}}
+  end;
+{{end}}{{end}}
+  // TProtocolListener writes "##delphi-test" result lines and skips the
+  // tests that are not selected.
+  TProtocolListener = class(TInterfacedObject, ITestListener)
+  private
+    FSuites: TStringList;
+    FStart: TDateTime;
+    procedure Lookup(test: ITest; out UnitName, Name: string);
+    procedure Finish(test: ITest; const Status, Message: string);
+    procedure Failed(failure: TTestFailure);
+  public
+    constructor Create;
+    destructor Destroy; override;
+
+    procedure Status(test: ITest; const Msg: string);
+    procedure TestingStarts;
+    procedure StartTest(test: ITest);
+    procedure AddSuccess(test: ITest);
+    procedure AddError(error: TTestFailure);
+    procedure AddFailure(failure: TTestFailure);
+    procedure EndTest(test: ITest);
+    procedure TestingEnds(testResult: TTestResult);
+    function ShouldRunTest(test: ITest): Boolean;
+  end;
+{{range $unit := .Units}}{{if .Funcs}}
+procedure {{.Class}}.SetUp;
+begin
+  RunFixture('Setup', {{if .Setup}}{{.Name}}.{{.Setup}}{{else}}nil{{end}});
+end;
+
+procedure {{.Class}}.TearDown;
+begin
+  RunFixture('Teardown', {{if .Teardown}}{{.Name}}.{{.Teardown}}{{else}}nil{{end}});
+end;
+{{end}}{{range .Funcs}}
+procedure {{$unit.Class}}.{{.Name}};
+begin
+  {{$unit.Name}}.{{.Name}};
+end;
+{{end}}{{end}}
+constructor TProtocolListener.Create;
+begin
+  inherited Create;
+  FSuites := TStringList.Create;
+end;
+
+destructor TProtocolListener.Destroy;
+begin
+  FSuites.Free;
+  inherited Destroy;
+end;
+
+// Lookup returns the result name of a test method, the class is the name
+// of the enclosing suite.
+procedure TProtocolListener.Lookup(test: ITest; out UnitName, Name: string);
+var
+  lClass: string;
+begin
+  lClass := '';
+  if FSuites.Count > 0 then
+    lClass := FSuites[FSuites.Count - 1];
+  TestName(lClass, test.Name, UnitName, Name);
+end;
+
+procedure TProtocolListener.Finish(test: ITest; const Status, Message: string);
+var
+  lUnit, lName: string;
+begin
+  Lookup(test, lUnit, lName);
+  Write('##delphi-test ', Status, ' ', lUnit, ' ', lName, ' ', MilliSecondsBetween(Now, FStart));
+  if Message <> '' then
+    Write(' ', Escape(Message));
+  WriteLn;
+  Flush(Output);
+end;
+
+// Failed writes the result of a failed test, failures raised by setup or
+// teardown are reported as fixture failures.
+procedure TProtocolListener.Failed(failure: TTestFailure);
+begin
+  if failure.ThrownExceptionName = EFixtureError.ClassName then
+    Finish(failure.FailedTest, 'fixture', failure.ThrownExceptionMessage)
+  else
+    Finish(failure.FailedTest, 'fail', failure.ThrownExceptionName + ': ' + failure.ThrownExceptionMessage);
+end;
+
+procedure TProtocolListener.Status(test: ITest; const Msg: string);
+begin
+  WriteLn(Msg);
+end;
+
+procedure TProtocolListener.TestingStarts;
+begin
+end;
+
+procedure TProtocolListener.StartTest(test: ITest);
+var
+  lUnit, lName: string;
+begin
+  if test.Tests.Count > 0 then
+  begin
+    FSuites.Add(test.Name);
+    if WrappedUnit(test.Name) <> '' then
+      StartUnit(WrappedUnit(test.Name));
+    Exit;
+  end;
+  Lookup(test, lUnit, lName);
+  WriteLn('##delphi-test start ', lUnit, ' ', lName);
+  Flush(Output);
+  FStart := Now;
+end;
+
+procedure TProtocolListener.AddSuccess(test: ITest);
+begin
+  if test.Tests.Count = 0 then
+    Finish(test, 'pass', '');
+end;
+
+procedure TProtocolListener.AddError(error: TTestFailure);
+begin
+  Failed(error);
+end;
+
+procedure TProtocolListener.AddFailure(failure: TTestFailure);
+begin
+  Failed(failure);
+end;
+
+procedure TProtocolListener.EndTest(test: ITest);
+begin
+  if (test.Tests.Count = 0) or (FSuites.Count = 0) then
+    Exit;
+  if WrappedUnit(test.Name) <> '' then
+    EndUnit(WrappedUnit(test.Name));
+  FSuites.Delete(FSuites.Count - 1);
+end;
+
+procedure TProtocolListener.TestingEnds(testResult: TTestResult);
+begin
+end;
+
+function TProtocolListener.ShouldRunTest(test: ITest): Boolean;
+var
+  lUnit, lName: string;
+begin
+  Result := True;
+  if test.Tests.Count = 0 then
+  begin
+    Lookup(test, lUnit, lName);
+    Result := Selected(lUnit + '.' + lName);
+  end;
+end;
+
+var
+  lResult: TTestResult;
+begin
+  SetupLeaks;
+  LoadSelection;
+  {{- range .Units}}{{if .Funcs}}
+  RegisterTest({{.Class}}.Suite);
+  {{- end}}{{end}}
+
+  lResult := TTestResult.Create;
+  try
+    lResult.AddListener(TProtocolListener.Create);
+    RegisteredTests.Run(lResult);
+    if not lResult.WasSuccessful or lFixtureFailed then
+      ExitCode := 1;
+  finally
+    lResult.Free;
+  end;
+end.
+`
+
+// DUnitXRunner_Template runs the registered DUnitX fixtures, Test_
+// procedures are wrapped in fixture classes.
+const DUnitXRunner_Template = `{{template "header" .}}
+program {{.Project}};
+
+{$APPTYPE CONSOLE}
+{$STRONGLINKTYPES ON}
+uses{{template "memory" .}}
+  SysUtils,
+  DateUtils,
+  Classes,
+  DUnitX.TestFramework,
+  DUnitX.Loggers.Null
+  {{- range .Units}},
+  {{.Name}}
+  {{- end}};
+{{template "selection" .}}
+{{template "leaks" .}}
+{{template "names" .}}
+{{template "fixtures" .}}
+
+type
+{{- range .Units}}{{if .Funcs}}
+  [TestFixture]
+  {{.Class}} = class
+  public
+    [SetupFixture]
+    procedure SetupFixture;
+    [TearDownFixture]
+    procedure TeardownFixture;
+    [Setup]
+    procedure SetupTest;
+    [TearDown]
+    procedure TeardownTest;
+  {{- range .Funcs}}
+    [Test]
+    procedure {{.Name}};
+  {{- end}}
+  end;
+{{end}}{{end}}
+  // TProtocolLogger writes "##delphi-test" result lines.
+  TProtocolLogger = class(TDUnitXNullLogger)
+  private
+    procedure Finish(const Test: ITestInfo; const Status: string; Duration: Int64; const Message: string);
+    procedure Failed(const Error: ITestError);
+  protected
+    procedure OnBeginTest(const threadId: TThreadID; const Test: ITestInfo); override;
+    procedure OnTestSuccess(const threadId: TThreadID; const Test: ITestResult); override;
+    procedure OnTestFailure(const threadId: TThreadID; const Failure: ITestError); override;
+    procedure OnTestError(const threadId: TThreadID; const Error: ITestError); override;
+    procedure OnTestIgnored(const threadId: TThreadID; const AIgnored: ITestResult); override;
+  end;
+{{range $unit := .Units}}{{if .Funcs}}
+procedure {{.Class}}.SetupFixture;
+begin
+  StartUnit('{{.Name}}');
+end;
+
+procedure {{.Class}}.TeardownFixture;
+begin
+  EndUnit('{{.Name}}');
+end;
+
+procedure {{.Class}}.SetupTest;
+begin
+  RunFixture('Setup', {{if .Setup}}{{.Name}}.{{.Setup}}{{else}}nil{{end}});
+end;
 
+procedure {{.Class}}.TeardownTest;
+begin
+  RunFixture('Teardown', {{if .Teardown}}{{.Name}}.{{.Teardown}}{{else}}nil{{end}});
+end;
+{{end}}{{range .Funcs}}
+procedure {{$unit.Class}}.{{.Name}};
+begin
+  {{$unit.Name}}.{{.Name}};
+end;
+{{end}}{{end}}
+// RunName returns the DUnitX name of a selected test.
+function RunName(const Name: string): string;
+begin
+  Result := Name;
+  {{- range $unit := .Units}}{{range .Funcs}}
+  if SameText(Name, '{{$unit.Name}}.{{.Name}}') then
+    Result := '{{$.Project}}.{{$unit.Class}}.{{.Name}}';
+  {{- end}}{{end}}
+end;
+
+procedure TProtocolLogger.Finish(const Test: ITestInfo; const Status: string; Duration: Int64; const Message: string);
+var
+  lUnit, lName: string;
+begin
+  TestName(Test.Fixture.Name, Test.MethodName, lUnit, lName);
+  Write('##delphi-test ', Status, ' ', lUnit, ' ', lName, ' ', Duration);
+  if Message <> '' then
+    Write(' ', Escape(Message));
+  WriteLn;
+  Flush(Output);
+end;
+
+procedure TProtocolLogger.OnBeginTest(const threadId: TThreadID; const Test: ITestInfo);
+var
+  lUnit, lName: string;
+begin
+  TestName(Test.Fixture.Name, Test.MethodName, lUnit, lName);
+  WriteLn('##delphi-test start ', lUnit, ' ', lName);
+  Flush(Output);
+end;
+
+procedure TProtocolLogger.OnTestSuccess(const threadId: TThreadID; const Test: ITestResult);
+begin
+  Finish(Test.Test, 'pass', Round(Test.Duration.TotalMilliseconds), '');
+end;
+
+// Failed writes the result of a failed test, failures raised by setup or
+// teardown are reported as fixture failures.
+procedure TProtocolLogger.Failed(const Error: ITestError);
+begin
+  if Error.ExceptionClass = EFixtureError then
+    Finish(Error.Test, 'fixture', Round(Error.Duration.TotalMilliseconds), Error.ExceptionMessage)
+  else
+    Finish(Error.Test, 'fail', Round(Error.Duration.TotalMilliseconds),
+      Error.ExceptionClass.ClassName + ': ' + Error.ExceptionMessage);
+end;
+
+procedure TProtocolLogger.OnTestFailure(const threadId: TThreadID; const Failure: ITestError);
+begin
+  Failed(Failure);
+end;
+
+procedure TProtocolLogger.OnTestError(const threadId: TThreadID; const Error: ITestError);
+begin
+  Failed(Error);
+end;
+
+procedure TProtocolLogger.OnTestIgnored(const threadId: TThreadID; const AIgnored: ITestResult);
+begin
+  Finish(AIgnored.Test, 'skip', 0, AIgnored.Message);
+end;
+
+var
+  lRunner: ITestRunner;
+  lResults: IRunResults;
+  I: Integer;
+begin
+  SetupLeaks;
+  LoadSelection;
+  {{- range .Units}}{{if .Funcs}}
+  TDUnitX.RegisterTestFixture({{.Class}});
+  {{- end}}{{end}}
+
+  if lSelected <> nil then
+    for I := 0 to lSelected.Count - 1 do
+      TDUnitX.Options.Run.Add(RunName(lSelected[I]));
+
+  lRunner := TDUnitX.CreateRunner;
+  lRunner.UseRTTI := True;
+  lRunner.FailsOnNoAsserts := False;
+  lRunner.AddLogger(TProtocolLogger.Create);
+  lResults := lRunner.Execute;
+  if not lResults.AllPassed or lFixtureFailed then
+    ExitCode := 1;
+end.
+`
+
+// FPCUnitRunner_Template runs the registered FPCUnit tests, Test_
+// procedures are wrapped in test case classes.
+const FPCUnitRunner_Template = `{{template "header" .}}
+program {{.Project}};
+
+{$MODE DELPHI}
+{$APPTYPE CONSOLE}
+uses{{template "memory" .}}
+  SysUtils,
+  DateUtils,
+  Classes,
+  fpcunit,
+  testregistry
+  {{- range .Units}},
+  {{.Name}}
+  {{- end}};
+{{template "selection" .}}
+{{template "leaks" .}}
+{{template "names" .}}
+{{template "fixtures" .}}
+
+type
+{{- range .Units}}{{if .Funcs}}
+  {{.Class}} = class(TTestCase)
+  public
+    procedure SetUp; override;
+    procedure TearDown; override;
+  published
+  {{- range .Funcs}}
+    procedure {{.Name}};
+  {{- end}}
+  end;
+{{end}}{{end}}
+  // TProtocolListener writes "##delphi-test" result lines.
+  TProtocolListener = class(TInterfacedObject, ITestListener)
+  private
+    FStart: TDateTime;
+    FFailed: Boolean;
+    procedure Finish(ATest: TTest; const Status, Message: string);
+    procedure Failed(ATest: TTest; AFailure: TTestFailure);
+  public
+    procedure AddFailure(ATest: TTest; AFailure: TTestFailure);
+    procedure AddError(ATest: TTest; AError: TTestFailure);
+    procedure StartTest(ATest: TTest);
+    procedure EndTest(ATest: TTest);
+    procedure StartTestSuite(ATestSuite: TTestSuite);
+    procedure EndTestSuite(ATestSuite: TTestSuite);
+  end;
+{{range $unit := .Units}}{{if .Funcs}}
+procedure {{.Class}}.SetUp;
+begin
+  RunFixture('Setup', {{if .Setup}}{{.Name}}.{{.Setup}}{{else}}nil{{end}});
+end;
+
+procedure {{.Class}}.TearDown;
+begin
+  RunFixture('Teardown', {{if .Teardown}}{{.Name}}.{{.Teardown}}{{else}}nil{{end}});
+end;
+{{end}}{{range .Funcs}}
+procedure {{$unit.Class}}.{{.Name}};
+begin
+  {{$unit.Name}}.{{.Name}};
+end;
+{{end}}{{end}}
+procedure TProtocolListener.Finish(ATest: TTest; const Status, Message: string);
+var
+  lUnit, lName: string;
+begin
+  TestName(ATest.ClassName, ATest.TestName, lUnit, lName);
+  Write('##delphi-test ', Status, ' ', lUnit, ' ', lName, ' ', MilliSecondsBetween(Now, FStart));
+  if Message <> '' then
+    Write(' ', Escape(Message));
+  WriteLn;
+  Flush(Output);
+end;
+
+procedure TProtocolListener.AddFailure(ATest: TTest; AFailure: TTestFailure);
+begin
+  Failed(ATest, AFailure);
+end;
+
+procedure TProtocolListener.AddError(ATest: TTest; AError: TTestFailure);
+begin
+  Failed(ATest, AError);
+end;
+
+// Failed writes the result of a failed test, failures raised by setup or
+// teardown are reported as fixture failures.
+procedure TProtocolListener.Failed(ATest: TTest; AFailure: TTestFailure);
+begin
+  FFailed := True;
+  if AFailure.ExceptionClassName = EFixtureError.ClassName then
+    Finish(ATest, 'fixture', AFailure.ExceptionMessage)
+  else
+    Finish(ATest, 'fail', AFailure.ExceptionClassName + ': ' + AFailure.ExceptionMessage);
+end;
+
+procedure TProtocolListener.StartTest(ATest: TTest);
+var
+  lUnit, lName: string;
+begin
+  TestName(ATest.ClassName, ATest.TestName, lUnit, lName);
+  WriteLn('##delphi-test start ', lUnit, ' ', lName);
+  Flush(Output);
+  FStart := Now;
+  FFailed := False;
+end;
+
+procedure TProtocolListener.EndTest(ATest: TTest);
+begin
+  if not FFailed then
+    Finish(ATest, 'pass', '');
+end;
+
+procedure TProtocolListener.StartTestSuite(ATestSuite: TTestSuite);
+begin
+end;
+
+procedure TProtocolListener.EndTestSuite(ATestSuite: TTestSuite);
+begin
+end;
+
+// RunTests runs the selected test cases in ATest.
+procedure RunTests(ATest: TTest; AResult: TTestResult);
+var
+  I: Integer;
+  lUnit, lName: string;
+begin
+  if ATest is TTestSuite then
+  begin
+    lUnit := WrappedUnit(ATest.TestName);
+    if lUnit <> '' then
+      StartUnit(lUnit);
+    for I := 0 to TTestSuite(ATest).ChildTestCount - 1 do
+      RunTests(TTestSuite(ATest).Test[I], AResult);
+    if lUnit <> '' then
+      EndUnit(lUnit);
+    Exit;
+  end;
+  TestName(ATest.ClassName, ATest.TestName, lUnit, lName);
+  if Selected(lUnit + '.' + lName) then
+    ATest.Run(AResult);
+end;
+
+var
+  lListener: ITestListener;
+  lResult: TTestResult;
+begin
+  SetupLeaks;
+  LoadSelection;
+  {{- range .Units}}{{if .Funcs}}
+  RegisterTest({{.Class}});
+  {{- end}}{{end}}
+
+  lListener := TProtocolListener.Create;
+  lResult := TTestResult.Create;
+  try
+    lResult.AddListener(lListener);
+    RunTests(GetTestRegistry, lResult);
+    if not lResult.WasSuccessful or lFixtureFailed then
+      ExitCode := 1;
+  finally
+    lResult.Free;
+  end;
+end.
+`
+
+var (
 	DOF_Template = template.Must(template.New("").Parse(`
 [FileVersion]
 Version=7.0
@@ -114,33 +704,14 @@ SearchPath={{range $include := .Search}}{{$include}};{{end}}
 DebugSourceDirs={{range $include := .Search}}{{$include}};{{end}}
 Conditionals={{range $define := .Define}}{{$define}};{{end}}
 `))
+	// CFG_Template has the dcc switches of the runner that differ from
+	// the defaults, the directories and defines are passed by the
+	// compiler backend on the command line.
 	CFG_Template = template.Must(template.New("").Parse(`
--$A8
--$B-
 -$C+
 -$D+
--$E-
--$F-
--$G+
--$H+
--$I+
--$J-
--$K-
 -$L+
--$M-
--$N+
 -$O-
--$P+
--$Q-
--$R-
--$S+
--$T-
--$U-
--$V+
--$W-
--$X+
--$YD
--$Z1
 -GD
 -cg
 -vn
@@ -150,15 +721,6 @@ Conditionals={{range $define := .Define}}{{$define}};{{end}}
 -M
 -$M16384,1048576
 -K$00400000
--E"{{.OutputDir}}"
--N"{{.BuildDir}}"
--LE"c:\Program Files (x86)\borland\delphi7\Projects\Bpl"
--LN"c:\Program Files (x86)\borland\delphi7\Projects\Bpl"
--U"{{range $include := .Search}}{{$include}};{{end}}"
--O"{{range $include := .Search}}{{$include}};{{end}}"
--I"{{range $include := .Search}}{{$include}};{{end}}"
--R"{{range $include := .Search}}{{$include}};{{end}}"
--D{{range $define := .Define}}{{$define}};{{end}}
 -w-SYMBOL_LIBRARY
 -w-SYMBOL_PLATFORM
 -w-UNIT_LIBRARY
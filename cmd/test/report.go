@@ -0,0 +1,486 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+// resultPrefix starts the lines written by the generated test runner:
+//
+//	##delphi-test start <unit> <name>
+//	##delphi-test pass <unit> <name> <ms>
+//	##delphi-test fail <unit> <name> <ms> <message>
+//	##delphi-test fixture <unit> <name> <ms> <message>
+//	##delphi-test skip <unit> <name> <ms> <message>
+//
+// A fixture line reports a failing Setup or Teardown of a test, or a
+// failing SetupUnit or TeardownUnit named as the result.
+//
+// Newlines and backslashes in the message are escaped as \n and \\.
+// The start lines act as heartbeats: a test that does not finish within
+// the per-test timeout is reported as hung.
+const resultPrefix = "##delphi-test "
+
+// Status is the outcome of a single test.
+type Status string
+
+const (
+	Pass    Status = "pass"
+	Fail    Status = "fail"
+	Error   Status = "error"   // the runner stopped during the test
+	Fixture Status = "fixture" // a setup or teardown failed
+	Skip    Status = "skip"
+)
+
+// Result is the outcome of running a single test.
+type Result struct {
+	Unit     string
+	Name     string
+	File     string
+	Line     int
+	Status   Status
+	Duration time.Duration
+	Message  string
+	Output   string // runner output while the test was running
+}
+
+// Report collects test results from the runner output written to it.
+type Report struct {
+	Results  []*Result
+	Duration time.Duration
+
+	Leaks     []*Leak // memory leaked by the runners
+	FailLeaks bool    // leaks fail the run
+
+	// Output receives the runner output without result lines, may be nil.
+	Output io.Writer
+
+	mu      sync.Mutex
+	running *Result
+	started time.Time // when the running test started
+	partial []byte
+}
+
+// Write parses every complete line in data.
+func (report *Report) Write(data []byte) (int, error) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	report.partial = append(report.partial, data...)
+	for {
+		p := bytes.IndexByte(report.partial, '\n')
+		if p < 0 {
+			break
+		}
+		line := report.partial[:p+1]
+		report.partial = report.partial[p+1:]
+		if err := report.line(string(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush handles the last unterminated line, a test that is still
+// running is reported as an error.
+func (report *Report) Flush() error {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+
+	var err error
+	if len(report.partial) > 0 {
+		err = report.line(string(report.partial))
+		report.partial = nil
+	}
+	if report.running != nil {
+		report.running.Status = Error
+		report.running.Message = "test did not finish"
+		report.running = nil
+	}
+	return err
+}
+
+func (report *Report) line(line string) error {
+	text := strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(text, resultPrefix) {
+		if report.running != nil {
+			report.running.Output += text + "\n"
+		}
+		if report.Output != nil {
+			_, err := io.WriteString(report.Output, line)
+			return err
+		}
+		return nil
+	}
+
+	fields := strings.SplitN(text[len(resultPrefix):], " ", 5)
+	if len(fields) < 3 {
+		return nil
+	}
+	status, unit, name := fields[0], fields[1], fields[2]
+
+	if status == "start" {
+		report.started = time.Now()
+		report.running = &Result{Unit: unit, Name: name, Status: Error}
+		report.Results = append(report.Results, report.running)
+		return nil
+	}
+
+	result := report.running
+	if result == nil || result.Unit != unit || result.Name != name {
+		result = &Result{Unit: unit, Name: name}
+		report.Results = append(report.Results, result)
+	}
+	report.running = nil
+
+	result.Status = Status(status)
+	if len(fields) > 3 {
+		ms, _ := strconv.Atoi(fields[3])
+		result.Duration = time.Duration(ms) * time.Millisecond
+	}
+	if len(fields) > 4 {
+		result.Message = unescape(fields[4])
+	}
+	return nil
+}
+
+// Running returns the "Unit.Test" name of the running test, empty when
+// no test is running.
+func (report *Report) Running() string {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.running == nil {
+		return ""
+	}
+	return report.running.Unit + "." + report.running.Name
+}
+
+// RunningFor returns how long the running test has been running, zero
+// when no test is running.
+func (report *Report) RunningFor() time.Duration {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.running == nil {
+		return 0
+	}
+	return time.Since(report.started)
+}
+
+// Abort reports the running test as an error with message, the output
+// captured so far is kept.
+func (report *Report) Abort(message string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if report.running == nil {
+		return
+	}
+	report.running.Status = Error
+	report.running.Message = message
+	report.running.Duration = time.Since(report.started)
+	report.running = nil
+}
+
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			if s[i] == 'n' {
+				b.WriteByte('\n')
+			} else {
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Locate fills in the source location of results from discovered tests
+// and fixture procedures.
+func (report *Report) Locate(files []*discover.TestFile) {
+	for _, result := range report.Results {
+		for _, file := range files {
+			if !strings.EqualFold(file.UnitName, result.Unit) {
+				continue
+			}
+			if line, ok := file.Line(result.Name); ok {
+				result.File = file.Path
+				result.Line = line
+			}
+			for _, test := range file.Tests {
+				if strings.EqualFold(test.FullName(), result.Name) {
+					result.File = file.Path
+					result.Line = test.Line
+				}
+			}
+		}
+	}
+}
+
+// Count returns the number of results with status.
+func (report *Report) Count(status Status) int {
+	n := 0
+	for _, result := range report.Results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed reports whether any test or fixture failed, a test did not
+// finish or memory leaked with FailLeaks.
+func (report *Report) Failed() bool {
+	if report.FailLeaks && len(report.Leaks) > 0 {
+		return true
+	}
+	return report.Count(Fail)+report.Count(Fixture)+report.Count(Error) > 0
+}
+
+func (report *Report) String() string {
+	s := fmt.Sprintf("%d passed, %d failed", report.Count(Pass), report.Count(Fail))
+	if n := report.Count(Fixture); n > 0 {
+		s += fmt.Sprintf(", %d fixture errors", n)
+	}
+	if n := report.Count(Error); n > 0 {
+		s += fmt.Sprintf(", %d did not finish", n)
+	}
+	if n := report.Count(Skip); n > 0 {
+		s += fmt.Sprintf(", %d skipped", n)
+	}
+	if n := len(report.Leaks); n > 0 {
+		s += fmt.Sprintf(", %d leaks", n)
+	}
+	return s
+}
+
+// WriteFile writes the report as JSON when filename ends with .json and
+// as JUnit XML otherwise.
+func (report *Report) WriteFile(filename string) error {
+	var buf bytes.Buffer
+	var err error
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		err = report.WriteJSON(&buf)
+	} else {
+		err = report.WriteJUnit(&buf)
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+type jsonResult struct {
+	Unit     string  `json:"unit"`
+	Name     string  `json:"name"`
+	File     string  `json:"file,omitempty"`
+	Line     int     `json:"line,omitempty"`
+	Status   Status  `json:"status"`
+	Duration float64 `json:"duration"` // seconds
+	Message  string  `json:"message,omitempty"`
+	Output   string  `json:"output,omitempty"`
+}
+
+type jsonLeak struct {
+	Unit  string      `json:"unit,omitempty"`
+	Test  string      `json:"test,omitempty"`
+	Size  int         `json:"size"`
+	Count int         `json:"count"`
+	Class string      `json:"class,omitempty"`
+	Stack []jsonFrame `json:"stack,omitempty"`
+}
+
+type jsonFrame struct {
+	Address string `json:"address"`
+	Func    string `json:"func,omitempty"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// WriteJSON writes the results as a JSON object.
+func (report *Report) WriteJSON(w io.Writer) error {
+	var out struct {
+		Passed   int          `json:"passed"`
+		Failed   int          `json:"failed"`
+		Fixtures int          `json:"fixtures"`
+		Errors   int          `json:"errors"`
+		Skipped  int          `json:"skipped"`
+		Duration float64      `json:"duration"`
+		Results  []jsonResult `json:"results"`
+		Leaks    []jsonLeak   `json:"leaks,omitempty"`
+	}
+	out.Passed = report.Count(Pass)
+	out.Failed = report.Count(Fail)
+	out.Fixtures = report.Count(Fixture)
+	out.Errors = report.Count(Error)
+	out.Skipped = report.Count(Skip)
+	out.Duration = report.Duration.Seconds()
+	out.Results = []jsonResult{}
+	for _, r := range report.Results {
+		out.Results = append(out.Results, jsonResult{
+			r.Unit, r.Name, r.File, r.Line, r.Status,
+			r.Duration.Seconds(), r.Message, r.Output,
+		})
+	}
+	for _, leak := range report.Leaks {
+		jl := jsonLeak{leak.Unit, leak.Test, leak.Size, leak.Count, leak.Class, nil}
+		for _, f := range leak.Stack {
+			jl.Stack = append(jl.Stack, jsonFrame{f.Address, f.Func, f.File, f.Line})
+		}
+		out.Leaks = append(out.Leaks, jl)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(out)
+}
+
+type (
+	junitSuites struct {
+		XMLName  xml.Name     `xml:"testsuites"`
+		Tests    int          `xml:"tests,attr"`
+		Failures int          `xml:"failures,attr"`
+		Errors   int          `xml:"errors,attr"`
+		Time     string       `xml:"time,attr"`
+		Suites   []junitSuite `xml:"testsuite"`
+	}
+	junitSuite struct {
+		Name     string      `xml:"name,attr"`
+		Tests    int         `xml:"tests,attr"`
+		Failures int         `xml:"failures,attr"`
+		Errors   int         `xml:"errors,attr"`
+		Skipped  int         `xml:"skipped,attr"`
+		Time     string      `xml:"time,attr"`
+		Cases    []junitCase `xml:"testcase"`
+	}
+	junitCase struct {
+		Classname string        `xml:"classname,attr"`
+		Name      string        `xml:"name,attr"`
+		File      string        `xml:"file,attr,omitempty"`
+		Line      int           `xml:"line,attr,omitempty"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure"`
+		Error     *junitMessage `xml:"error"`
+		Skipped   *junitMessage `xml:"skipped"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+	junitMessage struct {
+		Message string `xml:"message,attr,omitempty"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+func seconds(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', 3, 64) }
+
+// WriteJUnit writes the results as JUnit XML with a test suite per unit.
+func (report *Report) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Time: seconds(report.Duration)}
+	index := map[string]int{}
+	durations := map[string]time.Duration{}
+
+	for _, r := range report.Results {
+		i, ok := index[r.Unit]
+		if !ok {
+			i = len(suites.Suites)
+			index[r.Unit] = i
+			suites.Suites = append(suites.Suites, junitSuite{Name: r.Unit})
+		}
+		suite := &suites.Suites[i]
+
+		tc := junitCase{
+			Classname: r.Unit,
+			Name:      r.Name,
+			File:      r.File,
+			Line:      r.Line,
+			Time:      seconds(r.Duration),
+			SystemOut: r.Output,
+		}
+		message := &junitMessage{Message: firstLine(r.Message), Text: r.Message}
+		switch r.Status {
+		case Fail:
+			tc.Failure = message
+			suite.Failures++
+			suites.Failures++
+		case Fixture, Error:
+			tc.Error = message
+			suite.Errors++
+			suites.Errors++
+		case Skip:
+			tc.Skipped = message
+			suite.Skipped++
+		}
+
+		suite.Tests++
+		suites.Tests++
+		durations[r.Unit] += r.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for i := range suites.Suites {
+		suites.Suites[i].Time = seconds(durations[suites.Suites[i].Name])
+	}
+	if len(report.Leaks) > 0 {
+		suites.Suites = append(suites.Suites, report.junitLeaks())
+		suites.Tests += len(report.Leaks)
+		if report.FailLeaks {
+			suites.Failures += len(report.Leaks)
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// junitLeaks returns a suite with a test case for each leak, failing
+// with FailLeaks.
+func (report *Report) junitLeaks() junitSuite {
+	suite := junitSuite{Name: "Leaks", Time: seconds(0)}
+	for _, leak := range report.Leaks {
+		var text strings.Builder
+		for _, frame := range leak.Stack {
+			fmt.Fprintf(&text, "%v\n", frame)
+		}
+		tc := junitCase{
+			Classname: "Leaks",
+			Name:      leak.Where(),
+			Time:      seconds(0),
+		}
+		message := "leaked " + leak.String()
+		if report.FailLeaks {
+			tc.Failure = &junitMessage{Message: message, Text: text.String()}
+			suite.Failures++
+		} else {
+			tc.SystemOut = message + "\n" + text.String()
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	return suite
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package test
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	var report Report
+	report.Write([]byte("started\r\n##delphi-test start Math_Test Test_Add\r\n##delphi-test pass Math_Test Test_Add 12\r\n"))
+	report.Write([]byte("##delphi-test start Math_Test Test_Sub\r\nexpected 1\r\n##delphi-test fail Math_Test Test_Sub 3 EAssertionFailed: a\\nb\\\\c\r\n"))
+	report.Write([]byte("##delphi-test fixture Math_Test SetupUnit 1 EInOutError: no db\r\n"))
+	report.Write([]byte("##delphi-test start Math_Test Test_Crash\r\nAccess vio"))
+	report.Flush()
+
+	exp := []Result{
+		{Unit: "Math_Test", Name: "Test_Add", Status: Pass, Duration: 12 * time.Millisecond},
+		{Unit: "Math_Test", Name: "Test_Sub", Status: Fail, Duration: 3 * time.Millisecond,
+			Message: "EAssertionFailed: a\nb\\c", Output: "expected 1\n"},
+		{Unit: "Math_Test", Name: "SetupUnit", Status: Fixture, Duration: time.Millisecond,
+			Message: "EInOutError: no db"},
+		{Unit: "Math_Test", Name: "Test_Crash", Status: Error,
+			Message: "test did not finish", Output: "Access vio\n"},
+	}
+	if len(report.Results) != len(exp) {
+		t.Fatalf("got %d results, expected %d", len(report.Results), len(exp))
+	}
+	for i, result := range report.Results {
+		if *result != exp[i] {
+			t.Errorf("%d: got %+v, expected %+v", i, *result, exp[i])
+		}
+	}
+	if got := report.String(); got != "1 passed, 1 failed, 1 fixture errors, 1 did not finish" {
+		t.Errorf("summary %q", got)
+	}
+}
+
+func TestReportAbort(t *testing.T) {
+	var report Report
+	report.Write([]byte("##delphi-test start Math_Test Test_Hang\r\nwaiting\r\n"))
+	if got := report.Running(); got != "Math_Test.Test_Hang" {
+		t.Errorf("running %q", got)
+	}
+	report.Abort("test timed out after 1s")
+	report.Flush()
+
+	if report.Running() != "" || report.RunningFor() != 0 {
+		t.Errorf("test still running after abort")
+	}
+	result := report.Results[0]
+	if result.Status != Error || result.Message != "test timed out after 1s" || result.Output != "waiting\n" {
+		t.Errorf("got %+v", *result)
+	}
+}
@@ -0,0 +1,348 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+// TemplateData is passed to the runner templates.
+//
+// A runner template is a Go text/template producing the test program. The
+// program runs the tests listed in the file named by DELPHI_TEST_RUN and
+// writes "##delphi-test" result lines, see resultPrefix. Templates can use
+// the blocks defined in Common_Template:
+//
+//	{{template "header" .}}     generated file comment
+//	{{template "selection" .}}  LoadSelection, Selected and Escape
+//	{{template "names" .}}      TestName mapping test methods to results
+//	{{template "fixtures" .}}   RunFixture, StartUnit and EndUnit, needs "selection"
+//	{{template "memory" .}}     FastMM4 at the start of the uses list with .Leaks
+//	{{template "leaks" .}}      SetupLeaks directing the leak report
+type TemplateData struct {
+	Project   string          // program or unit name of the generated file
+	Units     []*TemplateUnit // units with tests
+	Define    []string        // compiler defines
+	Search    []string        // unit search path
+	OutputDir string          // directory of the runner executable
+	BuildDir  string          // directory of the compiled units
+	Leaks     bool            // report memory leaks
+}
+
+// TemplateUnit is a unit with tests.
+type TemplateUnit struct {
+	Name     string           // unit name
+	Path     string           // absolute path of the unit
+	Class    string           // class wrapping Funcs for frameworks that run methods
+	Funcs    []TemplateFunc   // standalone Test_ procedures
+	Cases    []string         // DUnit and FPCUnit test case classes
+	Fixtures []string         // DUnitX fixture classes
+	Tests    []*discover.Test // all tests of the unit
+
+	// fixture procedures run around Funcs, empty when not declared
+	Setup        string
+	Teardown     string
+	SetupUnit    string
+	TeardownUnit string
+}
+
+// TemplateFunc is a standalone Test_ procedure.
+type TemplateFunc struct {
+	Name   string // procedure name, e.g. Test_Add
+	Method string // name without the Test_ prefix, e.g. Add
+}
+
+// NewTemplateData creates the template data for the tests in files.
+func NewTemplateData(project string, files []*discover.TestFile) *TemplateData {
+	data := &TemplateData{Project: project}
+	for _, file := range files {
+		unit := &TemplateUnit{
+			Name:  file.UnitName,
+			Path:  file.Path,
+			Class: "T" + trimSuffix(file.UnitName, "_Test") + "Tests",
+			Tests: file.Tests,
+
+			Setup:        file.Setup,
+			Teardown:     file.Teardown,
+			SetupUnit:    file.SetupUnit,
+			TeardownUnit: file.TeardownUnit,
+		}
+		for _, name := range file.Funcs {
+			unit.Funcs = append(unit.Funcs, TemplateFunc{
+				Name:   name,
+				Method: trimPrefix(name, "Test_"),
+			})
+		}
+		for _, test := range file.Tests {
+			switch test.Kind {
+			case discover.DUnit:
+				if !contains(test.Class, unit.Cases) {
+					unit.Cases = append(unit.Cases, test.Class)
+				}
+			case discover.DUnitX:
+				if !contains(test.Class, unit.Fixtures) {
+					unit.Fixtures = append(unit.Fixtures, test.Class)
+				}
+			}
+		}
+		data.Units = append(data.Units, unit)
+	}
+	return data
+}
+
+// TemplateData returns the data for the runner templates of the build.
+func (build *Build) TemplateData() *TemplateData {
+	data := NewTemplateData(build.Project, build.Tests)
+	// including the defines of leakOptions
+	data.Define = build.Options().Define
+	data.Search = build.Search
+	data.OutputDir = build.OutputDir()
+	data.BuildDir = build.BuildDir()
+	data.Leaks = build.Leaks == LeaksReport || build.Leaks == LeaksFail
+	return data
+}
+
+// Templates are the built-in runner templates.
+var Templates = map[string]*template.Template{
+	"delphi":  runnerTemplate(Delphi_Template),
+	"dunit":   runnerTemplate(DUnitRunner_Template),
+	"dunitx":  runnerTemplate(DUnitXRunner_Template),
+	"fpcunit": runnerTemplate(FPCUnitRunner_Template),
+}
+
+// TemplateName returns the runner template set by DELPHI_TEST_TEMPLATE,
+// "delphi" by default.
+func TemplateName() string {
+	if name := os.Getenv("DELPHI_TEST_TEMPLATE"); name != "" {
+		return name
+	}
+	return "delphi"
+}
+
+// TemplateNames returns the names of the built-in runner templates.
+func TemplateNames() []string {
+	var names []string
+	for name := range Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadTemplate returns the built-in runner template with name, other
+// names are loaded as template files.
+func LoadTemplate(name string) (*template.Template, error) {
+	if t, ok := Templates[strings.ToLower(name)]; ok {
+		return t, nil
+	}
+	if filepath.Ext(name) == "" {
+		return nil, fmt.Errorf("unknown template %q, expected %v or a file", name, strings.Join(TemplateNames(), ", "))
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.Must(Common_Template.Clone()).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("template %v: %v", name, err)
+	}
+	return t, nil
+}
+
+func runnerTemplate(text string) *template.Template {
+	return template.Must(template.Must(Common_Template.Clone()).Parse(text))
+}
+
+// Common_Template defines the blocks shared by the runner templates.
+var Common_Template = template.Must(template.New("").Parse(`
+{{- define "header" -}}
+// AUTOMATICALLY GENERATED BY "delphi test"
+{{- end}}
+
+{{- define "selection"}}
+var
+  lSelected: TStringList;
+
+// LoadSelection reads the names of the tests to run from the file in
+// DELPHI_TEST_RUN, all tests run when it is not set.
+procedure LoadSelection;
+var
+  lFile: string;
+begin
+  lFile := GetEnvironmentVariable('DELPHI_TEST_RUN');
+  if (lFile = '') or not FileExists(lFile) then
+    Exit;
+  lSelected := TStringList.Create;
+  lSelected.LoadFromFile(lFile);
+  lSelected.CaseSensitive := False;
+  lSelected.Sorted := True;
+end;
+
+// Selected reports whether the test with the "Unit.Test" name runs.
+function Selected(const Name: string): Boolean;
+begin
+  Result := (lSelected = nil) or (lSelected.IndexOf(Name) >= 0);
+end;
+
+// UnitSelected reports whether any test of the unit runs.
+function UnitSelected(const UnitName: string): Boolean;
+var
+  I: Integer;
+begin
+  Result := True;
+  if lSelected = nil then
+    Exit;
+  for I := 0 to lSelected.Count - 1 do
+    if SameText(Copy(lSelected[I], 1, Length(UnitName) + 1), UnitName + '.') then
+      Exit;
+  Result := False;
+end;
+
+// Escape keeps a message on a single result line.
+function Escape(const S: string): string;
+begin
+  Result := StringReplace(S, '\', '\\', [rfReplaceAll]);
+  Result := StringReplace(Result, #13#10, '\n', [rfReplaceAll]);
+  Result := StringReplace(Result, #10, '\n', [rfReplaceAll]);
+  Result := StringReplace(Result, #13, '\n', [rfReplaceAll]);
+end;
+{{- end}}
+
+{{- define "memory"}}{{if .Leaks}}
+  {$IFNDEF FPC}FastMM4,{$ENDIF}{{end}}{{end}}
+
+{{- define "leaks"}}
+// SetupLeaks writes the leak report to the file in DELPHI_TEST_LEAKS,
+// heaptrc reads the file from HEAPTRC.
+procedure SetupLeaks;
+begin
+  {{- if .Leaks}}
+  {$IFNDEF FPC}
+  ReportMemoryLeaksOnShutdown := True;
+  if GetEnvironmentVariable('DELPHI_TEST_LEAKS') <> '' then
+    SetMMLogFileName(PAnsiChar(AnsiString(GetEnvironmentVariable('DELPHI_TEST_LEAKS'))));
+  {$ENDIF}
+  {{- end}}
+end;
+{{- end}}
+
+{{- define "fixtures"}}
+type
+  // EFixtureError is raised when a setup or teardown procedure fails.
+  EFixtureError = class(Exception);
+
+var
+  // lUnitError fails the tests of a unit whose SetupUnit failed.
+  lUnitError: string;
+  // lFixtureFailed is set when a SetupUnit or TeardownUnit failed.
+  lFixtureFailed: Boolean;
+
+// RunFixture runs a Setup or Teardown procedure, which may be nil, its
+// exceptions are raised as EFixtureError. The tests of a unit whose
+// SetupUnit failed fail here.
+procedure RunFixture(const Name: string; Fixture: TProcedure);
+begin
+  if lUnitError <> '' then
+    raise EFixtureError.Create(lUnitError);
+  if not Assigned(Fixture) then
+    Exit;
+  try
+    Fixture;
+  except
+    on E: Exception do
+      raise EFixtureError.Create(Name + ': ' + E.ClassName + ': ' + E.Message);
+  end;
+end;
+
+// UnitFixture runs a SetupUnit or TeardownUnit procedure and writes a
+// fixture result line when it fails.
+function UnitFixture(const UnitName, Name: string; Fixture: TProcedure): Boolean;
+var
+  lStart: TDateTime;
+begin
+  Result := True;
+  lStart := Now;
+  try
+    Fixture;
+  except
+    on E: Exception do
+    begin
+      Result := False;
+      lFixtureFailed := True;
+      WriteLn('##delphi-test fixture ', UnitName, ' ', Name, ' ', MilliSecondsBetween(Now, lStart), ' ',
+        Escape(E.ClassName + ': ' + E.Message));
+      Flush(Output);
+    end;
+  end;
+end;
+
+// StartUnit runs SetupUnit of a unit with selected tests.
+procedure StartUnit(const UnitName: string);
+begin
+  lUnitError := '';
+  if not UnitSelected(UnitName) then
+    Exit;
+  {{- range .Units}}{{if .SetupUnit}}
+  if SameText(UnitName, '{{.Name}}') and not UnitFixture('{{.Name}}', '{{.SetupUnit}}', {{.Name}}.{{.SetupUnit}}) then
+    lUnitError := '{{.SetupUnit}} failed';
+  {{- end}}{{end}}
+end;
+
+// EndUnit runs TeardownUnit of a unit with selected tests.
+procedure EndUnit(const UnitName: string);
+begin
+  lUnitError := '';
+  if not UnitSelected(UnitName) then
+    Exit;
+  {{- range .Units}}{{if .TeardownUnit}}
+  if SameText(UnitName, '{{.Name}}') then
+    UnitFixture('{{.Name}}', '{{.TeardownUnit}}', {{.Name}}.{{.TeardownUnit}});
+  {{- end}}{{end}}
+end;
+
+// WrappedUnit returns the unit of the Test_ procedures wrapped by a
+// class, empty for other classes.
+function WrappedUnit(const ClassName: string): string;
+begin
+  Result := '';
+  {{- range .Units}}{{if .Funcs}}
+  if SameText(ClassName, '{{.Class}}') then
+    Result := '{{.Name}}';
+  {{- end}}{{end}}
+end;
+{{- end}}
+
+{{- define "names"}}
+// TestName finds the unit and the result name of a test method, methods
+// wrapping Test_ procedures are named after the procedure.
+procedure TestName(const ClassName, Method: string; out UnitName, Name: string);
+begin
+  UnitName := '{{.Project}}';
+  Name := ClassName + '.' + Method;
+  {{- range $unit := .Units}}
+  {{- if .Funcs}}
+  if SameText(ClassName, '{{.Class}}') then
+  begin
+    UnitName := '{{.Name}}';
+    Name := Method;
+  end;
+  {{- end}}
+  {{- range .Cases}}
+  if SameText(ClassName, '{{.}}') then
+    UnitName := '{{$unit.Name}}';
+  {{- end}}
+  {{- range .Fixtures}}
+  if SameText(ClassName, '{{.}}') then
+    UnitName := '{{$unit.Name}}';
+  {{- end}}
+  {{- end}}
+end;
+{{- end}}
+`))
@@ -0,0 +1,52 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/raintreeinc/delphi/discover"
+)
+
+func TestTemplates(t *testing.T) {
+	files := []*discover.TestFile{{
+		UnitName: "Math_Test",
+		Funcs:    []string{"Test_Add"},
+		Setup:    "Setup",
+
+		SetupUnit: "SetupUnit",
+		Tests: []*discover.Test{
+			{Kind: discover.Procedure, Name: "Test_Add"},
+			{Kind: discover.DUnit, Class: "TMathTest", Name: "TestSub"},
+			{Kind: discover.DUnitX, Class: "TFixture", Name: "Simple"},
+		},
+	}}
+	data := NewTemplateData("All_Tests", files)
+	data.Leaks = true
+
+	unit := data.Units[0]
+	if unit.Class != "TMathTests" || unit.Funcs[0].Method != "Add" {
+		t.Errorf("got class %q, method %q", unit.Class, unit.Funcs[0].Method)
+	}
+	if len(unit.Cases) != 1 || len(unit.Fixtures) != 1 {
+		t.Errorf("got cases %v, fixtures %v", unit.Cases, unit.Fixtures)
+	}
+
+	for _, name := range TemplateNames() {
+		var buf bytes.Buffer
+		if err := Templates[name].Execute(&buf, data); err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		out := buf.String()
+		for _, exp := range []string{"program All_Tests;", "Math_Test", "##delphi-test", "Math_Test.SetupUnit", "Math_Test.Setup", "FastMM4,", "SetupLeaks;"} {
+			if !strings.Contains(out, exp) {
+				t.Errorf("%v: missing %q", name, exp)
+			}
+		}
+	}
+
+	if _, err := LoadTemplate("nunit"); err == nil {
+		t.Errorf("expected error for unknown template")
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/loov/watchrun/pgroup"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// watchInterval is how often running tests are checked for timeouts.
+const watchInterval = 100 * time.Millisecond
+
+// runTests runs the runner cmd writing its results into report. A test
+// running longer than build.TestTimeout is reported as hung and the
+// runner process tree is terminated.
+func (build *Build) runTests(cmd *exec.Cmd, report *Report) error {
+	build.mu.Lock()
+	build.reports = append(build.reports, report)
+	build.mu.Unlock()
+
+	if err := build.start(cmd); err != nil {
+		return err
+	}
+	if build.TestTimeout <= 0 {
+		return cmd.Wait()
+	}
+
+	done := make(chan struct{})
+	hung := make(chan string, 1)
+	go build.watch(cmd, report, done, hung)
+	err := cmd.Wait()
+	close(done)
+
+	select {
+	case name := <-hung:
+		return fmt.Errorf("%v timed out after %v", name, build.TestTimeout)
+	default:
+		return err
+	}
+}
+
+// watch kills cmd when the running test in report exceeds the test
+// timeout and sends the name of the test to hung.
+func (build *Build) watch(cmd *exec.Cmd, report *Report, done chan struct{}, hung chan string) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if report.RunningFor() < build.TestTimeout {
+			continue
+		}
+		name := report.Running()
+		cli.Warnf("%v: hung, timed out after %v\n", name, build.TestTimeout)
+		report.Abort(fmt.Sprintf("test timed out after %v", build.TestTimeout))
+		hung <- name
+		pgroup.Kill(cmd)
+		return
+	}
+}
+
+// timeout stops the run when it exceeds build.Timeout, the tests that
+// are running are reported as timed out.
+func (build *Build) timeout() {
+	build.mu.Lock()
+	build.timedOut = true
+	reports := build.reports
+	build.mu.Unlock()
+
+	cli.Warnf("run timed out after %v\n", build.Timeout)
+	for _, report := range reports {
+		if name := report.Running(); name != "" {
+			cli.Warnf("%v: still running\n", name)
+		}
+		report.Abort(fmt.Sprintf("run timed out after %v", build.Timeout))
+	}
+	build.Kill()
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/loov/watchrun/watch"
+	"github.com/raintreeinc/delphi/deps"
+	"github.com/raintreeinc/delphi/discover"
+	"github.com/raintreeinc/delphi/internal/cli"
+)
+
+// WatchInterval is the interval between checking the watched files.
+var WatchInterval = 300 * time.Millisecond
+
+// watchIgnore are the files written by compilers.
+var watchIgnore = append(watch.DefaultIgnore[:],
+	"*.dcu", "*.ppu", "*.o", "*.map", "*.exe",
+)
+
+// Watch runs initial and then, on every change to the units in the
+// search path and the test directories, reruns the tests affected by
+// the changed units. collect finds the current tests.
+//
+// The runner is compiled with all tests in the same build directory, so
+// only the changed units are recompiled.
+func (build *Build) Watch(initial []*discover.TestFile, collect func() []*discover.TestFile) {
+	search := append([]string{}, build.Search...)
+
+	watcher := watch.New(WatchInterval, deps.Roots(build.Search), watchIgnore, nil, true)
+
+	first := true
+	for changes := range watcher.Changes {
+		all := collect()
+		selected := initial
+		if !first {
+			var units *Changes
+			units, selected = build.affectedBy(changes, all, search)
+			if units == nil {
+				continue
+			}
+
+			cli.Clear()
+			cli.Priorityf("changed %v\n", strings.Join(units.Units, ", "))
+		}
+		first = false
+
+		if len(selected) == 0 {
+			cli.Infof("no tests affected\n")
+			continue
+		}
+
+		build.Search = append([]string{}, search...)
+		build.SetTests(all)
+		build.Selected = selected
+		build.rerun()
+	}
+}
+
+// affectedBy returns the units changed outside the build directory and
+// the tests in all affected by them, the changed units are nil when no
+// unit changed.
+func (build *Build) affectedBy(changes []watch.Change, all []*discover.TestFile, search []string) (*Changes, []*discover.TestFile) {
+	var changed []string
+	for _, change := range changes {
+		if !within(change.Path, build.Dir) {
+			changed = append(changed, change.Path)
+		}
+	}
+
+	units := ChangedFiles(changed)
+	if units.Empty() {
+		return nil, nil
+	}
+	return units, units.Affected(all, search, build.Verbose)
+}
+
+// rerun compiles the runner, runs the selected tests and prints a one
+// line summary.
+func (build *Build) rerun() {
+	var tests int
+	for _, file := range build.Selected {
+		tests += len(file.Tests)
+	}
+	cli.Priorityf("running %d tests in %d units\n", tests, len(build.Selected))
+
+	err := build.Prepare()
+	if err == nil && build.Covering() {
+		err = build.Instrument()
+	}
+	if err == nil {
+		err = build.Create()
+	}
+	if err == nil {
+		err = build.Run()
+	}
+
+	now := time.Now().Format("15:04:05")
+	switch {
+	case build.Report != nil && build.Report.Failed():
+		// the runner exits with an error when tests fail
+		cli.Warnf("%v FAIL %v\n", now, build.Report)
+	case err != nil:
+		cli.Errorf("%v FAIL %v\n", now, err)
+	default:
+		cli.Infof("%v PASS %v\n", now, build.Report)
+	}
+}
+
+// within reports whether path is inside dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
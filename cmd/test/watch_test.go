@@ -0,0 +1,48 @@
+package test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/loov/watchrun/watch"
+)
+
+func TestAffectedBy(t *testing.T) {
+	dir, files, search := writeAffected(t)
+	build := &Build{Dir: filepath.Join(dir, "build")}
+
+	for _, test := range []struct {
+		changed []string
+		units   []string
+		exp     []string
+	}{
+		{[]string{"src/sub/Mid.pas", "src/notes.txt"}, []string{"Mid"}, []string{"Calc_Test"}},
+		{[]string{"tests/Other_Test.pas", "src/Core.dfm"}, []string{"Other_Test", "Core"}, []string{"Calc_Test", "Other_Test"}},
+		{[]string{"src/Unused.pas"}, []string{"Unused"}, nil},
+		// the generated runner and the instrumented units are not changes
+		{[]string{"build/Runner.dpr", "build/cover/Core.pas"}, nil, nil},
+		{[]string{"src/notes.txt"}, nil, nil},
+	} {
+		var changes []watch.Change
+		for _, name := range test.changed {
+			changes = append(changes, watch.Change{Path: filepath.Join(dir, filepath.FromSlash(name))})
+		}
+
+		units, selected := build.affectedBy(changes, files, search)
+		var got []string
+		for _, file := range selected {
+			got = append(got, file.UnitName)
+		}
+		if test.units == nil {
+			if units != nil {
+				t.Errorf("%v: got changed units %v, expected none", test.changed, units.Units)
+			}
+		} else if units == nil || !reflect.DeepEqual(units.Units, test.units) {
+			t.Errorf("%v: got changed units %+v, expected %v", test.changed, units, test.units)
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v: got %v, expected %v", test.changed, got, test.exp)
+		}
+	}
+}
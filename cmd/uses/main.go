@@ -1,15 +1,14 @@
 package uses
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/deps"
 	"github.com/raintreeinc/delphi/internal/cli"
 )
 
@@ -21,6 +20,8 @@ func Help(args []string) {
 	cli.Helpf(`Arguments:
   -search    search path
   -root      search path root, add all folders recursively
+  -dir       same as -root
+             the folders of the project files are always searched
 
   -out       output file
 
@@ -56,6 +57,7 @@ func (flags *Flags) Parse(args []string) {
 
 	flags.Set.StringVar(&flags.Search, "search", "", "search path, default DELPHI_SEARCH")
 	flags.Set.StringVar(&flags.Root, "root", "", "search path root, add all folders recursively")
+	flags.Set.StringVar(&flags.Root, "dir", "", "search path root, same as -root")
 
 	flags.Set.StringVar(&flags.Output, "out", "", "output file")
 	flags.Set.StringVar(&flags.Why, "why", "", "why is a particular file included")
@@ -78,22 +80,43 @@ func Main(args []string) {
 		flags.Search = delphi.SearchPath()
 	}
 
-	index := NewIndex()
+	index := deps.NewIndex()
+	index.InterfaceOnly = flags.InterfaceOnly
 
+	dirs := []string{}
 	if flags.Root != "" {
-		index.AddSourceDir(flags.Root)
+		dirs = append(dirs, flags.Root)
 	}
 	if flags.Search != "" {
 		for _, p := range strings.Split(flags.Search, ";") {
-			index.AddSourceDir(p)
+			if p != "" {
+				dirs = append(dirs, p)
+			}
+		}
+	}
+	for _, path := range flags.Paths {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+	for _, dir := range dirs {
+		if err := index.AddSourceDir(dir); err != nil {
+			cli.Errorf("%v\n", err)
 		}
 	}
 
-	index.Verbose = flags.Verbose
-	index.Build(flags.Paths)
+	err := index.Build(flags.Paths)
+	if flags.Verbose {
+		for _, warning := range index.Warnings {
+			cli.Warnf("%v\n", warning)
+		}
+	}
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		os.Exit(1)
+	}
 
 	if flags.Why != "" {
-		for _, reason := range Why(index, flags.Why) {
+		fmt.Println(trimExt(filepath.Base(flags.Why)))
+		for _, reason := range deps.Why(index, flags.Why) {
 			fmt.Println(reason)
 		}
 		return
@@ -102,26 +125,12 @@ func Main(args []string) {
 	if flags.Output == "" {
 		flags.Output = trimExt(filepath.Base(flags.Paths[0])) + ".txt"
 	}
-
-	file, err := os.Create(flags.Output)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-
-	wr := bufio.NewWriter(file)
-	defer wr.Flush()
-
-	ext := strings.ToLower(filepath.Ext(flags.Output))
-	if ext == ".tgf" {
-		WriteTGF(index, wr)
-	} else if ext == ".dot" {
-		WriteDOT(index, wr)
-	} else if ext == ".txt" {
-		WriteTXT(index, wr)
-	} else if ext == ".glay" {
-		WriteGLAY(index, wr)
-	} else {
-		log.Fatal("Unknown file extension " + ext)
+	if err := deps.WriteFile(index, flags.Output); err != nil {
+		cli.Errorf("%v\n", err)
+		os.Exit(1)
 	}
 }
+
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
@@ -0,0 +1,203 @@
+package watch
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/loov/watchrun/pgroup"
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/deps"
+	"github.com/raintreeinc/delphi/internal/cli"
+
+	watchrun "github.com/loov/watchrun/watch"
+)
+
+// Build compiles a program and restarts it after every build.
+type Build struct {
+	Verbose  bool
+	Compiler delphi.Compiler
+	Format   string
+
+	DPR    string // program to compile
+	Bin    string // directory of the executable
+	DCU    string // directory of the compiled units
+	Dir    string // working directory of the program
+	Define []string
+	Search []string
+
+	built    bool
+	units    map[string]bool // lowercase names of the units used by the program
+	includes map[string]bool // lowercase names of the include files of the units
+	execute  *exec.Cmd
+}
+
+func (build *Build) addSearch(dir string) {
+	for _, existing := range build.Search {
+		if strings.EqualFold(existing, dir) {
+			return
+		}
+	}
+	build.Search = append(build.Search, dir)
+}
+
+// Monitor returns the directories to watch, the directory of the program
+// and the search directories not inside another one of them.
+func (build *Build) Monitor() []string {
+	return deps.Roots(append([]string{filepath.Dir(build.DPR)}, build.Search...))
+}
+
+// Triggers reports whether the changes affect the program, the first
+// changes always trigger the initial build.
+func (build *Build) Triggers(changes []watchrun.Change) bool {
+	if !build.built {
+		return true
+	}
+	for _, change := range changes {
+		if build.affects(change.Path) {
+			if build.Verbose {
+				cli.Infof("changed %v\n", change.Path)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// affects reports whether the file at path is part of the program.
+func (build *Build) affects(path string) bool {
+	name := strings.ToLower(filepath.Base(path))
+	unit := strings.TrimSuffix(name, filepath.Ext(name))
+	switch filepath.Ext(name) {
+	case ".dpr", ".pas", ".dfm", ".lfm", ".res", ".rc":
+		return build.units[unit]
+	case ".inc":
+		return build.includes[unit]
+	}
+	return false
+}
+
+// scan finds the units used by the program.
+func (build *Build) scan() {
+	index := deps.NewIndex()
+	for _, dir := range build.Monitor() {
+		if err := index.AddSourceDir(dir); err != nil {
+			cli.Warnf("%v\n", err)
+		}
+	}
+	err := index.Build([]string{build.DPR})
+	if build.Verbose {
+		for _, warning := range index.Warnings {
+			cli.Warnf("%v\n", warning)
+		}
+	}
+	if err != nil {
+		cli.Warnf("%v\n", err)
+	}
+
+	build.units = map[string]bool{}
+	build.includes = map[string]bool{}
+	for name, uses := range index.Uses {
+		if _, found := index.Path[name]; found {
+			build.units[name] = true
+		}
+		for _, include := range uses.Includes {
+			build.includes[include] = true
+		}
+	}
+}
+
+// Rerun compiles the program into a temporary directory, then replaces
+// and restarts the running executable.
+func (build *Build) Rerun() {
+	cli.Clear()
+	build.built = true
+	build.scan()
+
+	tmpbin := filepath.Join(build.Bin, "tmp")
+	os.MkdirAll(tmpbin, 0755)
+	if build.DCU != "" {
+		os.MkdirAll(build.DCU, 0755)
+	}
+
+	opts := &delphi.Options{
+		Source:    build.DPR,
+		OutputDir: tmpbin,
+		UnitDir:   build.DCU,
+		Search:    build.Search,
+		Define:    build.Define,
+	}
+	if _, ok := build.Compiler.(*delphi.DCC); ok {
+		opts.Args = []string{"-W"}
+	}
+
+	diags := &delphi.Diagnostics{Compiler: build.Compiler}
+	if build.Format == "text" || build.Format == "" {
+		diags.Output = os.Stdout
+	}
+
+	cli.Priorityf("Compiling %v\n", filepath.Base(build.DPR))
+	compile := Start(build.Compiler.Command(opts))
+	compile.Stdout = diags
+	compile.Stderr = diags
+	err := compile.Run()
+
+	diags.Flush()
+	if diags.Output == nil {
+		delphi.WriteDiagnostics(os.Stdout, build.Format, build.Compiler.Name(), diags.List)
+	}
+	if err != nil {
+		cli.Priorityf("Failed to compile: %v, %v\n", err, diags.Summary())
+		return
+	}
+	cli.Priorityf("Compiled with %v\n", diags.Summary())
+
+	tmpexe := build.Compiler.Executable(opts)
+	exe := filepath.Join(build.Bin, filepath.Base(tmpexe))
+
+	cli.Priorityf("Stopping \"%v\"\n", exe)
+	build.Stop()
+
+	if err := os.Remove(exe); err != nil && !os.IsNotExist(err) {
+		cli.Priorityf("Failed to remove previous executable: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmpexe, exe); err != nil {
+		cli.Priorityf("Failed to rename build result: %v\n", err)
+		return
+	}
+
+	cli.Priorityf("Starting \"%v\"\n", exe)
+	build.execute = Start(exec.Command(delphi.AbsPath(exe)))
+	build.execute.Dir = build.Dir
+	if err := build.execute.Start(); err != nil {
+		cli.Priorityf("Failed to start: %v\n", err)
+		build.execute = nil
+		return
+	}
+	go func(cmd *exec.Cmd) {
+		if err := cmd.Wait(); err != nil {
+			cli.Priorityf("Finished: %v\n", err)
+		} else {
+			cli.Priorityf("Finished\n")
+		}
+	}(build.execute)
+}
+
+// Stop stops the running executable.
+func (build *Build) Stop() {
+	if build.execute != nil {
+		pgroup.Kill(build.execute)
+		build.execute = nil
+	}
+}
+
+// Start connects cmd to the standard streams and its own process group.
+func Start(cmd *exec.Cmd) *exec.Cmd {
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	pgroup.Setup(cmd)
+	return cmd
+}
@@ -0,0 +1,93 @@
+package watch
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	watchrun "github.com/loov/watchrun/watch"
+)
+
+func TestMonitor(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "project")
+	build := &Build{
+		DPR: filepath.Join(root, "app", "App.dpr"),
+		Search: []string{
+			filepath.Join(root, "app", "forms"),
+			filepath.Join(root, "lib"),
+			filepath.Join(root, "lib", "json"),
+		},
+	}
+	exp := []string{filepath.Join(root, "app"), filepath.Join(root, "lib")}
+	if got := build.Monitor(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got %v, expected %v", got, exp)
+	}
+}
+
+func TestAffects(t *testing.T) {
+	build := &Build{
+		units:    map[string]bool{"app": true, "mainform": true},
+		includes: map[string]bool{"defines": true},
+	}
+	for path, exp := range map[string]bool{
+		filepath.Join("src", "MainForm.pas"): true,
+		filepath.Join("src", "MainForm.dfm"): true,
+		filepath.Join("src", "App.dpr"):      true,
+		filepath.Join("src", "App.res"):      true,
+		filepath.Join("src", "Other.pas"):    false,
+		filepath.Join("src", "defines.inc"):  true,
+		filepath.Join("src", "Defines.INC"):  true,
+		filepath.Join("src", "other.inc"):    false,
+		filepath.Join("src", "MainForm.dcu"): false,
+		filepath.Join("src", "notes.txt"):    false,
+	} {
+		if got := build.affects(path); got != exp {
+			t.Errorf("%v: got %v, expected %v", path, got, exp)
+		}
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	build := &Build{units: map[string]bool{"app": true}}
+	other := []watchrun.Change{{Path: "Other.pas"}}
+	if !build.Triggers(other) {
+		t.Errorf("first changes do not trigger the initial build")
+	}
+	build.built = true
+	if build.Triggers(other) {
+		t.Errorf("unrelated change triggers a build")
+	}
+	if !build.Triggers(append(other, watchrun.Change{Path: "App.dpr"})) {
+		t.Errorf("change to the program does not trigger a build")
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	changes := make(chan []watchrun.Change)
+	merged := debounce(changes, 50*time.Millisecond)
+
+	go func() {
+		for _, name := range []string{"A.pas", "B.pas", "C.pas"} {
+			changes <- []watchrun.Change{{Path: name}}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		changes <- []watchrun.Change{{Path: "D.pas"}}
+		close(changes)
+	}()
+
+	var batches [][]string
+	for batch := range merged {
+		var paths []string
+		for _, change := range batch {
+			paths = append(paths, change.Path)
+		}
+		batches = append(batches, paths)
+	}
+
+	exp := [][]string{{"A.pas", "B.pas", "C.pas"}, {"D.pas"}}
+	if !reflect.DeepEqual(batches, exp) {
+		t.Errorf("got %v, expected %v", batches, exp)
+	}
+}
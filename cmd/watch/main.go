@@ -0,0 +1,213 @@
+package watch
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/internal/cli"
+
+	watchrun "github.com/loov/watchrun/watch"
+)
+
+const ShortDesc = "rebuild and restart a program on changes"
+
+func Help(args []string) {
+	cli.Helpf("Usage:\n")
+	cli.Helpf("\t%s project.dpr\n\n", args[0])
+	cli.Helpf(`Arguments:
+  -search   search path
+  -define   compilator defines
+  -root     search path root, add all folders recursively
+
+  -compiler          dcc32, dcc64, fpc or path to the compiler, default DELPHI_COMPILER
+  -compiler-version  Delphi version of dcc, e.g. 7 or XE2, default DELPHI_COMPILER_VERSION
+  -format   compiler diagnostics format: text, json or sarif
+
+  -bin      output directory for the executable, default bin
+  -dcu      output directory for the compiled units, default dcu
+  -wd       working directory of the started executable
+
+  -interval interval between checking the files, default 300ms
+  -debounce wait until no file changed for the duration before rebuilding,
+            default 200ms
+  -ignore   ignore files and folders matching the glob, can be repeated
+
+The search path and the folder of the project are watched. Only changes to
+the units used by the project, directly or through other units, their
+forms and resources and include files trigger a rebuild. The program is
+compiled into a temporary folder, then the running executable is stopped,
+replaced and started again.
+`)
+}
+
+type Flags struct {
+	Help    bool
+	Verbose bool
+
+	Search string
+	Root   string
+	Define string
+	Paths  []string
+
+	Compiler        string
+	CompilerVersion string
+	Format          string
+
+	Bin        string
+	DCU        string
+	WorkingDir string
+
+	Interval time.Duration
+	Debounce time.Duration
+	Ignore   watchrun.Globs
+
+	Set *flag.FlagSet
+}
+
+func (flags *Flags) Parse(args []string) {
+	flags.Set = flag.NewFlagSet(args[0], flag.ExitOnError)
+	flags.Set.BoolVar(&flags.Help, "help", false, "show help")
+	flags.Set.BoolVar(&flags.Help, "h", false, "show help")
+
+	flags.Set.BoolVar(&flags.Verbose, "v", false, "verbose")
+	flags.Set.BoolVar(&flags.Verbose, "verbose", false, "verbose")
+
+	flags.Set.StringVar(&flags.Search, "search", "", "search path, default DELPHI_SEARCH")
+	flags.Set.StringVar(&flags.Define, "define", "", "compile defines, default DELPHI_DEFINE")
+	flags.Set.StringVar(&flags.Root, "root", "", "search root, adds all folders recursively")
+
+	flags.Set.StringVar(&flags.Compiler, "compiler", "", "compiler to use, default DELPHI_COMPILER")
+	flags.Set.StringVar(&flags.CompilerVersion, "compiler-version", "", "Delphi version of dcc, default DELPHI_COMPILER_VERSION")
+	flags.Set.StringVar(&flags.Format, "format", "text", "compiler diagnostics format: text, json or sarif")
+
+	flags.Set.StringVar(&flags.Bin, "bin", "bin", "output directory for the executable")
+	flags.Set.StringVar(&flags.DCU, "dcu", "dcu", "output directory for the compiled units")
+	flags.Set.StringVar(&flags.WorkingDir, "wd", "", "working directory for running the executable")
+
+	flags.Set.DurationVar(&flags.Interval, "interval", 300*time.Millisecond, "interval between checking the files")
+	flags.Set.DurationVar(&flags.Debounce, "debounce", 200*time.Millisecond, "quiet period before rebuilding")
+	flags.Ignore = watchrun.Globs{Default: DefaultIgnore}
+	flags.Set.Var(&flags.Ignore, "ignore", "ignore files and folders matching the glob")
+
+	flags.Set.Parse(args[1:])
+	flags.Paths = flags.Set.Args()
+
+	if flags.Search == "" {
+		flags.Search = delphi.SearchPath()
+	}
+	if flags.Define == "" {
+		flags.Define = delphi.Define()
+	}
+	if flags.CompilerVersion == "" {
+		flags.CompilerVersion = delphi.CompilerVersion()
+	}
+}
+
+// DefaultIgnore are the files that never trigger a rebuild.
+var DefaultIgnore = append(watchrun.DefaultIgnore[:],
+	"*.dcu", "*.ppu", "*.o", "*.map", "*.exe",
+)
+
+func Main(args []string) {
+	var flags Flags
+	flags.Parse(args)
+	if flags.Help || len(flags.Paths) != 1 {
+		Help(args)
+		return
+	}
+
+	compiler, err := delphi.NewCompiler(flags.Compiler, flags.CompilerVersion)
+	if err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+	if err := delphi.CheckFormat(flags.Format); err != nil {
+		cli.Errorf("%v\n", err)
+		return
+	}
+
+	build := &Build{
+		Verbose:  flags.Verbose,
+		Compiler: compiler,
+		Format:   flags.Format,
+		DPR:      delphi.AbsPath(flags.Paths[0]),
+		Bin:      flags.Bin,
+		DCU:      flags.DCU,
+		Dir:      flags.WorkingDir,
+		Define:   splitList(flags.Define),
+		Search:   splitList(flags.Search),
+	}
+	build.Search = delphi.AbsPaths(build.Search)
+	if flags.Root != "" {
+		for _, dir := range delphi.SearchPathFromRoot(delphi.AbsPath(flags.Root)) {
+			build.addSearch(dir)
+		}
+	}
+
+	watcher := watchrun.New(
+		flags.Interval,
+		build.Monitor(),
+		flags.Ignore.All(),
+		nil,
+		true,
+	)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		watcher.Stop()
+	}()
+
+	for changes := range debounce(watcher.Changes, flags.Debounce) {
+		if build.Triggers(changes) {
+			build.Rerun()
+		}
+	}
+	build.Stop()
+}
+
+// debounce merges the changes arriving within quiet of each other.
+func debounce(changes chan []watchrun.Change, quiet time.Duration) chan []watchrun.Change {
+	merged := make(chan []watchrun.Change)
+	go func() {
+		defer close(merged)
+		for batch := range changes {
+			timer := time.NewTimer(quiet)
+		wait:
+			for {
+				select {
+				case more, ok := <-changes:
+					if !ok {
+						timer.Stop()
+						break wait
+					}
+					batch = append(batch, more...)
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(quiet)
+				case <-timer.C:
+					break wait
+				}
+			}
+			merged <- batch
+		}
+	}()
+	return merged
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ";") {
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,211 @@
+package delphi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Compiler builds a Delphi program.
+type Compiler interface {
+	// Name returns the compiler name, e.g. "dcc32" or "fpc".
+	Name() string
+	// Command returns the command that compiles opts.
+	Command(opts *Options) *exec.Cmd
+	// Executable returns the path of the program built from opts.
+	Executable(opts *Options) string
+	// Parse parses a line of compiler output.
+	Parse(line string) (Diagnostic, bool)
+}
+
+// Options describes a program to compile.
+type Options struct {
+	Source    string // program file (.dpr)
+	OutputDir string // directory for the executable
+	UnitDir   string // directory for compiled units
+
+	Search    []string // unit, include, resource and object directories
+	Define    []string // conditional defines
+
+	// Args are additional compiler arguments.
+	Args []string
+}
+
+// DCC is the Embarcadero (Borland) Delphi command line compiler.
+type DCC struct {
+	Path    string // path to dcc32.exe or dcc64.exe
+	Version string // Delphi version, e.g. "7", "XE2" or "10.4"
+}
+
+// FPC is the Free Pascal compiler in Delphi mode.
+type FPC struct {
+	Path string // path to fpc
+}
+
+// DefaultDCC32 is the location of the Delphi 7 compiler.
+const DefaultDCC32 = `c:\Program Files (x86)\Borland\Delphi7\Bin\dcc32.exe`
+
+// DCCPath returns the path of the default dcc32 compiler, DELPHI_DCC.
+func DCCPath() string {
+	if path := os.Getenv("DELPHI_DCC"); path != "" {
+		return path
+	}
+	return DefaultDCC32
+}
+
+// CompilerName returns the compiler selected with DELPHI_COMPILER,
+// by default dcc32 on Windows and fpc elsewhere.
+func CompilerName() string {
+	if name := os.Getenv("DELPHI_COMPILER"); name != "" {
+		return name
+	}
+	if runtime.GOOS == "windows" {
+		return "dcc32"
+	}
+	return "fpc"
+}
+
+// CompilerVersion returns the Delphi version from DELPHI_COMPILER_VERSION.
+func CompilerVersion() string { return os.Getenv("DELPHI_COMPILER_VERSION") }
+
+// NewCompiler returns the compiler with the given name. The name is one
+// of "dcc32", "dcc64" or "fpc", or a path to one of these executables.
+// An empty name selects CompilerName().
+func NewCompiler(name, version string) (Compiler, error) {
+	if name == "" {
+		name = CompilerName()
+	}
+
+	path := ""
+	kind := strings.ToLower(name)
+	if strings.ContainsAny(name, `/\`) {
+		path = name
+		kind = executableName(name)
+	}
+
+	switch kind {
+	case "dcc32":
+		if path == "" {
+			path = DCCPath()
+			if version == "" && path == DefaultDCC32 {
+				version = "7"
+			}
+		}
+		return &DCC{Path: path, Version: version}, nil
+	case "dcc64":
+		if path == "" {
+			path = "dcc64"
+		}
+		return &DCC{Path: path, Version: version}, nil
+	case "fpc", "ppc386", "ppcx64":
+		if path == "" {
+			path = kind
+		}
+		return &FPC{Path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown compiler %q, expected dcc32, dcc64 or fpc", name)
+}
+
+func (dcc *DCC) Name() string { return executableName(dcc.Path) }
+
+// legacy reports whether the compiler predates the XE2 command line.
+func (dcc *DCC) legacy() bool {
+	switch dcc.Version {
+	case "5", "6", "7", "2005", "2006", "2007", "2009", "2010", "XE":
+		return true
+	}
+	return false
+}
+
+func (dcc *DCC) Command(opts *Options) *exec.Cmd {
+	args := []string{"-Q"}
+	if opts.OutputDir != "" {
+		args = append(args, "-E"+opts.OutputDir)
+	}
+	if opts.UnitDir != "" {
+		if dcc.legacy() {
+			args = append(args, "-N"+opts.UnitDir)
+		} else {
+			args = append(args, "-NU"+opts.UnitDir)
+		}
+	}
+	if search := joinList(opts.Search); search != "" {
+		args = append(args, "-U"+search, "-I"+search, "-R"+search, "-O"+search)
+	}
+	if define := joinList(opts.Define); define != "" {
+		args = append(args, "-D"+define)
+	}
+	args = append(args, opts.Args...)
+	args = append(args, opts.Source)
+	return exec.Command(dcc.Path, args...)
+}
+
+func (dcc *DCC) Executable(opts *Options) string {
+	return filepath.Join(opts.OutputDir, trimExt(filepath.Base(opts.Source))+".exe")
+}
+
+func (dcc *DCC) Parse(line string) (Diagnostic, bool) { return parseDCC(line) }
+
+func (fpc *FPC) Name() string { return "fpc" }
+
+func (fpc *FPC) Command(opts *Options) *exec.Cmd {
+	args := []string{"-Mdelphi"}
+	if opts.OutputDir != "" {
+		args = append(args, "-FE"+opts.OutputDir)
+	}
+	if opts.UnitDir != "" {
+		args = append(args, "-FU"+opts.UnitDir)
+	}
+	for _, path := range opts.Search {
+		if path == "" {
+			continue
+		}
+		args = append(args, "-Fu"+path, "-Fi"+path)
+	}
+	for _, define := range opts.Define {
+		if define == "" {
+			continue
+		}
+		args = append(args, "-d"+define)
+	}
+	args = append(args, opts.Args...)
+	args = append(args, opts.Source)
+	return exec.Command(fpc.Path, args...)
+}
+
+func (fpc *FPC) Executable(opts *Options) string {
+	name := trimExt(filepath.Base(opts.Source))
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return filepath.Join(opts.OutputDir, name)
+}
+
+func (fpc *FPC) Parse(line string) (Diagnostic, bool) { return parseFPC(line) }
+
+// executableName returns the lower-case file name of path without
+// the .exe extension, path may use either separator.
+func executableName(path string) string {
+	if i := strings.LastIndexAny(path, `/\`); i >= 0 {
+		path = path[i+1:]
+	}
+	return strings.TrimSuffix(strings.ToLower(path), ".exe")
+}
+
+// joinList joins non-empty items with ';'.
+func joinList(list []string) string {
+	var items []string
+	for _, item := range list {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return strings.Join(items, ";")
+}
+
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
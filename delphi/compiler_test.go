@@ -0,0 +1,33 @@
+package delphi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	opts := &Options{
+		Source:    "App.dpr",
+		OutputDir: "bin",
+		UnitDir:   "dcu",
+		Search:    []string{"src", "", "lib"},
+		Define:    []string{"DEBUG", "", "TEST"},
+		Args:      []string{"-W"},
+	}
+
+	for _, test := range []struct {
+		compiler Compiler
+		exp      []string
+	}{
+		{&DCC{Path: "dcc32", Version: "7"}, []string{"dcc32", "-Q", "-Ebin", "-Ndcu",
+			"-Usrc;lib", "-Isrc;lib", "-Rsrc;lib", "-Osrc;lib", "-DDEBUG;TEST", "-W", "App.dpr"}},
+		{&DCC{Path: "dcc64", Version: "XE2"}, []string{"dcc64", "-Q", "-Ebin", "-NUdcu",
+			"-Usrc;lib", "-Isrc;lib", "-Rsrc;lib", "-Osrc;lib", "-DDEBUG;TEST", "-W", "App.dpr"}},
+		{&FPC{Path: "fpc"}, []string{"fpc", "-Mdelphi", "-FEbin", "-FUdcu",
+			"-Fusrc", "-Fisrc", "-Fulib", "-Filib", "-dDEBUG", "-dTEST", "-W", "App.dpr"}},
+	} {
+		if got := test.compiler.Command(opts).Args; !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("%v:\ngot      %q\nexpected %q", test.compiler.Name(), got, test.exp)
+		}
+	}
+}
@@ -15,6 +15,9 @@ func SearchPath() string {
 	return ""
 }
 
+// Define returns the compiler defines from DELPHI_DEFINE.
+func Define() string { return os.Getenv("DELPHI_DEFINE") }
+
 func TempDir() string {
 	if dir := os.Getenv("DELPHI_TEMP"); dir != "" {
 		return dir
@@ -22,10 +25,6 @@ func TempDir() string {
 	return os.TempDir()
 }
 
-func DCC() string {
-	return "c:\\Program Files (x86)\\Borland\\Delphi7\\Bin\\dcc32.exe"
-}
-
 func SearchPathFromRoot(root string) []string {
 	filenames := make(chan string, 8)
 	errors := make(chan error, 8)
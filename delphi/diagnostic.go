@@ -0,0 +1,228 @@
+package delphi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Severity is the severity of a compiler message.
+type Severity int
+
+const (
+	Hint Severity = iota
+	Warning
+	Error
+	Fatal
+)
+
+var severities = [...]string{
+	Hint:    "hint",
+	Warning: "warning",
+	Error:   "error",
+	Fatal:   "fatal",
+}
+
+func (severity Severity) String() string {
+	if 0 <= severity && int(severity) < len(severities) {
+		return severities[severity]
+	}
+	return "severity(" + strconv.Itoa(int(severity)) + ")"
+}
+
+func parseSeverity(s string) (Severity, bool) {
+	switch strings.ToLower(s) {
+	case "hint", "note":
+		return Hint, true
+	case "warning", "warn":
+		return Warning, true
+	case "error":
+		return Error, true
+	case "fatal":
+		return Fatal, true
+	}
+	return Hint, false
+}
+
+// Diagnostic is a message reported by the compiler.
+type Diagnostic struct {
+	File     string // empty when the message is not about a file
+	Line     int
+	Col      int // 0 when unknown
+	Severity Severity
+	Code     string // e.g. "E2003" for dcc or "5000" for fpc, may be empty
+	Message  string
+}
+
+func (diag Diagnostic) String() string {
+	pos := diag.File
+	if diag.Line > 0 {
+		pos += fmt.Sprintf("(%d", diag.Line)
+		if diag.Col > 0 {
+			pos += fmt.Sprintf(",%d", diag.Col)
+		}
+		pos += ")"
+	}
+	if pos != "" {
+		pos += " "
+	}
+	msg := diag.Message
+	if diag.Code != "" {
+		msg = diag.Code + " " + msg
+	}
+	return pos + strings.Title(diag.Severity.String()) + ": " + msg
+}
+
+var (
+	// Unit.pas(12) Error: ...
+	// Unit.pas(12): error E2003: ...
+	// [dcc32 Error] Unit.pas(12): E2003 ...
+	// [dcc32 Fatal Error] Unit.pas(1): F1026 ...
+	rxDCC = regexp.MustCompile(`^(?:\[\w+ (\w+)(?: Error)?\] )?(?:(.+?)\((\d+)\):? )?(?:(?i:(Hint|Warning|Error|Fatal))(?: error)?:? )?(.*)$`)
+
+	// Unit.pas(12,5) Error: ...
+	rxFPC = regexp.MustCompile(`^(?:(.+?)\((\d+)(?:,(\d+))?\) )?(?i:(Hint|Note|Warning|Error|Fatal)): (.*)$`)
+
+	// E2003 Undeclared identifier
+	rxDCCCode = regexp.MustCompile(`^([EWHFX]\d{4}):? (.*)$`)
+	// (5000) Identifier not found, with fpc -vq
+	rxFPCCode = regexp.MustCompile(`^\((\d+)\) (.*)$`)
+)
+
+// splitCode splits the message number from the start of diag.Message.
+func (diag *Diagnostic) splitCode(rx *regexp.Regexp) {
+	if match := rx.FindStringSubmatch(diag.Message); match != nil {
+		diag.Code, diag.Message = match[1], match[2]
+	}
+}
+
+func parseDCC(line string) (Diagnostic, bool) {
+	line = strings.TrimSpace(line)
+	match := rxDCC.FindStringSubmatch(line)
+	if match == nil {
+		return Diagnostic{}, false
+	}
+
+	word := match[1]
+	if word == "" {
+		word = match[4]
+	}
+	severity, ok := parseSeverity(word)
+	if !ok {
+		return Diagnostic{}, false
+	}
+
+	diag := Diagnostic{
+		File:     match[2],
+		Severity: severity,
+		Message:  match[5],
+	}
+	diag.Line, _ = strconv.Atoi(match[3])
+	diag.splitCode(rxDCCCode)
+	return diag, true
+}
+
+func parseFPC(line string) (Diagnostic, bool) {
+	line = strings.TrimSpace(line)
+	match := rxFPC.FindStringSubmatch(line)
+	if match == nil {
+		return Diagnostic{}, false
+	}
+
+	severity, _ := parseSeverity(match[4])
+	diag := Diagnostic{
+		File:     match[1],
+		Severity: severity,
+		Message:  match[5],
+	}
+	diag.Line, _ = strconv.Atoi(match[2])
+	diag.Col, _ = strconv.Atoi(match[3])
+	diag.splitCode(rxFPCCode)
+	return diag, true
+}
+
+// Summary counts diagnostics by severity.
+type Summary struct {
+	Hints    int
+	Warnings int
+	Errors   int // including fatal errors
+}
+
+// Summarize counts diags by severity.
+func Summarize(diags []Diagnostic) Summary {
+	var summary Summary
+	for _, diag := range diags {
+		switch diag.Severity {
+		case Hint:
+			summary.Hints++
+		case Warning:
+			summary.Warnings++
+		default:
+			summary.Errors++
+		}
+	}
+	return summary
+}
+
+func (summary Summary) String() string {
+	return plural(summary.Errors, "error") + ", " +
+		plural(summary.Warnings, "warning") + ", " +
+		plural(summary.Hints, "hint")
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return strconv.Itoa(n) + " " + word + "s"
+}
+
+// Diagnostics collects diagnostics from compiler output written to it.
+// It can be used as the Stdout and Stderr of a compiler command.
+type Diagnostics struct {
+	Compiler Compiler
+	Output   io.Writer // receives the unmodified output, may be nil
+	List     []Diagnostic
+
+	partial []byte
+}
+
+// Write parses every complete line in data.
+func (diags *Diagnostics) Write(data []byte) (int, error) {
+	if diags.Output != nil {
+		if _, err := diags.Output.Write(data); err != nil {
+			return 0, err
+		}
+	}
+
+	diags.partial = append(diags.partial, data...)
+	for {
+		p := bytes.IndexByte(diags.partial, '\n')
+		if p < 0 {
+			break
+		}
+		diags.parse(string(diags.partial[:p]))
+		diags.partial = diags.partial[p+1:]
+	}
+	return len(data), nil
+}
+
+// Flush parses the last line when it did not end with a newline.
+func (diags *Diagnostics) Flush() {
+	if len(diags.partial) > 0 {
+		diags.parse(string(diags.partial))
+		diags.partial = nil
+	}
+}
+
+func (diags *Diagnostics) parse(line string) {
+	if diag, ok := diags.Compiler.Parse(line); ok {
+		diags.List = append(diags.List, diag)
+	}
+}
+
+// Summary counts the collected diagnostics.
+func (diags *Diagnostics) Summary() Summary { return Summarize(diags.List) }
@@ -0,0 +1,63 @@
+package delphi
+
+import (
+	"testing"
+)
+
+var parseTests = []struct {
+	compiler Compiler
+	line     string
+	ok       bool
+	diag     Diagnostic
+}{
+	{&DCC{}, `Unit1.pas(12) Error: Undeclared identifier: 'X'`, true,
+		Diagnostic{File: "Unit1.pas", Line: 12, Severity: Error, Message: "Undeclared identifier: 'X'"}},
+	{&DCC{}, `Unit1.pas(12) Error: E2003 Undeclared identifier: 'X'`, true,
+		Diagnostic{File: "Unit1.pas", Line: 12, Severity: Error, Code: "E2003", Message: "Undeclared identifier: 'X'"}},
+	{&DCC{}, `C:\src\Unit1.pas(7) Hint: H2164 Variable 'I' is declared but never used in 'Run'`, true,
+		Diagnostic{File: `C:\src\Unit1.pas`, Line: 7, Severity: Hint, Code: "H2164", Message: "Variable 'I' is declared but never used in 'Run'"}},
+	{&DCC{}, `[dcc32 Warning] Unit1.pas(3): W1000 Symbol 'X' is deprecated`, true,
+		Diagnostic{File: "Unit1.pas", Line: 3, Severity: Warning, Code: "W1000", Message: "Symbol 'X' is deprecated"}},
+	{&DCC{}, `[dcc32 Fatal Error] Unit1.pas(1): F1026 File not found: 'Missing.dcu'`, true,
+		Diagnostic{File: "Unit1.pas", Line: 1, Severity: Fatal, Code: "F1026", Message: "File not found: 'Missing.dcu'"}},
+	{&DCC{}, `Unit1.pas(12): error E2003: Undeclared identifier: 'X'`, true,
+		Diagnostic{File: "Unit1.pas", Line: 12, Severity: Error, Code: "E2003", Message: "Undeclared identifier: 'X'"}},
+	{&DCC{}, `Fatal: File not found: 'Missing.dcu'`, true,
+		Diagnostic{Severity: Fatal, Message: "File not found: 'Missing.dcu'"}},
+	{&DCC{}, `Borland Delphi Version 15.0`, false, Diagnostic{}},
+	{&DCC{}, `Unit1.pas(120)`, false, Diagnostic{}},
+
+	{&FPC{}, `Unit1.pas(12,5) Error: Identifier not found "X"`, true,
+		Diagnostic{File: "Unit1.pas", Line: 12, Col: 5, Severity: Error, Message: `Identifier not found "X"`}},
+	{&FPC{}, `Unit1.pas(12,5) Error: (5000) Identifier not found "X"`, true,
+		Diagnostic{File: "Unit1.pas", Line: 12, Col: 5, Severity: Error, Code: "5000", Message: `Identifier not found "X"`}},
+	{&FPC{}, `Unit1.pas(3,4) Note: Local variable "I" not used`, true,
+		Diagnostic{File: "Unit1.pas", Line: 3, Col: 4, Severity: Hint, Message: `Local variable "I" not used`}},
+	{&FPC{}, `Fatal: Compilation aborted`, true,
+		Diagnostic{Severity: Fatal, Message: "Compilation aborted"}},
+	{&FPC{}, `Free Pascal Compiler version 3.2.2`, false, Diagnostic{}},
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range parseTests {
+		diag, ok := test.compiler.Parse(test.line)
+		if ok != test.ok || diag != test.diag {
+			t.Errorf("%s %q:\n\tgot  %v %#v\n\texp  %v %#v", test.compiler.Name(), test.line, ok, diag, test.ok, test.diag)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	diags := &Diagnostics{Compiler: &DCC{}}
+	diags.Write([]byte("Borland Delphi\r\nUnit1.pas(1) Warning: W1000 X\r\nUnit1.pas(2) Hint: "))
+	diags.Write([]byte("H2164 Y\r\nUnit1.pas(3) Error: E2003 Z"))
+	diags.Flush()
+
+	exp := Summary{Hints: 1, Warnings: 1, Errors: 1}
+	if got := diags.Summary(); got != exp {
+		t.Errorf("got %v, expected %v", got, exp)
+	}
+	if len(diags.List) == 3 && diags.List[2].Code != "E2003" {
+		t.Errorf("last line not parsed: %v", diags.List[2])
+	}
+}
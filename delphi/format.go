@@ -0,0 +1,171 @@
+package delphi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Formats lists the output formats for diagnostics.
+var Formats = []string{"text", "json", "sarif"}
+
+// CheckFormat returns an error when format is not one of Formats,
+// an empty format is the same as "text".
+func CheckFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, known := range Formats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, expected %s", format, strings.Join(Formats, ", "))
+}
+
+// WriteDiagnostics writes diags in the given format, tool is the
+// compiler name reported in SARIF.
+func WriteDiagnostics(w io.Writer, format, tool string, diags []Diagnostic) error {
+	switch format {
+	case "", "text":
+		for _, diag := range diags {
+			if _, err := fmt.Fprintln(w, diag); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		return WriteJSON(w, diags)
+	case "sarif":
+		return WriteSARIF(w, tool, diags)
+	}
+	return CheckFormat(format)
+}
+
+func (severity Severity) MarshalText() ([]byte, error) {
+	return []byte(severity.String()), nil
+}
+
+func (severity *Severity) UnmarshalText(text []byte) error {
+	s, ok := parseSeverity(string(text))
+	if !ok {
+		return fmt.Errorf("unknown severity %q", text)
+	}
+	*severity = s
+	return nil
+}
+
+type jsonDiagnostic struct {
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Col      int      `json:"col,omitempty"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// WriteJSON writes diags as a JSON array.
+func WriteJSON(w io.Writer, diags []Diagnostic) error {
+	list := make([]jsonDiagnostic, 0, len(diags))
+	for _, diag := range diags {
+		list = append(list, jsonDiagnostic(diag))
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(list)
+}
+
+// SARIF 2.1.0, only the parts needed for reporting compiler messages.
+type (
+	sarifLog struct {
+		Schema  string     `json:"$schema"`
+		Version string     `json:"version"`
+		Runs    []sarifRun `json:"runs"`
+	}
+	sarifRun struct {
+		Tool    sarifTool     `json:"tool"`
+		Results []sarifResult `json:"results"`
+	}
+	sarifTool struct {
+		Driver struct {
+			Name string `json:"name"`
+		} `json:"driver"`
+	}
+	sarifResult struct {
+		RuleID    string          `json:"ruleId,omitempty"`
+		Level     string          `json:"level"`
+		Message   sarifMessage    `json:"message"`
+		Locations []sarifLocation `json:"locations,omitempty"`
+	}
+	sarifMessage struct {
+		Text string `json:"text"`
+	}
+	sarifLocation struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region *sarifRegion `json:"region,omitempty"`
+		} `json:"physicalLocation"`
+	}
+	sarifRegion struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn,omitempty"`
+	}
+)
+
+// WriteSARIF writes diags as a SARIF log.
+func WriteSARIF(w io.Writer, tool string, diags []Diagnostic) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = tool
+
+	for _, diag := range diags {
+		result := sarifResult{
+			RuleID:  diag.Code,
+			Level:   sarifLevel(diag.Severity),
+			Message: sarifMessage{diag.Message},
+		}
+		if diag.File != "" {
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = fileURI(diag.File)
+			if diag.Line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{diag.Line, diag.Col}
+			}
+			result.Locations = []sarifLocation{loc}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func sarifLevel(severity Severity) string {
+	switch severity {
+	case Hint:
+		return "note"
+	case Warning:
+		return "warning"
+	}
+	return "error"
+}
+
+// fileURI converts a file name from compiler output to a URI, relative
+// names stay relative to the working directory.
+func fileURI(name string) string {
+	name = strings.Replace(name, `\`, "/", -1)
+	switch {
+	case len(name) >= 2 && name[1] == ':':
+		name = "/" + name
+	case !strings.HasPrefix(name, "/"):
+		return (&url.URL{Path: name}).String()
+	}
+	return (&url.URL{Scheme: "file", Path: name}).String()
+}
@@ -1,21 +1,26 @@
-package main
+package deps
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/gonum/graph/simple"
 	"github.com/gonum/graph/topo"
 )
 
+// FindCycles returns the groups of units that use each other through
+// their interface sections. The units of a cycle and the cycles are
+// sorted by name.
 func FindCycles(index *Index) [][]string {
 	refid := map[string]simple.Node{}
 	refunit := map[simple.Node]string{}
 	graph := simple.NewDirectedGraph(1.0, 0.0)
 
-	for _, use := range index.Uses {
+	for _, cunitname := range index.Units() {
+		use := index.Uses[cunitname]
 		id := graph.NewNodeID()
 		node := simple.Node(id)
-		refid[strings.ToLower(use.Unit)] = node
+		refid[cunitname] = node
 		refunit[node] = use.Unit
 
 		graph.AddNode(node)
@@ -27,7 +32,7 @@ func FindCycles(index *Index) [][]string {
 			cdep := strings.ToLower(dep)
 
 			from, to := refid[cuse], refid[cdep]
-			graph.SetEdge(simple.Edge{from, to, 1.0})
+			graph.SetEdge(simple.Edge{F: from, T: to, W: 1.0})
 		}
 	}
 
@@ -41,9 +46,15 @@ func FindCycles(index *Index) [][]string {
 		for _, node := range component {
 			cycle = append(cycle, refunit[node.(simple.Node)])
 		}
+		sort.Slice(cycle, func(i, k int) bool {
+			return strings.ToLower(cycle[i]) < strings.ToLower(cycle[k])
+		})
 
 		cycles = append(cycles, cycle)
 	}
+	sort.Slice(cycles, func(i, k int) bool {
+		return strings.ToLower(cycles[i][0]) < strings.ToLower(cycles[k][0])
+	})
 
 	return cycles
 }
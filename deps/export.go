@@ -0,0 +1,148 @@
+package deps
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Writers are the graph formats by file extension.
+var Writers = map[string]func(index *Index, out io.Writer) (int, error){
+	".txt":  WriteTXT,
+	".dot":  WriteDOT,
+	".tgf":  WriteTGF,
+	".glay": WriteGLAY,
+}
+
+// WriteFile writes the graph in the format of the filename extension.
+func WriteFile(index *Index, filename string) error {
+	write, ok := Writers[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return fmt.Errorf("unknown file extension %q, expected .txt, .dot, .tgf or .glay", filepath.Ext(filename))
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(file)
+	_, err = write(index, wr)
+	if ferr := wr.Flush(); err == nil {
+		err = ferr
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writer counts the written bytes and keeps the first error.
+type writer struct {
+	out io.Writer
+	n   int
+	err error
+}
+
+func (w *writer) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	var x int
+	x, w.err = fmt.Fprintf(w.out, format, args...)
+	w.n += x
+}
+
+// WriteTXT writes the interface cycles followed by the uses of each
+// unit, interface uses prefixed with + and implementation uses with -.
+func WriteTXT(index *Index, out io.Writer) (int, error) {
+	w := &writer{out: out}
+
+	if cycles := FindCycles(index); len(cycles) > 0 {
+		w.printf("Circular interface uses:\n")
+		for _, cycle := range cycles {
+			w.printf("\t%v\n", cycle)
+		}
+		w.printf("\n")
+	}
+
+	for _, cunitname := range index.Units() {
+		uses := index.Uses[cunitname]
+
+		w.printf("# %v\n", uses.Unit)
+		for _, use := range uses.Interface {
+			w.printf("\t+ %v\n", index.NormalName(use))
+		}
+		for _, use := range uses.Implementation {
+			w.printf("\t- %v\n", index.NormalName(use))
+		}
+		w.printf("\n")
+	}
+
+	return w.n, w.err
+}
+
+// WriteDOT writes a Graphviz graph, implementation uses are dashed.
+func WriteDOT(index *Index, out io.Writer) (int, error) {
+	w := &writer{out: out}
+
+	w.printf("digraph G{\n")
+	for _, cunitname := range index.Units() {
+		uses := index.Uses[cunitname]
+		for _, use := range uses.Interface {
+			w.printf("\t%v -> %v;\n", uses.Unit, index.NormalName(use))
+		}
+		for _, use := range uses.Implementation {
+			w.printf("\t%v -> %v [style=dashed;dir=both;weight=0];\n", uses.Unit, index.NormalName(use))
+		}
+	}
+	w.printf("}\n")
+
+	return w.n, w.err
+}
+
+// WriteTGF writes the graph in Trivial Graph Format.
+func WriteTGF(index *Index, out io.Writer) (int, error) {
+	w := &writer{out: out}
+
+	units := index.Units()
+	ids := make(map[string]int, len(units))
+	for i, cunitname := range units {
+		ids[cunitname] = i + 1
+		w.printf("%v %v\n", i+1, index.Uses[cunitname].Unit)
+	}
+
+	w.printf("#\n")
+
+	for _, cunitname := range units {
+		uses := index.Uses[cunitname]
+		for _, use := range uses.Interface {
+			w.printf("%v %v\n", ids[cunitname], ids[strings.ToLower(use)])
+		}
+		for _, use := range uses.Implementation {
+			w.printf("%v %v\n", ids[cunitname], ids[strings.ToLower(use)])
+		}
+	}
+
+	return w.n, w.err
+}
+
+// WriteGLAY writes the edges of the graph for glay.
+func WriteGLAY(index *Index, out io.Writer) (int, error) {
+	w := &writer{out: out}
+
+	for _, cunitname := range index.Units() {
+		uses := index.Uses[cunitname]
+		for _, use := range uses.Interface {
+			w.printf("\t%v -> %v;\n", uses.Unit, index.NormalName(use))
+		}
+		for _, use := range uses.Implementation {
+			w.printf("\t%v -> %v;\n", uses.Unit, index.NormalName(use))
+		}
+	}
+
+	return w.n, w.err
+}
@@ -0,0 +1,332 @@
+// Package deps builds the uses graph of Delphi units.
+//
+// An Index maps unit names to the files found in the source directories,
+// Build scans the uses clauses starting from the root files:
+//
+//	index := deps.NewIndex()
+//	index.AddSourceDir("src")
+//	if err := index.Build([]string{"src/Main.dpr"}); err != nil {
+//		return err
+//	}
+//	cycles := deps.FindCycles(index)
+//
+// Unit names are case insensitive, the maps of the index are keyed by the
+// lowercase names.
+package deps
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// Index is the uses graph of the units reachable from the root files.
+type Index struct {
+	InterfaceOnly bool // ignore the uses of implementation sections
+
+	RootFiles []string // names of the root units
+
+	// Warnings are the duplicate units, missing units and includes and
+	// the syntax errors found while building.
+	Warnings []error
+
+	Path    map[string]string    // unit file of each unit
+	IncPath map[string]string    // include file by name without extension
+	Uses    map[string]*UnitUses // uses of each loaded unit
+}
+
+// UnitUses are the units used by a unit. Only units with a file in the
+// index are listed.
+type UnitUses struct {
+	Unit           string
+	Interface      []string // case insensitive sorted names
+	Implementation []string // case insensitive sorted names
+	Includes       []string // lower-case include names without extension
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{
+		Path:    make(map[string]string),
+		IncPath: make(map[string]string),
+		Uses:    make(map[string]*UnitUses),
+	}
+}
+
+// AddSourceDir adds the units and include files in dir and its sub
+// directories, hidden and backup files are skipped. The first file found
+// for a unit is used.
+func (index *Index) AddSourceDir(dir string) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		abs, _ := filepath.Abs(path)
+		if abs != "" {
+			path = abs
+		}
+
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") || strings.HasSuffix(path, "~") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".inc" {
+			index.addIncludePath(path)
+		}
+		if ext == ".pas" || ext == ".dpr" {
+			index.addSourcePath(path)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// Roots returns the directories of dirs that are not inside another one
+// of them, in their original order. Adding the roots with AddSourceDir
+// walks every directory once.
+func Roots(dirs []string) []string {
+	var roots []string
+	for i, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		nested := false
+		for k, other := range dirs {
+			if other == "" || k == i {
+				continue
+			}
+			if within(dir, other) && (!within(other, dir) || k < i) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// within reports whether path is dir or inside it.
+func within(path, dir string) bool {
+	path, _ = filepath.Abs(path)
+	dir, _ = filepath.Abs(dir)
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (index *Index) addSourcePath(path string) {
+	name := filepath.Base(path)
+	unitname := strings.ToLower(trimExt(name))
+
+	if existing, duplicate := index.Path[unitname]; duplicate {
+		index.warnf("duplicate unit %v, using %v", path, existing)
+		return
+	}
+	index.Path[unitname] = path
+}
+
+func (index *Index) addIncludePath(path string) {
+	name := filepath.Base(path)
+	unitname := strings.ToLower(trimExt(name))
+
+	if existing, duplicate := index.IncPath[unitname]; duplicate {
+		index.warnf("duplicate include %v, using %v", path, existing)
+		return
+	}
+	index.IncPath[unitname] = path
+}
+
+func (index *Index) warnf(format string, args ...interface{}) {
+	index.Warnings = append(index.Warnings, fmt.Errorf(format, args...))
+}
+
+// Build loads the root files and all units they use, directly or
+// through other units. Units that cannot be read are skipped, the first
+// such error is returned after building the rest of the graph.
+func (index *Index) Build(rootfiles []string) error {
+	var first error
+	queue := []string{}
+	for _, rootfile := range rootfiles {
+		name := trimExt(filepath.Base(rootfile))
+		queue = append(queue, name)
+		index.RootFiles = append(index.RootFiles, name)
+	}
+
+	for len(queue) > 0 {
+		var unit string
+		unit, queue = queue[len(queue)-1], queue[:len(queue)-1]
+
+		uses, err := index.Load(unit)
+		if err != nil && first == nil {
+			first = err
+		}
+		if uses == nil {
+			continue
+		}
+
+		for _, use := range uses.Interface {
+			if !index.IsLoaded(use) {
+				queue = append(queue, use)
+			}
+		}
+
+		for _, use := range uses.Implementation {
+			if !index.IsLoaded(use) {
+				queue = append(queue, use)
+			}
+		}
+	}
+	return first
+}
+
+// IsLoaded reports whether the uses of the unit have been loaded.
+func (index *Index) IsLoaded(unitname string) bool {
+	cunitname := strings.ToLower(unitname)
+	_, loaded := index.Uses[cunitname]
+	return loaded
+}
+
+// Load scans the uses of the unit, it returns nil when the unit has
+// already been loaded or has no file in the index.
+func (index *Index) Load(unitname string) (*UnitUses, error) {
+	if index.IsLoaded(unitname) {
+		return nil, nil
+	}
+
+	uses := &UnitUses{}
+	uses.Unit = unitname
+	index.Uses[strings.ToLower(unitname)] = uses
+
+	unitpath, ok := index.Path[strings.ToLower(unitname)]
+	if !ok {
+		index.warnf("did not find unit %v", unitname)
+		return nil, nil
+	}
+
+	if err := index.scanUses(uses, unitpath, 1); err != nil {
+		return nil, err
+	}
+	return uses, nil
+}
+
+func (index *Index) handleInclude(uses *UnitUses, directive string, state int) error {
+	p := strings.IndexRune(directive, ' ')
+	name := strings.Trim(directive[p:], "{}'\" ")
+	key := strings.ToLower(trimExt(name))
+	if !contains(key, uses.Includes) {
+		uses.Includes = append(uses.Includes, key)
+	}
+
+	includepath, ok := index.IncPath[key]
+	if !ok {
+		index.warnf("%v: did not find include %v", uses.Unit, name)
+		return nil
+	}
+
+	return index.scanUses(uses, includepath, state)
+}
+
+func (index *Index) scanUses(uses *UnitUses, unitpath string, state int) error {
+	src, err := ioutil.ReadFile(unitpath)
+	if err != nil {
+		return err
+	}
+
+	cunitname := strings.ToLower(uses.Unit)
+
+	var failed error
+	err = scanner.Scan(src, 0, func(tok token.Token, lit string) error {
+		if tok == token.CDIRECTIVE {
+			llit := strings.ToLower(lit)
+			if strings.HasPrefix(llit, "{$i ") ||
+				strings.HasPrefix(llit, "{$include ") {
+				if err := index.handleInclude(uses, lit, state); err != nil {
+					failed = err
+					return scanner.ErrStop
+				}
+			}
+			return nil
+		}
+
+		if tok == token.IMPLEMENTATION {
+			state = 2
+		} else if tok == token.IDENT {
+			cusename := strings.ToLower(lit)
+			if cusename == cunitname {
+				return nil
+			}
+
+			_, isunit := index.Path[cusename]
+			if !isunit {
+				return nil
+			}
+
+			if state == 1 {
+				uses.Interface = includeString(uses.Interface, lit)
+			} else if state == 2 {
+				if !index.InterfaceOnly {
+					uses.Implementation = includeString(uses.Implementation, lit)
+				}
+			}
+		}
+		return nil
+	}, func(pos token.Position, msg string) {
+		index.warnf("%s: %s: %s", unitpath, pos, msg)
+	})
+	if err != nil {
+		// too many syntax errors, keep the uses found so far
+		index.warnf("%s: %v", unitpath, err)
+	}
+	return failed
+}
+
+// UsedBy returns the reversed graph, the lowercase names of the units
+// using each unit.
+func (index *Index) UsedBy() map[string][]string {
+	usedBy := make(map[string][]string, len(index.Uses))
+	for name, uses := range index.Uses {
+		for _, target := range uses.Interface {
+			target = strings.ToLower(target)
+			usedBy[target] = includeString(usedBy[target], name)
+		}
+		for _, target := range uses.Implementation {
+			target = strings.ToLower(target)
+			usedBy[target] = includeString(usedBy[target], name)
+		}
+	}
+	return usedBy
+}
+
+// Units returns the lowercase names of the loaded units, sorted.
+func (index *Index) Units() []string {
+	names := make([]string, 0, len(index.Uses))
+	for name := range index.Uses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NormalName returns the name of a loaded unit as it was first written,
+// empty when the unit is not loaded.
+func (index *Index) NormalName(name string) string {
+	use, ok := index.Uses[strings.ToLower(name)]
+	if !ok {
+		return ""
+	}
+	return use.Unit
+}
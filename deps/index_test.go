@@ -0,0 +1,127 @@
+package deps
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testUnits = map[string]string{
+	"Main.dpr": `program Main;
+uses
+  A, B;
+begin
+end.
+`,
+	"A.pas": `unit A;
+interface
+uses B;
+implementation
+end.
+`,
+	"B.pas": `unit B;
+interface
+uses A;
+implementation
+uses {$I extra.inc} SysUtils;
+end.
+`,
+	"extra.inc": `C,`,
+	"C.pas": `unit C;
+interface
+implementation
+end.
+`,
+	"D.pas": `unit D;
+interface
+uses A;
+implementation
+end.
+`,
+}
+
+func testIndex(t *testing.T) *Index {
+	dir, err := ioutil.TempDir("", "deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, src := range testUnits {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := NewIndex()
+	if err := index.AddSourceDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Build([]string{filepath.Join(dir, "Main.dpr")}); err != nil {
+		t.Fatal(err)
+	}
+	return index
+}
+
+func TestBuild(t *testing.T) {
+	index := testIndex(t)
+
+	if units := index.Units(); !reflect.DeepEqual(units, []string{"a", "b", "c", "main"}) {
+		t.Errorf("got units %v", units)
+	}
+	b := index.Uses["b"]
+	if !reflect.DeepEqual(b.Interface, []string{"A"}) || !reflect.DeepEqual(b.Implementation, []string{"C"}) || !reflect.DeepEqual(b.Includes, []string{"extra"}) {
+		t.Errorf("got uses of B %+v", b)
+	}
+	if users := index.UsedBy()["b"]; !reflect.DeepEqual(users, []string{"a", "main"}) {
+		t.Errorf("got B used by %v", users)
+	}
+	if len(index.Warnings) != 0 {
+		t.Errorf("got warnings %v", index.Warnings)
+	}
+}
+
+func TestFindCycles(t *testing.T) {
+	cycles := FindCycles(testIndex(t))
+	if !reflect.DeepEqual(cycles, [][]string{{"A", "B"}}) {
+		t.Errorf("got cycles %v", cycles)
+	}
+}
+
+func TestWhy(t *testing.T) {
+	reasons := Why(testIndex(t), "C.pas")
+	if !reflect.DeepEqual(reasons, []string{">a>b>c", ">b>c"}) {
+		t.Errorf("got %v", reasons)
+	}
+}
+
+func TestWriteTXT(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := WriteTXT(testIndex(t), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != buf.Len() {
+		t.Errorf("got n = %v, wrote %v bytes", n, buf.Len())
+	}
+
+	exp := "Circular interface uses:\n\t[A B]\n\n" +
+		"# A\n\t+ B\n\n" +
+		"# B\n\t+ A\n\t- C\n\n" +
+		"# C\n\n" +
+		"# Main\n\t+ A\n\t+ B\n\n"
+	if buf.String() != exp {
+		t.Errorf("got\n%s\nexpected\n%s", buf.String(), exp)
+	}
+}
+
+func TestRoots(t *testing.T) {
+	sep := string(filepath.Separator)
+	dirs := []string{"src" + sep + "a", "src", "", "lib", "src" + sep + "b" + sep + "c", "src" + sep, "library"}
+	if roots := Roots(dirs); !reflect.DeepEqual(roots, []string{"src", "lib", "library"}) {
+		t.Errorf("got roots %v", roots)
+	}
+}
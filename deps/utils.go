@@ -1,4 +1,4 @@
-package uses
+package deps
 
 import (
 	"path/filepath"
@@ -0,0 +1,42 @@
+package deps
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Why returns the chains of uses leading from the root files to the
+// target unit. Each chain is formatted as ">unit>...>target" with
+// lowercase names, starting with a unit used by a root file.
+func Why(index *Index, target string) (reasons []string) {
+	target = trimExt(filepath.Base(target))
+	usedBy := index.UsedBy()
+
+	roots := make(map[string]bool)
+	for _, root := range index.RootFiles {
+		roots[strings.ToLower(root)] = true
+	}
+
+	var reverse func(target string, chain []string)
+	reverse = func(target string, chain []string) {
+		if roots[target] {
+			reason := ""
+			for i := len(chain) - 1; i >= 0; i-- {
+				reason += ">" + chain[i]
+			}
+			reasons = append(reasons, reason)
+			return
+		}
+		if contains(target, chain) {
+			return
+		}
+
+		chain = append(chain, target)
+		for _, parent := range usedBy[target] {
+			reverse(parent, chain)
+		}
+	}
+	reverse(strings.ToLower(target), nil)
+
+	return reasons
+}
@@ -0,0 +1,215 @@
+package discover
+
+import (
+	"strings"
+
+	"github.com/raintreeinc/delphi/resolve"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// TestKind describes how a test is declared.
+type TestKind int
+
+const (
+	// Procedure is a standalone Test_ procedure declared in the interface.
+	Procedure TestKind = iota
+	// DUnit is a published method of a TTestCase descendant.
+	DUnit
+	// DUnitX is a method with a [Test] or [TestCase] attribute.
+	DUnitX
+)
+
+var testKinds = [...]string{
+	Procedure: "procedure",
+	DUnit:     "dunit",
+	DUnitX:    "dunitx",
+}
+
+func (kind TestKind) String() string { return testKinds[kind] }
+
+// Test is a single test found in a unit.
+type Test struct {
+	Kind  TestKind
+	Class string // empty for standalone procedures
+	Name  string
+	Line  int
+	Cases []string // names of DUnitX TestCase attributes
+}
+
+// FullName returns the test name qualified with its class.
+func (test *Test) FullName() string {
+	if test.Class == "" {
+		return test.Name
+	}
+	return test.Class + "." + test.Name
+}
+
+// TestCaseBases are the classes whose descendants are DUnit or FPCUnit
+// test cases. Projects with their own test case base classes, declared
+// outside the discovered units, add them here.
+var TestCaseBases = []string{"TTestCase"}
+
+// testClass is a class declaration found while discovering tests.
+type testClass struct {
+	Name     string
+	Ancestor string
+	Methods  []*testMethod
+}
+
+// testMethod is a method declaration in a class body.
+type testMethod struct {
+	Name       string
+	Line       int
+	Visibility token.Token
+	Procedure  bool // parameterless instance procedure
+	Attributes []attribute
+}
+
+// attribute is a [Name(args)] attribute, string arguments are unquoted.
+type attribute struct {
+	Name string
+	Args []string
+}
+
+func (attr *attribute) is(name string) bool {
+	return strings.EqualFold(attr.Name, name) || strings.EqualFold(attr.Name, name+"Attribute")
+}
+
+// LinkTests collects the tests of files, classes are matched with their
+// ancestors across all files to find indirect TTestCase descendants.
+func LinkTests(files []*TestFile) {
+	ancestors := map[string]string{}
+	for _, file := range files {
+		for _, class := range file.classes {
+			ancestors[strings.ToLower(class.Name)] = strings.ToLower(class.Ancestor)
+		}
+	}
+	for _, base := range TestCaseBases {
+		ancestors[strings.ToLower(base)] = ""
+	}
+
+	isTestCase := func(name string) bool {
+		name = strings.ToLower(name)
+		for depth := 0; name != "" && depth < 32; depth++ {
+			for _, base := range TestCaseBases {
+				if strings.EqualFold(name, base) {
+					return true
+				}
+			}
+			name = ancestors[name]
+		}
+		return false
+	}
+
+	for _, file := range files {
+		file.Tests = file.Tests[:0]
+		for _, name := range file.Funcs {
+			file.Tests = append(file.Tests, &Test{
+				Kind: Procedure,
+				Name: name,
+				Line: file.lines[strings.ToLower(name)],
+			})
+		}
+
+		for _, class := range file.classes {
+			testcase := isTestCase(class.Ancestor)
+			for _, method := range class.Methods {
+				if test := method.test(class, testcase); test != nil {
+					file.Tests = append(file.Tests, test)
+				}
+			}
+		}
+	}
+}
+
+// test returns the test declared by method or nil.
+func (method *testMethod) test(class *testClass, testcase bool) *Test {
+	test := &Test{
+		Class: class.Name,
+		Name:  method.Name,
+		Line:  method.Line,
+	}
+
+	for _, attr := range method.Attributes {
+		switch {
+		case attr.is("Test"):
+			if len(attr.Args) > 0 && strings.EqualFold(attr.Args[0], "false") {
+				return nil
+			}
+			test.Kind = DUnitX
+		case attr.is("TestCase"):
+			test.Kind = DUnitX
+			if len(attr.Args) > 0 {
+				test.Cases = append(test.Cases, attr.Args[0])
+			}
+		}
+	}
+	if test.Kind == DUnitX {
+		return test
+	}
+
+	if testcase && method.Procedure && method.Visibility == token.PUBLISHED {
+		test.Kind = DUnit
+		return test
+	}
+	return nil
+}
+
+// discover parses src skipping inactive conditional code and records
+// the interface procedures and the classes of the unit. Declarations
+// before a syntax error are still found.
+func (file *TestFile) discover(src []byte, defines []string) {
+	prog := resolve.NewProgram(nil, defines)
+	unit, _ := prog.LoadSource(file.Path, src)
+	line := func(pos token.Pos) int { return prog.Fset.Position(pos).Line }
+
+	for _, decl := range unit.Decls {
+		if decl.Implementation || decl.Keyword != token.PROCEDURE || decl.Params > 0 {
+			continue
+		}
+		name := decl.Objs[0].Name
+		if strings.HasPrefix(strings.ToLower(name), "test_") {
+			file.addFunc(name, line(decl.Pos))
+		} else {
+			file.addFixture(name, line(decl.Pos))
+		}
+	}
+
+	for _, class := range unit.Classes {
+		if class.Kind != token.CLASS && class.Kind != token.OBJECT {
+			continue
+		}
+		tc := &testClass{Name: class.Object.Name, Ancestor: class.Ancestor}
+		for _, method := range class.Methods {
+			m := &testMethod{
+				Name: method.Name,
+				Line: line(method.Pos),
+				// classes compiled with {$M+}, which includes all test
+				// cases, have published members by default
+				Visibility: method.Visibility,
+				Procedure:  method.Keyword == token.PROCEDURE && !method.ClassMethod && method.Params == 0,
+			}
+			if m.Visibility == token.ILLEGAL {
+				m.Visibility = token.PUBLISHED
+			}
+			for _, attr := range method.Attributes {
+				a := attribute{Name: attr.Name}
+				for _, arg := range attr.Args {
+					a.Args = append(a.Args, unquote(arg))
+				}
+				m.Attributes = append(m.Attributes, a)
+			}
+			tc.Methods = append(tc.Methods, m)
+		}
+		file.classes = append(file.classes, tc)
+	}
+}
+
+// unquote returns the value of a string literal, other literals are
+// returned as is.
+func unquote(lit string) string {
+	if len(lit) >= 2 && lit[0] == '\'' && lit[len(lit)-1] == '\'' {
+		return strings.Replace(lit[1:len(lit)-1], "''", "'", -1)
+	}
+	return lit
+}
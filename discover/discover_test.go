@@ -0,0 +1,253 @@
+package discover
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var discoverSources = map[string]string{
+	"Math_Test.pas": `unit Math_Test;
+
+interface
+
+uses
+  TestFramework, DUnitX.TestFramework, BaseTests;
+
+type
+  TCallback = procedure(Sender: TObject) of object;
+
+  TMathTest = class(TTestCase)
+    FValue: Integer;
+  private
+    procedure Test_Private;
+  protected
+    procedure SetUp; override;
+  published
+    procedure TestAdd;
+    procedure TestWithArg(X: Integer);
+    function TestFunc: Boolean;
+    class procedure TestClassProc;
+    property Value: Integer read FValue write FValue;
+    procedure TestSub; virtual;
+  end;
+
+  TDerivedTest = class(TBaseTest)
+  published
+    procedure TestDerived;
+  end;
+
+  TOther = class(TObject)
+  published
+    procedure Test_NotATest;
+  end;
+
+  [TestFixture]
+  TFixture = class
+  public
+    [Setup]
+    procedure Setup;
+    [Test]
+    procedure Simple;
+    [Test(False)]
+    procedure Disabled;
+    [TestCase('First', '1,2')]
+    [TestCase('Second', '3,4')]
+    procedure Cases(A, B: Integer);
+  end;
+
+procedure Test_Standalone;
+procedure Test_WithArgs(X: Integer);
+function Test_Function: Boolean;
+procedure Helper;
+procedure SetUp;
+procedure TearDown(Arg: Integer);
+procedure SetupUnit;
+{$IFDEF NEVER}
+procedure Test_Inactive;
+{$ENDIF}
+
+implementation
+
+type
+  TLocalTest = class(TestFramework.TTestCase)
+  published
+    procedure TestLocal;
+  end;
+
+procedure Test_Hidden; forward;
+
+procedure Test_Standalone;
+  procedure Test_Nested;
+  begin
+  end;
+begin
+  Test_Nested;
+end;
+
+procedure TMathTest.TestAdd;
+begin
+end;
+
+end.
+`,
+	"BaseTests.pas": `unit BaseTests;
+
+interface
+
+uses TestFramework;
+
+type
+  TBaseTest = class(TTestCase);
+
+implementation
+
+end.
+`,
+}
+
+func TestDiscover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files []*TestFile
+	for _, name := range []string{"Math_Test.pas", "BaseTests.pas"} {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(discoverSources[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := NewTestFile(filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	LinkTests(files)
+
+	var got []string
+	for _, test := range files[0].Tests {
+		got = append(got, fmt.Sprintf("%v %v:%v %v", test.Kind, test.FullName(), test.Line, test.Cases))
+	}
+	exp := []string{
+		"procedure Test_Standalone:50 []",
+		"dunit TMathTest.TestAdd:18 []",
+		"dunit TMathTest.TestSub:23 []",
+		"dunit TDerivedTest.TestDerived:28 []",
+		"dunitx TFixture.Simple:42 []",
+		"dunitx TFixture.Cases:47 [First Second]",
+		"dunit TLocalTest.TestLocal:66 []",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got:\n\t%v\nexpected:\n\t%v", got, exp)
+	}
+	file := files[0]
+	if file.Setup != "SetUp" || file.Teardown != "" || file.SetupUnit != "SetupUnit" || file.TeardownUnit != "" {
+		t.Errorf("got fixtures %q %q %q %q", file.Setup, file.Teardown, file.SetupUnit, file.TeardownUnit)
+	}
+	if len(files[1].Tests) != 0 {
+		t.Errorf("BaseTests: unexpected tests %v", files[1].Tests)
+	}
+}
+
+func TestDiscoverDeclarations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "Generic_Test.pas")
+	src := `unit Generic_Test;
+
+interface
+
+type
+  [TestFixture]
+  TListTest<T: class> = class(TTestCase, ITestable)
+  strict private
+    FItems: array of T;
+    procedure ITestable.Run = TestRun;
+  published
+    procedure TestRun;
+    [DUnitX.TestFramework.TestCase('It''s', '1')]
+    procedure Quoted(const S: string; N: Integer);
+  end;
+
+  [TestFixture]
+  TPlain = class
+  public
+    [Test] procedure One;
+  end;
+
+implementation
+
+end.
+`
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := NewTestFile(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, test := range file.Tests {
+		got = append(got, fmt.Sprintf("%v %v:%v %v", test.Kind, test.FullName(), test.Line, test.Cases))
+	}
+	exp := []string{
+		"dunit TListTest.TestRun:12 []",
+		"dunitx TListTest.Quoted:14 [It's]",
+		"dunitx TPlain.One:20 []",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("got:\n\t%v\nexpected:\n\t%v", got, exp)
+	}
+}
+
+func TestTestCaseBases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "Custom_Test.pas")
+	src := `unit Custom_Test;
+interface
+type
+  TCustomTest = class(TInHouseTestCase)
+  published
+    procedure TestOne;
+  end;
+implementation
+end.
+`
+	if err := ioutil.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func() int {
+		file, err := NewTestFile(filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(file.Tests)
+	}
+
+	if n := count(); n != 0 {
+		t.Errorf("unknown base class: got %d tests", n)
+	}
+
+	defer func(bases []string) { TestCaseBases = bases }(TestCaseBases)
+	TestCaseBases = append(TestCaseBases, "TInHouseTestCase")
+	if n := count(); n != 1 {
+		t.Errorf("configured base class: got %d tests, expected 1", n)
+	}
+}
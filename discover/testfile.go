@@ -0,0 +1,167 @@
+// Package discover finds the tests declared in Delphi units.
+//
+// Standalone Test_ procedures in the interface, published methods of
+// TTestCase descendants and methods with DUnitX [Test] attributes are
+// recognized, inactive {$IFDEF} branches are skipped:
+//
+//	files, errs := discover.Collect([]string{"tests"}, defines)
+//	for _, file := range files {
+//		for _, test := range file.Tests {
+//			fmt.Println(file.UnitName, test.FullName())
+//		}
+//	}
+package discover
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/raintreeinc/delphi/delphi"
+	"github.com/raintreeinc/delphi/internal/walk"
+)
+
+// TestFile is a unit with tests.
+type TestFile struct {
+	Path     string
+	Full     string
+	UnitName string
+	Funcs    []string // standalone Test_ procedures
+	Tests    []*Test  // all tests, filled in by LinkTests
+
+	// fixture procedures run around the Test_ procedures, empty when
+	// the unit does not declare them
+	Setup        string // before each test
+	Teardown     string // after each test
+	SetupUnit    string // before the first test of the unit
+	TeardownUnit string // after the last test of the unit
+
+	classes []*testClass
+	lines   map[string]int // line of each func
+}
+
+// NewTestFile parses the unit at path and discovers its tests, classes
+// deriving from test cases in other units are found with LinkTests.
+func NewTestFile(path string, defines []string) (*TestFile, error) {
+	ext := filepath.Ext(path)
+	file := &TestFile{
+		Path:     path,
+		UnitName: filepath.Base(path[:len(path)-len(ext)]),
+		Funcs:    []string{},
+		lines:    map[string]int{},
+	}
+
+	file.Path = delphi.AbsPath(path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file.discover(data, defines)
+	LinkTests([]*TestFile{file})
+
+	return file, nil
+}
+
+// Collect finds the test units in paths, globs of files and directories.
+// Units that cannot be read are skipped and reported in errs.
+func Collect(paths []string, defines []string) (files []*TestFile, errs []error) {
+	filenames := make(chan string, 8)
+	errors := make(chan error, 8)
+	go func() {
+		walk.Globs(paths, filenames, errors, walk.IsDelphiFile)
+		close(filenames)
+		close(errors)
+	}()
+
+	walked := make(chan []error)
+	go func() {
+		var errs []error
+		for err := range errors {
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+		walked <- errs
+	}()
+
+	for filename := range filenames {
+		if !strings.EqualFold(filepath.Ext(filename), ".pas") {
+			continue
+		}
+
+		file, err := NewTestFile(filename, defines)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	errs = append(<-walked, errs...)
+
+	// test case ancestors may be declared in other units
+	LinkTests(files)
+	return files, errs
+}
+
+// Line returns the line of a Test_ or fixture procedure.
+func (file *TestFile) Line(name string) (int, bool) {
+	line, ok := file.lines[strings.ToLower(name)]
+	return line, ok
+}
+
+// TestOf returns the test with the function in a stack trace, FastMM
+// names methods "TClass.Method", heaptrc "TCLASS__METHOD".
+func (file *TestFile) TestOf(fn string) string {
+	fn = strings.Replace(fn, "__", ".", -1)
+	for _, test := range file.Tests {
+		if strings.EqualFold(fn, test.FullName()) {
+			return test.FullName()
+		}
+		if strings.EqualFold(fn, file.UnitName+"."+test.FullName()) ||
+			strings.EqualFold(fn, file.UnitName+"_$$_"+test.FullName()) {
+			return test.FullName()
+		}
+	}
+	return ""
+}
+
+func (file *TestFile) addFunc(name string, line int) {
+	if contains(name, file.Funcs) {
+		return
+	}
+	file.Funcs = append(file.Funcs, name)
+	file.lines[strings.ToLower(name)] = line
+}
+
+// addFixture records name when it is a conventionally named fixture
+// procedure.
+func (file *TestFile) addFixture(name string, line int) {
+	var fixture *string
+	switch strings.ToLower(name) {
+	case "setup":
+		fixture = &file.Setup
+	case "teardown":
+		fixture = &file.Teardown
+	case "setupunit":
+		fixture = &file.SetupUnit
+	case "teardownunit":
+		fixture = &file.TeardownUnit
+	default:
+		return
+	}
+	if *fixture == "" {
+		*fixture = name
+		file.lines[strings.ToLower(name)] = line
+	}
+}
+
+func contains(value string, list []string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
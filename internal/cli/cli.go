@@ -2,6 +2,7 @@ package cli
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/fatih/color"
@@ -11,26 +12,32 @@ var (
 	fmtPriority = color.New(color.FgBlack, color.BgWhite)
 	fmtError    = color.New(color.FgRed, color.BgWhite)
 	fmtDefault  = color.New()
+	fmtDeleted  = color.New(color.FgHiWhite, color.BgRed)
+	fmtInserted = color.New(color.FgHiWhite, color.BgGreen)
 )
 
+// Output receives progress messages, it is set to os.Stderr when
+// stdout is reserved for machine readable output.
+var Output io.Writer = os.Stdout
+
 func Clear() {
 	fmt.Println("\x1b[3;J\x1b[H\x1b[2J")
 }
 
 func Printf(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stdout, format, args...)
+	fmt.Fprintf(Output, format, args...)
 }
 
 func Warnf(format string, args ...interface{}) {
-	fmtError.Fprintf(os.Stdout, format, args...)
+	fmtError.Fprintf(Output, format, args...)
 }
 
 func Infof(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stdout, format, args...)
+	fmt.Fprintf(Output, format, args...)
 }
 
 func Priorityf(format string, args ...interface{}) {
-	fmtPriority.Fprintf(os.Stdout, format, args...)
+	fmtPriority.Fprintf(Output, format, args...)
 }
 
 func Helpf(format string, args ...interface{}) {
@@ -40,3 +47,9 @@ func Helpf(format string, args ...interface{}) {
 func Errorf(format string, args ...interface{}) {
 	fmtError.Fprintf(os.Stderr, format, args...)
 }
+
+// Deleted highlights removed text, e.g. in diffs.
+func Deleted(text string) string { return fmtDeleted.Sprint(text) }
+
+// Inserted highlights added text, e.g. in diffs.
+func Inserted(text string) string { return fmtInserted.Sprint(text) }
@@ -0,0 +1,343 @@
+// Package diff implements line based unified diffs.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Context is the number of unchanged lines shown around changes.
+const Context = 3
+
+// maxEdits limits the edit distance computed by the diff algorithm,
+// beyond that the whole file is shown as replaced.
+const maxEdits = 1024
+
+// Kind describes a line in an edit script.
+type Kind byte
+
+const (
+	Equal  Kind = ' '
+	Delete Kind = '-'
+	Insert Kind = '+'
+)
+
+// Line is a single line in an edit script.
+type Line struct {
+	Kind Kind
+	Text string // including the line ending, if any
+
+	A, B int // line index in old and new file
+}
+
+// Hunk is a group of changes with surrounding context.
+type Hunk struct {
+	A, B       int // first line index in old and new file
+	LenA, LenB int // number of lines in old and new file
+	Lines      []Line
+}
+
+// Header returns the "@@ -a,n +b,m @@" line for the hunk.
+func (hunk *Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", span(hunk.A, hunk.LenA), span(hunk.B, hunk.LenB))
+}
+
+func span(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// SplitLines splits data into lines, keeping line endings.
+func SplitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		p := bytes.IndexByte(data, '\n')
+		if p < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:p+1]))
+		data = data[p+1:]
+	}
+	return lines
+}
+
+// Lines computes the edit script transforming a into b.
+func Lines(a, b []string) []Line {
+	// trim common prefix and suffix
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var script []Line
+	for i := 0; i < prefix; i++ {
+		script = append(script, Line{Equal, a[i], i, i})
+	}
+	script = append(script, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for i := suffix; i > 0; i-- {
+		ia, ib := len(a)-i, len(b)-i
+		script = append(script, Line{Equal, a[ia], ia, ib})
+	}
+	return script
+}
+
+// myers implements the Myers O(ND) difference algorithm.
+func myers(a, b []string, offa, offb int) []Line {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return replace(a, b, offa, offb)
+	}
+
+	max := n + m
+	if max > maxEdits {
+		max = maxEdits
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return replace(a, b, offa, offb)
+	}
+
+	// backtrack
+	var rev []Line
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevk int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevk = k + 1
+		} else {
+			prevk = k - 1
+		}
+		prevx := v[offset+prevk]
+		prevy := prevx - prevk
+		if d == 0 {
+			prevx, prevy = 0, 0
+		}
+
+		for x > prevx && y > prevy {
+			x, y = x-1, y-1
+			rev = append(rev, Line{Equal, a[x], offa + x, offb + y})
+		}
+		if d > 0 {
+			if x == prevx {
+				y--
+				rev = append(rev, Line{Insert, b[y], offa + x, offb + y})
+			} else {
+				x--
+				rev = append(rev, Line{Delete, a[x], offa + x, offb + y})
+			}
+		}
+	}
+
+	script := make([]Line, len(rev))
+	for i, line := range rev {
+		script[len(rev)-1-i] = line
+	}
+	return script
+}
+
+func replace(a, b []string, offa, offb int) []Line {
+	var script []Line
+	for i, line := range a {
+		script = append(script, Line{Delete, line, offa + i, offb})
+	}
+	for i, line := range b {
+		script = append(script, Line{Insert, line, offa + len(a), offb + i})
+	}
+	return script
+}
+
+// Hunks groups an edit script into hunks with context lines.
+func Hunks(script []Line, context int) []*Hunk {
+	var hunks []*Hunk
+	var hunk *Hunk
+	last := -1 // index of the last change
+
+	for i, line := range script {
+		if line.Kind == Equal {
+			continue
+		}
+
+		// changes separated by at most 2*context equal lines share a hunk
+		if hunk == nil || i-last-1 > 2*context {
+			if hunk != nil {
+				hunk.trail(script, last, context)
+				hunks = append(hunks, hunk)
+			}
+			start := i - context
+			if start < 0 {
+				start = 0
+			}
+			hunk = &Hunk{A: script[start].A, B: script[start].B}
+			last = start - 1
+		}
+		for k := last + 1; k <= i; k++ {
+			hunk.add(script[k])
+		}
+		last = i
+	}
+	if hunk != nil {
+		hunk.trail(script, last, context)
+		hunks = append(hunks, hunk)
+	}
+	return hunks
+}
+
+func (hunk *Hunk) add(line Line) {
+	hunk.Lines = append(hunk.Lines, line)
+	if line.Kind != Insert {
+		hunk.LenA++
+	}
+	if line.Kind != Delete {
+		hunk.LenB++
+	}
+}
+
+func (hunk *Hunk) trail(script []Line, last, context int) {
+	for k := last + 1; k < len(script) && k <= last+context; k++ {
+		hunk.add(script[k])
+	}
+}
+
+// Unified returns the unified diff between a and b, the result is empty
+// when the contents are equal.
+func Unified(oldname, newname string, a, b []byte) string {
+	return UnifiedHighlight(oldname, newname, a, b, nil)
+}
+
+// Range is the byte range [Start, End) of a file.
+type Range struct{ Start, End int }
+
+// Highlight marks parts of the changed lines, e.g. the replaced text.
+type Highlight struct {
+	A, B   []Range             // sorted ranges in the old and new content
+	Delete func(string) string // marks text of deleted lines
+	Insert func(string) string // marks text of inserted lines
+}
+
+// UnifiedHighlight returns the unified diff between a and b with the
+// ranges of hl marked, hl may be nil.
+func UnifiedHighlight(oldname, newname string, a, b []byte, hl *Highlight) string {
+	if bytes.Equal(a, b) {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n", oldname)
+	fmt.Fprintf(&out, "+++ %s\n", newname)
+	WriteHunks(&out, a, b, hl)
+	return out.String()
+}
+
+// WriteHunks writes the hunks of the unified diff between a and b
+// without the file header, hl may be nil.
+func WriteHunks(out *strings.Builder, a, b []byte, hl *Highlight) {
+	linesA, linesB := SplitLines(a), SplitLines(b)
+	offsA, offsB := offsets(linesA), offsets(linesB)
+
+	for _, hunk := range Hunks(Lines(linesA, linesB), Context) {
+		out.WriteString(hunk.Header())
+		out.WriteString("\n")
+		for _, line := range hunk.Lines {
+			switch {
+			case hl != nil && line.Kind == Delete:
+				WriteMarked(out, line, offsA[line.A], hl.A, hl.Delete)
+			case hl != nil && line.Kind == Insert:
+				WriteMarked(out, line, offsB[line.B], hl.B, hl.Insert)
+			default:
+				WriteLine(out, line)
+			}
+		}
+	}
+}
+
+// offsets returns the byte offset of each line.
+func offsets(lines []string) []int {
+	offs := make([]int, len(lines))
+	offset := 0
+	for i, line := range lines {
+		offs[i] = offset
+		offset += len(line)
+	}
+	return offs
+}
+
+// WriteLine writes a single diff line, marking a missing final newline.
+func WriteLine(out *strings.Builder, line Line) {
+	out.WriteByte(byte(line.Kind))
+	out.WriteString(line.Text)
+	if !strings.HasSuffix(line.Text, "\n") {
+		out.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// WriteMarked writes a single diff line starting at offset in its file,
+// the parts inside ranges are wrapped with mark. Line endings are not
+// marked.
+func WriteMarked(out *strings.Builder, line Line, offset int, ranges []Range, mark func(string) string) {
+	text := strings.TrimRight(line.Text, "\r\n")
+	end := offset + len(text)
+
+	var marked strings.Builder
+	at := offset
+	for _, r := range ranges {
+		if r.Start >= end {
+			break
+		}
+		if r.End <= at || r.Start == r.End {
+			continue
+		}
+		start := r.Start
+		if start < at {
+			start = at
+		}
+		stop := r.End
+		if stop > end {
+			stop = end
+		}
+		marked.WriteString(text[at-offset : start-offset])
+		marked.WriteString(mark(text[start-offset : stop-offset]))
+		at = stop
+	}
+	marked.WriteString(text[at-offset:])
+	marked.WriteString(line.Text[len(text):])
+
+	WriteLine(out, Line{Kind: line.Kind, Text: marked.String(), A: line.A, B: line.B})
+}
@@ -0,0 +1,115 @@
+package diff
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// patch applies hunks to a, checking that context and deleted lines
+// match a.
+func patch(t *testing.T, a []string, hunks []*Hunk) []string {
+	var out []string
+	at := 0
+	for _, hunk := range hunks {
+		if hunk.A < at {
+			t.Fatalf("overlapping hunk %s", hunk.Header())
+		}
+		out = append(out, a[at:hunk.A]...)
+		k := hunk.A
+		for _, line := range hunk.Lines {
+			if line.Kind != Insert {
+				if k >= len(a) || a[k] != line.Text {
+					t.Fatalf("hunk %s: line %d is %q, not %q", hunk.Header(), k+1, a[k], line.Text)
+				}
+				k++
+			}
+			if line.Kind != Delete {
+				out = append(out, line.Text)
+			}
+		}
+		if k != hunk.A+hunk.LenA {
+			t.Fatalf("hunk %s: covers %d lines", hunk.Header(), k-hunk.A)
+		}
+		at = k
+	}
+	return append(out, a[at:]...)
+}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"begin\n", "end;\n", "X := 1;\n", "Y := 2;\n", "\n"}
+	random := func() []string {
+		lines := make([]string, rng.Intn(40))
+		for i := range lines {
+			lines[i] = words[rng.Intn(len(words))]
+		}
+		return lines
+	}
+
+	for i := 0; i < 200; i++ {
+		a, b := random(), random()
+		script := Lines(a, b)
+
+		var olds, news []string
+		for _, line := range script {
+			if line.Kind != Insert {
+				olds = append(olds, line.Text)
+			}
+			if line.Kind != Delete {
+				news = append(news, line.Text)
+			}
+		}
+		if strings.Join(olds, "") != strings.Join(a, "") || strings.Join(news, "") != strings.Join(b, "") {
+			t.Fatalf("script of %q -> %q does not reproduce the inputs", a, b)
+		}
+
+		if got := patch(t, a, Hunks(script, Context)); strings.Join(got, "") != strings.Join(b, "") {
+			t.Fatalf("patching %q got %q, expected %q", a, got, b)
+		}
+	}
+}
+
+func TestHunksMerge(t *testing.T) {
+	lines := func(n int) []string {
+		var list []string
+		for i := 0; i < n; i++ {
+			list = append(list, string(rune('a'+i))+"\n")
+		}
+		return list
+	}
+
+	// changes at the first and last line separated by gap equal lines
+	for _, test := range []struct{ gap, hunks int }{
+		{2*Context - 1, 1},
+		{2 * Context, 1},
+		{2*Context + 1, 2},
+	} {
+		a := lines(test.gap + 2)
+		b := append([]string{}, a...)
+		b[0], b[len(b)-1] = "X\n", "Y\n"
+
+		if got := len(Hunks(Lines(a, b), Context)); got != test.hunks {
+			t.Errorf("gap %d: got %d hunks, expected %d", test.gap, got, test.hunks)
+		}
+	}
+}
+
+func TestUnified(t *testing.T) {
+	a := "unit A;\ninterface\nvar\n  X: Integer;\nimplementation\nend.\n"
+	b := "unit A;\ninterface\nvar\n  Y: Integer;\nimplementation\nend.\n"
+	exp := `--- a/A.pas
++++ b/A.pas
+@@ -1,6 +1,6 @@
+ unit A;
+ interface
+ var
+-  X: Integer;
++  Y: Integer;
+ implementation
+ end.
+`
+	if got := Unified("a/A.pas", "b/A.pas", []byte(a), []byte(b)); got != exp {
+		t.Errorf("got\n%s\nexpected\n%s", got, exp)
+	}
+}
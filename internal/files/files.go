@@ -0,0 +1,273 @@
+// Package files implements atomic file updates with backups.
+package files
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Change is the new content for a file. When From is set the file is
+// renamed from From to Filename.
+type Change struct {
+	Filename string
+	Data     []byte
+	From     string
+}
+
+// WriteAtomic replaces the content of filename by writing a temporary
+// file in the same directory and renaming it over the original. The
+// original file mode is preserved.
+func WriteAtomic(filename string, data []byte) error {
+	return Apply([]Change{{Filename: filename, Data: data}})
+}
+
+// Apply writes all changes or, when one of them fails, none of them.
+// Every change is first written to a temporary file; only when all of
+// them succeed are the originals moved aside and the temporary files
+// renamed over them. When a rename fails, the files replaced so far are
+// put back.
+func Apply(changes []Change) error {
+	temps := make([]string, 0, len(changes))
+	cleanup := func() {
+		for _, temp := range temps {
+			if temp != "" {
+				os.Remove(temp)
+			}
+		}
+	}
+
+	for _, change := range changes {
+		if change.From != "" && !same(change.From, change.Filename) {
+			if _, err := os.Stat(change.Filename); err == nil {
+				cleanup()
+				return fmt.Errorf("%s: cannot rename %s, file already exists", change.Filename, change.From)
+			}
+		}
+		temp, err := writeTemp(change.modeFrom(), change.Filename, change.Data)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		temps = append(temps, temp)
+	}
+
+	// asides are the moved originals, empty for new files
+	asides := make([]string, 0, len(changes))
+	rollback := func() {
+		for i := len(asides) - 1; i >= 0; i-- {
+			os.Remove(changes[i].Filename)
+			if asides[i] != "" {
+				os.Rename(asides[i], changes[i].Filename)
+			}
+		}
+		cleanup()
+	}
+
+	for i, change := range changes {
+		aside, err := moveAside(change.Filename)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("%s: %v, no files written", change.Filename, err)
+		}
+		asides = append(asides, aside)
+		if err := os.Rename(temps[i], change.Filename); err != nil {
+			rollback()
+			return fmt.Errorf("%s: %v, no files written", change.Filename, err)
+		}
+		temps[i] = ""
+	}
+
+	var errs []string
+	for i, change := range changes {
+		if asides[i] != "" {
+			if err := os.Remove(asides[i]); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		if change.From != "" && !same(change.From, change.Filename) {
+			if err := os.Remove(change.From); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("changes written, cleaning up failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// moveAside renames filename to a new name in the same directory and
+// returns it, or returns "" when filename does not exist.
+func moveAside(filename string) (string, error) {
+	if _, err := os.Lstat(filename); os.IsNotExist(err) {
+		return "", nil
+	}
+	file, err := ioutil.TempFile(filepath.Dir(filename), "~"+filepath.Base(filename)+".orig.")
+	if err != nil {
+		return "", err
+	}
+	aside := file.Name()
+	file.Close()
+	if err := os.Rename(filename, aside); err != nil {
+		os.Remove(aside)
+		return "", err
+	}
+	return aside, nil
+}
+
+// modeFrom returns the file whose mode the result should have.
+func (change *Change) modeFrom() string {
+	if change.From != "" {
+		return change.From
+	}
+	return change.Filename
+}
+
+// same reports whether a and b name the same file, which happens with
+// case-only renames on case-insensitive file systems.
+func same(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ia, erra := os.Stat(a)
+	ib, errb := os.Stat(b)
+	return erra == nil && errb == nil && os.SameFile(ia, ib)
+}
+
+func writeTemp(modefile, filename string, data []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(modefile); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), "~"+filepath.Base(filename)+".")
+	if err != nil {
+		return "", err
+	}
+	temp := file.Name()
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(temp, mode)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", fmt.Errorf("%s: %v", filename, err)
+	}
+	return temp, nil
+}
+
+// manifest lists the backed up files, one "backupname<TAB>path" per line.
+// Files that did not exist before are listed with the backup name "-".
+const manifest = "MANIFEST"
+
+// created marks files in the manifest that Restore removes.
+const created = "-"
+
+// Backup copies the current content of filenames into dir, which must
+// not contain an earlier backup. Files that do not exist yet are recorded
+// as created. Restore undoes the changes.
+func Backup(dir string, filenames []string) error {
+	if _, err := os.Stat(filepath.Join(dir, manifest)); err == nil {
+		return fmt.Errorf("%s already contains a backup", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var list strings.Builder
+	for i, filename := range filenames {
+		abs, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(abs)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(&list, "%s\t%s\n", created, abs)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%04d-%s", i, filepath.Base(abs))
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "%s\t%s\n", name, abs)
+	}
+
+	return WriteAtomic(filepath.Join(dir, manifest), []byte(list.String()))
+}
+
+// Restore writes the files saved by Backup in dir back to their original
+// location, removes files created since and returns the restored names.
+func Restore(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, manifest))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var changes []Change
+	var filenames, remove []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			return nil, fmt.Errorf("%s: invalid manifest line %q", dir, line)
+		}
+		name, filename := line[:tab], line[tab+1:]
+		if name == created {
+			remove = append(remove, filename)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, Change{Filename: filename, Data: data})
+		filenames = append(filenames, filename)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// remove created files first, a case-only rename may refer to the
+	// same file as the restored original
+	for _, filename := range remove {
+		if isRestored(filename, filenames) {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return filenames, Apply(changes)
+}
+
+func isRestored(filename string, restored []string) bool {
+	for _, other := range restored {
+		if same(filename, other) {
+			return true
+		}
+	}
+	return false
+}
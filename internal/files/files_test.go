@@ -0,0 +1,150 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func write(t *testing.T, filename, data string, mode os.FileMode) {
+	if err := ioutil.WriteFile(filename, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filename, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expect(t *testing.T, filename, exp string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Errorf("%s: %v", filepath.Base(filename), err)
+		return
+	}
+	if string(data) != exp {
+		t.Errorf("%s: got %q, expected %q", filepath.Base(filename), data, exp)
+	}
+}
+
+// expectClean checks that no temporary files are left in dir.
+func expectClean(t *testing.T, dir string) {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "~") {
+			t.Errorf("temporary file %s left", info.Name())
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	dir := tempDir(t)
+	a, b, c := filepath.Join(dir, "A.pas"), filepath.Join(dir, "B.pas"), filepath.Join(dir, "C.pas")
+	write(t, a, "unit A;", 0755)
+	write(t, b, "unit B;", 0644)
+
+	err := Apply([]Change{
+		{Filename: a, Data: []byte("unit A2;")},
+		{Filename: c, Data: []byte("unit C;"), From: b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, a, "unit A2;")
+	expect(t, c, "unit C;")
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("B.pas was not removed: %v", err)
+	}
+	if info, err := os.Stat(a); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("A.pas mode not preserved: %v %v", info.Mode(), err)
+	}
+	expectClean(t, dir)
+}
+
+func TestApplyNoneWritten(t *testing.T) {
+	dir := tempDir(t)
+	a, b := filepath.Join(dir, "A.pas"), filepath.Join(dir, "B.pas")
+	write(t, a, "unit A;", 0644)
+	write(t, b, "unit B;", 0644)
+
+	// the target of the second change is a directory, it cannot be
+	// replaced after A.pas has been
+	sub := filepath.Join(dir, "Sub")
+	if err := os.MkdirAll(filepath.Join(sub, "Inner"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := Apply([]Change{
+		{Filename: a, Data: []byte("unit A2;")},
+		{Filename: sub, Data: []byte("unit Sub;")},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	expect(t, a, "unit A;")
+	if info, err := os.Stat(sub); err != nil || !info.IsDir() {
+		t.Errorf("Sub was not restored: %v", err)
+	}
+	expectClean(t, dir)
+
+	// a rename onto an existing file is refused before writing
+	err = Apply([]Change{
+		{Filename: a, Data: []byte("unit A2;")},
+		{Filename: a, Data: []byte("unit B2;"), From: b},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	expect(t, a, "unit A;")
+	expect(t, b, "unit B;")
+	expectClean(t, dir)
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := tempDir(t)
+	backup := filepath.Join(dir, "backup")
+	a, b := filepath.Join(dir, "A.pas"), filepath.Join(dir, "B.pas")
+	write(t, a, "unit A;", 0644)
+
+	if err := Backup(backup, []string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Backup(backup, []string{a}); err == nil {
+		t.Error("expected error for a second backup into the same directory")
+	}
+
+	err := Apply([]Change{
+		{Filename: a, Data: []byte("unit A2;")},
+		{Filename: b, Data: []byte("unit B;")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := Restore(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || filepath.Base(restored[0]) != "A.pas" {
+		t.Errorf("restored %v, expected A.pas", restored)
+	}
+	expect(t, a, "unit A;")
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("created B.pas was not removed: %v", err)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"strings"
 
 	"github.com/raintreeinc/delphi/cmd/regex"
+	"github.com/raintreeinc/delphi/cmd/rewrite"
 	"github.com/raintreeinc/delphi/cmd/test"
 	"github.com/raintreeinc/delphi/cmd/tokenize"
 	"github.com/raintreeinc/delphi/cmd/uses"
+	"github.com/raintreeinc/delphi/cmd/watch"
 	"github.com/raintreeinc/delphi/internal/cli"
 )
 
@@ -77,8 +79,10 @@ func Help(args []string) {
 func main() {
 	Commands = []Command{
 		{"test", test.ShortDesc, test.Main, test.Help},
+		{"watch", watch.ShortDesc, watch.Main, watch.Help},
 		{"uses", uses.ShortDesc, uses.Main, uses.Help},
 		{"regex", regex.ShortDesc, regex.Main, regex.Help},
+		{"rewrite", rewrite.ShortDesc, rewrite.Main, rewrite.Help},
 		{},
 		{"tokenize", tokenize.ShortDesc, tokenize.Main, tokenize.Help},
 		{"help", "print help about a command", CommandHelp, HelpHelp},
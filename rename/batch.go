@@ -0,0 +1,290 @@
+// Package rename renames and moves Delphi declarations and units across
+// a code base.
+//
+// Identifiers are resolved to their declarations, hence only references
+// to the declaration in the named unit are renamed. Edits are collected
+// for each configuration of defines and applied at once:
+//
+//	batch, err := rename.LoadBatchFile("rename.toml")
+//	...
+//	sources := rename.NewSources()
+//	sources.Add("src/Main.dpr")
+//	prog, _ := sources.Load(defines)
+//
+//	edits, renames := make(rename.Edits), make(rename.Renames)
+//	errs := batch.Collect(prog, edits, renames)
+//	for _, filename := range edits.Files() {
+//		change, err := rename.Process(filename, edits[filename])
+//		...
+//	}
+package rename
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/raintreeinc/delphi/ast"
+	"github.com/raintreeinc/delphi/resolve"
+)
+
+// BatchRename describes the renames and moves of a batch file, see
+// cmd/drename/example/rename.toml.
+type BatchRename struct {
+	Unit       map[string]Mapping // declarations to rename by unit
+	UnitRename Mapping            `toml:"unitrename"` // units to rename
+	Move       map[string]Mapping // declarations to move by unit, to the target unit
+
+	// Unresolved reports the unresolved identifiers named like a
+	// renamed declaration, they may be references that are not renamed.
+	Unresolved bool `toml:"-"`
+}
+
+// Mapping maps canonical names to their replacement.
+type Mapping map[string]string
+
+// LoadBatchFile reads a TOML batch file.
+func LoadBatchFile(file string) (*BatchRename, error) {
+	m := &BatchRename{}
+	_, err := toml.DecodeFile(file, m)
+	if err != nil {
+		return nil, err
+	}
+
+	m.canonicalize()
+	return m, nil
+}
+
+// CheckDuplicates reports renames to the same name and moves combined
+// with renames.
+func (batch *BatchRename) CheckDuplicates() []error {
+	dups := []error{}
+	duplicate := map[string]bool{}
+	for unit, mapping := range batch.Unit {
+		for _, name := range mapping {
+			cname := strings.ToLower(name)
+			if duplicate[cname] {
+				dups = append(dups, errors.New(fmt.Sprintf("%s: %s", unit, name)))
+			}
+			duplicate[cname] = true
+		}
+	}
+
+	units := map[string]bool{}
+	for unit, name := range batch.UnitRename {
+		cname := Canonical(name)
+		if units[cname] {
+			dups = append(dups, fmt.Errorf("unitrename %s: %s", unit, name))
+		}
+		units[cname] = true
+	}
+
+	if len(batch.Move) > 0 && (len(batch.Unit) > 0 || len(batch.UnitRename) > 0) {
+		dups = append(dups, errors.New("moves cannot be combined with renames in a single batch"))
+	}
+
+	return dups
+}
+
+// Converts all source identifiers to Canonical form
+func (batch *BatchRename) canonicalize() {
+	units := make(map[string]Mapping, len(batch.Unit))
+	for unit, mapping := range batch.Unit {
+		cmapping := make(Mapping, len(mapping))
+		for ident, repl := range mapping {
+			cmapping[Canonical(ident)] = repl
+		}
+		units[Canonical(unit)] = cmapping
+	}
+	batch.Unit = units
+
+	moves := make(map[string]Mapping, len(batch.Move))
+	for unit, mapping := range batch.Move {
+		cmapping := make(Mapping, len(mapping))
+		for ident, target := range mapping {
+			cmapping[Canonical(ident)] = target
+		}
+		moves[Canonical(unit)] = cmapping
+	}
+	batch.Move = moves
+
+	unitrename := make(Mapping, len(batch.UnitRename))
+	for unit, repl := range batch.UnitRename {
+		unitrename[Canonical(unit)] = repl
+	}
+	batch.UnitRename = unitrename
+}
+
+// Names returns the canonical names of the renamed and moved
+// declarations and units, members without their class.
+func (batch *BatchRename) Names() map[string]bool {
+	names := make(map[string]bool)
+	for _, mapping := range batch.Unit {
+		for ident := range mapping {
+			names[ident[strings.LastIndex(ident, ".")+1:]] = true
+		}
+	}
+	for _, mapping := range batch.Move {
+		for ident := range mapping {
+			names[ident] = true
+		}
+	}
+	for unit := range batch.UnitRename {
+		names[unit] = true
+	}
+	return names
+}
+
+// Collect adds edits for every identifier in prog that refers to
+// a renamed declaration or unit. Files of renamed units are added
+// to renames.
+func (batch *BatchRename) Collect(prog *resolve.Program, edits Edits, renames Renames) []error {
+	var errs []error
+
+	type target struct{ name, repl string }
+	targets := make(map[*ast.Object]target)
+	names := make(map[string]bool)
+	for unitname, mapping := range batch.Unit {
+		unit := prog.Lookup(unitname)
+		if unit == nil || !unit.Found() {
+			errs = append(errs, fmt.Errorf("unit %s not found", unitname))
+			continue
+		}
+		for ident, repl := range mapping {
+			obj := Declaration(unit, ident)
+			if obj == nil {
+				errs = append(errs, fmt.Errorf("%s: %s is not declared", unit.Name, ident))
+				continue
+			}
+			targets[obj] = target{unit.Name + "." + obj.Name, repl}
+			names[Canonical(obj.Name)] = true
+		}
+	}
+
+	units := make(map[*resolve.Unit]string)
+	for unitname, repl := range batch.UnitRename {
+		unit := prog.Lookup(unitname)
+		if unit == nil || !unit.Found() {
+			errs = append(errs, fmt.Errorf("unit %s not found", unitname))
+			continue
+		}
+		if strings.Contains(unit.Name, ".") || strings.Contains(repl, ".") {
+			errs = append(errs, fmt.Errorf("unit %s: renaming dotted unit names is not supported", unit.Name))
+			continue
+		}
+		if existing := prog.Lookup(repl); existing != nil && existing != unit && existing.Found() {
+			errs = append(errs, fmt.Errorf("unit %s: %s already exists", unit.Name, repl))
+			continue
+		}
+
+		units[unit] = repl
+		targets[unit.Object] = target{"unit " + unit.Name, repl}
+		names[Canonical(unit.Name)] = true
+
+		for _, filename := range UnitFiles(unit.Path) {
+			dir, name := filepath.Split(filename)
+			renames[filename] = filepath.Join(dir, repl+filepath.Ext(name))
+		}
+	}
+
+	for _, unit := range prog.Order {
+		for _, ident := range unit.Idents {
+			target, ok := targets[ident.Obj]
+			if !ok {
+				continue
+			}
+			pos := prog.Fset.Position(ident.NamePos)
+			edits.Add(pos.Filename, Edit{
+				Offset: pos.Offset,
+				Length: len(ident.Name),
+				Text:   target.repl,
+				Target: target.name,
+			})
+		}
+		for _, path := range unit.Paths {
+			repl, ok := units[path.Unit]
+			if !ok {
+				continue
+			}
+			pos := prog.Fset.Position(path.LitPos)
+			edits.Add(pos.Filename, Edit{
+				Offset: pos.Offset,
+				Length: len(path.Lit),
+				Text:   "'" + renamePath(path.Path, repl) + "'",
+				Target: "path of unit " + path.Unit.Name,
+			})
+		}
+		if batch.Unresolved {
+			for _, ident := range unit.Unresolved {
+				if names[Canonical(ident.Name)] {
+					errs = append(errs, fmt.Errorf("%s: unresolved %s not renamed", prog.Fset.Position(ident.NamePos), ident.Name))
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// UnitFiles returns the unit source file and the form file (.dfm) next
+// to it, if there is one.
+func UnitFiles(filename string) []string {
+	list := []string{filename}
+
+	dir, name := filepath.Split(filename)
+	base := strings.ToLower(name[:len(name)-len(filepath.Ext(name))])
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return list
+	}
+	for _, info := range infos {
+		name := info.Name()
+		ext := filepath.Ext(name)
+		if strings.EqualFold(ext, ".dfm") && strings.ToLower(name[:len(name)-len(ext)]) == base {
+			list = append(list, filepath.Join(dir, name))
+		}
+	}
+	return list
+}
+
+// renamePath replaces the file name in a uses clause path, keeping the
+// directory, separators and extension as written.
+func renamePath(path, unitname string) string {
+	slash := strings.LastIndexAny(path, `/\`)
+	dir, name := path[:slash+1], path[slash+1:]
+	return dir + unitname + filepath.Ext(name)
+}
+
+// Declaration finds the declaration of name in unit. Members are
+// specified with a dotted name, e.g. TClass.Method.
+func Declaration(unit *resolve.Unit, name string) *ast.Object {
+	path := strings.Split(name, ".")
+
+	var obj *ast.Object
+	for _, scope := range []*ast.Scope{unit.Interface, unit.Implementation} {
+		if scope == nil {
+			continue
+		}
+		if obj = scope.Lookup(path[0]); obj != nil {
+			break
+		}
+	}
+
+	for _, member := range path[1:] {
+		if obj == nil {
+			return nil
+		}
+		members, ok := obj.Data.(*ast.Scope)
+		if !ok {
+			return nil
+		}
+		obj = members.Lookup(member)
+	}
+	return obj
+}
+
+// Canonical returns the case insensitive form of name.
+func Canonical(name string) string { return strings.ToLower(name) }
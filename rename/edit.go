@@ -0,0 +1,159 @@
+package rename
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/raintreeinc/delphi/internal/files"
+)
+
+// Edit replaces Length bytes at Offset with Text.
+type Edit struct {
+	Offset int
+	Length int
+	Text   string
+	Target string // renamed declaration, e.g. Unit.Name
+}
+
+// Renames maps files to their new name.
+type Renames map[string]string
+
+// Edits collects edits by filename.
+type Edits map[string][]Edit
+
+// Add adds an edit, ignoring duplicates.
+func (edits Edits) Add(filename string, edit Edit) {
+	for _, existing := range edits[filename] {
+		if existing.Offset == edit.Offset && existing.Length == edit.Length && existing.Text == edit.Text {
+			return
+		}
+	}
+	edits[filename] = append(edits[filename], edit)
+}
+
+// Files returns the edited files, each with edits sorted by offset.
+// Insertions are placed before replacements at the same offset.
+func (edits Edits) Files() []string {
+	var files []string
+	for filename, list := range edits {
+		sort.SliceStable(list, func(i, k int) bool {
+			if list[i].Offset != list[k].Offset {
+				return list[i].Offset < list[k].Offset
+			}
+			return list[i].Length < list[k].Length
+		})
+		files = append(files, filename)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Summary describes the number of renamed references per declaration,
+// e.g. "Unit.Name -> NewName: 3 references in 2 files".
+func (edits Edits) Summary() []string {
+	type count struct{ refs, files int }
+	counts := make(map[string]*count)
+	for _, list := range edits {
+		seen := make(map[string]bool)
+		for _, edit := range list {
+			if edit.Target == "" {
+				continue
+			}
+			key := edit.Target + " -> " + edit.Text
+			c, ok := counts[key]
+			if !ok {
+				c = &count{}
+				counts[key] = c
+			}
+			c.refs++
+			if !seen[key] {
+				seen[key] = true
+				c.files++
+			}
+		}
+	}
+
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		c := counts[key]
+		lines = append(lines, fmt.Sprintf("%s: %d references in %d files", key, c.refs, c.files))
+	}
+	return lines
+}
+
+// Change is the original and renamed content of a file.
+type Change struct {
+	Filename string
+	Rename   string // new file name, if the file is renamed
+	Old, New []byte
+}
+
+// Target returns the file name after the change.
+func (change *Change) Target() string {
+	if change.Rename != "" {
+		return change.Rename
+	}
+	return change.Filename
+}
+
+// Process applies the edits, sorted by offset, to the content of
+// filename.
+func Process(filename string, edits []Edit) (Change, error) {
+	change := Change{Filename: filename}
+
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return change, err
+	}
+	change.Old = src
+
+	var out bytes.Buffer
+	start := 0
+	for _, edit := range edits {
+		if edit.Offset < start || edit.Offset+edit.Length > len(src) {
+			return change, fmt.Errorf("overlapping edit at offset %v", edit.Offset)
+		}
+		out.Write(src[start:edit.Offset])
+		out.WriteString(edit.Text)
+		start = edit.Offset + edit.Length
+	}
+	out.Write(src[start:])
+
+	change.New = out.Bytes()
+	return change, nil
+}
+
+// Apply backs up the original files to the backup directory, unless
+// it is empty, and then writes all changes atomically.
+func Apply(changes []Change, backup string) error {
+	if backup != "" {
+		var filenames []string
+		for _, change := range changes {
+			filenames = append(filenames, change.Filename)
+			if change.Rename != "" {
+				filenames = append(filenames, change.Rename)
+			}
+		}
+		if err := files.Backup(backup, filenames); err != nil {
+			return fmt.Errorf("backup: %v", err)
+		}
+	}
+
+	var list []files.Change
+	for _, change := range changes {
+		if change.Rename != "" {
+			list = append(list, files.Change{Filename: change.Rename, Data: change.New, From: change.Filename})
+		} else {
+			list = append(list, files.Change{Filename: change.Filename, Data: change.New})
+		}
+	}
+	return files.Apply(list)
+}
@@ -0,0 +1,49 @@
+package rename
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "Main.pas")
+	if err := ioutil.WriteFile(filename, []byte("x := lg(y) + lg(z);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	edits := make(Edits)
+	edits.Add(filename, Edit{Offset: 13, Length: 2, Text: "muLog2", Target: "MathUtils.lg"})
+	edits.Add(filename, Edit{Offset: 5, Length: 2, Text: "muLog2", Target: "MathUtils.lg"})
+	edits.Add(filename, Edit{Offset: 5, Length: 2, Text: "muLog2", Target: "MathUtils.lg"})
+
+	if files := edits.Files(); !reflect.DeepEqual(files, []string{filename}) {
+		t.Fatalf("got files %v", files)
+	}
+	change, err := Process(filename, edits[filename])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(change.New) != "x := muLog2(y) + muLog2(z);" {
+		t.Errorf("got %q", change.New)
+	}
+
+	summary := edits.Summary()
+	if !reflect.DeepEqual(summary, []string{"MathUtils.lg -> muLog2: 2 references in 1 files"}) {
+		t.Errorf("got summary %v", summary)
+	}
+
+	edits.Add(filename, Edit{Offset: 6, Length: 2, Text: "overlap"})
+	edits.Files()
+	if _, err := Process(filename, edits[filename]); err == nil {
+		t.Errorf("expected overlapping edit error")
+	}
+}
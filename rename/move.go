@@ -0,0 +1,792 @@
+package rename
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/ast"
+	"github.com/raintreeinc/delphi/resolve"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// CollectMoves adds edits that move top-level declarations, including
+// their implementation and doc comments, to other units. Uses clauses of
+// units that reference moved declarations are updated. It returns a
+// description of each move.
+func (batch *BatchRename) CollectMoves(prog *resolve.Program, edits Edits) ([]string, []error) {
+	if len(batch.Move) == 0 {
+		return nil, nil
+	}
+
+	m := &mover{
+		prog:    prog,
+		edits:   edits,
+		sources: make(map[string][]byte),
+		target:  make(map[*ast.Object]*resolve.Unit),
+		owner:   make(map[*ast.Object]*resolve.Unit),
+		needs:   make(map[*resolve.Unit]map[*resolve.Unit]bool),
+	}
+
+	var unitnames []string
+	for unitname := range batch.Move {
+		unitnames = append(unitnames, unitname)
+	}
+	sort.Strings(unitnames)
+
+	for _, unitname := range unitnames {
+		from := prog.Lookup(unitname)
+		if from == nil || !from.Found() || from.Kind != token.UNIT {
+			m.errorf("unit %s not found", unitname)
+			continue
+		}
+
+		mapping := batch.Move[unitname]
+		var names []string
+		for name := range mapping {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			to := prog.Lookup(mapping[name])
+			if to == nil || !to.Found() || to.Kind != token.UNIT {
+				m.errorf("%s.%s: target unit %s not found", from.Name, name, mapping[name])
+				continue
+			}
+			if to == from {
+				m.errorf("%s.%s: target is the same unit", from.Name, name)
+				continue
+			}
+			m.declaration(from, to, name)
+		}
+	}
+
+	if len(m.target) == 0 {
+		return nil, m.errs
+	}
+
+	m.extract()
+	m.insert()
+	m.references()
+	m.uses()
+
+	var summary []string
+	for obj, to := range m.target {
+		summary = append(summary, m.owner[obj].Name+"."+obj.Name+" -> "+to.Name)
+	}
+	sort.Strings(summary)
+	return summary, m.errs
+}
+
+// mover collects the edits for moving declarations.
+type mover struct {
+	prog    *resolve.Program
+	edits   Edits
+	sources map[string][]byte
+
+	target map[*ast.Object]*resolve.Unit // moved objects and their new unit
+	owner  map[*ast.Object]*resolve.Unit // moved objects and their old unit
+	decls  []*moved
+
+	// needs[unit][used] is true when unit requires used in its
+	// interface uses clause, false for the implementation uses clause
+	needs map[*resolve.Unit]map[*resolve.Unit]bool
+
+	errs []error
+}
+
+// moved is a declaration that is moved to another unit.
+type moved struct {
+	decl *resolve.Decl
+	from *resolve.Unit
+	to   *resolve.Unit
+
+	filename   string
+	start, end int  // source range, including doc comments
+	public     bool // placed in the interface of the target
+	text       string
+}
+
+func (m *mover) errorf(format string, args ...interface{}) {
+	m.errs = append(m.errs, fmt.Errorf(format, args...))
+}
+
+// source returns the content of filename.
+func (m *mover) source(filename string) []byte {
+	if src, ok := m.sources[filename]; ok {
+		return src
+	}
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		m.errorf("%v", err)
+	}
+	m.sources[filename] = src
+	return src
+}
+
+func (m *mover) offset(pos token.Pos) (string, int) {
+	position := m.prog.Fset.Position(pos)
+	return position.Filename, position.Offset
+}
+
+// declaration finds the declarations of name in from to be moved to to.
+func (m *mover) declaration(from, to *resolve.Unit, name string) {
+	obj := from.Interface.Lookup(name)
+	if obj == nil {
+		obj = from.Implementation.Lookup(name)
+	}
+	if obj == nil {
+		m.errorf("%s: %s is not declared", from.Name, name)
+		return
+	}
+	if existing := to.Interface.Lookup(obj.Name); existing != nil {
+		m.errorf("%s.%s: %s already declares %s", from.Name, obj.Name, to.Name, existing.Name)
+		return
+	}
+
+	var decls []*moved
+	public := false
+	for _, decl := range from.Decls {
+		if decl.Class != obj && !declares(decl, obj) {
+			continue
+		}
+		if len(decl.Objs) > 1 {
+			m.errorf("%s.%s: declared together with other names, split the declaration first", from.Name, obj.Name)
+			return
+		}
+		if !decl.Implementation {
+			public = true
+		}
+		decls = append(decls, &moved{decl: decl, from: from, to: to})
+	}
+
+	if len(decls) == 0 {
+		m.errorf("%s.%s: declaration not found, it may be in an include file", from.Name, obj.Name)
+		return
+	}
+	if !public && obj.Kind == ast.ObjFun {
+		m.errorf("%s.%s: routines without an interface declaration cannot be moved", from.Name, obj.Name)
+		return
+	}
+
+	m.target[obj] = to
+	m.owner[obj] = from
+	m.decls = append(m.decls, decls...)
+}
+
+func declares(decl *resolve.Decl, obj *ast.Object) bool {
+	for _, declared := range decl.Objs {
+		if declared == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// isSection reports whether tok starts a declaration section.
+func isSection(tok token.Token) bool {
+	switch tok {
+	case token.TYPE, token.CONST, token.RESOURCESTRING, token.VAR, token.THREADVAR:
+		return true
+	}
+	return false
+}
+
+// extract removes the moved declarations from their units, including
+// section keywords that are left without declarations.
+func (m *mover) extract() {
+	for _, mv := range m.decls {
+		decl := mv.decl
+
+		filename, pos := m.offset(decl.Pos)
+		_, end := m.offset(decl.End)
+		src := m.source(filename)
+		if src == nil {
+			continue
+		}
+
+		mv.filename = filename
+		mv.start, mv.end = extent(src, pos, end)
+		mv.public = isSection(decl.Keyword) || !decl.Implementation
+
+		text := strings.TrimRight(string(src[mv.start:mv.end]), " \t\r\n")
+		if mv.start != lineStart(src, mv.start) {
+			// declaration shares the line with the section keyword
+			text = "  " + text
+		}
+		mv.text = strings.Replace(text, "\r\n", "\n", -1) + "\n"
+
+		m.edits.Add(filename, Edit{
+			Offset: mv.start,
+			Length: mv.end - mv.start,
+		})
+	}
+
+	// remove section keywords whose declarations all moved
+	for _, unit := range m.units() {
+		sections := make(map[token.Pos]int)
+		for _, decl := range unit.Decls {
+			if isSection(decl.Keyword) {
+				sections[decl.KeywordPos]++
+			}
+		}
+		for _, mv := range m.decls {
+			if mv.from == unit && isSection(mv.decl.Keyword) {
+				sections[mv.decl.KeywordPos]--
+			}
+		}
+
+		for pos, remaining := range sections {
+			if remaining > 0 {
+				continue
+			}
+			filename, offset := m.offset(pos)
+			src := m.source(filename)
+			start, end := offset, offset+len(keyword(src, offset))
+			if blank(src[lineStart(src, start):start]) && blank(src[end:lineEnd(src, end)]) {
+				start, end = lineStart(src, start), lineEnd(src, end)
+			}
+			m.edits.Add(filename, Edit{Offset: start, Length: end - start})
+		}
+	}
+}
+
+// insert adds the moved declarations to their new units.
+func (m *mover) insert() {
+	for _, unit := range m.units() {
+		var public, implementation strings.Builder
+		section := ""
+		for _, mv := range m.decls {
+			if mv.to != unit {
+				continue
+			}
+			if !mv.public {
+				implementation.WriteString(mv.text + "\n")
+				continue
+			}
+
+			if isSection(mv.decl.Keyword) {
+				_, offset := m.offset(mv.decl.KeywordPos)
+				kw := keyword(m.source(mv.filename), offset)
+				if !strings.EqualFold(kw, section) {
+					if section != "" {
+						public.WriteString("\n")
+					}
+					public.WriteString(kw + "\n")
+					section = kw
+				}
+			} else {
+				if section != "" {
+					public.WriteString("\n")
+				}
+				section = ""
+			}
+			public.WriteString(mv.text)
+		}
+
+		if public.Len() > 0 {
+			filename, offset := m.offset(unit.Layout.Implementation)
+			src := m.source(filename)
+			m.edits.Add(filename, Edit{
+				Offset: lineStart(src, offset),
+				Text:   strings.Replace(public.String()+"\n", "\n", newline(src), -1),
+			})
+		}
+		if implementation.Len() > 0 {
+			filename, offset := m.offset(unit.Layout.End)
+			src := m.source(filename)
+			m.edits.Add(filename, Edit{
+				Offset: lineStart(src, offset),
+				Text:   strings.Replace(implementation.String(), "\n", newline(src), -1),
+			})
+		}
+	}
+}
+
+// references finds the units that need the target units in their uses
+// clauses and rewrites qualified references such as OldUnit.Name.
+func (m *mover) references() {
+	public := make(map[*ast.Object]*resolve.Unit)
+	for _, unit := range m.prog.Order {
+		if unit.Kind != token.UNIT || unit.Interface == nil {
+			continue
+		}
+		for _, obj := range unit.Interface.Objects {
+			public[obj] = unit
+		}
+	}
+
+	for _, unit := range m.prog.Order {
+		if !unit.Found() {
+			continue
+		}
+
+		// unresolved names in moved code may come from units whose
+		// source is missing, keep using them
+		for _, ident := range unit.Unresolved {
+			filename, offset := m.offset(ident.NamePos)
+			if mv := m.movedAt(filename, offset); mv != nil {
+				for _, clause := range mv.from.Layout.Clauses {
+					for _, entry := range clause.Entries {
+						if !entry.Unit.Found() {
+							m.need(mv.to, entry.Unit, mv.public)
+						}
+					}
+				}
+			}
+		}
+
+		for i, ident := range unit.Idents {
+			if ident.Obj == nil || ident.Obj.Decl == ident {
+				continue
+			}
+			filename, offset := m.offset(ident.NamePos)
+			if m.inClause(unit, ident.NamePos) {
+				continue
+			}
+			mv := m.movedAt(filename, offset)
+
+			// the unit the code ends up in
+			user, iface := unit, m.inInterface(unit, ident.NamePos)
+			if mv != nil {
+				user, iface = mv.to, mv.public
+			}
+
+			if to, ok := m.target[ident.Obj]; ok {
+				m.need(user, to, iface)
+				if i > 0 {
+					m.requalify(unit, unit.Idents[i-1], ident, to)
+				}
+				continue
+			}
+
+			if mv == nil {
+				continue
+			}
+
+			// references from the moved code
+			switch {
+			case ident.Obj.Kind == ast.ObjMod:
+				if used := m.prog.Lookup(ident.Obj.Name); used != nil && used != user {
+					m.need(user, used, iface)
+				}
+			case public[ident.Obj] != nil:
+				if used := public[ident.Obj]; used != user {
+					m.need(user, used, iface)
+				}
+			case mv.from.Implementation.Lookup(ident.Obj.Name) == ident.Obj:
+				m.errorf("%s: %s is private to %s and not visible after the move",
+					m.prog.Fset.Position(ident.NamePos), ident.Name, mv.from.Name)
+			}
+		}
+	}
+}
+
+// requalify rewrites qual in "qual.ident" to the new unit of ident.
+func (m *mover) requalify(unit *resolve.Unit, qual, ident *ast.Ident, to *resolve.Unit) {
+	from := m.owner[ident.Obj]
+	if qual.Obj != from.Object {
+		return
+	}
+
+	filename, start := m.offset(qual.NamePos)
+	_, end := m.offset(ident.NamePos)
+	src := m.source(filename)
+	between := strings.TrimSpace(string(src[start+len(qual.Name) : end]))
+	if between != "." {
+		return
+	}
+
+	m.edits.Add(filename, Edit{
+		Offset: start,
+		Length: len(qual.Name),
+		Text:   to.Name,
+	})
+}
+
+// need records that unit uses used. Units that refer to moved
+// declarations are recorded even when they declare them after the move.
+func (m *mover) need(unit, used *resolve.Unit, iface bool) {
+	if unit.Kind != token.UNIT {
+		iface = true
+	}
+	needs, ok := m.needs[unit]
+	if !ok {
+		needs = make(map[*resolve.Unit]bool)
+		m.needs[unit] = needs
+	}
+	if used != unit {
+		needs[used] = needs[used] || iface
+	}
+}
+
+// uses adds the needed units to uses clauses and removes the source
+// units when they are no longer referenced.
+func (m *mover) uses() {
+	var units []*resolve.Unit
+	for unit := range m.needs {
+		units = append(units, unit)
+	}
+	sort.Slice(units, func(i, k int) bool { return units[i].Name < units[k].Name })
+
+	for _, unit := range units {
+		var ifaceAdd, implAdd []string
+		remove := make(map[*resolve.Unit]bool)
+
+		for used, iface := range m.needs[unit] {
+			ifaceClause, implClause := m.used(unit, used)
+			switch {
+			case ifaceClause:
+			case iface:
+				ifaceAdd = append(ifaceAdd, used.Name)
+				if implClause {
+					remove[used] = true
+				}
+			case !implClause:
+				implAdd = append(implAdd, used.Name)
+			}
+		}
+
+		for _, from := range m.origins() {
+			if _, needed := m.needs[unit][from]; !needed && from != unit && !m.stillUses(unit, from) {
+				remove[from] = true
+			}
+		}
+
+		sort.Strings(ifaceAdd)
+		sort.Strings(implAdd)
+
+		var iface, impl *resolve.UsesClause
+		for _, clause := range unit.Layout.Clauses {
+			if clause.Implementation {
+				impl = clause
+			} else {
+				iface = clause
+			}
+		}
+
+		m.clause(unit, iface, false, ifaceAdd, remove)
+		if unit.Kind == token.UNIT {
+			m.clause(unit, impl, true, implAdd, remove)
+		}
+
+		// circular references are only allowed through implementation uses
+		for used, iface := range m.needs[unit] {
+			if !iface || used.Name > unit.Name && m.needs[used] != nil {
+				continue
+			}
+			back, _ := m.used(used, unit)
+			if m.needs[used][unit] || back {
+				m.errorf("%s and %s use each other in their interfaces, move more declarations to break the cycle", unit.Name, used.Name)
+			}
+		}
+	}
+}
+
+// used reports whether unit lists used in its interface and
+// implementation uses clauses.
+func (m *mover) used(unit, used *resolve.Unit) (iface, impl bool) {
+	for _, clause := range unit.Layout.Clauses {
+		for _, entry := range clause.Entries {
+			if entry.Unit == used {
+				if clause.Implementation {
+					impl = true
+				} else {
+					iface = true
+				}
+			}
+		}
+	}
+	return iface, impl
+}
+
+// origins returns the units declarations are moved from.
+func (m *mover) origins() []*resolve.Unit {
+	var units []*resolve.Unit
+	for _, mv := range m.decls {
+		units = appendUnit(units, mv.from)
+	}
+	return units
+}
+
+// units returns the units taking part in the move.
+func (m *mover) units() []*resolve.Unit {
+	var units []*resolve.Unit
+	for _, mv := range m.decls {
+		units = appendUnit(units, mv.from)
+		units = appendUnit(units, mv.to)
+	}
+	return units
+}
+
+func appendUnit(list []*resolve.Unit, unit *resolve.Unit) []*resolve.Unit {
+	for _, existing := range list {
+		if existing == unit {
+			return list
+		}
+	}
+	return append(list, unit)
+}
+
+// stillUses reports whether unit references from after the move.
+// Units that could not be fully resolved are assumed to do so.
+func (m *mover) stillUses(unit, from *resolve.Unit) bool {
+	if len(unit.Unresolved) > 0 {
+		return true
+	}
+	for i, ident := range unit.Idents {
+		if ident.Obj == nil || ident.Obj.Decl == ident {
+			continue
+		}
+		filename, offset := m.offset(ident.NamePos)
+		if m.movedAt(filename, offset) != nil || m.inClause(unit, ident.NamePos) {
+			continue
+		}
+		if ident.Obj == from.Object {
+			// qualifiers of moved declarations are rewritten
+			if i+1 < len(unit.Idents) && m.target[unit.Idents[i+1].Obj] != nil {
+				continue
+			}
+			return true
+		}
+		if _, moved := m.target[ident.Obj]; moved {
+			continue
+		}
+		if from.Interface.Lookup(ident.Obj.Name) == ident.Obj {
+			return true
+		}
+	}
+	return false
+}
+
+// clause edits a uses clause, adding and removing units. When clause is
+// nil a new clause is created.
+func (m *mover) clause(unit *resolve.Unit, clause *resolve.UsesClause, impl bool, add []string, remove map[*resolve.Unit]bool) {
+	if clause == nil {
+		if len(add) == 0 {
+			return
+		}
+		pos := unit.Layout.Header
+		if unit.Kind == token.UNIT {
+			pos = unit.Layout.Interface
+			if impl {
+				pos = unit.Layout.Body
+			}
+		}
+		filename, offset := m.offset(pos)
+		nl := newline(m.source(filename))
+		m.edits.Add(filename, Edit{
+			Offset: offset,
+			Text:   nl + nl + "uses" + nl + "  " + strings.Join(add, ","+nl+"  ") + ";",
+		})
+		return
+	}
+
+	entries := clause.Entries
+	if len(entries) == 0 {
+		return
+	}
+	filename, _ := m.offset(clause.Pos)
+	src := m.source(filename)
+	offset := func(pos token.Pos) int {
+		_, offset := m.offset(pos)
+		return offset
+	}
+
+	kept := -1
+	for i, entry := range entries {
+		if !remove[entry.Unit] {
+			kept = i
+			break
+		}
+	}
+
+	if kept < 0 {
+		if len(add) > 0 {
+			start, end := offset(entries[0].Pos), offset(entries[len(entries)-1].End)
+			m.edits.Add(filename, Edit{Offset: start, Length: end - start, Text: strings.Join(add, ", ")})
+			return
+		}
+		start, end := offset(clause.Pos), offset(clause.End)+1
+		if blank(src[lineStart(src, start):start]) && blank(src[end:lineEnd(src, end)]) {
+			start, end = lineStart(src, start), lineEnd(src, end)
+		}
+		m.edits.Add(filename, Edit{Offset: start, Length: end - start})
+		return
+	}
+
+	if kept > 0 {
+		start, end := offset(entries[0].Pos), offset(entries[kept].Pos)
+		m.edits.Add(filename, Edit{Offset: start, Length: end - start})
+	}
+	for i := kept + 1; i < len(entries); i++ {
+		if remove[entries[i].Unit] {
+			start, end := offset(entries[i-1].End), offset(entries[i].End)
+			m.edits.Add(filename, Edit{Offset: start, Length: end - start})
+		}
+	}
+
+	if len(add) > 0 {
+		separator := ", "
+		if len(entries) > 1 {
+			separator = string(src[offset(entries[0].End):offset(entries[1].Pos)])
+		} else if first := offset(entries[0].Pos); blank(src[lineStart(src, first):first]) {
+			// one unit per line
+			separator = "," + newline(src) + string(src[lineStart(src, first):first])
+		}
+		m.edits.Add(filename, Edit{
+			Offset: offset(entries[len(entries)-1].End),
+			Text:   separator + strings.Join(add, separator),
+		})
+	}
+}
+
+// movedAt returns the moved declaration containing offset.
+func (m *mover) movedAt(filename string, offset int) *moved {
+	for _, mv := range m.decls {
+		if mv.filename == filename && mv.start <= offset && offset < mv.end {
+			return mv
+		}
+	}
+	return nil
+}
+
+// inClause reports whether pos is inside a uses clause of unit.
+func (m *mover) inClause(unit *resolve.Unit, pos token.Pos) bool {
+	for _, clause := range unit.Layout.Clauses {
+		if clause.Pos <= pos && pos <= clause.End {
+			return true
+		}
+	}
+	return false
+}
+
+// inInterface reports whether pos is in the interface section of unit.
+func (m *mover) inInterface(unit *resolve.Unit, pos token.Pos) bool {
+	if unit.Kind != token.UNIT || !unit.Layout.Implementation.IsValid() {
+		return true
+	}
+	return m.prog.Fset.File(pos) == m.prog.Fset.File(unit.Layout.Implementation) && pos < unit.Layout.Implementation
+}
+
+// extent returns the range of a declaration at src[pos:end] extended by
+// the preceding doc comment and the rest of the last line.
+func extent(src []byte, pos, end int) (int, int) {
+	start := pos
+	if blank(src[lineStart(src, pos):pos]) {
+		start = lineStart(src, pos)
+		for start > 0 {
+			prev := lineStart(src, start-1)
+			line := strings.TrimSpace(string(src[prev:start]))
+			if !isComment(line) {
+				if strings.HasSuffix(line, "}") || strings.HasSuffix(line, "*)") {
+					// multi-line comment ending on this line
+					if open := commentStart(src, prev); open >= 0 {
+						start = open
+						continue
+					}
+				}
+				break
+			}
+			start = prev
+		}
+	}
+
+	if rest := strings.TrimSpace(string(src[end:lineEnd(src, end)])); rest == "" || isComment(rest) {
+		end = lineEnd(src, end)
+		// avoid leaving a blank line after a blank line or a section keyword
+		if start > 0 && start == lineStart(src, start) {
+			prev := strings.TrimSpace(string(src[lineStart(src, start-1):start]))
+			if prev == "" || token.Lookup(prev).IsKeyword() {
+				if next := lineEnd(src, end); next > end && blank(src[end:next]) {
+					end = next
+				}
+			}
+		}
+	}
+	return start, end
+}
+
+// newline returns the line ending used in src.
+func newline(src []byte) string {
+	if bytes.Contains(src, []byte("\r\n")) {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// commentStart finds the line starting a multi-line comment that ends on
+// the line at offset, it returns -1 when there is none.
+func commentStart(src []byte, offset int) int {
+	line := strings.TrimSpace(string(src[offset:lineEnd(src, offset)]))
+	open, close := "{", "}"
+	if strings.HasSuffix(line, "*)") {
+		open, close = "(*", "*)"
+	}
+	if strings.Contains(line, open) || strings.Contains(line[:len(line)-len(close)], close) {
+		return -1
+	}
+
+	for start := offset; start > 0; {
+		start = lineStart(src, start-1)
+		line := strings.TrimSpace(string(src[start:lineEnd(src, start)]))
+		if strings.Contains(line, close) {
+			return -1
+		}
+		if strings.HasPrefix(line, open) && !strings.HasPrefix(line, "{$") {
+			return start
+		}
+		if strings.Contains(line, open) {
+			return -1
+		}
+	}
+	return -1
+}
+
+// isComment reports whether a trimmed line consists of a comment.
+func isComment(line string) bool {
+	switch {
+	case strings.HasPrefix(line, "//"):
+		return true
+	case strings.HasPrefix(line, "{$"):
+		return false
+	case strings.HasPrefix(line, "{"):
+		return strings.HasSuffix(line, "}") && strings.Count(line, "}") == 1
+	case strings.HasPrefix(line, "(*"):
+		return strings.HasSuffix(line, "*)") && strings.Count(line, "*)") == 1
+	}
+	return false
+}
+
+// keyword returns the word starting at offset.
+func keyword(src []byte, offset int) string {
+	end := offset
+	for end < len(src) && isLetter(src[end]) {
+		end++
+	}
+	return string(src[offset:end])
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_'
+}
+
+// lineStart returns the offset of the line containing offset.
+func lineStart(src []byte, offset int) int {
+	return bytes.LastIndexByte(src[:offset], '\n') + 1
+}
+
+// lineEnd returns the offset after the line ending following offset.
+func lineEnd(src []byte, offset int) int {
+	if p := bytes.IndexByte(src[offset:], '\n'); p >= 0 {
+		return offset + p + 1
+	}
+	return len(src)
+}
+
+func blank(text []byte) bool {
+	return len(bytes.TrimSpace(text)) == 0
+}
@@ -0,0 +1,441 @@
+package rename
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var mathUtils = `unit MathUtils;
+
+interface
+
+// lg returns the binary logarithm.
+function lg(X: Double): Double;
+function sn(X: Double): Double;
+
+implementation
+
+function lg(X: Double): Double;
+begin
+  Result := Ln(X) / Ln(2);
+end;
+
+function sn(X: Double): Double;
+begin
+  Result := Sin(X);
+end;
+
+end.
+`
+
+var logarithms = `unit Logarithms;
+
+interface
+
+implementation
+
+end.
+`
+
+var mainUnit = `unit Main;
+
+interface
+
+uses
+  MathUtils;
+
+procedure Run;
+
+implementation
+
+procedure Run;
+var
+  lg: Double;
+begin
+  lg := MathUtils.lg(8);
+  lg := lg + sn(1);
+end;
+
+end.
+`
+
+var useLg = `unit UseLg;
+
+interface
+
+implementation
+
+uses
+  MathUtils;
+
+procedure Log;
+begin
+  lg(2);
+end;
+
+end.
+`
+
+// result is the outcome of a batch over a set of sources.
+type result struct {
+	files   map[string]string // new content by base name of the target
+	renames map[string]string // renamed files by base name
+	moves   []string
+	errs    []error
+	skipped []error // references in code inactive for every configuration
+}
+
+// run writes sources to a temporary directory and applies batch, a
+// TOML batch file, to them for every configuration of their conditional
+// symbols without writing the changes.
+func run(t *testing.T, sources map[string]string, batchfile string) *result {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	all := NewSources()
+	var names []string
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(sources[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		all.Add(filename)
+	}
+
+	batchpath := filepath.Join(dir, "rename.toml")
+	if err := ioutil.WriteFile(batchpath, []byte(batchfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	batch, err := LoadBatchFile(batchpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := &result{files: map[string]string{}, renames: map[string]string{}}
+	edits, renames := make(Edits), make(Renames)
+	configs := Configurations(all.Conditionals())
+	for i, config := range configs {
+		prog, errs := all.Load(config)
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		res.errs = append(res.errs, batch.Collect(prog, edits, renames)...)
+		if i == 0 {
+			moves, errs := batch.CollectMoves(prog, edits)
+			res.moves = moves
+			res.errs = append(res.errs, errs...)
+		}
+	}
+	res.skipped = all.Inactive(configs, batch.Names())
+
+	edits.Files() // sorts the edits
+	for _, filename := range all.Files {
+		change, err := Process(filename, edits[filename])
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(filename), err)
+		}
+		change.Rename = renames[filename]
+		if change.Rename != "" {
+			res.renames[filepath.Base(filename)] = filepath.Base(change.Rename)
+		}
+		res.files[filepath.Base(change.Target())] = string(change.New)
+	}
+	return res
+}
+
+func (res *result) expect(t *testing.T, name, exp string) {
+	t.Helper()
+	if got := res.files[name]; got != exp {
+		t.Errorf("%s:\ngot\n%s\nexpected\n%s", name, got, exp)
+	}
+}
+
+func TestLoadBatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	batchpath := filepath.Join(dir, "rename.toml")
+	err = ioutil.WriteFile(batchpath, []byte(`
+[unit.MathUtils]
+LG = "muLog2"
+
+[unitrename]
+MathUtils = "MathLib"
+Main = "MathLib"
+
+[move.MathUtils]
+Sn = "Trigonometry"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := LoadBatchFile(batchpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batch.Unit, map[string]Mapping{"mathutils": {"lg": "muLog2"}}) {
+		t.Errorf("got unit %v", batch.Unit)
+	}
+	if !reflect.DeepEqual(batch.UnitRename, Mapping{"mathutils": "MathLib", "main": "MathLib"}) {
+		t.Errorf("got unitrename %v", batch.UnitRename)
+	}
+	if !reflect.DeepEqual(batch.Move, map[string]Mapping{"mathutils": {"sn": "Trigonometry"}}) {
+		t.Errorf("got move %v", batch.Move)
+	}
+
+	// MathLib twice and moves combined with renames
+	if errs := batch.CheckDuplicates(); len(errs) != 2 {
+		t.Errorf("got %v", errs)
+	}
+}
+
+func TestRenameResolved(t *testing.T) {
+	res := run(t, map[string]string{
+		"MathUtils.pas": mathUtils,
+		"Main.pas":      mainUnit,
+	}, `
+[unit.MathUtils]
+lg = "muLog2"
+`)
+	if len(res.errs) > 0 {
+		t.Fatal(res.errs)
+	}
+
+	// the local variable lg is not renamed
+	res.expect(t, "Main.pas", `unit Main;
+
+interface
+
+uses
+  MathUtils;
+
+procedure Run;
+
+implementation
+
+procedure Run;
+var
+  lg: Double;
+begin
+  lg := MathUtils.muLog2(8);
+  lg := lg + sn(1);
+end;
+
+end.
+`)
+}
+
+func TestConditionalBranches(t *testing.T) {
+	res := run(t, map[string]string{
+		"Main.pas": `unit Main;
+
+interface
+
+type
+  {$IFDEF EXTENDED}
+  state = record X, Y: Extended; end;
+  {$ELSE}
+  state = record X, Y, Z: Extended; end;
+  {$ENDIF}
+
+var
+  {$IF Defined(EXTENDED) and Defined(DEBUG)}
+  s: state;
+  {$IFEND}
+  {$IFOPT R+}
+  {$ELSE}
+  t: state;
+  {$ENDIF}
+
+implementation
+
+end.
+`,
+	}, `
+[unit.Main]
+state = "TGlobalState"
+`)
+	if len(res.errs) > 0 {
+		t.Fatal(res.errs)
+	}
+
+	res.expect(t, "Main.pas", `unit Main;
+
+interface
+
+type
+  {$IFDEF EXTENDED}
+  TGlobalState = record X, Y: Extended; end;
+  {$ELSE}
+  TGlobalState = record X, Y, Z: Extended; end;
+  {$ENDIF}
+
+var
+  {$IF Defined(EXTENDED) and Defined(DEBUG)}
+  s: TGlobalState;
+  {$IFEND}
+  {$IFOPT R+}
+  {$ELSE}
+  t: state;
+  {$ENDIF}
+
+implementation
+
+end.
+`)
+
+	// {$IFOPT} is assumed to be true, its {$ELSE} branch is never seen
+	if len(res.skipped) != 1 || !strings.Contains(res.skipped[0].Error(), "Main.pas:18:6: state") {
+		t.Errorf("got skipped %v", res.skipped)
+	}
+}
+
+func TestUnitRename(t *testing.T) {
+	res := run(t, map[string]string{
+		"MathUtils.pas": mathUtils,
+		"Main.pas":      mainUnit,
+	}, `
+[unitrename]
+MathUtils = "MathLib"
+`)
+	if len(res.errs) > 0 {
+		t.Fatal(res.errs)
+	}
+
+	if !reflect.DeepEqual(res.renames, map[string]string{"MathUtils.pas": "MathLib.pas"}) {
+		t.Errorf("got renames %v", res.renames)
+	}
+	if got := res.files["MathLib.pas"]; !strings.HasPrefix(got, "unit MathLib;") {
+		t.Errorf("MathLib.pas header not renamed:\n%s", got)
+	}
+	res.expect(t, "Main.pas", `unit Main;
+
+interface
+
+uses
+  MathLib;
+
+procedure Run;
+
+implementation
+
+procedure Run;
+var
+  lg: Double;
+begin
+  lg := MathLib.lg(8);
+  lg := lg + sn(1);
+end;
+
+end.
+`)
+}
+
+func TestMove(t *testing.T) {
+	res := run(t, map[string]string{
+		"MathUtils.pas":  mathUtils,
+		"Logarithms.pas": logarithms,
+		"Main.pas":       mainUnit,
+		"UseLg.pas":      useLg,
+	}, `
+[move.MathUtils]
+lg = "Logarithms"
+`)
+	if len(res.errs) > 0 {
+		t.Fatal(res.errs)
+	}
+	if !reflect.DeepEqual(res.moves, []string{"MathUtils.lg -> Logarithms"}) {
+		t.Errorf("got moves %v", res.moves)
+	}
+
+	res.expect(t, "MathUtils.pas", `unit MathUtils;
+
+interface
+
+function sn(X: Double): Double;
+
+implementation
+
+function sn(X: Double): Double;
+begin
+  Result := Sin(X);
+end;
+
+end.
+`)
+	res.expect(t, "Logarithms.pas", `unit Logarithms;
+
+interface
+
+// lg returns the binary logarithm.
+function lg(X: Double): Double;
+
+implementation
+
+function lg(X: Double): Double;
+begin
+  Result := Ln(X) / Ln(2);
+end;
+
+end.
+`)
+	// Main still uses sn from MathUtils, lg is only used in the
+	// implementation
+	res.expect(t, "Main.pas", `unit Main;
+
+interface
+
+uses
+  MathUtils;
+
+procedure Run;
+
+implementation
+
+uses
+  Logarithms;
+
+procedure Run;
+var
+  lg: Double;
+begin
+  lg := Logarithms.lg(8);
+  lg := lg + sn(1);
+end;
+
+end.
+`)
+	// UseLg no longer needs MathUtils
+	res.expect(t, "UseLg.pas", `unit UseLg;
+
+interface
+
+implementation
+
+uses
+  Logarithms;
+
+procedure Log;
+begin
+  lg(2);
+end;
+
+end.
+`)
+}
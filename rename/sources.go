@@ -0,0 +1,233 @@
+package rename
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/internal/walk"
+	"github.com/raintreeinc/delphi/resolve"
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// IsSourceFile reports whether file takes part in renaming, packages
+// are included for their contains clause.
+func IsSourceFile(file string) bool {
+	return walk.IsDelphiFile(file) || strings.EqualFold(filepath.Ext(file), ".dpk")
+}
+
+// Sources contains the files that participate in renaming.
+type Sources struct {
+	Files    []string
+	Units    map[string]string // canonical unit name to path
+	Includes map[string]string // lower-case file name to path
+}
+
+// NewSources returns an empty set of sources.
+func NewSources() *Sources {
+	return &Sources{
+		Units:    make(map[string]string),
+		Includes: make(map[string]string),
+	}
+}
+
+// Add adds a unit, program, package or include file.
+func (sources *Sources) Add(filename string) {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+
+	name := filepath.Base(filename)
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".inc" {
+		sources.Includes[strings.ToLower(name)] = filename
+		return
+	}
+
+	sources.Files = append(sources.Files, filename)
+	if ext == ".pas" {
+		unitname := resolve.Canonical(name[:len(name)-len(ext)])
+		if _, exists := sources.Units[unitname]; !exists {
+			sources.Units[unitname] = filename
+		}
+	}
+}
+
+// Load parses and resolves all sources with the specified defines, the
+// files that fail to parse are returned in errs.
+func (sources *Sources) Load(defines []string) (prog *resolve.Program, errs []error) {
+	prog = resolve.NewProgram(func(unitname string) (string, bool) {
+		path, ok := sources.Units[resolve.Canonical(unitname)]
+		return path, ok
+	}, defines)
+	prog.FindInclude = func(name string) (string, bool) {
+		path, ok := sources.Includes[strings.ToLower(filepath.Base(name))]
+		return path, ok
+	}
+
+	for _, filename := range sources.Files {
+		if _, err := prog.LoadFile(filename); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	prog.Resolve()
+	return prog, errs
+}
+
+// Conditionals returns the lower-case conditional symbols tested by
+// {$IFDEF}, {$IFNDEF} and {$IF Defined(X)} in the sources.
+func (sources *Sources) Conditionals() []string {
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, filename := range sources.all() {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		scanner.Scan(src, 0, func(tok token.Token, lit string) error {
+			if tok != token.CDIRECTIVE {
+				return nil
+			}
+			for _, symbol := range scanner.Symbols(lit) {
+				symbol = strings.ToLower(symbol)
+				if !seen[symbol] {
+					seen[symbol] = true
+					symbols = append(symbols, symbol)
+				}
+			}
+			return nil
+		}, nil)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// all returns the source and include files.
+func (sources *Sources) all() []string {
+	filenames := append([]string{}, sources.Files...)
+	var includes []string
+	for _, filename := range sources.Includes {
+		includes = append(includes, filename)
+	}
+	sort.Strings(includes)
+	return append(filenames, includes...)
+}
+
+// maxCombined limits the symbols that are combined by Configurations,
+// every symbol doubles the number of configurations.
+const maxCombined = 6
+
+// Configurations returns the define sets for every combination of
+// symbols. With more than maxCombined symbols only no symbols, each
+// symbol alone and all symbols together are returned.
+func Configurations(symbols []string) [][]string {
+	if len(symbols) > maxCombined {
+		configs := [][]string{nil}
+		for _, symbol := range symbols {
+			configs = append(configs, []string{symbol})
+		}
+		return append(configs, symbols)
+	}
+
+	var configs [][]string
+	for mask := 0; mask < 1<<uint(len(symbols)); mask++ {
+		var config []string
+		for i, symbol := range symbols {
+			if mask&(1<<uint(i)) != 0 {
+				config = append(config, symbol)
+			}
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// Inactive reports the identifiers named like one of names, given in
+// canonical form, that are excluded by conditional directives in every
+// configuration. These are not seen by Load and hence not renamed.
+func (sources *Sources) Inactive(configs [][]string, names map[string]bool) []error {
+	const maxIncludeDepth = 16
+
+	type ident struct {
+		pos  token.Position
+		name string
+	}
+	idents := make(map[token.Position]ident)
+	active := make(map[token.Position]bool)
+
+	var scan func(filename string, conds *scanner.Conditions, depth int)
+	scan = func(filename string, conds *scanner.Conditions, depth int) {
+		src, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return
+		}
+		var sc scanner.Scanner
+		fset := token.NewFileSet()
+		sc.Init(fset.AddFile(filename, fset.Base(), len(src)), src, nil, 0)
+		for {
+			pos, tok, lit := sc.Scan()
+			if tok == token.EOF {
+				return
+			}
+			if tok == token.CDIRECTIVE {
+				if conds.Directive(lit) || !conds.Active() || depth >= maxIncludeDepth {
+					continue
+				}
+				if name, arg := scanner.SplitDirective(lit); name == "I" || name == "INCLUDE" {
+					if path, ok := sources.include(filename, arg); ok {
+						scan(path, conds, depth+1)
+					}
+				}
+				continue
+			}
+			if tok != token.IDENT || !names[Canonical(lit)] {
+				continue
+			}
+			position := fset.Position(pos)
+			idents[position] = ident{position, lit}
+			if conds.Active() {
+				active[position] = true
+			}
+		}
+	}
+	for _, config := range configs {
+		for _, filename := range sources.Files {
+			scan(filename, scanner.NewConditions(config), 0)
+		}
+	}
+
+	var inactive []ident
+	for key, ident := range idents {
+		if !active[key] {
+			inactive = append(inactive, ident)
+		}
+	}
+	sort.Slice(inactive, func(i, k int) bool {
+		if inactive[i].pos.Filename != inactive[k].pos.Filename {
+			return inactive[i].pos.Filename < inactive[k].pos.Filename
+		}
+		return inactive[i].pos.Offset < inactive[k].pos.Offset
+	})
+
+	var errs []error
+	for _, ident := range inactive {
+		errs = append(errs, fmt.Errorf("%s: %s in inactive code not renamed", ident.pos, ident.name))
+	}
+	return errs
+}
+
+// include finds the file of an {$I name} directive in from, either
+// relative to from or among the include files.
+func (sources *Sources) include(from, name string) (string, bool) {
+	name = strings.Trim(name, "'\" ")
+	filename := filepath.Join(filepath.Dir(from), name)
+	if _, err := os.Stat(filename); err == nil {
+		return filename, true
+	}
+	filename, ok := sources.Includes[strings.ToLower(filepath.Base(name))]
+	return filename, ok
+}
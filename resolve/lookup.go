@@ -0,0 +1,216 @@
+package resolve
+
+import (
+	"github.com/raintreeinc/delphi/ast"
+)
+
+// maxChain limits walks over ancestor and alias chains, which may be
+// cyclic in broken code.
+const maxChain = 64
+
+// resolve binds a single reference.
+func (prog *Program) resolve(r *ref) {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	name := r.ident.Name
+	switch {
+	case r.selector:
+		if r.qual == nil {
+			r.unknown = true
+			return
+		}
+		prog.resolveIdent(r.qual)
+		qual := r.qual.Obj
+		if qual == nil {
+			r.unknown = true
+			return
+		}
+
+		if qual.Kind == ast.ObjMod {
+			scope, ok := qual.Data.(*ast.Scope)
+			if !ok {
+				r.unknown = true
+				return
+			}
+			r.ident.Obj = scope.Lookup(name)
+			return
+		}
+
+		typ := prog.typeOf(qual)
+		if typ == nil {
+			r.unknown = true
+			return
+		}
+		r.ident.Obj = prog.member(typ, name)
+		if r.ident.Obj == nil && !prog.complete(typ) {
+			r.unknown = true
+		}
+
+	case r.inherited:
+		class := prog.enclosingClass(r.scope)
+		if class == nil {
+			r.unknown = true
+			return
+		}
+		r.ident.Obj = prog.member(prog.base(class), name)
+		if r.ident.Obj == nil {
+			r.unknown = true
+		}
+
+	default:
+		obj, uncertain := prog.lookup(r.scope, name)
+		r.ident.Obj = obj
+		r.unknown = obj == nil && uncertain
+	}
+}
+
+// resolveIdent binds ident if it is a pending reference.
+func (prog *Program) resolveIdent(ident *ast.Ident) {
+	if r, ok := prog.refs[ident]; ok {
+		prog.resolve(r)
+	}
+}
+
+// lookup searches name starting from scope. uncertain is set when the
+// name might be a member of a with statement subject of unknown type.
+func (prog *Program) lookup(scope *ast.Scope, name string) (obj *ast.Object, uncertain bool) {
+	for s := scope; s != nil; s = s.Outer {
+		if obj := s.Lookup(name); obj != nil {
+			return obj, uncertain
+		}
+		if class, ok := prog.classes[s]; ok {
+			if obj := prog.member(class, name); obj != nil {
+				return obj, uncertain
+			}
+		}
+		if subjects, ok := prog.withs[s]; ok {
+			for i := len(subjects) - 1; i >= 0; i-- {
+				subject := subjects[i]
+				if subject == nil {
+					uncertain = true
+					continue
+				}
+				prog.resolveIdent(subject)
+				typ := prog.typeOf(subject.Obj)
+				if typ == nil {
+					uncertain = true
+					continue
+				}
+				if obj := prog.member(typ, name); obj != nil {
+					return obj, uncertain
+				}
+				if !prog.complete(typ) {
+					uncertain = true
+				}
+			}
+		}
+		if units, ok := prog.uses[s]; ok {
+			// later units shadow earlier ones
+			for i := len(units) - 1; i >= 0; i-- {
+				unit := units[i]
+				if unit.Interface == nil {
+					continue
+				}
+				if obj := unit.Interface.Lookup(name); obj != nil {
+					return obj, uncertain
+				}
+			}
+		}
+	}
+	return nil, uncertain
+}
+
+// typeOf returns the type object of obj, following aliases.
+func (prog *Program) typeOf(obj *ast.Object) *ast.Object {
+	if obj == nil {
+		return nil
+	}
+
+	typ := obj
+	if obj.Kind != ast.ObjTyp {
+		ident, ok := obj.Type.(*ast.Ident)
+		if !ok || ident == nil {
+			return nil
+		}
+		prog.resolveIdent(ident)
+		typ = ident.Obj
+	}
+
+	for i := 0; typ != nil && i < maxChain; i++ {
+		if typ.Kind != ast.ObjTyp {
+			return nil
+		}
+		if _, ok := typ.Data.(*ast.Scope); ok {
+			return typ
+		}
+		ident, ok := typ.Type.(*ast.Ident)
+		if !ok || ident == nil {
+			return typ
+		}
+		prog.resolveIdent(ident)
+		typ = ident.Obj
+	}
+	return nil
+}
+
+// base returns the ancestor of a class type.
+func (prog *Program) base(typ *ast.Object) *ast.Object {
+	if typ == nil {
+		return nil
+	}
+	if ident, ok := typ.Type.(*ast.Ident); ok && ident != nil {
+		prog.resolveIdent(ident)
+		return prog.typeOf(ident.Obj)
+	}
+	if prog.isClass[typ] && typ != prog.tobject() {
+		return prog.tobject()
+	}
+	return nil
+}
+
+// member finds a member of typ or its ancestors.
+func (prog *Program) member(typ *ast.Object, name string) *ast.Object {
+	for i := 0; typ != nil && i < maxChain; i++ {
+		if members, ok := typ.Data.(*ast.Scope); ok {
+			if obj := members.Lookup(name); obj != nil {
+				return obj
+			}
+		}
+		typ = prog.base(typ)
+	}
+	return nil
+}
+
+// complete reports whether all ancestors of typ are known.
+func (prog *Program) complete(typ *ast.Object) bool {
+	for i := 0; typ != nil && i < maxChain; i++ {
+		if _, ok := typ.Data.(*ast.Scope); !ok {
+			return false
+		}
+		if ident, ok := typ.Type.(*ast.Ident); ok && ident != nil {
+			prog.resolveIdent(ident)
+			if ident.Obj == nil {
+				return false
+			}
+		}
+		typ = prog.base(typ)
+	}
+	return true
+}
+
+// enclosingClass finds the class of the method enclosing scope.
+func (prog *Program) enclosingClass(scope *ast.Scope) *ast.Object {
+	for s := scope; s != nil; s = s.Outer {
+		if class, ok := prog.classes[s]; ok {
+			return class
+		}
+	}
+	return nil
+}
+
+func (prog *Program) tobject() *ast.Object {
+	return prog.universe.Lookup("TObject")
+}
@@ -0,0 +1,1499 @@
+package resolve
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/raintreeinc/delphi/ast"
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// item is a single token in the active source.
+type item struct {
+	pos token.Pos
+	end token.Pos
+	tok token.Token
+	lit string
+}
+
+// section describes where declarations are located.
+type section int
+
+const (
+	secInterface section = iota
+	secImplementation
+	secProgram
+	secLocal
+)
+
+// ref is an identifier that must be bound in the resolve pass.
+type ref struct {
+	ident *ast.Ident
+	scope *ast.Scope
+
+	selector  bool       // ident follows a '.'
+	qual      *ast.Ident // identifier before the '.', nil when unknown
+	inherited bool       // ident follows "inherited"
+
+	done    bool
+	unknown bool // binding cannot be determined, do not report
+}
+
+// parser walks the token stream of a single file, declares the entities
+// it finds and records references for the resolve pass.
+type parser struct {
+	prog  *Program
+	unit  *Unit
+	conds *scanner.Conditions
+
+	items []item
+	p     int
+
+	includes int // include nesting depth
+}
+
+func (p *parser) init(filename string, src []byte) {
+	p.conds = scanner.NewConditions(p.prog.Defines)
+	p.scan(filename, src)
+}
+
+// scan tokenizes src, skipping inactive conditional code and expanding
+// {$I} includes.
+func (p *parser) scan(filename string, src []byte) {
+	var sc scanner.Scanner
+	file := p.prog.Fset.AddFile(filename, p.prog.Fset.Base(), len(src))
+	sc.Init(file, src, func(pos token.Position, msg string) {
+		p.unit.Errors.Add(pos, msg)
+	}, 0)
+
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			return
+		}
+		if tok == token.CDIRECTIVE {
+			if p.conds.Directive(lit) || !p.conds.Active() {
+				continue
+			}
+			if name, arg := scanner.SplitDirective(lit); name == "I" || name == "INCLUDE" {
+				p.include(filename, arg)
+			}
+			continue
+		}
+		if !p.conds.Active() {
+			continue
+		}
+		end := pos + token.Pos(len(lit))
+		if lit == "" {
+			end = pos + token.Pos(len(tok.String()))
+		}
+		p.items = append(p.items, item{pos, end, tok, lit})
+	}
+}
+
+func (p *parser) include(from, name string) {
+	const maxIncludeDepth = 16
+	if p.includes >= maxIncludeDepth {
+		return
+	}
+
+	name = strings.Trim(name, "'\" ")
+	filename := filepath.Join(filepath.Dir(from), name)
+	src, err := ioutil.ReadFile(filename)
+	if err != nil && p.prog.FindInclude != nil {
+		if path, ok := p.prog.FindInclude(name); ok {
+			filename = path
+			src, err = ioutil.ReadFile(filename)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	p.includes++
+	p.scan(filename, src)
+	p.includes--
+}
+
+// token navigation
+
+func (p *parser) tok() token.Token { return p.peek(0) }
+
+func (p *parser) peek(n int) token.Token {
+	if p.p+n < len(p.items) {
+		return p.items[p.p+n].tok
+	}
+	return token.EOF
+}
+
+func (p *parser) lit() string {
+	if p.p < len(p.items) {
+		return p.items[p.p].lit
+	}
+	return ""
+}
+
+func (p *parser) next() {
+	if p.p < len(p.items) {
+		p.p++
+	}
+}
+
+func (p *parser) got(tok token.Token) bool {
+	if p.tok() == tok {
+		p.next()
+		return true
+	}
+	return false
+}
+
+// skip advances to the next stop token at nesting depth 0.
+func (p *parser) skip(stops ...token.Token) {
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		if depth == 0 && isOneOf(tok, stops) {
+			return
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+		p.next()
+	}
+}
+
+// isWord reports whether the current token is the identifier word, for
+// words such as operator that the scanner does not treat as directives.
+func (p *parser) isWord(word string) bool {
+	return p.tok() == token.IDENT && strings.EqualFold(p.lit(), word)
+}
+
+// isName reports whether tok can be used as an identifier.
+func isName(tok token.Token) bool { return tok == token.IDENT || tok.IsDirective() }
+
+// isRoutine reports whether tok starts a routine heading.
+func isRoutine(tok token.Token) bool {
+	switch tok {
+	case token.PROCEDURE, token.FUNCTION, token.CONSTRUCTOR, token.DESTRUCTOR:
+		return true
+	}
+	return false
+}
+
+func isOneOf(tok token.Token, list []token.Token) bool {
+	for _, x := range list {
+		if tok == x {
+			return true
+		}
+	}
+	return false
+}
+
+// ident consumes the current token as an identifier.
+func (p *parser) ident() *ast.Ident {
+	it := p.items[p.p]
+	p.next()
+	ident := &ast.Ident{NamePos: it.pos, Name: it.lit}
+	p.unit.Idents = append(p.unit.Idents, ident)
+	return ident
+}
+
+// declare creates an object for ident in scope. Overloaded routines and
+// forward declared types share a single object.
+func (p *parser) declare(scope *ast.Scope, ident *ast.Ident, kind ast.ObjKind) *ast.Object {
+	obj := ast.NewObj(kind, ident.Name)
+	obj.Decl = ident
+	if alt := scope.Insert(obj); alt != nil && alt.Kind == kind && (kind == ast.ObjFun || kind == ast.ObjTyp) {
+		obj = alt
+	}
+	ident.Obj = obj
+	return obj
+}
+
+// reference records ident as a reference to be bound later.
+func (p *parser) reference(scope *ast.Scope, ident *ast.Ident) *ref {
+	r := &ref{ident: ident, scope: scope}
+	p.unit.refs = append(p.unit.refs, r)
+	p.prog.refs[ident] = r
+	return r
+}
+
+// selection tracks qualified identifiers such as A.B.C.
+type selection struct {
+	last      *ast.Ident // identifier that was just consumed
+	qual      *ast.Ident // qualifier for the pending selector
+	selector  bool
+	inherited bool
+}
+
+// expr records the references of the current token and advances.
+func (p *parser) expr(scope *ast.Scope, sel *selection) {
+	tok := p.tok()
+	switch {
+	case isName(tok):
+		p.reference(scope, p.ident()).apply(sel)
+		return
+	case tok == token.PERIOD:
+		*sel = selection{qual: sel.last, selector: true}
+	case tok == token.INHERITED:
+		*sel = selection{inherited: true}
+	default:
+		*sel = selection{}
+	}
+	p.next()
+}
+
+// refs records references until one of the stops at depth 0.
+func (p *parser) refs(scope *ast.Scope, stops ...token.Token) {
+	var sel selection
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		if depth == 0 && isOneOf(tok, stops) {
+			return
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+		p.expr(scope, &sel)
+	}
+}
+
+// qualified consumes a possibly dotted name such as Unit.Name.
+func (p *parser) qualified() string {
+	name := ""
+	for isName(p.tok()) {
+		name += p.lit()
+		p.next()
+		if p.tok() != token.PERIOD || !isName(p.peek(1)) {
+			break
+		}
+		name += "."
+		p.next()
+	}
+	return name
+}
+
+// typeName parses a possibly qualified type name such as Unit.TName as
+// references and returns the last identifier.
+func (p *parser) typeName(scope *ast.Scope) *ast.Ident {
+	var sel selection
+	var last *ast.Ident
+	for isName(p.tok()) {
+		last = p.ident()
+		p.reference(scope, last).apply(&sel)
+		if p.tok() != token.PERIOD || !isName(p.peek(1)) {
+			break
+		}
+		p.expr(scope, &sel)
+	}
+	return last
+}
+
+// tail records references up to the ';' ending a declaration, skipping
+// hint directives such as platform and deprecated.
+func (p *parser) tail(scope *ast.Scope) {
+	var sel selection
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		switch tok {
+		case token.SEMICOLON:
+			if depth == 0 {
+				p.next()
+				return
+			}
+		case token.END:
+			if depth == 0 {
+				return
+			}
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			if depth == 0 {
+				return
+			}
+			depth--
+		case token.PLATFORM, token.DEPRECATED, token.EXPERIMENTAL, token.ABSOLUTE:
+			sel = selection{}
+			p.next()
+			continue
+		}
+		p.expr(scope, &sel)
+	}
+}
+
+// file structure
+
+func (p *parser) parseFile() {
+	unit := p.unit
+	switch p.tok() {
+	case token.UNIT:
+		unit.Kind = p.tok()
+		p.next()
+		p.header()
+		if p.tok() == token.INTERFACE {
+			unit.Layout.Interface = p.items[p.p].end
+			p.next()
+		}
+
+		unit.Interface = ast.NewScope(p.usesScope(p.prog.universe, nil))
+		unit.Object.Data = unit.Interface
+		unit.Implementation = unit.Interface
+		p.section(unit.Interface, secInterface, token.IMPLEMENTATION)
+
+		if p.tok() == token.IMPLEMENTATION {
+			unit.Layout.Implementation = p.items[p.p].pos
+			unit.Layout.Body = p.items[p.p].end
+			p.next()
+			unit.Implementation = ast.NewScope(p.usesScope(unit.Interface.Outer, unit))
+			p.section(unit.Implementation, secImplementation, token.INITIALIZATION, token.BEGIN, token.END)
+		}
+
+		if p.p < len(p.items) {
+			unit.Layout.End = p.items[p.p].pos
+		}
+		switch p.tok() {
+		case token.INITIALIZATION, token.BEGIN:
+			p.compound(unit.Implementation)
+		case token.END:
+			p.next()
+		}
+
+	case token.PROGRAM, token.LIBRARY:
+		unit.Kind = p.tok()
+		p.next()
+		p.header()
+
+		unit.Interface = ast.NewScope(p.usesScope(p.prog.universe, nil))
+		unit.Object.Data = unit.Interface
+		unit.Implementation = unit.Interface
+
+		p.section(unit.Interface, secProgram, token.BEGIN)
+		if p.p < len(p.items) {
+			unit.Layout.End = p.items[p.p].pos
+		}
+		if p.tok() == token.BEGIN {
+			p.compound(unit.Interface)
+		}
+
+	case token.PACKAGE:
+		unit.Kind = p.tok()
+		p.next()
+		p.header()
+
+		unit.Interface = ast.NewScope(p.prog.universe)
+		unit.Object.Data = unit.Interface
+		unit.Implementation = unit.Interface
+
+		// only the contains clause refers to units, requires lists packages
+		for p.tok() != token.EOF && p.tok() != token.END {
+			if p.tok() == token.IDENT && strings.EqualFold(p.lit(), "contains") {
+				clause := &UsesClause{Pos: p.items[p.p].pos}
+				p.next()
+				p.unitList(clause, func(name string) {
+					unit.Uses = appendUnique(unit.Uses, name)
+				})
+				unit.Layout.Clauses = append(unit.Layout.Clauses, clause)
+				continue
+			}
+			start := p.p
+			p.skip(token.SEMICOLON)
+			if !p.got(token.SEMICOLON) && p.p == start {
+				p.next()
+			}
+		}
+
+	default:
+		// fragments do not declare anything usable
+		unit.Interface = ast.NewScope(p.prog.universe)
+		unit.Object.Data = unit.Interface
+		unit.Implementation = unit.Interface
+	}
+}
+
+// header parses the unit name and directives up to ';'.
+func (p *parser) header() {
+	if isName(p.tok()) {
+		ident := p.ident()
+		ident.Obj = p.unit.Object
+		p.unit.Object.Decl = ident
+		for p.tok() == token.PERIOD && isName(p.peek(1)) {
+			p.next()
+			p.ident().Obj = p.unit.Object
+		}
+	}
+	p.skip(token.SEMICOLON)
+	if p.got(token.SEMICOLON) {
+		p.unit.Layout.Header = p.items[p.p-1].end
+	}
+}
+
+// usesScope parses an optional uses clause and returns a scope that
+// searches the used units. When self is set, its interface shadows the
+// used units, as is the case for the implementation section.
+func (p *parser) usesScope(outer *ast.Scope, self *Unit) *ast.Scope {
+	scope := ast.NewScope(outer)
+	if self == nil {
+		scope.Insert(p.unit.Object)
+	}
+
+	var units []*Unit
+	if p.tok() == token.USES {
+		clause := &UsesClause{Implementation: self != nil, Pos: p.items[p.p].pos}
+		p.next()
+		units = p.unitList(clause, func(name string) {
+			if self == nil {
+				p.unit.Uses = appendUnique(p.unit.Uses, name)
+			} else {
+				p.unit.ImplUses = appendUnique(p.unit.ImplUses, name)
+			}
+		})
+		for _, used := range units {
+			scope.Insert(used.Object)
+		}
+		p.unit.Layout.Clauses = append(p.unit.Layout.Clauses, clause)
+	}
+
+	if self != nil {
+		units = append(units, self)
+	}
+	p.prog.uses[scope] = units
+	return scope
+}
+
+// unitList parses a list of "Name [in 'path']" entries up to and
+// including ';' into clause, loads the units and calls add for each name.
+func (p *parser) unitList(clause *UsesClause, add func(name string)) []*Unit {
+	var units []*Unit
+	for isName(p.tok()) {
+		start := p.p
+		name := p.qualified()
+
+		inpath, pathpos, pathlit := "", token.NoPos, ""
+		if p.got(token.IN) && p.tok() == token.STRING {
+			pathlit, pathpos = p.lit(), p.items[p.p].pos
+			inpath = strings.Trim(pathlit, "'")
+			p.next()
+		}
+
+		used := p.prog.use(p.unit, name, inpath)
+		p.bindUnitName(start, used)
+		if inpath != "" {
+			p.unit.Paths = append(p.unit.Paths, UsesPath{
+				Unit:   used,
+				Path:   inpath,
+				Lit:    pathlit,
+				LitPos: pathpos,
+			})
+		}
+
+		clause.Entries = append(clause.Entries, UsesEntry{
+			Unit: used,
+			Pos:  p.items[start].pos,
+			End:  p.items[p.p-1].end,
+		})
+		add(name)
+		units = append(units, used)
+
+		if !p.got(token.COMMA) {
+			break
+		}
+	}
+	p.skip(token.SEMICOLON)
+	if p.tok() == token.SEMICOLON {
+		clause.End = p.items[p.p].pos
+		p.next()
+	}
+	return units
+}
+
+// bindUnitName records the identifiers of a uses clause entry, starting
+// at token index start, as references to unit.
+func (p *parser) bindUnitName(start int, unit *Unit) {
+	for i := start; i < p.p; i++ {
+		it := p.items[i]
+		if !isName(it.tok) {
+			continue
+		}
+		ident := &ast.Ident{NamePos: it.pos, Name: it.lit, Obj: unit.Object}
+		p.unit.Idents = append(p.unit.Idents, ident)
+	}
+}
+
+// declarations
+
+// section parses declarations until one of the stops, skipping tokens
+// that cannot start a declaration.
+func (p *parser) section(scope *ast.Scope, sec section, stops ...token.Token) {
+	for {
+		p.decls(scope, sec)
+		if tok := p.tok(); tok == token.EOF || isOneOf(tok, stops) {
+			return
+		}
+		p.next()
+	}
+}
+
+func (p *parser) decls(scope *ast.Scope, sec section) {
+	for {
+		start := p.p
+		switch p.tok() {
+		case token.USES:
+			// uses clause in an unexpected location
+			p.next()
+			p.skip(token.SEMICOLON)
+			p.got(token.SEMICOLON)
+		case token.TYPE:
+			p.next()
+			for {
+				if p.tok() == token.LBRACK {
+					// attributes such as [TestFixture]
+					p.attributes()
+					continue
+				}
+				if !isName(p.tok()) || (p.peek(1) != token.EQL && p.peek(1) != token.LSS) {
+					break
+				}
+				at := p.p
+				obj := p.typeDecl(scope)
+				p.record(sec, start, at, nil, 0, obj)
+			}
+		case token.CONST, token.RESOURCESTRING:
+			p.next()
+			for isName(p.tok()) {
+				at := p.p
+				obj := p.constDecl(scope)
+				p.record(sec, start, at, nil, 0, obj)
+			}
+		case token.VAR, token.THREADVAR:
+			p.next()
+			for isName(p.tok()) {
+				at := p.p
+				objs := p.varDecl(scope, ast.ObjVar)
+				p.record(sec, start, at, nil, 0, objs...)
+			}
+		case token.LABEL:
+			p.next()
+			for tok := p.tok(); tok != token.SEMICOLON && tok != token.EOF; tok = p.tok() {
+				if isName(tok) {
+					p.declare(scope, p.ident(), ast.ObjLbl)
+					continue
+				}
+				p.next()
+			}
+			p.got(token.SEMICOLON)
+		case token.CLASS:
+			p.next()
+			if isRoutine(p.tok()) || p.isWord("operator") && isName(p.peek(1)) {
+				obj, class, params := p.routine(scope, sec)
+				p.record(sec, start, start, class, params, obj)
+			}
+		case token.PROCEDURE, token.FUNCTION, token.CONSTRUCTOR, token.DESTRUCTOR:
+			obj, class, params := p.routine(scope, sec)
+			p.record(sec, start, start, class, params, obj)
+		case token.EXPORTS:
+			p.next()
+			p.refs(scope, token.SEMICOLON)
+			p.got(token.SEMICOLON)
+		case token.SEMICOLON:
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+// record adds a top-level declaration starting at token index start,
+// with the declared name at token index at, to the unit. params is the
+// number of parameters of a routine.
+func (p *parser) record(sec section, start, at int, class *ast.Object, params int, objs ...*ast.Object) {
+	if sec == secLocal || p.p <= at || len(objs) == 0 || objs[0] == nil {
+		return
+	}
+
+	first, name, last := p.items[start], p.items[at], p.items[p.p-1]
+	file := p.prog.Fset.File(first.pos)
+	if file == nil || file.Name() != p.unit.Path || p.prog.Fset.File(last.pos) != file {
+		// declarations in include files cannot be edited in place
+		return
+	}
+
+	p.unit.Decls = append(p.unit.Decls, &Decl{
+		Objs:           objs,
+		Class:          class,
+		Keyword:        first.tok,
+		KeywordPos:     first.pos,
+		Implementation: sec == secImplementation,
+		Pos:            name.pos,
+		End:            last.end,
+		Params:         params,
+	})
+}
+
+func (p *parser) typeDecl(scope *ast.Scope) *ast.Object {
+	ident := p.ident()
+	obj := p.declare(scope, ident, ast.ObjTyp)
+	if p.tok() == token.LSS {
+		// the parameters of a generic type are visible in the type
+		scope = ast.NewScope(scope)
+		p.typeParams(scope)
+	}
+	p.got(token.EQL)
+	p.got(token.TYPE)
+
+	if typ := p.typeSpec(scope, obj); typ != nil && obj.Type == nil {
+		obj.Type = typ
+	}
+	p.tail(scope)
+	return obj
+}
+
+// typeParams parses "<T, U: constraint>" declaring the parameters in
+// scope, constraints are references in the enclosing scope.
+func (p *parser) typeParams(scope *ast.Scope) {
+	p.next() // <
+	constraint := false
+	for tok := p.tok(); tok != token.GTR && tok != token.EOF; tok = p.tok() {
+		switch {
+		case tok == token.COLON:
+			constraint = true
+		case tok == token.SEMICOLON:
+			constraint = false
+		case isName(tok):
+			if constraint {
+				p.reference(scope.Outer, p.ident())
+			} else {
+				p.declare(scope, p.ident(), ast.ObjTyp)
+			}
+			continue
+		}
+		p.next()
+	}
+	p.got(token.GTR)
+}
+
+func (p *parser) constDecl(scope *ast.Scope) *ast.Object {
+	obj := p.declare(scope, p.ident(), ast.ObjCon)
+	if p.got(token.COLON) {
+		obj.Type = p.typeSpec(scope, nil)
+	}
+	p.got(token.EQL)
+	p.tail(scope)
+	return obj
+}
+
+// varDecl parses "a, b: T = x;" declaring names in scope. It is also
+// used for fields, where the declaration may end at ')' or END.
+func (p *parser) varDecl(scope *ast.Scope, kind ast.ObjKind) []*ast.Object {
+	var objs []*ast.Object
+	for isName(p.tok()) {
+		objs = append(objs, p.declare(scope, p.ident(), kind))
+		if !p.got(token.COMMA) {
+			break
+		}
+	}
+
+	if p.got(token.COLON) {
+		typ := p.typeSpec(scope, nil)
+		for _, obj := range objs {
+			obj.Type = typ
+		}
+	}
+
+	p.got(token.EQL)
+	p.tail(scope)
+	return objs
+}
+
+// typeSpec parses a type. owner is the type object being declared, if
+// any. It returns the identifier of a named type.
+func (p *parser) typeSpec(scope *ast.Scope, owner *ast.Object) *ast.Ident {
+	p.got(token.PACKED)
+
+	switch p.tok() {
+	case token.CLASS, token.INTERFACE, token.DISPINTERFACE, token.OBJECT:
+		return p.classType(scope, owner)
+	case token.RECORD:
+		p.next()
+		members := ast.NewScope(scope)
+		if owner != nil {
+			owner.Data = members
+			p.prog.classes[members] = owner
+		}
+		p.members(members, owner, nil)
+		return nil
+	case token.LPAREN:
+		// enumeration, values are declared in the enclosing scope
+		p.next()
+		for tok := p.tok(); tok != token.RPAREN && tok != token.EOF; tok = p.tok() {
+			if isName(tok) {
+				obj := p.declare(scope, p.ident(), ast.ObjCon)
+				if owner != nil {
+					obj.Type = owner.Decl
+				}
+				if p.got(token.EQL) {
+					p.refs(scope, token.COMMA)
+				}
+				continue
+			}
+			p.next()
+		}
+		p.got(token.RPAREN)
+		return nil
+	case token.IDENT:
+		if !p.isWord("reference") || p.peek(1) != token.TO || (p.peek(2) != token.PROCEDURE && p.peek(2) != token.FUNCTION) {
+			break
+		}
+		// reference to procedure(...), an anonymous method type
+		p.next()
+		p.next()
+		fallthrough
+	case token.PROCEDURE, token.FUNCTION:
+		p.next()
+		params := ast.NewScope(scope)
+		p.params(params)
+		if p.got(token.COLON) {
+			p.typeSpec(scope, nil)
+		}
+		if p.got(token.OF) {
+			p.got(token.OBJECT)
+		}
+		return nil
+	}
+
+	// named types, subranges, arrays, sets, pointers, strings
+	var sel selection
+	var last *ast.Ident
+	simple := true
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		if depth == 0 {
+			switch tok {
+			case token.SEMICOLON, token.EQL, token.RPAREN, token.END,
+				token.ABSOLUTE, token.READ, token.WRITE, token.INDEX,
+				token.DEFAULT, token.STORED, token.IMPLEMENTS,
+				token.NODEFAULT, token.DISPID, token.READONLY, token.WRITEONLY:
+				if simple {
+					return last
+				}
+				return nil
+			case token.PLATFORM, token.DEPRECATED:
+				if last != nil {
+					if simple {
+						return last
+					}
+					return nil
+				}
+			}
+		}
+		switch tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			depth--
+		}
+		if isName(tok) {
+			last = p.ident()
+			p.reference(scope, last).apply(&sel)
+			continue
+		}
+		if tok != token.PERIOD {
+			simple = false
+		}
+		if tok == token.OF && depth == 0 {
+			// array of X, set of X, file of X
+			p.next()
+			p.typeSpec(scope, nil)
+			return nil
+		}
+		p.expr(scope, &sel)
+	}
+	return nil
+}
+
+// apply sets the selection information of r and advances sel.
+func (r *ref) apply(sel *selection) {
+	r.selector = sel.selector
+	r.qual = sel.qual
+	r.inherited = sel.inherited
+	*sel = selection{last: r.ident}
+}
+
+// classType parses classes, interfaces and objects.
+func (p *parser) classType(scope *ast.Scope, owner *ast.Object) *ast.Ident {
+	kind := p.tok()
+	p.next()
+
+	if kind == token.CLASS && p.got(token.OF) {
+		// class reference, members are those of the referenced class
+		ident := p.typeName(scope)
+		if owner != nil {
+			owner.Type = ident
+		}
+		return nil
+	}
+
+	if p.tok() == token.SEMICOLON {
+		// forward declaration
+		if owner != nil && kind != token.INTERFACE && kind != token.DISPINTERFACE {
+			p.prog.isClass[owner] = true
+		}
+		return nil
+	}
+
+	// class abstract, class sealed
+	for p.tok() == token.IDENT && (strings.EqualFold(p.lit(), "abstract") || strings.EqualFold(p.lit(), "sealed")) {
+		p.next()
+	}
+
+	members := ast.NewScope(scope)
+	if owner != nil {
+		owner.Data = members
+		if kind == token.CLASS || kind == token.OBJECT {
+			p.prog.isClass[owner] = true
+		}
+		p.prog.classes[members] = owner
+	}
+
+	var ancestor *ast.Ident
+	if p.got(token.LPAREN) {
+		for tok := p.tok(); tok != token.RPAREN && tok != token.EOF; tok = p.tok() {
+			if isName(tok) {
+				last := p.typeName(scope)
+				if ancestor == nil {
+					ancestor = last
+				}
+				continue
+			}
+			p.next()
+		}
+		p.got(token.RPAREN)
+	}
+
+	var class *Class
+	if owner != nil {
+		if ancestor != nil {
+			owner.Type = ancestor
+		}
+		class = &Class{Object: owner, Kind: kind}
+		if ancestor != nil {
+			class.Ancestor = ancestor.Name
+		}
+		p.unit.Classes = append(p.unit.Classes, class)
+	}
+
+	if p.tok() == token.SEMICOLON {
+		// class(TAncestor); without a body
+		return nil
+	}
+
+	// interface GUID
+	if p.tok() == token.LBRACK && p.peek(1) == token.STRING {
+		p.skip(token.RBRACK)
+		p.got(token.RBRACK)
+	}
+
+	p.members(members, owner, class)
+	return nil
+}
+
+// members parses the body of a class, record or interface up to
+// and including END. The methods are recorded in class when not nil.
+func (p *parser) members(members *ast.Scope, owner *ast.Object, class *Class) {
+	visibility := token.ILLEGAL
+	var attrs []*Attribute
+	for {
+		switch tok := p.tok(); tok {
+		case token.EOF:
+			return
+		case token.END:
+			p.next()
+			return
+		case token.LBRACK:
+			// attributes of the next member
+			attrs = append(attrs, p.attributes()...)
+			continue
+		case token.CLASS:
+			p.next()
+			if isRoutine(p.tok()) || p.isWord("operator") && isName(p.peek(1)) {
+				p.method(members, class, visibility, attrs, true)
+			}
+		case token.PRIVATE, token.PROTECTED, token.PUBLIC, token.PUBLISHED, token.AUTOMATED:
+			visibility = tok
+			p.next()
+		case token.STRICT, token.VAR, token.SEMICOLON:
+			p.next()
+		case token.CONST:
+			p.next()
+			for isName(p.tok()) && p.peek(1) == token.EQL {
+				p.constDecl(members)
+			}
+		case token.TYPE:
+			p.next()
+			for isName(p.tok()) && (p.peek(1) == token.EQL || p.peek(1) == token.LSS) {
+				p.typeDecl(members)
+			}
+		case token.PROCEDURE, token.FUNCTION, token.CONSTRUCTOR, token.DESTRUCTOR:
+			p.method(members, class, visibility, attrs, false)
+		case token.PROPERTY:
+			p.property(members, owner)
+		case token.CASE:
+			p.variant(members)
+		default:
+			if isName(tok) {
+				p.varDecl(members, ast.ObjVar)
+			} else {
+				p.next()
+			}
+		}
+		attrs = nil
+	}
+}
+
+// method parses a routine heading in a class body and records it in
+// class when not nil.
+func (p *parser) method(members *ast.Scope, class *Class, visibility token.Token, attrs []*Attribute, classMethod bool) {
+	if isName(p.peek(1)) && p.peek(2) == token.PERIOD {
+		// interface method mapping: procedure IFoo.Bar = Baz;
+		p.skip(token.SEMICOLON)
+		p.got(token.SEMICOLON)
+		return
+	}
+
+	method := &Method{
+		Keyword:     p.tok(),
+		ClassMethod: classMethod,
+		Visibility:  visibility,
+		Attributes:  attrs,
+	}
+	if isName(p.peek(1)) {
+		method.Name, method.Pos = p.items[p.p+1].lit, p.items[p.p+1].pos
+	}
+	_, _, method.Params = p.routine(members, secInterface)
+	if class != nil && method.Name != "" {
+		class.Methods = append(class.Methods, method)
+	}
+}
+
+// attributes parses "[Name, Name(args)]" lists. The names and arguments
+// are not resolved.
+func (p *parser) attributes() []*Attribute {
+	var attrs []*Attribute
+	for p.got(token.LBRACK) {
+		for tok := p.tok(); tok != token.RBRACK && tok != token.EOF; tok = p.tok() {
+			if !isName(tok) {
+				p.next()
+				continue
+			}
+			name := p.qualified()
+			attr := &Attribute{Name: name[strings.LastIndex(name, ".")+1:]}
+			if p.got(token.LPAREN) {
+				attr.Args = p.attributeArgs()
+			}
+			attrs = append(attrs, attr)
+		}
+		p.got(token.RBRACK)
+	}
+	return attrs
+}
+
+// attributeArgs returns the source of the arguments up to and including
+// the closing ')'.
+func (p *parser) attributeArgs() []string {
+	var args []string
+	var arg strings.Builder
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		switch tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			if depth == 0 {
+				if arg.Len() > 0 || len(args) > 0 {
+					args = append(args, arg.String())
+				}
+				p.got(token.RPAREN)
+				return args
+			}
+			depth--
+		case token.COMMA:
+			if depth == 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+				p.next()
+				continue
+			}
+		}
+		if lit := p.lit(); lit != "" {
+			arg.WriteString(lit)
+		} else {
+			arg.WriteString(tok.String())
+		}
+		p.next()
+	}
+	return args
+}
+
+// variant parses the variant part of a record. A nested variant part
+// ends at the ')' of the enclosing variant, which is left to the caller.
+func (p *parser) variant(members *ast.Scope) {
+	p.next() // case
+	if isName(p.tok()) && p.peek(1) == token.COLON {
+		obj := p.declare(members, p.ident(), ast.ObjVar)
+		p.next()
+		// the tag type is an ordinal type name, typeSpec would take
+		// "Byte of" for "set of"
+		obj.Type = p.typeName(members.Outer)
+	} else {
+		p.refs(members.Outer, token.OF)
+	}
+	p.got(token.OF)
+
+	for tok := p.tok(); tok != token.END && tok != token.RPAREN && tok != token.EOF; tok = p.tok() {
+		// case labels
+		at := p.p
+		p.refs(members.Outer, token.COLON, token.END)
+		if !p.got(token.COLON) {
+			if p.p == at {
+				// stray token such as an unmatched ']'
+				p.next()
+			}
+			continue
+		}
+		if !p.got(token.LPAREN) {
+			continue
+		}
+		for tok := p.tok(); tok != token.RPAREN && tok != token.EOF; tok = p.tok() {
+			switch {
+			case tok == token.CASE:
+				p.variant(members)
+				continue
+			case isName(tok):
+				p.varDecl(members, ast.ObjVar)
+				continue
+			}
+			p.next()
+		}
+		p.got(token.RPAREN)
+		p.got(token.SEMICOLON)
+	}
+	// END is shared with the record
+}
+
+// property parses a property declaration inside a class.
+func (p *parser) property(members *ast.Scope, owner *ast.Object) {
+	p.next() // property
+	if !isName(p.tok()) {
+		return
+	}
+
+	ident := p.ident()
+	if p.tok() != token.COLON && p.tok() != token.LBRACK {
+		// redeclaration of an inherited property
+		r := p.reference(members, ident)
+		r.inherited = true
+	} else {
+		obj := p.declare(members, ident, ast.ObjProp)
+		if p.got(token.LBRACK) {
+			params := ast.NewScope(members)
+			p.paramList(params, token.RBRACK)
+			p.got(token.RBRACK)
+		}
+		if p.got(token.COLON) {
+			obj.Type = p.typeSpec(members.Outer, nil)
+		}
+	}
+
+	var sel selection
+	for tok := p.tok(); tok != token.SEMICOLON && tok != token.EOF; tok = p.tok() {
+		switch tok {
+		case token.READ, token.WRITE, token.STORED, token.IMPLEMENTS,
+			token.INDEX, token.DEFAULT, token.NODEFAULT, token.DISPID,
+			token.READONLY, token.WRITEONLY:
+			sel = selection{}
+			p.next()
+			continue
+		}
+		p.expr(members, &sel)
+	}
+	p.got(token.SEMICOLON)
+
+	if p.tok() == token.DEFAULT && p.peek(1) == token.SEMICOLON {
+		p.next()
+		p.next()
+	}
+}
+
+// params parses an optional parameter list, declaring names in scope.
+// It returns the number of parameters.
+func (p *parser) params(scope *ast.Scope) int {
+	if !p.got(token.LPAREN) {
+		return 0
+	}
+	n := p.paramList(scope, token.RPAREN)
+	p.got(token.RPAREN)
+	return n
+}
+
+// paramList parses parameters up to end and returns their number.
+func (p *parser) paramList(scope *ast.Scope, end token.Token) int {
+	n := 0
+	for tok := p.tok(); tok != end && tok != token.EOF; tok = p.tok() {
+		switch {
+		case tok == token.SEMICOLON:
+			p.next()
+		case (tok == token.VAR || tok == token.CONST || tok == token.OUT) && isName(p.peek(1)):
+			p.next()
+		case isName(tok):
+			var objs []*ast.Object
+			for isName(p.tok()) {
+				objs = append(objs, p.declare(scope, p.ident(), ast.ObjVar))
+				if !p.got(token.COMMA) {
+					break
+				}
+			}
+			n += len(objs)
+			if p.got(token.COLON) {
+				typ := p.typeSpec(scope.Outer, nil)
+				for _, obj := range objs {
+					obj.Type = typ
+				}
+			}
+			if p.got(token.EQL) {
+				p.refs(scope.Outer, token.SEMICOLON, end)
+			}
+		default:
+			p.next()
+		}
+	}
+	return n
+}
+
+// routineDirectives lists directives that may follow a routine heading.
+var routineDirectives = map[string]bool{
+	"abstract": true, "assembler": true, "cdecl": true, "deprecated": true,
+	"dispid": true, "dynamic": true, "experimental": true, "export": true,
+	"external": true, "far": true, "final": true, "forward": true,
+	"inline": true, "library": true, "local": true, "message": true,
+	"near": true, "overload": true, "override": true, "pascal": true,
+	"platform": true, "register": true, "reintroduce": true, "safecall": true,
+	"static": true, "stdcall": true, "varargs": true, "virtual": true,
+}
+
+// routine parses a procedure, function, constructor, destructor or class
+// operator and, outside of interfaces and class declarations, its body.
+// It returns the routine object, for method implementations the
+// outermost class, and the number of parameters.
+func (p *parser) routine(scope *ast.Scope, sec section) (obj, owner *ast.Object, params int) {
+	p.next() // procedure, function, ...
+	if !isName(p.tok()) {
+		p.skip(token.SEMICOLON)
+		p.got(token.SEMICOLON)
+		return nil, nil, 0
+	}
+
+	locals := ast.NewScope(scope)
+	var class *ast.Object
+
+	name := p.ident()
+	if p.tok() == token.PERIOD && sec != secInterface {
+		// method implementation: TClass.Method
+		r := p.reference(scope, name)
+		class = p.localType(scope, name.Name)
+		owner = class
+		if class != nil {
+			name.Obj = class
+			r.done = true
+		}
+		for p.tok() == token.PERIOD && isName(p.peek(1)) {
+			p.next()
+			member := p.ident()
+			r := p.reference(scope, member)
+			r.selector, r.qual = true, name
+			if class != nil {
+				if members, ok := class.Data.(*ast.Scope); ok {
+					if m := members.Lookup(member.Name); m != nil {
+						member.Obj = m
+						r.done = true
+						if m.Kind == ast.ObjTyp {
+							class = m // nested type
+						}
+					}
+				}
+			}
+			name = member
+		}
+		obj = name.Obj
+
+		view := ast.NewScope(scope)
+		if class != nil {
+			p.prog.classes[view] = class
+		}
+		locals = ast.NewScope(view)
+		self := p.declareBuiltin(locals, "Self", ast.ObjVar)
+		if class != nil {
+			self.Type = class.Decl
+		}
+	} else {
+		if sec == secImplementation || sec == secLocal || sec == secProgram {
+			obj = p.existingRoutine(scope, name.Name, sec)
+		}
+		if obj != nil {
+			name.Obj = obj
+			p.reference(scope, name).done = true
+		} else {
+			obj = p.declare(scope, name, ast.ObjFun)
+		}
+	}
+
+	params = p.params(locals)
+	if p.got(token.COLON) {
+		typ := p.typeSpec(scope, nil)
+		if obj != nil && obj.Type == nil {
+			obj.Type = typ
+		}
+		result := p.declareBuiltin(locals, "Result", ast.ObjVar)
+		result.Type = typ
+	} else if obj != nil && obj.Type != nil {
+		// implementation may omit the result type
+		result := p.declareBuiltin(locals, "Result", ast.ObjVar)
+		result.Type = obj.Type
+	}
+	p.skip(token.SEMICOLON)
+	p.got(token.SEMICOLON)
+
+	body := sec != secInterface
+	for p.isRoutineDirective() {
+		lit := strings.ToLower(p.lit())
+		if lit == "forward" || lit == "external" {
+			body = false
+		}
+		p.next()
+		// arguments such as: external 'dll' name 'x'; message WM_X;
+		for tok := p.tok(); tok != token.SEMICOLON && tok != token.EOF; tok = p.tok() {
+			if tok == token.IDENT {
+				p.reference(scope, p.ident())
+				continue
+			}
+			p.next()
+		}
+		p.got(token.SEMICOLON)
+	}
+
+	if !body {
+		return obj, owner, params
+	}
+
+	p.decls(locals, secLocal)
+	switch p.tok() {
+	case token.BEGIN, token.ASM:
+		p.compound(locals)
+		p.got(token.SEMICOLON)
+	}
+	return obj, owner, params
+}
+
+func (p *parser) isRoutineDirective() bool {
+	tok := p.tok()
+	if tok != token.IDENT && !tok.IsDirective() && !tok.IsKeyword() {
+		return false
+	}
+	return routineDirectives[strings.ToLower(p.lit())]
+}
+
+// declareBuiltin declares an implicit name such as Self or Result.
+func (p *parser) declareBuiltin(scope *ast.Scope, name string, kind ast.ObjKind) *ast.Object {
+	obj := ast.NewObj(kind, name)
+	scope.Insert(obj)
+	return obj
+}
+
+// localType finds a type declared in the current unit.
+func (p *parser) localType(scope *ast.Scope, name string) *ast.Object {
+	for _, s := range []*ast.Scope{scope, p.unit.Implementation, p.unit.Interface} {
+		if s == nil {
+			continue
+		}
+		if obj := s.Lookup(name); obj != nil && obj.Kind == ast.ObjTyp {
+			return obj
+		}
+	}
+	return nil
+}
+
+// existingRoutine finds an earlier (interface or forward) declaration of
+// a routine implemented in the current section.
+func (p *parser) existingRoutine(scope *ast.Scope, name string, sec section) *ast.Object {
+	scopes := []*ast.Scope{scope}
+	if sec == secImplementation && p.unit.Interface != scope {
+		scopes = append(scopes, p.unit.Interface)
+	}
+	for _, s := range scopes {
+		if obj := s.Lookup(name); obj != nil && obj.Kind == ast.ObjFun {
+			return obj
+		}
+	}
+	return nil
+}
+
+// statements
+
+// compound parses a statement starting with BEGIN, TRY, CASE, ASM,
+// INITIALIZATION or FINALIZATION up to and including its END.
+func (p *parser) compound(scope *ast.Scope) {
+	opener := p.tok()
+	p.next()
+	if opener == token.ASM {
+		// assembler blocks reference registers and labels,
+		// they are not resolved
+		for tok := p.tok(); tok != token.END && tok != token.EOF; tok = p.tok() {
+			p.next()
+		}
+		p.got(token.END)
+		return
+	}
+
+	p.statements(scope, false)
+	p.got(token.END)
+}
+
+// statements parses statements. When single is set it stops after a
+// single statement, otherwise it stops before the END of the enclosing
+// compound statement.
+func (p *parser) statements(scope *ast.Scope, single bool) {
+	var sel selection
+	ifs := 0
+	depth := 0
+	for tok := p.tok(); tok != token.EOF; tok = p.tok() {
+		switch tok {
+		case token.END:
+			return
+		case token.SEMICOLON, token.UNTIL, token.EXCEPT, token.FINALLY:
+			if single && depth == 0 {
+				return
+			}
+		case token.ELSE:
+			if single && depth == 0 {
+				if ifs == 0 {
+					return
+				}
+				ifs--
+			}
+		case token.IF:
+			ifs++
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			depth--
+		case token.BEGIN, token.TRY, token.CASE, token.ASM:
+			p.compound(scope)
+			sel = selection{}
+			continue
+		case token.WITH:
+			p.with(scope)
+			sel = selection{}
+			continue
+		case token.PROCEDURE, token.FUNCTION:
+			p.anonymous(scope)
+			sel = selection{}
+			continue
+		case token.IDENT:
+			if sel.last == nil && !sel.selector && strings.EqualFold(p.lit(), "on") && p.handler(scope) {
+				sel = selection{}
+				continue
+			}
+		}
+		p.expr(scope, &sel)
+	}
+}
+
+// anonymous parses an anonymous method "procedure(X: T) begin ... end"
+// declaring its parameters, result and local declarations in its own
+// scope, as for nested routines.
+func (p *parser) anonymous(scope *ast.Scope) {
+	p.next() // procedure, function
+	locals := ast.NewScope(scope)
+	p.params(locals)
+	if p.got(token.COLON) {
+		// a type name, typeSpec would continue into the body
+		result := p.declareBuiltin(locals, "Result", ast.ObjVar)
+		result.Type = p.typeName(scope)
+	}
+	p.decls(locals, secLocal)
+	switch p.tok() {
+	case token.BEGIN, token.ASM:
+		p.compound(locals)
+	}
+}
+
+// with parses "with a, b do statement".
+func (p *parser) with(scope *ast.Scope) {
+	p.next() // with
+
+	var subjects []*ast.Ident
+	var sel selection
+	depth := 0
+	for tok := p.tok(); tok != token.DO && tok != token.EOF; tok = p.tok() {
+		switch tok {
+		case token.LPAREN, token.LBRACK:
+			depth++
+		case token.RPAREN, token.RBRACK:
+			depth--
+		case token.COMMA:
+			if depth == 0 {
+				subjects = append(subjects, sel.last)
+			}
+		}
+		p.expr(scope, &sel)
+	}
+	subjects = append(subjects, sel.last)
+	p.got(token.DO)
+
+	inner := ast.NewScope(scope)
+	p.prog.withs[inner] = subjects
+	p.statements(inner, true)
+}
+
+// handler parses an exception handler "on E: Exception do statement".
+// It reports false when the current "on" is not a handler.
+func (p *parser) handler(scope *ast.Scope) bool {
+	// on E: T do, on T do, on Unit.T do
+	n := 1
+	switch {
+	case isName(p.peek(1)) && p.peek(2) == token.COLON:
+		n = 3
+	}
+	for isName(p.peek(n)) && p.peek(n+1) == token.PERIOD {
+		n += 2
+	}
+	if !isName(p.peek(n)) || p.peek(n+1) != token.DO {
+		return false
+	}
+
+	p.next() // on
+	inner := ast.NewScope(scope)
+	var obj *ast.Object
+	if p.peek(1) == token.COLON {
+		obj = p.declare(inner, p.ident(), ast.ObjVar)
+		p.next()
+	}
+	typ := p.typeName(scope)
+	if obj != nil {
+		obj.Type = typ
+	}
+	p.got(token.DO)
+	p.statements(inner, true)
+	return true
+}
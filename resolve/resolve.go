@@ -0,0 +1,317 @@
+// Package resolve binds Delphi identifiers to their declarations.
+//
+// A Program loads units following their uses clauses, declares every
+// unit, class, routine and local entity in nested scopes and then binds
+// each identifier reference (ast.Ident.Obj) to the declaring object.
+//
+// Lookups follow the Delphi scoping rules: locals, then members of the
+// enclosing class (including ancestors), the unit itself and finally the
+// used units, where units later in the uses list shadow earlier ones.
+//
+// The resolver works on the token stream and does not type-check. Member
+// selections (X.Y) are resolved when the type of X is a named class,
+// record or interface type; otherwise they are left unbound.
+package resolve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/raintreeinc/delphi/ast"
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// Program is a set of units that reference each other.
+type Program struct {
+	Fset    *token.FileSet
+	Defines []string
+
+	// Find returns the source file for the named unit.
+	Find func(unitname string) (filename string, ok bool)
+	// FindInclude returns the file for an {$I name} directive, when
+	// it is not found next to the including file.
+	FindInclude func(name string) (filename string, ok bool)
+
+	Units map[string]*Unit // keyed by canonical (lower-case) unit name
+	Order []*Unit          // units in load order
+
+	universe *ast.Scope
+	refs     map[*ast.Ident]*ref
+	classes  map[*ast.Scope]*ast.Object // member scopes and their class
+	withs    map[*ast.Scope][]*ast.Ident
+	uses     map[*ast.Scope][]*Unit
+	isClass  map[*ast.Object]bool
+}
+
+// Unit is a single loaded unit, program or library.
+type Unit struct {
+	Name   string
+	Path   string      // empty if the source was not found
+	Kind   token.Token // UNIT, PROGRAM, LIBRARY or PACKAGE
+	Object *ast.Object // unit object, Data is the Interface scope
+
+	Interface      *ast.Scope
+	Implementation *ast.Scope // for programs the main scope
+
+	Uses     []string // units used in interface (or program)
+	ImplUses []string // units used in implementation
+	Missing  []string // used units whose source was not found
+
+	// Paths lists the "uses Name in 'path'" entries of programs and the
+	// contains clause of packages.
+	Paths []UsesPath
+
+	// Idents lists every identifier in the unit in source order,
+	// both declarations and references.
+	Idents []*ast.Ident
+	// Unresolved lists references that could not be bound.
+	Unresolved []*ast.Ident
+	// Errors lists syntax errors encountered while scanning.
+	Errors scanner.ErrorList
+
+	// Decls lists the top-level declarations in source order.
+	Decls []*Decl
+	// Classes lists the class, object and interface types declared in
+	// the unit, nested and local types included, in source order.
+	Classes []*Class
+	// Layout contains source positions of the unit structure.
+	Layout Layout
+
+	refs []*ref
+}
+
+// UsesPath is a uses clause entry with an explicit source path.
+type UsesPath struct {
+	Unit   *Unit
+	Path   string    // path as written, without quotes
+	Lit    string    // string literal, including quotes
+	LitPos token.Pos // position of the string literal
+}
+
+// Decl is the source range of a top-level declaration. Declarations in
+// include files are not listed.
+type Decl struct {
+	Objs  []*ast.Object // declared objects, "var a, b: T" declares two
+	Class *ast.Object   // outermost class of a method implementation
+
+	// Keyword is the section keyword (TYPE, CONST, VAR, ...) or, for
+	// routines, the first token of the heading.
+	Keyword        token.Token
+	KeywordPos     token.Pos
+	Implementation bool // declared in the implementation section
+
+	Pos token.Pos // start of the name, or of the routine heading
+	End token.Pos // after the terminating ';'
+
+	Params int // number of parameters of a routine
+}
+
+// Class is a class, object or interface type declaration with a body or
+// an ancestor list.
+type Class struct {
+	Object   *ast.Object // the type, Data is the member scope
+	Kind     token.Token // CLASS, OBJECT, INTERFACE or DISPINTERFACE
+	Ancestor string      // first type of the ancestor list, unqualified
+	Methods  []*Method   // in source order
+}
+
+// Method is a routine heading in a class body. Interface method mappings
+// such as "procedure IFoo.Bar = Baz;" are not listed.
+type Method struct {
+	Name string
+	Pos  token.Pos // start of the name
+
+	// Keyword is the first token of the heading after class, IDENT for
+	// class operators.
+	Keyword     token.Token
+	ClassMethod bool
+	Params      int // number of parameters
+
+	// Visibility is the visibility section of the method, ILLEGAL
+	// before the first section. Such methods are published in classes
+	// compiled with {$M+} and public otherwise.
+	Visibility token.Token
+	Attributes []*Attribute
+}
+
+// Attribute is an attribute such as [TestCase('A', '1,2')] preceding a
+// declaration.
+type Attribute struct {
+	Name string   // last part of the name as written
+	Args []string // source of each argument, string literals are quoted
+}
+
+// Layout describes where the parts of a unit are located.
+type Layout struct {
+	Header         token.Pos // after the ';' ending the unit header
+	Interface      token.Pos // after the interface keyword
+	Implementation token.Pos // start of the implementation keyword
+	Body           token.Pos // after the implementation keyword
+	End            token.Pos // start of initialization, begin or the final end
+
+	Clauses []*UsesClause
+}
+
+// UsesClause is a uses clause, or the contains clause of a package.
+type UsesClause struct {
+	Implementation bool
+	Pos            token.Pos // start of the uses keyword
+	End            token.Pos // start of the terminating ';'
+	Entries        []UsesEntry
+}
+
+// UsesEntry is a single unit in a uses clause.
+type UsesEntry struct {
+	Unit *Unit
+	Pos  token.Pos // start of the unit name
+	End  token.Pos // after the name or the in path
+}
+
+// Found reports whether the unit source was loaded.
+func (unit *Unit) Found() bool { return unit.Path != "" }
+
+// NewProgram creates an empty program that uses find to locate units.
+func NewProgram(find func(unitname string) (string, bool), defines []string) *Program {
+	return &Program{
+		Fset:    token.NewFileSet(),
+		Defines: defines,
+		Find:    find,
+
+		Units: make(map[string]*Unit),
+
+		universe: newUniverse(),
+		refs:     make(map[*ast.Ident]*ref),
+		classes:  make(map[*ast.Scope]*ast.Object),
+		withs:    make(map[*ast.Scope][]*ast.Ident),
+		uses:     make(map[*ast.Scope][]*Unit),
+		isClass:  make(map[*ast.Object]bool),
+	}
+}
+
+// Canonical returns the canonical form of a Delphi identifier.
+func Canonical(name string) string { return strings.ToLower(name) }
+
+// LoadFile loads a unit or program file and all the units it uses.
+func (prog *Program) LoadFile(filename string) (*Unit, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return prog.LoadSource(filename, src)
+}
+
+// LoadSource loads a unit or program from src and all the units it uses.
+func (prog *Program) LoadSource(filename string, src []byte) (*Unit, error) {
+	name := trimExt(filepath.Base(filename))
+	if unit, ok := prog.Units[Canonical(name)]; ok && unit.Found() {
+		return unit, nil
+	}
+
+	unit := prog.unit(name)
+	unit.Path = filename
+	prog.Order = append(prog.Order, unit)
+
+	p := &parser{prog: prog, unit: unit}
+	p.init(filename, src)
+	if len(p.items) == 0 {
+		return unit, fmt.Errorf("%s: no source", filename)
+	}
+	p.parseFile()
+
+	if len(unit.Errors) > 0 {
+		return unit, unit.Errors.Err()
+	}
+	return unit, nil
+}
+
+// Lookup returns the loaded unit with the given name.
+func (prog *Program) Lookup(unitname string) *Unit {
+	return prog.Units[Canonical(unitname)]
+}
+
+// unit returns the unit with name, creating a placeholder if needed.
+func (prog *Program) unit(name string) *Unit {
+	cname := Canonical(name)
+	if unit, ok := prog.Units[cname]; ok {
+		return unit
+	}
+
+	unit := &Unit{Name: name}
+	unit.Object = ast.NewObj(ast.ObjMod, name)
+	prog.Units[cname] = unit
+	return unit
+}
+
+// use returns the unit with name, loading it when necessary.
+// inpath is the path from a program "uses X in 'path'" clause.
+func (prog *Program) use(from *Unit, name, inpath string) *Unit {
+	unit := prog.unit(name)
+	if unit.Found() || unit.Interface != nil {
+		return unit
+	}
+
+	filename := ""
+	if inpath != "" {
+		filename = inpath
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(from.Path), filename)
+		}
+	} else if prog.Find != nil {
+		filename, _ = prog.Find(name)
+	}
+
+	if filename != "" {
+		if _, err := prog.LoadFile(filename); err == nil || unit.Found() {
+			return unit
+		}
+	}
+
+	from.Missing = appendUnique(from.Missing, name)
+	return unit
+}
+
+// Resolve binds all references in loaded units to their declarations
+// and collects unresolved identifiers.
+func (prog *Program) Resolve() {
+	for _, unit := range prog.Order {
+		for _, r := range unit.refs {
+			prog.resolve(r)
+		}
+	}
+
+	for _, unit := range prog.Order {
+		unit.Unresolved = nil
+		for _, r := range unit.refs {
+			if r.ident.Obj == nil && !r.unknown {
+				unit.Unresolved = append(unit.Unresolved, r.ident)
+			}
+		}
+	}
+}
+
+// Unresolved returns unresolved identifiers of all units as errors.
+func (prog *Program) Unresolved() scanner.ErrorList {
+	var list scanner.ErrorList
+	for _, unit := range prog.Order {
+		for _, ident := range unit.Unresolved {
+			list.Add(prog.Fset.Position(ident.NamePos), "undeclared identifier: "+ident.Name)
+		}
+	}
+	return list
+}
+
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return list
+		}
+	}
+	return append(list, value)
+}
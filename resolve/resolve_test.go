@@ -0,0 +1,401 @@
+package resolve_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintreeinc/delphi/ast"
+	"github.com/raintreeinc/delphi/resolve"
+	"github.com/raintreeinc/delphi/token"
+)
+
+var sources = map[string]string{
+	"First.pas": `unit First;
+interface
+var
+  Shared: Integer;
+function Compute(X: Integer): Integer;
+implementation
+function Compute(X: Integer): Integer;
+begin
+  Result := X * 2;
+end;
+end.`,
+
+	"Second.pas": `unit Second;
+interface
+type
+  TShape = class(TObject)
+  private
+    FSize: Integer;
+  public
+    Shared: Integer;
+    function Area: Integer; virtual;
+    property Size: Integer read FSize write FSize;
+  end;
+
+  TSquare = class(TShape)
+  public
+    function Area: Integer; override;
+  end;
+
+var
+  Shared: string;
+
+implementation
+
+function TShape.Area: Integer;
+begin
+  Result := FSize;
+end;
+
+function TSquare.Area: Integer;
+begin
+  Result := inherited Area * Size + Shared;
+end;
+
+end.`,
+
+	"Main.dpr": `program Main;
+uses
+  First,
+  Second;
+
+var
+  Square: TSquare;
+
+procedure Run;
+var
+  Compute: Integer;
+begin
+  Compute := First.Compute(1);
+  Square.Size := Compute;
+  with Square do
+    Area;
+  Shared := Missing;
+end;
+
+begin
+  Run;
+end.`,
+}
+
+func load(t *testing.T, sources map[string]string, main string) (*resolve.Program, *resolve.Unit) {
+	dir, err := ioutil.TempDir("", "resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, src := range sources {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prog := resolve.NewProgram(func(unitname string) (string, bool) {
+		path := filepath.Join(dir, unitname+".pas")
+		_, err := os.Stat(path)
+		return path, err == nil
+	}, nil)
+
+	unit, err := prog.LoadFile(filepath.Join(dir, main))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog.Resolve()
+	return prog, unit
+}
+
+// find returns the n-th identifier with name in unit.
+func find(t *testing.T, unit *resolve.Unit, name string, n int) *ast.Ident {
+	for _, ident := range unit.Idents {
+		if strings.EqualFold(ident.Name, name) {
+			if n == 0 {
+				return ident
+			}
+			n--
+		}
+	}
+	t.Fatalf("%s: identifier %s not found", unit.Name, name)
+	return nil
+}
+
+func TestResolve(t *testing.T) {
+	prog, main := load(t, sources, "Main.dpr")
+	first, second := prog.Lookup("First"), prog.Lookup("Second")
+
+	compute := first.Interface.Lookup("Compute")
+	if compute == nil {
+		t.Fatal("First.Compute not declared")
+	}
+	if impl := find(t, first, "Compute", 1); impl.Obj != compute {
+		t.Errorf("implementation of Compute not bound to its declaration")
+	}
+
+	// local variable shadows the unit function
+	if ident := find(t, main, "Compute", 1); ident.Obj == compute || ident.Obj == nil || ident.Obj.Kind != ast.ObjVar {
+		t.Errorf("local Compute bound to %v", ident.Obj)
+	}
+	// qualified reference
+	if ident := find(t, main, "Compute", 2); ident.Obj != compute {
+		t.Errorf("First.Compute bound to %v", ident.Obj)
+	}
+
+	// later units shadow earlier ones
+	shared := second.Interface.Lookup("Shared")
+	if ident := find(t, main, "Shared", 0); ident.Obj != shared {
+		t.Errorf("Shared bound to %v, expected Second.Shared", ident.Obj)
+	}
+
+	shape := second.Interface.Lookup("TShape").Data.(*ast.Scope)
+	square := second.Interface.Lookup("TSquare").Data.(*ast.Scope)
+
+	// members through a variable and a with statement
+	if ident := find(t, main, "Size", 0); ident.Obj != shape.Lookup("Size") {
+		t.Errorf("Square.Size bound to %v", ident.Obj)
+	}
+	if ident := find(t, main, "Area", 0); ident.Obj != square.Lookup("Area") {
+		t.Errorf("with Square do Area bound to %v", ident.Obj)
+	}
+
+	// method implementation, inherited and member shadowing
+	if ident := find(t, second, "Area", 3); ident.Obj != square.Lookup("Area") {
+		t.Errorf("TSquare.Area implementation bound to %v", ident.Obj)
+	}
+	if ident := find(t, second, "Area", 4); ident.Obj != shape.Lookup("Area") {
+		t.Errorf("inherited Area bound to %v", ident.Obj)
+	}
+	if ident := find(t, second, "Shared", 2); ident.Obj != shape.Lookup("Shared") {
+		t.Errorf("Shared inside method bound to %v, expected field", ident.Obj)
+	}
+
+	if len(main.Unresolved) != 1 || main.Unresolved[0].Name != "Missing" {
+		t.Errorf("unresolved %v, expected [Missing]", names(main.Unresolved))
+	}
+	for _, unit := range []*resolve.Unit{first, second} {
+		if len(unit.Unresolved) > 0 {
+			t.Errorf("%s: unexpected unresolved %v", unit.Name, names(unit.Unresolved))
+		}
+	}
+}
+
+func names(idents []*ast.Ident) []string {
+	var list []string
+	for _, ident := range idents {
+		list = append(list, ident.Name)
+	}
+	return list
+}
+
+func TestNestedVariant(t *testing.T) {
+	src := map[string]string{"Variants.pas": `unit Variants;
+interface
+type
+  TValue = record
+    Tag: Byte;
+    case Kind: Byte of
+      0: (I: Integer);
+      1: (case B: Byte of 0: (X: Integer); 1: (Y: Byte));
+  end;
+
+var
+  Value: TValue;
+
+implementation
+
+initialization
+  Value.Y := 1;
+end.`}
+
+	done := make(chan *resolve.Unit)
+	go func() {
+		_, unit := load(t, src, "Variants.pas")
+		done <- unit
+	}()
+
+	var unit *resolve.Unit
+	select {
+	case unit = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parsing a nested variant part does not terminate")
+	}
+
+	value := unit.Interface.Lookup("TValue").Data.(*ast.Scope)
+	if ident := find(t, unit, "Y", 1); ident.Obj == nil || ident.Obj != value.Lookup("Y") {
+		t.Errorf("Value.Y bound to %v", ident.Obj)
+	}
+	if unit.Interface.Lookup("Value") == nil {
+		t.Errorf("declarations after the record are missing")
+	}
+	if len(unit.Unresolved) > 0 {
+		t.Errorf("unexpected unresolved %v", names(unit.Unresolved))
+	}
+}
+
+func TestOperatorsAndReferences(t *testing.T) {
+	src := map[string]string{"Ops.pas": `unit Ops;
+interface
+type
+  TProc = reference to procedure(X: Integer);
+  TFunc = reference to function(const S: string): Boolean;
+
+  TVec = record
+    X, Y: Integer;
+    class operator Add(const A, B: TVec): TVec;
+    class operator Implicit(V: Integer): TVec;
+  end;
+
+procedure Each(P: TProc; F: TFunc);
+
+implementation
+
+class operator TVec.Add(const A, B: TVec): TVec;
+begin
+  Result.X := A.X + B.X;
+end;
+
+class operator TVec.Implicit(V: Integer): TVec;
+begin
+  Result.X := V;
+end;
+
+procedure Each(P: TProc; F: TFunc);
+begin
+  if F('x') then
+    P(1);
+end;
+
+end.`}
+
+	_, unit := load(t, src, "Ops.pas")
+	if len(unit.Unresolved) > 0 {
+		t.Errorf("unexpected unresolved %v", names(unit.Unresolved))
+	}
+
+	vec := unit.Interface.Lookup("TVec").Data.(*ast.Scope)
+	if ident := find(t, unit, "Add", 1); ident.Obj == nil || ident.Obj != vec.Lookup("Add") {
+		t.Errorf("TVec.Add implementation bound to %v", ident.Obj)
+	}
+	if ident := find(t, unit, "X", 4); ident.Obj != vec.Lookup("X") {
+		t.Errorf("A.X bound to %v", ident.Obj)
+	}
+	if obj := unit.Interface.Lookup("X"); obj != nil {
+		t.Errorf("parameter X of TProc declared in the unit scope")
+	}
+}
+
+func TestClasses(t *testing.T) {
+	src := map[string]string{"Classes.pas": `unit Classes;
+interface
+type
+  [Fixture]
+  TBox<T> = class(Base.TBase, IBox)
+    FValue: T;
+    procedure IBox.Put = SetValue;
+  private
+    procedure SetValue(const Value: T);
+  public
+    [Check('a', Length('bc')), Skip]
+    class function Make(A, B: T): TBox<T>;
+    constructor Create;
+  end;
+
+  TForward = class;
+  TRef = class of TBox;
+
+procedure Run(X, Y: Integer; Z: Byte);
+
+implementation
+
+procedure Run(X, Y: Integer; Z: Byte);
+begin
+end;
+
+end.`}
+
+	_, unit := load(t, src, "Classes.pas")
+
+	if len(unit.Classes) != 1 {
+		t.Fatalf("got %d classes, expected TBox", len(unit.Classes))
+	}
+	box := unit.Classes[0]
+	if box.Object != unit.Interface.Lookup("TBox") || box.Kind != token.CLASS || box.Ancestor != "TBase" {
+		t.Errorf("got class %v %v(%v)", box.Object.Name, box.Kind, box.Ancestor)
+	}
+
+	var methods []string
+	for _, m := range box.Methods {
+		var attrs []string
+		for _, attr := range m.Attributes {
+			attrs = append(attrs, attr.Name+"("+strings.Join(attr.Args, ";")+")")
+		}
+		methods = append(methods, fmt.Sprintf("%v %v %v class=%v params=%v %v", m.Visibility, m.Keyword, m.Name, m.ClassMethod, m.Params, attrs))
+	}
+	exp := []string{
+		"private procedure SetValue class=false params=1 []",
+		"public function Make class=true params=2 [Check('a';Length('bc')) Skip()]",
+		"public constructor Create class=false params=0 []",
+	}
+	if !reflect.DeepEqual(methods, exp) {
+		t.Errorf("got methods:\n\t%v\nexpected:\n\t%v", methods, exp)
+	}
+
+	for _, decl := range unit.Decls {
+		if decl.Objs[0].Name == "Run" && decl.Params != 3 {
+			t.Errorf("Run declared with %d parameters, expected 3", decl.Params)
+		}
+	}
+	if ident := find(t, unit, "T", 2); ident.Obj == nil || ident.Obj.Kind != ast.ObjTyp {
+		t.Errorf("type parameter T bound to %v", ident.Obj)
+	}
+}
+
+func TestAnonymousMethods(t *testing.T) {
+	src := map[string]string{"Anon.pas": `unit Anon;
+interface
+type
+  TProc = reference to procedure(X: Integer);
+  TFunc = reference to function(S: string): Integer;
+
+procedure Run;
+
+implementation
+
+procedure Run;
+var
+  P: TProc;
+  F: TFunc;
+begin
+  P := procedure(Z: Integer)
+    var
+      Twice: Integer;
+    begin
+      Twice := Z * 2;
+    end;
+  F := function(S: string): Integer
+    begin
+      Result := Length(S);
+    end;
+  P(F('abc'));
+end;
+
+end.`}
+
+	_, unit := load(t, src, "Anon.pas")
+	if len(unit.Unresolved) > 0 {
+		t.Errorf("unexpected unresolved %v", names(unit.Unresolved))
+	}
+	if ident := find(t, unit, "Z", 1); ident.Obj == nil || ident.Obj != find(t, unit, "Z", 0).Obj {
+		t.Errorf("parameter Z bound to %v", ident.Obj)
+	}
+	if ident := find(t, unit, "P", 2); ident.Obj == nil || ident.Obj.Kind != ast.ObjVar {
+		t.Errorf("P after the anonymous methods bound to %v", ident.Obj)
+	}
+}
@@ -0,0 +1,67 @@
+package resolve
+
+import (
+	"strings"
+
+	"github.com/raintreeinc/delphi/ast"
+)
+
+// Predeclared entities of the System unit.
+var (
+	universeTypes = `
+		Boolean ByteBool WordBool LongBool
+		Byte ShortInt Word SmallInt Cardinal LongWord Integer LongInt Int64 UInt64
+		NativeInt NativeUInt
+		Char AnsiChar WideChar PChar PAnsiChar PWideChar
+		String AnsiString WideString UnicodeString ShortString RawByteString
+		Real Real48 Single Double Extended Currency Comp
+		Pointer Variant OleVariant TVarRec TDateTime TextFile Text File
+		HRESULT TGUID PGUID TClass IInterface IUnknown IDispatch
+		TInterfacedObject PInteger PByte PWord PCardinal PExtended PDouble PVariant
+		THandle TMethod TBoundArray`
+
+	universeConsts = `True False MaxInt MaxLongInt Pi`
+
+	universeVars = `
+		ExitCode ErrorAddr DebugHook IsConsole IsLibrary MainThreadID
+		Input Output ErrOutput HInstance MainInstance RandSeed FileMode`
+
+	universeFuncs = `
+		Abs Addr Append Assert Assign AssignFile Assigned BlockRead BlockWrite
+		Break ChDir Chr Close CloseFile Concat Continue Copy Cos Dec Delete
+		Dispose Eof Eoln Erase Exclude Exit Exp FilePos FileSize FillChar
+		Finalize Flush Frac FreeMem GetDir GetMem Halt Hi High Inc Include
+		Initialize Insert Int IOResult Length Ln Lo Low MkDir Move New Odd Ord
+		ParamCount ParamStr Pos Pred Ptr Random Randomize Read ReadLn ReallocMem
+		Rename Reset Rewrite RmDir Round RunError Seek SeekEof SeekEoln SetLength
+		SetString Sin SizeOf Slice Sqr Sqrt Str Succ Swap Trunc TypeInfo TypeOf
+		UpCase Val VarClear VarIsNull Write WriteLn ArcTan`
+
+	tobjectMembers = `
+		Create Free Destroy ClassName ClassNameIs ClassType ClassParent ClassInfo
+		InstanceSize InheritsFrom MethodAddress MethodName FieldAddress
+		GetInterface AfterConstruction BeforeDestruction Dispatch DefaultHandler
+		NewInstance FreeInstance InitInstance CleanupInstance SafeCallException`
+)
+
+func newUniverse() *ast.Scope {
+	universe := ast.NewScope(nil)
+	declareAll(universe, ast.ObjTyp, universeTypes)
+	declareAll(universe, ast.ObjCon, universeConsts)
+	declareAll(universe, ast.ObjVar, universeVars)
+	declareAll(universe, ast.ObjFun, universeFuncs)
+
+	tobject := ast.NewObj(ast.ObjTyp, "TObject")
+	members := ast.NewScope(universe)
+	declareAll(members, ast.ObjFun, tobjectMembers)
+	tobject.Data = members
+	universe.Insert(tobject)
+
+	return universe
+}
+
+func declareAll(scope *ast.Scope, kind ast.ObjKind, names string) {
+	for _, name := range strings.Fields(names) {
+		scope.Insert(ast.NewObj(kind, name))
+	}
+}
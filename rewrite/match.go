@@ -0,0 +1,296 @@
+package rewrite
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// Match is code matching a pattern.
+type Match struct {
+	Start, End   int // byte offsets of the matched code
+	Line, Column int // position of Start, 1-based
+
+	// Vars is the code matched by each metavariable, as written.
+	Vars map[string]string
+}
+
+// Code returns the matched code.
+func (match *Match) Code(src []byte) string { return string(src[match.Start:match.End]) }
+
+// span is a scanned source token.
+type span struct {
+	tok        token.Token
+	text       string // normalized text
+	start, end int
+}
+
+// segments splits the active code of src into runs of tokens that are
+// not interrupted by compiler directives or inactive code.
+func segments(src []byte, defines []string) (*token.File, [][]span) {
+	conds := scanner.NewConditions(defines)
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, 0)
+
+	var all [][]span
+	var current []span
+	flush := func() {
+		if len(current) > 0 {
+			all = append(all, current)
+			current = nil
+		}
+	}
+
+	for {
+		pos, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.CDIRECTIVE {
+			flush()
+			conds.Directive(lit)
+			continue
+		}
+		if !conds.Active() {
+			continue
+		}
+
+		start := file.Offset(pos)
+		text := lit
+		if text == "" {
+			text = tok.String()
+		}
+		current = append(current, span{
+			tok:   tok,
+			text:  normalize(tok, lit),
+			start: start,
+			end:   start + len(text),
+		})
+	}
+	flush()
+
+	return file, all
+}
+
+// Find returns the non-overlapping matches of the pattern in src,
+// conditional code is evaluated with defines.
+func (p *Pattern) Find(src []byte, defines []string) []*Match {
+	file, segs := segments(src, defines)
+
+	var matches []*Match
+	for _, seg := range segs {
+		m := &matcher{pattern: p, spans: seg}
+		for at := 0; at < len(seg); {
+			m.vars = map[string][2]int{}
+			end, ok := m.match(0, at)
+			if !ok {
+				at++
+				continue
+			}
+
+			match := &Match{
+				Start: seg[at].start,
+				End:   seg[end-1].end,
+				Vars:  map[string]string{},
+			}
+			position := file.Position(file.Pos(match.Start))
+			match.Line, match.Column = position.Line, position.Column
+			for name, r := range m.vars {
+				if r[0] < r[1] {
+					match.Vars[name] = string(src[seg[r[0]].start:seg[r[1]-1].end])
+				} else {
+					match.Vars[name] = ""
+				}
+			}
+			matches = append(matches, match)
+			at = end
+		}
+	}
+
+	sort.Slice(matches, func(i, k int) bool { return matches[i].Start < matches[k].Start })
+	return matches
+}
+
+// matcher matches a pattern against a segment with backtracking.
+type matcher struct {
+	pattern *Pattern
+	spans   []span
+	vars    map[string][2]int // bound span ranges of the metavariables
+}
+
+// match matches the pattern items from pi against the spans from si, it
+// returns the end of the match.
+func (m *matcher) match(pi, si int) (int, bool) {
+	items := m.pattern.items
+	if pi == len(items) {
+		return si, true
+	}
+
+	it := items[pi]
+	if !it.meta {
+		if si < len(m.spans) && equal(it.tok, it.text, m.spans[si]) {
+			return m.match(pi+1, si+1)
+		}
+		return 0, false
+	}
+
+	if bound, ok := m.vars[it.text]; ok {
+		n := bound[1] - bound[0]
+		if si+n > len(m.spans) {
+			return 0, false
+		}
+		for i := 0; i < n; i++ {
+			s := m.spans[bound[0]+i]
+			if !equal(s.tok, s.text, m.spans[si+i]) {
+				return 0, false
+			}
+		}
+		return m.match(pi+1, si+n)
+	}
+
+	ends := m.extents(si, it.kind)
+	if pi == len(items)-1 {
+		// nothing follows, take the longest
+		for i, k := 0, len(ends)-1; i < k; i, k = i+1, k-1 {
+			ends[i], ends[k] = ends[k], ends[i]
+		}
+	}
+	for _, end := range ends {
+		m.vars[it.text] = [2]int{si, end}
+		if result, ok := m.match(pi+1, end); ok {
+			return result, true
+		}
+	}
+	delete(m.vars, it.text)
+	return 0, false
+}
+
+// extents returns the possible ends of a metavariable starting at si,
+// shortest first. Each extent has balanced brackets and blocks.
+func (m *matcher) extents(si int, kind kind) []int {
+	var ends []int
+	if kind == block {
+		ends = append(ends, si)
+	}
+
+	var closers []token.Token
+	for i := si; i < len(m.spans); i++ {
+		tok := m.spans[i].tok
+		switch {
+		case len(closers) > 0 && tok == closers[len(closers)-1]:
+			closers = closers[:len(closers)-1]
+		case len(closers) == 0 && (closes(tok) || !allowed(tok, kind)):
+			return ends
+		case len(closers) > 0 && closes(tok) && tok != token.EXCEPT && tok != token.FINALLY:
+			// unbalanced
+			return ends
+		default:
+			if closer, ok := openers[tok]; ok {
+				closers = append(closers, closer)
+			}
+		}
+		if len(closers) == 0 {
+			ends = append(ends, i+1)
+		}
+	}
+	return ends
+}
+
+// openers are the tokens starting a nested group and the tokens ending it.
+var openers = map[token.Token]token.Token{
+	token.LPAREN: token.RPAREN,
+	token.LBRACK: token.RBRACK,
+	token.BEGIN:  token.END,
+	token.CASE:   token.END,
+	token.TRY:    token.END,
+	token.ASM:    token.END,
+	token.REPEAT: token.UNTIL,
+}
+
+// closes reports whether tok ends a group or a block section.
+func closes(tok token.Token) bool {
+	switch tok {
+	case token.RPAREN, token.RBRACK, token.END, token.UNTIL, token.EXCEPT, token.FINALLY:
+		return true
+	}
+	return false
+}
+
+// allowed reports whether tok may appear outside of nested groups in a
+// metavariable of kind.
+func allowed(tok token.Token, kind kind) bool {
+	switch kind {
+	case block:
+		return true
+	case statement:
+		return tok != token.SEMICOLON && tok != token.ELSE
+	}
+
+	switch tok {
+	case token.SEMICOLON, token.ASSIGN:
+		return false
+	case token.AND, token.OR, token.XOR, token.NOT, token.DIV, token.MOD,
+		token.SHL, token.SHR, token.IN, token.IS, token.AS, token.NIL, token.INHERITED:
+		return true
+	}
+	return tok.IsDirective() || !tok.IsKeyword()
+}
+
+// equal reports whether the pattern token matches s.
+func equal(tok token.Token, text string, s span) bool {
+	if isWord(tok) && isWord(s.tok) {
+		return text == s.text
+	}
+	return tok == s.tok && text == s.text
+}
+
+// Replace replaces the matches in src with the replacement, the
+// metavariables of the replacement are substituted by the code they
+// matched. Line breaks of the replacement are converted to the line
+// ending used in src.
+func Replace(src []byte, matches []*Match, replacement string) []byte {
+	replacement = withLineEndings(replacement, lineEnding(src))
+	var out []byte
+	last := 0
+	for _, match := range matches {
+		out = append(out, src[last:match.Start]...)
+		out = append(out, Expand(replacement, match)...)
+		last = match.End
+	}
+	return append(out, src[last:]...)
+}
+
+// Expand substitutes the metavariables of the replacement.
+func Expand(replacement string, match *Match) string {
+	return Metavariables(replacement, func(name string) string {
+		if code, ok := match.Vars[name]; ok {
+			return code
+		}
+		return "$" + name
+	})
+}
+
+// lineEnding returns the line ending used by most lines of src.
+func lineEnding(src []byte) string {
+	lf := bytes.Count(src, []byte("\n"))
+	crlf := bytes.Count(src, []byte("\r\n"))
+	if crlf > 0 && crlf >= lf-crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// withLineEndings converts the line breaks of text to ending.
+func withLineEndings(text, ending string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if ending != "\n" {
+		text = strings.Replace(text, "\n", ending, -1)
+	}
+	return text
+}
@@ -0,0 +1,208 @@
+// Package rewrite searches and replaces Delphi code by its structure.
+//
+// A pattern is Delphi code with metavariables, a $ followed by a name:
+//
+//	FreeAndNil($x)
+//	if $c then begin $s end
+//
+// Patterns are matched on the tokens of the active code, hence white
+// space, line breaks and comments between the tokens don't matter, and
+// identifiers and keywords are compared ignoring case. Matches do not
+// span compiler directives or inactive {$IFDEF} branches.
+//
+// A metavariable matches a sequence of tokens with balanced parentheses,
+// brackets and blocks. What else it may contain depends on where it is
+// used in the pattern:
+//
+//   - before end, until, except or finally it matches the statements
+//     of the block, possibly none
+//   - after then, else, do, begin, try, repeat or ; it matches a single
+//     statement
+//   - otherwise it matches part of an expression
+//
+// A metavariable used several times must match the same code each time.
+// Hexadecimal numbers in patterns are written with a leading digit, e.g.
+// $0FF, as $FF is a metavariable.
+//
+// The replacement is text where the metavariables are substituted by the
+// code they matched, as it was written:
+//
+//	pattern, err := rewrite.Compile("FreeAndNil($x)")
+//	...
+//	matches := pattern.Find(src, defines)
+//	src = rewrite.Replace(src, matches, "$x.Free; $x := nil")
+package rewrite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// Pattern is a compiled pattern.
+type Pattern struct {
+	Source string
+	items  []item
+	vars   map[string]bool
+}
+
+// kind is what a metavariable may match.
+type kind int
+
+const (
+	expression kind = iota // part of an expression
+	statement              // a single statement
+	block                  // statements of a block
+)
+
+// item is a token or a metavariable of a pattern.
+type item struct {
+	tok  token.Token
+	text string // normalized text of the token or the metavariable name
+	meta bool
+	kind kind
+}
+
+// placeholder prefixes the identifiers standing in for metavariables
+// while scanning a pattern.
+const placeholder = "__rewrite_"
+
+// Compile parses a pattern.
+func Compile(pattern string) (*Pattern, error) {
+	p := &Pattern{
+		Source: pattern,
+		vars:   map[string]bool{},
+	}
+
+	src := []byte(Metavariables(pattern, func(name string) string {
+		return placeholder + name
+	}))
+
+	var errs []string
+	fset := token.NewFileSet()
+	var sc scanner.Scanner
+	sc.Init(fset.AddFile("", fset.Base(), len(src)), src, func(pos token.Position, msg string) {
+		errs = append(errs, fmt.Sprintf("%d: %s", pos.Column, msg))
+	}, 0)
+
+	for {
+		_, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		switch tok {
+		case token.CDIRECTIVE:
+			return nil, fmt.Errorf("invalid pattern %q: compiler directives are not supported", pattern)
+		case token.ILLEGAL:
+			return nil, fmt.Errorf("invalid pattern %q: illegal character %q", pattern, lit)
+		}
+
+		if tok == token.IDENT && strings.HasPrefix(lit, placeholder) {
+			name := strings.TrimPrefix(lit, placeholder)
+			if n := len(p.items); n > 0 && p.items[n-1].meta {
+				return nil, fmt.Errorf("invalid pattern %q: metavariables $%s and $%s must be separated by code", pattern, p.items[n-1].text, name)
+			}
+			p.items = append(p.items, item{tok: tok, text: name, meta: true})
+			p.vars[name] = true
+			continue
+		}
+		p.items = append(p.items, item{tok: tok, text: normalize(tok, lit)})
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid pattern %q: %s", pattern, strings.Join(errs, ", "))
+	}
+
+	code := false
+	for i := range p.items {
+		if !p.items[i].meta {
+			code = true
+			continue
+		}
+		p.items[i].kind = p.kindOf(i)
+	}
+	if !code {
+		return nil, errors.New("pattern must contain code besides metavariables")
+	}
+
+	return p, nil
+}
+
+// kindOf determines what the metavariable at i may match from the
+// tokens around it.
+func (p *Pattern) kindOf(i int) kind {
+	if i+1 < len(p.items) {
+		switch p.items[i+1].tok {
+		case token.END, token.UNTIL, token.EXCEPT, token.FINALLY:
+			return block
+		}
+	}
+	if i > 0 {
+		switch p.items[i-1].tok {
+		case token.THEN, token.ELSE, token.DO, token.BEGIN, token.TRY, token.REPEAT, token.SEMICOLON:
+			return statement
+		}
+	}
+	return expression
+}
+
+// CheckReplacement verifies that the metavariables of replacement are
+// defined by the pattern.
+func (p *Pattern) CheckReplacement(replacement string) error {
+	var unknown []string
+	Metavariables(replacement, func(name string) string {
+		if !p.vars[name] {
+			unknown = append(unknown, "$"+name)
+		}
+		return ""
+	})
+	if len(unknown) > 0 {
+		return fmt.Errorf("replacement uses %s not defined in the pattern", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Metavariables replaces the metavariables in text with the result of
+// fn, string literals and compiler directives are left unchanged.
+func Metavariables(text string, fn func(name string) string) string {
+	var out strings.Builder
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		if ch == '\'' {
+			quoted = !quoted
+		}
+		directive := i > 0 && text[i-1] == '{'
+		if quoted || directive || ch != '$' || i+1 >= len(text) || !isLetter(text[i+1]) {
+			out.WriteByte(ch)
+			continue
+		}
+
+		end := i + 1
+		for end < len(text) && (isLetter(text[end]) || isDigit(text[end])) {
+			end++
+		}
+		out.WriteString(fn(text[i+1 : end]))
+		i = end - 1
+	}
+	return out.String()
+}
+
+func isLetter(ch byte) bool { return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' }
+func isDigit(ch byte) bool  { return '0' <= ch && ch <= '9' }
+
+// normalize returns the text tokens are compared by.
+func normalize(tok token.Token, lit string) string {
+	switch {
+	case isWord(tok):
+		return strings.ToLower(lit)
+	case lit != "":
+		return lit
+	}
+	return tok.String()
+}
+
+// isWord reports whether tok is an identifier, a keyword or a directive.
+func isWord(tok token.Token) bool { return tok == token.IDENT || tok.IsKeyword() }
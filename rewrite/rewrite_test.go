@@ -0,0 +1,106 @@
+package rewrite
+
+import (
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		pattern, replacement string
+		src, exp             string
+	}{
+		{
+			"FreeAndNil($x)", "$x.Free; $x := nil",
+			"begin FreeAndNil( List ); freeandnil(FItems[I + 1]) end.",
+			"begin List.Free; List := nil; FItems[I + 1].Free; FItems[I + 1] := nil end.",
+		},
+		{
+			"if $c then begin $s end", "if $c then $s",
+			"if Assigned(X) then\n  begin\n    X.Free; { comment }\n  end;\nif Y then begin A; B; end;",
+			"if Assigned(X) then X.Free;;\nif Y then A; B;;",
+		},
+		{
+			"$x := $x + 1", "Inc($x)",
+			"I := I + 1; J := I + 1; A[I] := A [ I ]+1;",
+			"Inc(I); J := I + 1; Inc(A[I]);",
+		},
+		{
+			"$x := nil", "FreeAndNil($x)",
+			"if Assigned(X) then X := nil else Obj.Field := NIL;",
+			"if Assigned(X) then FreeAndNil(X) else FreeAndNil(Obj.Field);",
+		},
+		{
+			"ShowMessage($s)", "Log($s)",
+			"ShowMessage('a' + IntToStr(X)); // ShowMessage(Y)\n{$IFDEF DEBUG}ShowMessage(Z);{$ENDIF}",
+			"Log('a' + IntToStr(X)); // ShowMessage(Y)\n{$IFDEF DEBUG}ShowMessage(Z);{$ENDIF}",
+		},
+		{
+			"try $a finally $b end", "$a",
+			"try try X; finally Y; end; finally Z; end;",
+			"try X; finally Y; end;;",
+		},
+		{
+			"Assert($c);", "",
+			"begin\n  Assert(X > 0);\n  Run(X);\nend;",
+			"begin\n  \n  Run(X);\nend;",
+		},
+		{
+			"$x.Free", "if $x <> nil then\n    $x.Free",
+			"begin\r\n  X.Free;\r\nend;",
+			"begin\r\n  if X <> nil then\r\n    X.Free;\r\nend;",
+		},
+	}
+
+	for _, test := range tests {
+		pattern, err := Compile(test.pattern)
+		if err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+		if err := pattern.CheckReplacement(test.replacement); err != nil {
+			t.Errorf("%q: %v", test.pattern, err)
+			continue
+		}
+
+		src := []byte(test.src)
+		got := string(Replace(src, pattern.Find(src, nil), test.replacement))
+		if got != test.exp {
+			t.Errorf("%q:\ngot      %q\nexpected %q", test.pattern, got, test.exp)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, pattern := range []string{"$x", "$a$b", "{$IFDEF X} A", "A ? B"} {
+		if _, err := Compile(pattern); err == nil {
+			t.Errorf("%q: expected error", pattern)
+		}
+	}
+
+	pattern, err := Compile("FreeAndNil($x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pattern.CheckReplacement("$y.Free; '$z'"); err == nil || err.Error() != "replacement uses $y not defined in the pattern" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestMatchPosition(t *testing.T) {
+	pattern, err := Compile("Screen.Cursor := $v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := []byte("begin\n  screen . cursor :=\n    crHourGlass;\nend.")
+	matches := pattern.Find(src, nil)
+	if len(matches) != 1 {
+		t.Fatalf("got %v matches", len(matches))
+	}
+	match := matches[0]
+	if match.Line != 2 || match.Column != 3 || match.Vars["v"] != "crHourGlass" {
+		t.Errorf("got %v:%v %v", match.Line, match.Column, match.Vars)
+	}
+	if code := match.Code(src); code != "screen . cursor :=\n    crHourGlass" {
+		t.Errorf("got code %q", code)
+	}
+}
@@ -0,0 +1,263 @@
+package scanner
+
+import (
+	"strings"
+)
+
+// Conditions tracks conditional compilation state while scanning.
+//
+// Directives are fed to it in source order through Directive; tokens
+// should be ignored while Active reports false. {$IFDEF}, {$IFNDEF},
+// {$IF}, {$ELSEIF}, {$ELSE}, {$ENDIF}, {$IFEND}, {$DEFINE} and
+// {$UNDEF} are understood. {$IF} expressions support Defined(X), not,
+// and, or and parentheses; anything else is assumed to be true.
+type Conditions struct {
+	defined map[string]bool
+	stack   []condition
+}
+
+type condition struct {
+	parent bool // whether the enclosing branch is active
+	active bool // whether the current branch is active
+	taken  bool // whether some branch has already been active
+}
+
+// NewConditions creates conditional compilation state with the given
+// symbols defined.
+func NewConditions(defines []string) *Conditions {
+	conds := &Conditions{defined: make(map[string]bool)}
+	for _, define := range defines {
+		if define = strings.TrimSpace(define); define != "" {
+			conds.Define(define)
+		}
+	}
+	return conds
+}
+
+// Define defines a conditional symbol.
+func (conds *Conditions) Define(name string) { conds.defined[strings.ToLower(name)] = true }
+
+// Undefine removes a conditional symbol.
+func (conds *Conditions) Undefine(name string) { delete(conds.defined, strings.ToLower(name)) }
+
+// IsDefined reports whether a conditional symbol is defined.
+func (conds *Conditions) IsDefined(name string) bool { return conds.defined[strings.ToLower(name)] }
+
+// Active reports whether code at the current position is compiled.
+func (conds *Conditions) Active() bool {
+	if len(conds.stack) == 0 {
+		return true
+	}
+	return conds.stack[len(conds.stack)-1].active
+}
+
+// Directive updates the state for a compiler directive literal such as
+// "{$IFDEF DEBUG}". It reports whether lit was a conditional compilation
+// directive.
+func (conds *Conditions) Directive(lit string) bool {
+	name, arg := SplitDirective(lit)
+	switch name {
+	case "IFDEF":
+		conds.push(conds.IsDefined(arg))
+	case "IFNDEF":
+		conds.push(!conds.IsDefined(arg))
+	case "IFOPT":
+		conds.push(true)
+	case "IF":
+		conds.push(conds.eval(arg))
+	case "ELSEIF":
+		if top := conds.top(); top != nil {
+			ok := !top.taken && conds.eval(arg)
+			top.active = top.parent && ok
+			top.taken = top.taken || ok
+		}
+	case "ELSE":
+		if top := conds.top(); top != nil {
+			top.active = top.parent && !top.taken
+			top.taken = true
+		}
+	case "ENDIF", "IFEND":
+		if len(conds.stack) > 0 {
+			conds.stack = conds.stack[:len(conds.stack)-1]
+		}
+	case "DEFINE":
+		if conds.Active() {
+			conds.Define(arg)
+		}
+	case "UNDEF":
+		if conds.Active() {
+			conds.Undefine(arg)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (conds *Conditions) push(ok bool) {
+	parent := conds.Active()
+	conds.stack = append(conds.stack, condition{
+		parent: parent,
+		active: parent && ok,
+		taken:  ok,
+	})
+}
+
+func (conds *Conditions) top() *condition {
+	if len(conds.stack) == 0 {
+		return nil
+	}
+	return &conds.stack[len(conds.stack)-1]
+}
+
+// SplitDirective splits a compiler directive literal such as "{$I file.inc}"
+// into its upper-cased name "I" and the remaining argument "file.inc".
+func SplitDirective(lit string) (name, arg string) {
+	lit = strings.TrimPrefix(lit, "{$")
+	lit = strings.TrimPrefix(lit, "(*$")
+	lit = strings.TrimSuffix(lit, "}")
+	lit = strings.TrimSuffix(lit, "*)")
+
+	p := strings.IndexAny(lit, " \t\r\n")
+	if p < 0 {
+		return strings.ToUpper(lit), ""
+	}
+	name, arg = strings.ToUpper(lit[:p]), strings.TrimSpace(lit[p:])
+	// only the first word is the symbol for IFDEF and friends
+	switch name {
+	case "IFDEF", "IFNDEF", "DEFINE", "UNDEF", "IFOPT":
+		if p := strings.IndexAny(arg, " \t\r\n"); p >= 0 {
+			arg = arg[:p]
+		}
+	}
+	return name, arg
+}
+
+// eval evaluates a {$IF} expression.
+func (conds *Conditions) eval(expr string) bool {
+	e := condExpr{conds: conds, words: condWords(expr)}
+	return e.or()
+}
+
+type condExpr struct {
+	conds *Conditions
+	words []string
+}
+
+func (e *condExpr) peek() string {
+	if len(e.words) == 0 {
+		return ""
+	}
+	return strings.ToLower(e.words[0])
+}
+
+func (e *condExpr) next() string {
+	word := e.peek()
+	if len(e.words) > 0 {
+		e.words = e.words[1:]
+	}
+	return word
+}
+
+func (e *condExpr) or() bool {
+	x := e.and()
+	for e.peek() == "or" {
+		e.next()
+		y := e.and()
+		x = x || y
+	}
+	return x
+}
+
+func (e *condExpr) and() bool {
+	x := e.unary()
+	for e.peek() == "and" {
+		e.next()
+		y := e.unary()
+		x = x && y
+	}
+	return x
+}
+
+func (e *condExpr) unary() bool {
+	switch e.peek() {
+	case "not":
+		e.next()
+		return !e.unary()
+	case "(":
+		e.next()
+		x := e.or()
+		if e.peek() == ")" {
+			e.next()
+		}
+		return x
+	case "defined":
+		e.next()
+		if e.peek() != "(" {
+			return true
+		}
+		e.next()
+		name := e.next()
+		if e.peek() == ")" {
+			e.next()
+		}
+		return e.conds.IsDefined(name)
+	}
+
+	// unsupported expression, e.g. CompilerVersion >= 20,
+	// skip until the next logical operator
+	for e.peek() != "" && e.peek() != "and" && e.peek() != "or" && e.peek() != ")" {
+		e.next()
+	}
+	return true
+}
+
+func condWords(expr string) []string {
+	var words []string
+	start := -1
+	for i, r := range expr {
+		switch {
+		case r == '(' || r == ')':
+			if start >= 0 {
+				words = append(words, expr[start:i])
+				start = -1
+			}
+			words = append(words, string(r))
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			if start >= 0 {
+				words = append(words, expr[start:i])
+				start = -1
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	if start >= 0 {
+		words = append(words, expr[start:])
+	}
+	return words
+}
+
+// Symbols returns the conditional symbols tested by a directive literal
+// such as "{$IFDEF DEBUG}" or "{$IF Defined(A) and not Defined(B)}".
+func Symbols(lit string) []string {
+	name, arg := SplitDirective(lit)
+	switch name {
+	case "IFDEF", "IFNDEF":
+		if arg != "" {
+			return []string{arg}
+		}
+	case "IF", "ELSEIF":
+		var symbols []string
+		words := condWords(arg)
+		for i, word := range words {
+			if strings.EqualFold(word, "defined") && i+2 < len(words) && words[i+1] == "(" {
+				symbols = append(symbols, words[i+2])
+			}
+		}
+		return symbols
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Package search counts and replaces regular expression matches in
+// source files.
+//
+//	counter := search.NewCounter()
+//	file, err := search.LoadFile("Main.pas")
+//	if err != nil {
+//		return err
+//	}
+//	file.CountRegular(re, counter, 0, true, false)
+//
+// Matches are counted by their canonical form, ignoring case or white
+// space when requested; Actual keeps the first spelling of each match.
+// With Locate set the position of every match is recorded as well.
+package search
+
+import (
+	"sort"
+	"strings"
+)
+
+// Counter counts the matches in files.
+type Counter struct {
+	Total   int
+	Matches map[string]*Match // by canonical match
+	Actual  map[string]string // first spelling of each canonical match
+
+	// Locate enables recording Locations.
+	Locate    bool
+	Locations []Location
+}
+
+// Location is the position of a match.
+type Location struct {
+	File      string
+	Line, Col int // 1-based, Col counts bytes
+
+	// Text is the match, or the submatch that was counted.
+	Text string
+	// Groups are the submatches of the match, empty when a group did
+	// not participate.
+	Groups []string
+}
+
+// Match is the number of occurrences of a match in total and per file.
+type Match struct {
+	Count int
+	Files map[string]int
+}
+
+// NewCounter returns an empty counter.
+func NewCounter() *Counter {
+	return &Counter{
+		Total:   0,
+		Matches: make(map[string]*Match),
+		Actual:  make(map[string]string),
+	}
+}
+
+// NewMatch returns a match with no occurrences.
+func NewMatch() *Match {
+	return &Match{0, make(map[string]int)}
+}
+
+// Add counts match found in file.
+func (counter *Counter) Add(file string, match string, ignoreCase, ignoreSpace bool) {
+	canon := match
+	if ignoreCase {
+		canon = strings.ToLower(canon)
+	}
+	if ignoreSpace {
+		canon = strings.Replace(canon, " ", "", -1)
+		canon = strings.Replace(canon, "\t", "", -1)
+		canon = strings.Replace(canon, "\n", "", -1)
+	}
+
+	if _, ok := counter.Actual[canon]; !ok {
+		counter.Actual[canon] = match
+		counter.Matches[canon] = NewMatch()
+	}
+
+	counter.Total++
+	counter.Matches[canon].Add(file)
+}
+
+// Add counts an occurrence in file.
+func (m *Match) Add(file string) {
+	m.Count++
+	m.Files[file]++
+}
+
+// Merge adds the counts of other, e.g. from another worker.
+func (counter *Counter) Merge(other *Counter) {
+	counter.Total += other.Total
+	for canon, actual := range other.Actual {
+		if _, ok := counter.Actual[canon]; !ok {
+			counter.Actual[canon] = actual
+			counter.Matches[canon] = NewMatch()
+		}
+	}
+
+	for canon, match := range other.Matches {
+		counter.Matches[canon].Merge(match)
+	}
+
+	counter.Locations = append(counter.Locations, other.Locations...)
+}
+
+// SortLocations sorts the locations by file and position.
+func (counter *Counter) SortLocations() {
+	sort.Slice(counter.Locations, func(i, k int) bool {
+		a, b := &counter.Locations[i], &counter.Locations[k]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+}
+
+// Merge adds the occurrences of other.
+func (m *Match) Merge(other *Match) {
+	m.Count += other.Count
+	for file, count := range other.Files {
+		m.Files[file] += count
+	}
+}
@@ -0,0 +1,60 @@
+package search
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCountRegular(t *testing.T) {
+	re := regexp.MustCompile(`(?i)screen\.(cursor)`)
+
+	a := &File{Path: "A.pas", Source: []byte("Screen.Cursor := crHourGlass;\nSCREEN.CURSOR := crDefault;")}
+	b := &File{Path: "B.pas", Source: []byte("if screen.cursor = crDefault then")}
+
+	total := NewCounter()
+	for _, file := range []*File{a, b} {
+		counter := NewCounter()
+		file.CountRegular(re, counter, 0, true, false)
+		total.Merge(counter)
+	}
+
+	if total.Total != 3 || len(total.Matches) != 1 {
+		t.Fatalf("got %v matches %v", total.Total, total.Matches)
+	}
+	if actual := total.Actual["screen.cursor"]; actual != "Screen.Cursor" {
+		t.Errorf("got actual %q", actual)
+	}
+	if files := total.Matches["screen.cursor"].Files; files["A.pas"] != 2 || files["B.pas"] != 1 {
+		t.Errorf("got files %v", files)
+	}
+
+	sub := NewCounter()
+	a.CountRegular(re, sub, 1, false, false)
+	if sub.Matches["Cursor"] == nil || sub.Matches["CURSOR"] == nil {
+		t.Errorf("got submatches %v", sub.Actual)
+	}
+}
+
+func TestLocations(t *testing.T) {
+	re := regexp.MustCompile(`(\w+)\.(Free|Destroy)`)
+	file := &File{Path: "A.pas", Source: []byte("begin\n  A.Free; B.Destroy;\nend.")}
+
+	counter := NewCounter()
+	counter.Locate = true
+	file.CountRegular(re, counter, 2, false, false)
+
+	exp := []Location{
+		{"A.pas", 2, 5, "Free", []string{"A", "Free"}},
+		{"A.pas", 2, 13, "Destroy", []string{"B", "Destroy"}},
+	}
+	if len(counter.Locations) != len(exp) {
+		t.Fatalf("got %v", counter.Locations)
+	}
+	for i, loc := range counter.Locations {
+		if loc.File != exp[i].File || loc.Line != exp[i].Line || loc.Col != exp[i].Col || loc.Text != exp[i].Text ||
+			strings.Join(loc.Groups, ",") != strings.Join(exp[i].Groups, ",") {
+			t.Errorf("%d: got %v, expected %v", i, loc, exp[i])
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package search
+
+import (
+	"bytes"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/raintreeinc/delphi/internal/files"
+)
+
+// File is the source of a file and its content after replacing.
+type File struct {
+	Path     string
+	Source   []byte
+	Modified []byte
+
+	// Regions restrict matching to parts of Source, nil matches the
+	// whole source.
+	Regions []Region
+
+	// Replacements are the replaced matches sorted by offset, Modified
+	// is Source with all of them applied.
+	Replacements []Replacement
+}
+
+// Replacement replaces a match in the source.
+type Replacement struct {
+	Start, End int    // byte offsets of the match in Source
+	Text       string // replacement with submatches expanded
+}
+
+// LoadFile reads the file at path.
+func LoadFile(path string) (*File, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Path: path, Source: src, Modified: src}, nil
+}
+
+// Changed reports whether replacing modified the file.
+func (file *File) Changed() bool {
+	return !bytes.Equal(file.Source, file.Modified)
+}
+
+// WriteChanges writes the modified content to the file atomically,
+// keeping the file mode.
+func (file *File) WriteChanges() error {
+	return files.WriteAtomic(file.Path, file.Modified)
+}
+
+// Restrict limits matching to the tokens in scope, conditional code is
+// evaluated with defines.
+func (file *File) Restrict(scope Scope, defines []string) {
+	if scope == Raw {
+		file.Regions = nil
+		return
+	}
+	file.Regions = Regions(file.Source, scope, defines)
+}
+
+func (file *File) regions() []Region {
+	if file.Regions == nil {
+		return []Region{{0, len(file.Source)}}
+	}
+	return file.Regions
+}
+
+// CountRegular counts the matches of re, or of its sub-th submatch
+// when sub is not 0. Matches do not cross the boundaries of Regions.
+func (file *File) CountRegular(re *regexp.Regexp, counter *Counter, sub int, ignoreCase, ignoreSpace bool) {
+	var lines []int
+	if counter.Locate {
+		lines = lineStarts(file.Source)
+	}
+
+	for _, region := range file.regions() {
+		src := file.Source[region.Start:region.End]
+		for _, match := range re.FindAllSubmatchIndex(src, -1) {
+			s, e := match[sub*2], match[sub*2+1]
+			if s < 0 {
+				// the submatch did not participate
+				continue
+			}
+			counter.Add(file.Path, string(src[s:e]), ignoreCase, ignoreSpace)
+
+			if counter.Locate {
+				offset := region.Start + s
+				line := sort.Search(len(lines), func(i int) bool { return lines[i] > offset })
+				location := Location{
+					File: file.Path,
+					Line: line,
+					Col:  offset - lines[line-1] + 1,
+					Text: string(src[s:e]),
+				}
+				for i := 2; i < len(match); i += 2 {
+					group := ""
+					if match[i] >= 0 {
+						group = string(src[match[i]:match[i+1]])
+					}
+					location.Groups = append(location.Groups, group)
+				}
+				counter.Locations = append(counter.Locations, location)
+			}
+		}
+	}
+}
+
+// lineStarts returns the offsets where the lines of src start.
+func lineStarts(src []byte) []int {
+	starts := []int{0}
+	for i, b := range src {
+		if b == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// Replace replaces the matches of re in the source, replacement may
+// refer to submatches as in regexp.Regexp.Expand. Only the matches
+// inside Regions are replaced. Line breaks in replacement are written
+// with the line endings of the file.
+func (file *File) Replace(re *regexp.Regexp, replacement string) {
+	template := []byte(withLineEndings(replacement, lineEnding(file.Source)))
+
+	file.Replacements = nil
+	for _, region := range file.regions() {
+		src := file.Source[region.Start:region.End]
+		for _, match := range re.FindAllSubmatchIndex(src, -1) {
+			text := re.Expand(nil, template, src, match)
+			file.Replacements = append(file.Replacements, Replacement{
+				Start: region.Start + match[0],
+				End:   region.Start + match[1],
+				Text:  string(text),
+			})
+		}
+	}
+	file.Modified = file.Apply(file.Replacements)
+}
+
+// Apply returns the source with the replacements, which must be sorted
+// by offset.
+func (file *File) Apply(replacements []Replacement) []byte {
+	var modified []byte
+	last := 0
+	for _, r := range replacements {
+		modified = append(modified, file.Source[last:r.Start]...)
+		modified = append(modified, r.Text...)
+		last = r.End
+	}
+	return append(modified, file.Source[last:]...)
+}
+
+// lineEnding returns the line ending used by most lines of src.
+func lineEnding(src []byte) string {
+	lf := bytes.Count(src, []byte("\n"))
+	crlf := bytes.Count(src, []byte("\r\n"))
+	if crlf > 0 && crlf >= lf-crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// withLineEndings converts the line breaks of text to ending.
+func withLineEndings(text, ending string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if ending != "\n" {
+		text = strings.Replace(text, "\n", ending, -1)
+	}
+	return text
+}
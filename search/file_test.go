@@ -0,0 +1,25 @@
+package search
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestReplaceLineEndings(t *testing.T) {
+	file := &File{Path: "U.pas", Source: []byte("begin\r\n  X.Free;\r\n  Y.Free;\r\nend.")}
+	file.Replace(regexp.MustCompile(`(\w+)\.Free;`), "if $1 <> nil then\n    $1.Free;")
+
+	exp := "begin\r\n  if X <> nil then\r\n    X.Free;\r\n  if Y <> nil then\r\n    Y.Free;\r\nend."
+	if string(file.Modified) != exp {
+		t.Errorf("got %q", file.Modified)
+	}
+	if len(file.Replacements) != 2 {
+		t.Fatalf("got %v replacements", len(file.Replacements))
+	}
+
+	partial := file.Apply(file.Replacements[1:])
+	exp = "begin\r\n  X.Free;\r\n  if Y <> nil then\r\n    Y.Free;\r\nend."
+	if string(partial) != exp {
+		t.Errorf("got %q", partial)
+	}
+}
@@ -0,0 +1,83 @@
+package search
+
+import (
+	"github.com/raintreeinc/delphi/scanner"
+	"github.com/raintreeinc/delphi/token"
+)
+
+// Scope selects the token classes that are searched.
+type Scope int
+
+// Raw searches the whole source, including inactive conditional code.
+const Raw Scope = 0
+
+const (
+	// Code searches the active code outside of comments and literals.
+	Code Scope = 1 << iota
+	// Comments searches the comments in active code, compiler directives
+	// are excluded.
+	Comments
+	// Strings searches the string and character literals in active code.
+	Strings
+)
+
+// Region is the byte range [Start, End) of a source.
+type Region struct{ Start, End int }
+
+// Regions returns the parts of src with tokens in scope, inactive
+// {$IFDEF} branches are skipped. Consecutive code tokens form a single
+// region including the white space between them, adjacent regions are
+// merged.
+func Regions(src []byte, scope Scope, defines []string) []Region {
+	conds := scanner.NewConditions(defines)
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+
+	var sc scanner.Scanner
+	sc.Init(file, src, nil, scanner.ScanComments)
+
+	regions := []Region{}
+	add := func(start, end int) {
+		if n := len(regions); n > 0 && regions[n-1].End == start {
+			regions[n-1].End = end
+			return
+		}
+		regions = append(regions, Region{start, end})
+	}
+
+	code := -1 // start of the current run of code tokens
+	for {
+		pos, tok, lit := sc.Scan()
+		offset := file.Offset(pos)
+
+		var class Scope
+		switch {
+		case tok == token.EOF || tok == token.CDIRECTIVE:
+		case !conds.Active():
+		case tok == token.COMMENT:
+			class = Comments
+		case tok == token.STRING || tok == token.CHAR:
+			class = Strings
+		default:
+			class = Code
+		}
+
+		if code >= 0 && class != Code {
+			add(code, offset)
+			code = -1
+		}
+
+		switch {
+		case tok == token.EOF:
+			return regions
+		case tok == token.CDIRECTIVE:
+			conds.Directive(lit)
+		case class == Code:
+			if scope&Code != 0 && code < 0 {
+				code = offset
+			}
+		case scope&class != 0:
+			add(offset, offset+len(lit))
+		}
+	}
+}
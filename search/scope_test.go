@@ -0,0 +1,51 @@
+package search
+
+import (
+	"regexp"
+	"testing"
+)
+
+const scopeSource = `begin
+  Screen.Cursor := crHourGlass; // Screen.Cursor
+  { Screen.Cursor := crDefault; }
+  ShowMessage('Screen.Cursor');
+  {$IFDEF OLD}
+  Screen.Cursor := crNone;
+  {$ENDIF}
+end.`
+
+func TestRestrict(t *testing.T) {
+	re := regexp.MustCompile(`Screen\.Cursor`)
+
+	tests := []struct {
+		scope   Scope
+		defines []string
+		exp     int
+	}{
+		{Raw, nil, 5},
+		{Code, nil, 1},
+		{Code, []string{"OLD"}, 2},
+		{Comments, nil, 2},
+		{Strings, nil, 1},
+		{Code | Strings, nil, 2},
+	}
+	for _, test := range tests {
+		file := &File{Path: "U.pas", Source: []byte(scopeSource)}
+		file.Restrict(test.scope, test.defines)
+
+		counter := NewCounter()
+		file.CountRegular(re, counter, 0, false, false)
+		if counter.Total != test.exp {
+			t.Errorf("scope %v %v: got %v matches, expected %v", test.scope, test.defines, counter.Total, test.exp)
+		}
+	}
+}
+
+func TestReplaceRegions(t *testing.T) {
+	file := &File{Path: "U.pas", Source: []byte(`x := 'x'; // x`)}
+	file.Restrict(Code, nil)
+	file.Replace(regexp.MustCompile(`x`), "y")
+	if string(file.Modified) != `y := 'x'; // x` {
+		t.Errorf("got %q", file.Modified)
+	}
+}
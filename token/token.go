@@ -445,3 +445,9 @@ func (tok Token) IsOperator() bool {
 // it returns false otherwise.
 //
 func (tok Token) IsKeyword() bool { return keyword_beg < tok && tok < keyword_end }
+
+// IsDirective returns true for tokens corresponding to directives;
+// it returns false otherwise. Directives are only reserved in specific
+// contexts and may otherwise be used as identifiers.
+//
+func (tok Token) IsDirective() bool { return ABSOLUTE <= tok && tok <= WRITEONLY }